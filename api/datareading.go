@@ -18,27 +18,50 @@ type DataReadingsPost struct {
 	DataReadings   []*DataReading `json:"data_readings"`
 }
 
+// DataType discriminates between the types of DataReading.Data. It is only
+// sent by the agent from schema version v3.0.0 onwards; readings using older
+// schema versions leave it empty.
+type DataType string
+
+const (
+	DataTypeDynamic       DataType = "dynamic"
+	DataTypeDiscovery     DataType = "discovery"
+	DataTypeOIDCDiscovery DataType = "oidc-discovery"
+	DataTypeFindings      DataType = "findings"
+	DataTypeCABundles     DataType = "ca-bundles"
+	DataTypeTLSProbes     DataType = "tls-probes"
+	DataTypeNodeFiles     DataType = "node-files"
+	DataTypeGeneric       DataType = "generic"
+)
+
 // DataReading is the output of a DataGatherer.
+//
+// DataReading is the internal representation of a data reading, and it is a
+// superset of all the schema versions that the agent knows about. Use the
+// conversion functions in the versioned packages (api/v2, api/v3) to convert
+// DataReadings to a specific schema version before sending them.
 type DataReading struct {
 	// ClusterID is optional as it can be inferred from the agent
 	// token when using basic authentication.
-	ClusterID     string `json:"cluster_id,omitempty"`
-	DataGatherer  string `json:"data-gatherer"`
-	Timestamp     Time   `json:"timestamp"`
-	Data          any    `json:"data"`
-	SchemaVersion string `json:"schema_version"`
+	ClusterID     string   `json:"cluster_id,omitempty"`
+	DataGatherer  string   `json:"data-gatherer"`
+	Timestamp     Time     `json:"timestamp"`
+	DataType      DataType `json:"data_type,omitempty"`
+	Data          any      `json:"data"`
+	SchemaVersion string   `json:"schema_version"`
 }
 
 // UnmarshalJSON implements the json.Unmarshaler interface for DataReading.
-// The function attempts to decode the Data field into known types in a prioritized order.
+// When the DataType discriminator is set, the Data field is decoded into the
+// matching type. Otherwise (schema versions older than v3.0.0), the function
+// attempts to decode the Data field into known types in a prioritized order.
 // Empty data is considered an error, because there is no way to discriminate between data types.
-// TODO(wallrj): Add a discriminator field to DataReading to avoid this complex logic.
-// E.g. "data_type": "discovery"|"dynamic"
 func (o *DataReading) UnmarshalJSON(data []byte) error {
 	var tmp struct {
 		ClusterID     string          `json:"cluster_id,omitempty"`
 		DataGatherer  string          `json:"data-gatherer"`
 		Timestamp     Time            `json:"timestamp"`
+		DataType      DataType        `json:"data_type,omitempty"`
 		Data          json.RawMessage `json:"data"`
 		SchemaVersion string          `json:"schema_version"`
 	}
@@ -52,6 +75,7 @@ func (o *DataReading) UnmarshalJSON(data []byte) error {
 	o.ClusterID = tmp.ClusterID
 	o.DataGatherer = tmp.DataGatherer
 	o.Timestamp = tmp.Timestamp
+	o.DataType = tmp.DataType
 	o.SchemaVersion = tmp.SchemaVersion
 
 	// Return an error if data is empty
@@ -61,12 +85,33 @@ func (o *DataReading) UnmarshalJSON(data []byte) error {
 
 	// Define a list of decoding attempts with prioritized types
 	dataTypes := []struct {
-		target any
-		assign func(any)
+		dataType DataType
+		target   any
+		assign   func(any)
 	}{
-		{&OIDCDiscoveryData{}, func(v any) { o.Data = v.(*OIDCDiscoveryData) }},
-		{&DiscoveryData{}, func(v any) { o.Data = v.(*DiscoveryData) }},
-		{&DynamicData{}, func(v any) { o.Data = v.(*DynamicData) }},
+		{DataTypeOIDCDiscovery, &OIDCDiscoveryData{}, func(v any) { o.Data = v.(*OIDCDiscoveryData) }},
+		{DataTypeDiscovery, &DiscoveryData{}, func(v any) { o.Data = v.(*DiscoveryData) }},
+		{DataTypeDynamic, &DynamicData{}, func(v any) { o.Data = v.(*DynamicData) }},
+		{DataTypeFindings, &FindingsData{}, func(v any) { o.Data = v.(*FindingsData) }},
+		{DataTypeCABundles, &CABundlesData{}, func(v any) { o.Data = v.(*CABundlesData) }},
+		{DataTypeTLSProbes, &TLSProbesData{}, func(v any) { o.Data = v.(*TLSProbesData) }},
+		{DataTypeNodeFiles, &NodeFilesData{}, func(v any) { o.Data = v.(*NodeFilesData) }},
+		{DataTypeGeneric, &GenericData{}, func(v any) { o.Data = v.(*GenericData) }},
+	}
+
+	// The discriminator, when present, tells us exactly which type to use.
+	if o.DataType != "" {
+		for _, dataType := range dataTypes {
+			if dataType.dataType != o.DataType {
+				continue
+			}
+			if err := jsonUnmarshalStrict(tmp.Data, dataType.target); err != nil {
+				return fmt.Errorf("failed to parse DataReading.Data for gatherer %q with data type %q: %s", o.DataGatherer, o.DataType, err)
+			}
+			dataType.assign(dataType.target)
+			return nil
+		}
+		return fmt.Errorf("failed to parse DataReading.Data for gatherer %q: unknown data type %q", o.DataGatherer, o.DataType)
 	}
 
 	// Attempt to decode the Data field into each type
@@ -95,29 +140,85 @@ type GatheredResource struct {
 	// should be of type unstructured.Unstructured, raw Object
 	Resource  any
 	DeletedAt Time
+	// DeletionInferred is true when the deletion of the resource wasn't
+	// observed but inferred, for instance because the watch missed the
+	// deletion and the resource was missing when relisting. DeletedAt is then
+	// the time at which the deletion was noticed.
+	DeletionInferred bool
+
+	// The following fields are the change timeline of the resource, as
+	// recorded by the data gatherer from the watch events. They are zero when
+	// unknown.
+
+	// FirstSeenAt is the time at which the data gatherer first saw the
+	// resource.
+	FirstSeenAt Time
+	// LastUpdatedAt is the time at which the data gatherer last saw the
+	// resource change.
+	LastUpdatedAt Time
+	// LastModifiedAt is the most recent time found in the managedFields of
+	// the resource, i.e. the time at which it was last written to the API
+	// server.
+	LastModifiedAt Time
+	// UpdateCount is the number of changes seen since the resources were
+	// last gathered.
+	UpdateCount int
+	// CreatedAndDeleted is true when the resource was both created and
+	// deleted since the resources were last gathered.
+	CreatedAndDeleted bool
+
+	// ComputedFields are the values derived from the resource by the CEL
+	// expressions configured on the data gatherer, by name. The values are
+	// JSON values.
+	ComputedFields map[string]any
 }
 
 func (v GatheredResource) MarshalJSON() ([]byte, error) {
-	dateString := ""
-	if !v.DeletedAt.IsZero() {
-		dateString = v.DeletedAt.Format(TimeFormat)
-	}
-
 	data := struct {
-		Resource  any    `json:"resource"`
-		DeletedAt string `json:"deleted_at,omitempty"`
+		Resource          any            `json:"resource"`
+		DeletedAt         string         `json:"deleted_at,omitempty"`
+		DeletionInferred  bool           `json:"deletion_inferred,omitempty"`
+		FirstSeenAt       string         `json:"first_seen_at,omitempty"`
+		LastUpdatedAt     string         `json:"last_updated_at,omitempty"`
+		LastModifiedAt    string         `json:"last_modified_at,omitempty"`
+		UpdateCount       int            `json:"update_count,omitempty"`
+		CreatedAndDeleted bool           `json:"created_and_deleted,omitempty"`
+		ComputedFields    map[string]any `json:"computed_fields,omitempty"`
 	}{
-		Resource:  v.Resource,
-		DeletedAt: dateString,
+		Resource:          v.Resource,
+		DeletedAt:         optionalTime(v.DeletedAt),
+		DeletionInferred:  v.DeletionInferred,
+		FirstSeenAt:       optionalTime(v.FirstSeenAt),
+		LastUpdatedAt:     optionalTime(v.LastUpdatedAt),
+		LastModifiedAt:    optionalTime(v.LastModifiedAt),
+		UpdateCount:       v.UpdateCount,
+		CreatedAndDeleted: v.CreatedAndDeleted,
+		ComputedFields:    v.ComputedFields,
 	}
 
 	return json.Marshal(data)
 }
 
+// optionalTime formats the time, or returns an empty string when the time is
+// zero so that it is omitted.
+func optionalTime(t Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(TimeFormat)
+}
+
 func (v *GatheredResource) UnmarshalJSON(data []byte) error {
 	var tmpResource struct {
-		Resource  *unstructured.Unstructured `json:"resource"`
-		DeletedAt Time                       `json:"deleted_at"`
+		Resource          *unstructured.Unstructured `json:"resource"`
+		DeletedAt         Time                       `json:"deleted_at"`
+		DeletionInferred  bool                       `json:"deletion_inferred"`
+		FirstSeenAt       Time                       `json:"first_seen_at"`
+		LastUpdatedAt     Time                       `json:"last_updated_at"`
+		LastModifiedAt    Time                       `json:"last_modified_at"`
+		UpdateCount       int                        `json:"update_count"`
+		CreatedAndDeleted bool                       `json:"created_and_deleted"`
+		ComputedFields    map[string]any             `json:"computed_fields"`
 	}
 
 	d := json.NewDecoder(bytes.NewReader(data))
@@ -128,6 +229,13 @@ func (v *GatheredResource) UnmarshalJSON(data []byte) error {
 	}
 	v.Resource = tmpResource.Resource
 	v.DeletedAt = tmpResource.DeletedAt
+	v.DeletionInferred = tmpResource.DeletionInferred
+	v.FirstSeenAt = tmpResource.FirstSeenAt
+	v.LastUpdatedAt = tmpResource.LastUpdatedAt
+	v.LastModifiedAt = tmpResource.LastModifiedAt
+	v.UpdateCount = tmpResource.UpdateCount
+	v.CreatedAndDeleted = tmpResource.CreatedAndDeleted
+	v.ComputedFields = tmpResource.ComputedFields
 	return nil
 }
 
@@ -165,3 +273,170 @@ type OIDCDiscoveryData struct {
 	// JWKSError contains any error encountered while fetching the JWKS
 	JWKSError string `json:"jwks_error,omitempty"`
 }
+
+// FindingsData is the DataReading.Data returned by the certificate findings
+// gatherer. It lists the problems found in the certificates of the gathered
+// Secrets.
+type FindingsData struct {
+	Findings []Finding `json:"findings"`
+}
+
+// FindingType identifies the check that produced a Finding.
+type FindingType string
+
+const (
+	FindingExpired                FindingType = "expired"
+	FindingNotYetValid            FindingType = "not-yet-valid"
+	FindingChainOrder             FindingType = "chain-order"
+	FindingUntrustedChain         FindingType = "untrusted-chain"
+	FindingWeakKey                FindingType = "weak-key"
+	FindingWeakSignatureAlgorithm FindingType = "weak-signature-algorithm"
+	FindingKeyMismatch            FindingType = "key-mismatch"
+)
+
+// FindingSeverity is either "error" or "warning".
+type FindingSeverity string
+
+const (
+	FindingSeverityError   FindingSeverity = "error"
+	FindingSeverityWarning FindingSeverity = "warning"
+)
+
+// Finding is a problem found in a certificate or in a certificate chain.
+type Finding struct {
+	Type     FindingType     `json:"type"`
+	Severity FindingSeverity `json:"severity"`
+	Message  string          `json:"message"`
+
+	// Resource is the resource in which the certificate was found.
+	Resource ResourceReference `json:"resource"`
+	// Key is the key of the Secret's data in which the certificate was
+	// found, e.g. "tls.crt".
+	Key string `json:"key"`
+
+	// The following fields identify the certificate. They are empty when the
+	// finding is about the chain as a whole.
+	SerialNumber      string `json:"serial_number,omitempty"`
+	SHA256Fingerprint string `json:"sha256_fingerprint,omitempty"`
+}
+
+// ResourceReference identifies the Kubernetes resource a Finding or a
+// CABundle was found in.
+type ResourceReference struct {
+	APIVersion string `json:"api_version"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	UID        string `json:"uid,omitempty"`
+}
+
+// CABundlesData is the DataReading.Data returned by the k8s-ca-bundles
+// gatherer. It lists the CA bundles embedded in the webhook configurations,
+// the APIServices, the CRD conversion webhooks, and the targets of the
+// trust-manager Bundles.
+type CABundlesData struct {
+	CABundles []CABundle `json:"ca_bundles"`
+}
+
+// CABundle is a bundle of CA certificates embedded in a resource.
+type CABundle struct {
+	// Resource is the resource that owns the bundle.
+	Resource ResourceReference `json:"resource"`
+	// Field is the location of the bundle in the resource, e.g.
+	// "webhooks[my-webhook.example.com].clientConfig.caBundle".
+	Field string `json:"field"`
+
+	Certificates []CertificateSummary `json:"certificates"`
+	// Error is set when the bundle can't be decoded, when a certificate can't
+	// be parsed, or when the bundle has no certificate. The certificates
+	// parsed before the error are kept.
+	Error string `json:"error,omitempty"`
+}
+
+// CertificateSummary identifies a certificate and its validity period, for
+// instance a certificate of a CABundle.
+type CertificateSummary struct {
+	Subject           string `json:"subject"`
+	Issuer            string `json:"issuer"`
+	SerialNumber      string `json:"serial_number"`
+	SHA256Fingerprint string `json:"sha256_fingerprint"`
+	NotBefore         Time   `json:"not_before"`
+	NotAfter          Time   `json:"not_after"`
+	// Expired is true if the certificate had expired when it was gathered.
+	Expired bool `json:"expired"`
+}
+
+// TLSProbesData is the DataReading.Data returned by the k8s-tls-probe
+// gatherer. It lists the certificates actually served by the Services, the
+// Ingresses, and the Routes of the cluster.
+type TLSProbesData struct {
+	Probes []TLSProbe `json:"probes"`
+}
+
+// TLSProbe is the result of a TLS handshake with an endpoint.
+type TLSProbe struct {
+	// Resource is the Service, Ingress, or Route that exposes the endpoint.
+	Resource ResourceReference `json:"resource"`
+	// Address is the host and port the agent connected to.
+	Address string `json:"address"`
+	// ServerName is the SNI sent during the handshake, if any.
+	ServerName string `json:"server_name,omitempty"`
+
+	TLSVersion  string `json:"tls_version,omitempty"`
+	CipherSuite string `json:"cipher_suite,omitempty"`
+	// Certificates is the chain served by the endpoint, leaf first. The chain
+	// isn't verified.
+	Certificates []CertificateSummary `json:"certificates"`
+	// MatchingSecrets are the gathered Secrets whose tls.crt has the same
+	// leaf certificate as the one served. It is empty when the served
+	// certificate isn't stored in any gathered Secret.
+	MatchingSecrets []ResourceReference `json:"matching_secrets,omitempty"`
+
+	// Error is set when the endpoint couldn't be reached or when the
+	// handshake failed.
+	Error string `json:"error,omitempty"`
+}
+
+// NodeFilesData is the DataReading.Data returned by the node-filesystem
+// gatherer. It lists the certificate files found on the host paths of a node,
+// such as the kubelet serving certificates and the control plane PKI, which
+// never appear in the Kubernetes API.
+type NodeFilesData struct {
+	NodeName string     `json:"node_name"`
+	Files    []NodeFile `json:"files"`
+}
+
+// NodeFile is a file of a node that contains certificates or private keys.
+// Only the public metadata of the certificates is recorded.
+type NodeFile struct {
+	// Path is the path of the file on the node.
+	Path string `json:"path"`
+	// Format is the detected format: "pem", "der", "pkcs12", or "jks".
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+
+	Certificates []CertificateSummary `json:"certificates"`
+	PrivateKeys  []PrivateKeySummary  `json:"private_keys,omitempty"`
+
+	// Error is set when the file was detected as a certificate file but
+	// couldn't be fully parsed, for instance an encrypted PKCS#12 file. The
+	// certificates parsed before the error are kept.
+	Error string `json:"error,omitempty"`
+}
+
+// PrivateKeySummary describes a private key without reading it: only the
+// type of the PEM block or of the keystore entry and its size are recorded.
+type PrivateKeySummary struct {
+	// Type is e.g. "RSA PRIVATE KEY", "PRIVATE KEY", "pkcs8ShroudedKeyBag",
+	// or "jks".
+	Type string `json:"type"`
+	// Size is the size of the encoded key in bytes.
+	Size int `json:"size"`
+}
+
+// GenericData is the DataReading.Data returned by the exec gatherer when the
+// plugin gathers resources that don't look like Kubernetes resources, for
+// instance the load balancers of a cloud provider.
+type GenericData struct {
+	Resources []map[string]any `json:"resources"`
+}
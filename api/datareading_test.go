@@ -37,6 +37,46 @@ func TestJSONGatheredResourceSetsTimeWhenPresent(t *testing.T) {
 	}
 }
 
+func TestJSONGatheredResourceTimeline(t *testing.T) {
+	resource := GatheredResource{
+		FirstSeenAt:       Time{time.Date(2021, 3, 29, 0, 0, 0, 0, time.UTC)},
+		LastUpdatedAt:     Time{time.Date(2021, 3, 29, 1, 0, 0, 0, time.UTC)},
+		LastModifiedAt:    Time{time.Date(2021, 3, 29, 0, 59, 0, 0, time.UTC)},
+		UpdateCount:       2,
+		CreatedAndDeleted: true,
+	}
+	bytes, err := json.Marshal(resource)
+	if err != nil {
+		t.Fatalf("failed to marshal %s", err)
+	}
+
+	expected := `{"resource":null,"first_seen_at":"2021-03-29T00:00:00Z","last_updated_at":"2021-03-29T01:00:00Z","last_modified_at":"2021-03-29T00:59:00Z","update_count":2,"created_and_deleted":true}`
+	assert.Equal(t, expected, string(bytes))
+
+	var decoded GatheredResource
+	assert.NoError(t, json.Unmarshal(bytes, &decoded))
+	assert.Equal(t, 2, decoded.UpdateCount)
+	assert.True(t, decoded.CreatedAndDeleted)
+	assert.True(t, resource.LastUpdatedAt.Equal(decoded.LastUpdatedAt.Time))
+}
+
+func TestJSONGatheredResourceComputedFields(t *testing.T) {
+	resource := GatheredResource{
+		ComputedFields: map[string]any{"owner": "cert-manager", "replicas": float64(2)},
+	}
+	bytes, err := json.Marshal(resource)
+	if err != nil {
+		t.Fatalf("failed to marshal %s", err)
+	}
+
+	expected := `{"resource":null,"computed_fields":{"owner":"cert-manager","replicas":2}}`
+	assert.Equal(t, expected, string(bytes))
+
+	var decoded GatheredResource
+	assert.NoError(t, json.Unmarshal(bytes, &decoded))
+	assert.Equal(t, resource.ComputedFields, decoded.ComputedFields)
+}
+
 // TestDataReading_UnmarshalJSON tests the UnmarshalJSON method of DataReading
 // with various scenarios including valid and invalid JSON inputs.
 func TestDataReading_UnmarshalJSON(t *testing.T) {
@@ -89,6 +129,97 @@ func TestDataReading_UnmarshalJSON(t *testing.T) {
 			}`,
 			wantDataType: &OIDCDiscoveryData{},
 		},
+		{
+			name: "DynamicData type with discriminator",
+			input: `{
+				"cluster_id": "69050b54-c61a-4384-95c3-35f890377a67",
+				"data-gatherer": "dynamic",
+				"timestamp": "2024-06-01T12:00:00Z",
+				"data_type": "dynamic",
+				"data": {"items": []},
+				"schema_version": "v3.0.0"
+			}`,
+			wantDataType: &DynamicData{},
+		},
+		{
+			name: "FindingsData type with discriminator",
+			input: `{
+				"data-gatherer": "certificate-findings",
+				"timestamp": "2024-06-01T12:00:00Z",
+				"data_type": "findings",
+				"data": {"findings": []},
+				"schema_version": "v3.0.0"
+			}`,
+			wantDataType: &FindingsData{},
+		},
+		{
+			name: "CABundlesData type with discriminator",
+			input: `{
+				"data-gatherer": "k8s-ca-bundles",
+				"timestamp": "2024-06-01T12:00:00Z",
+				"data_type": "ca-bundles",
+				"data": {"ca_bundles": []},
+				"schema_version": "v3.0.0"
+			}`,
+			wantDataType: &CABundlesData{},
+		},
+		{
+			name: "TLSProbesData type with discriminator",
+			input: `{
+				"data-gatherer": "k8s-tls-probe",
+				"timestamp": "2024-06-01T12:00:00Z",
+				"data_type": "tls-probes",
+				"data": {"probes": []},
+				"schema_version": "v3.0.0"
+			}`,
+			wantDataType: &TLSProbesData{},
+		},
+		{
+			name: "NodeFilesData type with discriminator",
+			input: `{
+				"data-gatherer": "node-filesystem",
+				"timestamp": "2024-06-01T12:00:00Z",
+				"data_type": "node-files",
+				"data": {"node_name": "node-1", "files": []},
+				"schema_version": "v3.0.0"
+			}`,
+			wantDataType: &NodeFilesData{},
+		},
+		{
+			name: "GenericData type with discriminator",
+			input: `{
+				"data-gatherer": "exec/load-balancers",
+				"timestamp": "2024-06-01T12:00:00Z",
+				"data_type": "generic",
+				"data": {"resources": [{"id": "lb-1"}]},
+				"schema_version": "v3.0.0"
+			}`,
+			wantDataType: &GenericData{},
+		},
+		{
+			name: "Mismatched discriminator",
+			input: `{
+				"cluster_id": "69050b54-c61a-4384-95c3-35f890377a67",
+				"data-gatherer": "dynamic",
+				"timestamp": "2024-06-01T12:00:00Z",
+				"data_type": "discovery",
+				"data": {"items": []},
+				"schema_version": "v3.0.0"
+			}`,
+			expectError: `failed to parse DataReading.Data for gatherer "dynamic" with data type "discovery": json: unknown field "items"`,
+		},
+		{
+			name: "Unknown discriminator",
+			input: `{
+				"cluster_id": "69050b54-c61a-4384-95c3-35f890377a67",
+				"data-gatherer": "dynamic",
+				"timestamp": "2024-06-01T12:00:00Z",
+				"data_type": "unknown",
+				"data": {"items": []},
+				"schema_version": "v3.0.0"
+			}`,
+			expectError: `failed to parse DataReading.Data for gatherer "dynamic": unknown data type "unknown"`,
+		},
 		{
 			name:        "Invalid JSON",
 			input:       `not a json`,
@@ -0,0 +1,119 @@
+package reader
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/jetstack/preflight/api"
+)
+
+// SecretData returns the decoded value of the given key of a Secret's data. It
+// returns false if the resource is not a Secret or if the key is absent (which
+// is the case for all keys except those allow-listed by the k8s-dynamic data
+// gatherer).
+func (r Resource) SecretData(key string) ([]byte, bool, error) {
+	switch obj := r.obj.(type) {
+	case *corev1.Secret:
+		value, found := obj.Data[key]
+		return value, found, nil
+	case *unstructured.Unstructured:
+		if obj.GetKind() != "Secret" || obj.GroupVersionKind().Group != "" {
+			return nil, false, nil
+		}
+		raw, found, err := unstructured.NestedFieldNoCopy(obj.Object, "data", key)
+		if err != nil || !found {
+			return nil, false, err
+		}
+		// Unstructured Secrets keep the base64 encoding used by the API.
+		switch v := raw.(type) {
+		case string:
+			decoded, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, false, fmt.Errorf("while decoding the base64 value of %s: %w", key, err)
+			}
+			return decoded, true, nil
+		case []byte:
+			return v, true, nil
+		default:
+			return nil, false, fmt.Errorf("%s is not a string or byte slice: %T", key, v)
+		}
+	default:
+		return nil, false, nil
+	}
+}
+
+// Certificates returns the certificates found in the PEM data stored under the
+// given key of a Secret, e.g. corev1.TLSCertKey. It returns no certificates and
+// no error if the resource is not a Secret or if the key is absent.
+func (r Resource) Certificates(key string) ([]*x509.Certificate, error) {
+	data, found, err := r.SecretData(key)
+	if err != nil || !found {
+		return nil, err
+	}
+	return ParseCertificates(data)
+}
+
+// ParseCertificates parses all the CERTIFICATE blocks of the supplied PEM data,
+// in order. Other PEM blocks are ignored. An error is returned if a
+// CERTIFICATE block can't be parsed.
+func ParseCertificates(pemData []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := pemData
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" || len(block.Bytes) == 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return certs, fmt.Errorf("while parsing certificate %d: %w", len(certs), err)
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// KeySize returns the size in bits of a certificate's public key, or 0 if the
+// key type is unknown.
+func KeySize(pub any) int {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return pub.N.BitLen()
+	case *ecdsa.PublicKey:
+		return pub.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
+	default:
+		return 0
+	}
+}
+
+// Summarize returns the summary of a certificate that is sent in the data
+// readings. The certificate is reported as expired if it had expired at the
+// given time.
+func Summarize(cert *x509.Certificate, now time.Time) api.CertificateSummary {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return api.CertificateSummary{
+		Subject:           cert.Subject.String(),
+		Issuer:            cert.Issuer.String(),
+		SerialNumber:      cert.SerialNumber.Text(16),
+		SHA256Fingerprint: hex.EncodeToString(fingerprint[:]),
+		NotBefore:         api.Time{Time: cert.NotBefore.UTC()},
+		NotAfter:          api.Time{Time: cert.NotAfter.UTC()},
+		Expired:           now.After(cert.NotAfter),
+	}
+}
@@ -0,0 +1,254 @@
+// Package reader is a library for consuming the data readings produced by the
+// agent, for example the files written using --output-path.
+//
+// Output files can be large, so Decoder reads them one data reading at a
+// time. Both the "json" and the "ndjson" output formats can be read, with or
+// without gzip compression. The resources gathered by the k8s-dynamic data gatherers can then be
+// listed with Resources, which gives access to the commonly used metadata
+// without having to know whether the resource was decoded as a typed or as an
+// unstructured object.
+//
+// To convert data readings into the snapshot format used by the CyberArk
+// Discovery and Context service, use client.SnapshotFromDataReadings.
+package reader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jetstack/preflight/api"
+)
+
+// Decoder decodes data readings one data reading at a time. Any of the schema
+// versions supported by api.DataReading can be decoded.
+//
+// The data readings can either be a JSON array, or NDJSON as written by the
+// "ndjson" output format, in which case the lines of the resources that
+// belong to the same data reading are grouped back into a single data
+// reading. Gzip compressed input is decompressed transparently.
+type Decoder struct {
+	r      io.Reader
+	dec    *json.Decoder
+	opened bool
+	ndjson bool
+
+	// pending is the NDJSON line that was read ahead while grouping the
+	// resources of the previous data reading.
+	pending *ndjsonLine
+}
+
+// NewDecoder returns a Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r: r,
+	}
+}
+
+// Next decodes and returns the next data reading. It returns io.EOF when all
+// the data readings have been read.
+func (d *Decoder) Next() (*api.DataReading, error) {
+	if !d.opened {
+		if err := d.open(); err != nil {
+			return nil, err
+		}
+		d.opened = true
+	}
+
+	if d.ndjson {
+		return d.nextNDJSON()
+	}
+
+	if !d.dec.More() {
+		// Consume the closing bracket so that trailing garbage is noticed.
+		if _, err := d.dec.Token(); err != nil {
+			return nil, fmt.Errorf("while reading the end of the data readings: %w", err)
+		}
+		return nil, io.EOF
+	}
+
+	var reading api.DataReading
+	if err := d.dec.Decode(&reading); err != nil {
+		return nil, fmt.Errorf("while decoding data reading: %w", err)
+	}
+	return &reading, nil
+}
+
+// gzipMagic is the header of gzip compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// open detects the compression and the format of the input, and reads the
+// start of the JSON array.
+func (d *Decoder) open() error {
+	br := bufio.NewReader(d.r)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("while reading the gzip header: %w", err)
+		}
+		br = bufio.NewReader(gz)
+	}
+
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return fmt.Errorf("while reading the start of the data readings: %w", err)
+	}
+	d.dec = json.NewDecoder(br)
+	switch first {
+	case '{':
+		d.ndjson = true
+		return nil
+	case '[':
+		_, err := d.dec.Token()
+		return err
+	default:
+		return fmt.Errorf("expected a JSON array or NDJSON data readings, got %q", first)
+	}
+}
+
+// peekNonSpace returns the first byte that isn't JSON whitespace without
+// consuming it.
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
+
+// ndjsonLine is a line of the "ndjson" output format. Exactly one of Item and
+// Data is set: Item is one of the resources of a data reading that contains
+// Kubernetes resources, and Data is the data of any other data reading.
+type ndjsonLine struct {
+	ClusterID     string          `json:"cluster_id,omitempty"`
+	DataGatherer  string          `json:"data-gatherer"`
+	Timestamp     api.Time        `json:"timestamp"`
+	DataType      api.DataType    `json:"data_type,omitempty"`
+	SchemaVersion string          `json:"schema_version"`
+	Item          json.RawMessage `json:"item,omitempty"`
+	Data          json.RawMessage `json:"data,omitempty"`
+}
+
+// sameReading returns true if both lines are resources of the same data
+// reading.
+func (l *ndjsonLine) sameReading(other *ndjsonLine) bool {
+	return l.Item != nil && other.Item != nil &&
+		l.ClusterID == other.ClusterID &&
+		l.DataGatherer == other.DataGatherer &&
+		l.Timestamp.Equal(other.Timestamp.Time) &&
+		l.DataType == other.DataType &&
+		l.SchemaVersion == other.SchemaVersion
+}
+
+func (d *Decoder) nextLine() (*ndjsonLine, error) {
+	if line := d.pending; line != nil {
+		d.pending = nil
+		return line, nil
+	}
+	var line ndjsonLine
+	if err := d.dec.Decode(&line); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("while decoding NDJSON line: %w", err)
+	}
+	return &line, nil
+}
+
+func (d *Decoder) nextNDJSON() (*api.DataReading, error) {
+	line, err := d.nextLine()
+	if err != nil {
+		return nil, err
+	}
+
+	data := line.Data
+	if line.Item != nil {
+		items := []json.RawMessage{line.Item}
+		for {
+			next, err := d.nextLine()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !line.sameReading(next) {
+				d.pending = next
+				break
+			}
+			items = append(items, next.Item)
+		}
+		data, err = json.Marshal(struct {
+			Items []json.RawMessage `json:"items"`
+		}{Items: items})
+		if err != nil {
+			return nil, fmt.Errorf("while grouping the NDJSON lines: %w", err)
+		}
+	}
+
+	// The reading is re-encoded so that its data is decoded exactly as in
+	// the JSON array format.
+	encoded, err := json.Marshal(&api.DataReading{
+		ClusterID:     line.ClusterID,
+		DataGatherer:  line.DataGatherer,
+		Timestamp:     line.Timestamp,
+		DataType:      line.DataType,
+		Data:          data,
+		SchemaVersion: line.SchemaVersion,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("while decoding data reading: %w", err)
+	}
+	var reading api.DataReading
+	if err := json.Unmarshal(encoded, &reading); err != nil {
+		return nil, fmt.Errorf("while decoding data reading: %w", err)
+	}
+	return &reading, nil
+}
+
+// ReadAll decodes all the data readings from r.
+func ReadAll(r io.Reader) ([]*api.DataReading, error) {
+	d := NewDecoder(r)
+	var readings []*api.DataReading
+	for {
+		reading, err := d.Next()
+		if err == io.EOF {
+			return readings, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		readings = append(readings, reading)
+	}
+}
+
+// ReadFile decodes all the data readings from the file at path.
+func ReadFile(path string) ([]*api.DataReading, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadAll(f)
+}
+
+// ByGatherer returns the first data reading produced by the named data
+// gatherer, or nil if there is none.
+func ByGatherer(readings []*api.DataReading, gatherer string) *api.DataReading {
+	for _, reading := range readings {
+		if reading != nil && reading.DataGatherer == gatherer {
+			return reading
+		}
+	}
+	return nil
+}
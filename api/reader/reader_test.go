@@ -0,0 +1,186 @@
+package reader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/testutil/testcert"
+)
+
+const outputFile = `[
+	{
+		"data-gatherer": "k8s/discovery",
+		"timestamp": "2024-06-01T12:00:00Z",
+		"data": {"cluster_id": "uid", "server_version": {"gitVersion": "v1.33.0"}},
+		"schema_version": "v2.0.0"
+	},
+	{
+		"data-gatherer": "k8s/secrets",
+		"timestamp": "2024-06-01T12:00:00Z",
+		"data": {
+			"items": [
+				{"resource": {"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "s1", "namespace": "ns1"}, "data": {"tls.crt": "%CERT%"}}},
+				{"resource": {"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "s2", "namespace": "ns1"}}, "deleted_at": "2024-06-01T11:00:00Z"}
+			]
+		},
+		"schema_version": "v2.0.0"
+	}
+]`
+
+func TestDecoder(t *testing.T) {
+	certPEM := testcert.New(t, testcert.Options{CommonName: "example.com"}).PEM()
+	input := strings.ReplaceAll(outputFile, "%CERT%", base64.StdEncoding.EncodeToString(certPEM))
+
+	d := NewDecoder(strings.NewReader(input))
+
+	first, err := d.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "k8s/discovery", first.DataGatherer)
+	assert.IsType(t, &api.DiscoveryData{}, first.Data)
+
+	second, err := d.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "k8s/secrets", second.DataGatherer)
+
+	_, err = d.Next()
+	assert.Equal(t, io.EOF, err)
+
+	t.Run("Resources", func(t *testing.T) {
+		all, err := Resources(second)
+		require.NoError(t, err)
+		require.Len(t, all, 2)
+		assert.Equal(t, schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, all[0].GroupVersionKind())
+		assert.Equal(t, "ns1", all[0].Namespace())
+		assert.Equal(t, "s1", all[0].Name())
+		assert.False(t, all[0].Deleted())
+		assert.True(t, all[1].Deleted())
+		assert.Equal(t, time.Date(2024, 6, 1, 11, 0, 0, 0, time.UTC), all[1].DeletedAt().UTC())
+
+		kept, err := Resources(second, ExcludeDeleted)
+		require.NoError(t, err)
+		require.Len(t, kept, 1)
+		assert.Equal(t, "s1", kept[0].Name())
+	})
+
+	t.Run("Certificates", func(t *testing.T) {
+		all, err := Resources(second)
+		require.NoError(t, err)
+
+		certs, err := all[0].Certificates(corev1.TLSCertKey)
+		require.NoError(t, err)
+		require.Len(t, certs, 1)
+		assert.Equal(t, "example.com", certs[0].Subject.CommonName)
+
+		certs, err = all[1].Certificates(corev1.TLSCertKey)
+		require.NoError(t, err)
+		assert.Empty(t, certs)
+	})
+
+	t.Run("Resources of a non-dynamic reading", func(t *testing.T) {
+		_, err := Resources(first)
+		assert.EqualError(t, err, "programmer mistake: the DataReading must have data type *api.DynamicData. This DataReading (k8s/discovery) has data type *api.DiscoveryData")
+	})
+}
+
+// ndjsonOutputFile is outputFile in the "ndjson" output format.
+const ndjsonOutputFile = `{"data-gatherer": "k8s/discovery", "timestamp": "2024-06-01T12:00:00Z", "schema_version": "v2.0.0", "data": {"cluster_id": "uid", "server_version": {"gitVersion": "v1.33.0"}}}
+{"data-gatherer": "k8s/secrets", "timestamp": "2024-06-01T12:00:00Z", "schema_version": "v2.0.0", "item": {"resource": {"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "s1", "namespace": "ns1"}}}}
+{"data-gatherer": "k8s/secrets", "timestamp": "2024-06-01T12:00:00Z", "schema_version": "v2.0.0", "item": {"resource": {"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "s2", "namespace": "ns1"}}, "deleted_at": "2024-06-01T11:00:00Z"}}
+{"data-gatherer": "k8s/pods", "timestamp": "2024-06-01T12:00:00Z", "schema_version": "v2.0.0", "item": {"resource": {"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "p1", "namespace": "ns1"}}}}
+`
+
+func TestDecoder_NDJSON(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write([]byte(ndjsonOutputFile))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	inputs := map[string]io.Reader{
+		"plain": strings.NewReader(ndjsonOutputFile),
+		"gzip":  &compressed,
+	}
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			readings, err := ReadAll(input)
+			require.NoError(t, err)
+			require.Len(t, readings, 3)
+
+			assert.Equal(t, "k8s/discovery", readings[0].DataGatherer)
+			assert.IsType(t, &api.DiscoveryData{}, readings[0].Data)
+
+			assert.Equal(t, "k8s/secrets", readings[1].DataGatherer)
+			secrets, err := Resources(readings[1])
+			require.NoError(t, err)
+			require.Len(t, secrets, 2)
+			assert.Equal(t, "s1", secrets[0].Name())
+			assert.True(t, secrets[1].Deleted())
+
+			assert.Equal(t, "k8s/pods", readings[2].DataGatherer)
+			pods, err := Resources(readings[2])
+			require.NoError(t, err)
+			require.Len(t, pods, 1)
+			assert.Equal(t, "p1", pods[0].Name())
+		})
+	}
+}
+
+func TestDecoder_Errors(t *testing.T) {
+	t.Run("not an array", func(t *testing.T) {
+		_, err := NewDecoder(strings.NewReader(`"foo"`)).Next()
+		assert.EqualError(t, err, `expected a JSON array or NDJSON data readings, got '"'`)
+	})
+	t.Run("invalid gzip", func(t *testing.T) {
+		_, err := NewDecoder(strings.NewReader("\x1f\x8b")).Next()
+		assert.EqualError(t, err, "while reading the gzip header: unexpected EOF")
+	})
+	t.Run("empty input", func(t *testing.T) {
+		_, err := NewDecoder(strings.NewReader(``)).Next()
+		assert.EqualError(t, err, "while reading the start of the data readings: EOF")
+	})
+	t.Run("empty array", func(t *testing.T) {
+		readings, err := ReadAll(strings.NewReader(`[]`))
+		require.NoError(t, err)
+		assert.Empty(t, readings)
+	})
+}
+
+func TestResources_TypedObjects(t *testing.T) {
+	certPEM := testcert.New(t, testcert.Options{CommonName: "typed.example.com"}).PEM()
+	reading := &api.DataReading{
+		DataGatherer: "k8s/secrets",
+		Data: &api.DynamicData{
+			Items: []*api.GatheredResource{
+				{Resource: &corev1.Secret{
+					TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+					ObjectMeta: metav1.ObjectMeta{Name: "typed", Namespace: "ns2"},
+					Data:       map[string][]byte{corev1.TLSCertKey: certPEM},
+				}},
+			},
+		},
+	}
+	resources, err := Resources(reading)
+	require.NoError(t, err)
+	require.Len(t, resources, 1)
+	assert.Equal(t, "ns2/typed", resources[0].Namespace()+"/"+resources[0].Name())
+
+	certs, err := resources[0].Certificates(corev1.TLSCertKey)
+	require.NoError(t, err)
+	require.Len(t, certs, 1)
+	assert.Equal(t, "typed.example.com", certs[0].Subject.CommonName)
+
+	assert.Equal(t, reading, ByGatherer([]*api.DataReading{reading}, "k8s/secrets"))
+	assert.Nil(t, ByGatherer([]*api.DataReading{reading}, "k8s/pods"))
+}
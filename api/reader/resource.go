@@ -0,0 +1,127 @@
+package reader
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/jetstack/preflight/api"
+)
+
+// Resource is a single item of the api.DynamicData returned by the
+// k8s-dynamic data gatherers.
+type Resource struct {
+	item *api.GatheredResource
+	obj  runtime.Object
+	meta metav1.Object
+}
+
+// Item returns the underlying GatheredResource.
+func (r Resource) Item() *api.GatheredResource {
+	return r.item
+}
+
+// Object returns the gathered Kubernetes object. Objects decoded from JSON are
+// always of type *unstructured.Unstructured, while objects coming straight
+// from the data gatherers may be typed (e.g. *corev1.Pod).
+func (r Resource) Object() runtime.Object {
+	return r.obj
+}
+
+// GroupVersionKind returns the GVK of the gathered object.
+func (r Resource) GroupVersionKind() schema.GroupVersionKind {
+	return r.obj.GetObjectKind().GroupVersionKind()
+}
+
+// Namespace returns the namespace of the gathered object. It is empty for
+// cluster-scoped objects.
+func (r Resource) Namespace() string {
+	return r.meta.GetNamespace()
+}
+
+// Name returns the name of the gathered object.
+func (r Resource) Name() string {
+	return r.meta.GetName()
+}
+
+// Deleted returns true if the object was deleted from the cluster before the
+// data was gathered.
+func (r Resource) Deleted() bool {
+	return !r.item.DeletedAt.IsZero()
+}
+
+// DeletedAt returns the time at which the agent noticed that the object was
+// deleted, or the zero time if it wasn't deleted.
+func (r Resource) DeletedAt() time.Time {
+	return r.item.DeletedAt.Time
+}
+
+// DeletionInferred returns true if the deletion of the object wasn't observed
+// but inferred, in which case DeletedAt is the time at which the deletion was
+// noticed.
+func (r Resource) DeletionInferred() bool {
+	return r.item.DeletionInferred
+}
+
+// Filter reports whether a Resource should be kept.
+type Filter func(Resource) bool
+
+// ExcludeDeleted is a Filter that drops deleted resources.
+func ExcludeDeleted(r Resource) bool {
+	return !r.Deleted()
+}
+
+// Resources returns the resources of a data reading produced by a k8s-dynamic
+// data gatherer, in the same order as they appear in the data reading.
+// Resources for which any of the filters returns false are skipped.
+func Resources(reading *api.DataReading, filters ...Filter) ([]Resource, error) {
+	if reading == nil {
+		return nil, fmt.Errorf("programmer mistake: the DataReading must not be nil")
+	}
+	data, ok := reading.Data.(*api.DynamicData)
+	if !ok {
+		return nil, fmt.Errorf(
+			"programmer mistake: the DataReading must have data type *api.DynamicData. "+
+				"This DataReading (%s) has data type %T", reading.DataGatherer, reading.Data)
+	}
+
+	resources := make([]Resource, 0, len(data.Items))
+items:
+	for i, item := range data.Items {
+		obj, ok := item.Resource.(runtime.Object)
+		if !ok {
+			return nil, fmt.Errorf(
+				"programmer mistake: the DynamicData items must have Resource type runtime.Object. "+
+					"This item (%d) has Resource type %T", i, item.Resource)
+		}
+		objMeta, err := meta.Accessor(obj)
+		if err != nil {
+			return nil, fmt.Errorf("item %d has no object metadata: %s", i, err)
+		}
+		resource := Resource{item: item, obj: obj, meta: objMeta}
+		for _, keep := range filters {
+			if !keep(resource) {
+				continue items
+			}
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// Objects is like Resources, but only returns the gathered objects.
+func Objects(reading *api.DataReading, filters ...Filter) ([]runtime.Object, error) {
+	resources, err := Resources(reading, filters...)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]runtime.Object, 0, len(resources))
+	for _, resource := range resources {
+		objects = append(objects, resource.obj)
+	}
+	return objects, nil
+}
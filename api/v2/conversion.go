@@ -0,0 +1,45 @@
+package v2
+
+import (
+	"fmt"
+
+	"github.com/jetstack/preflight/api"
+)
+
+// ConvertFromInternal converts the supplied readings to the v2 schema. The
+// supplied readings are not modified; the returned readings are shallow copies
+// whose Data has been replaced by the v2 equivalent. Data of a type unknown to
+// this package is passed through unchanged, since v2 never constrained it.
+func ConvertFromInternal(in []*api.DataReading) ([]*api.DataReading, error) {
+	out := make([]*api.DataReading, 0, len(in))
+	for _, reading := range in {
+		if reading == nil {
+			return nil, fmt.Errorf("programmer mistake: the DataReading must not be nil")
+		}
+		converted := *reading
+		converted.SchemaVersion = SchemaVersion
+		// The discriminator was only introduced in v3.
+		converted.DataType = ""
+		if data, ok := reading.Data.(*api.DynamicData); ok {
+			converted.Data = convertDynamicDataFromInternal(data)
+		}
+		out = append(out, &converted)
+	}
+	return out, nil
+}
+
+func convertDynamicDataFromInternal(in *api.DynamicData) *DynamicData {
+	if in == nil {
+		return nil
+	}
+	out := &DynamicData{
+		Items: make([]*GatheredResource, 0, len(in.Items)),
+	}
+	for _, item := range in.Items {
+		out.Items = append(out.Items, &GatheredResource{
+			Resource:  item.Resource,
+			DeletedAt: item.DeletedAt,
+		})
+	}
+	return out
+}
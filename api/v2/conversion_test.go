@@ -0,0 +1,69 @@
+package v2
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/jetstack/preflight/api"
+)
+
+func TestConvertFromInternal(t *testing.T) {
+	deletedAt := api.Time{Time: time.Date(2021, 3, 29, 0, 0, 0, 0, time.UTC)}
+	in := []*api.DataReading{
+		{
+			ClusterID:    "cluster-1",
+			DataGatherer: "k8s/secrets",
+			Timestamp:    api.Time{Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)},
+			DataType:     api.DataTypeDynamic,
+			Data: &api.DynamicData{
+				Items: []*api.GatheredResource{
+					{
+						Resource: &unstructured.Unstructured{Object: map[string]any{
+							"apiVersion": "v1",
+							"kind":       "Secret",
+						}},
+						DeletedAt: deletedAt,
+					},
+				},
+			},
+		},
+		{
+			DataGatherer: "local",
+			Data:         []byte("raw"),
+		},
+	}
+
+	out, err := ConvertFromInternal(in)
+	require.NoError(t, err)
+	require.Len(t, out, 2)
+
+	// The input must not be modified.
+	assert.Equal(t, api.DataTypeDynamic, in[0].DataType)
+	assert.IsType(t, &api.DynamicData{}, in[0].Data)
+
+	bytes, err := json.Marshal(out[0])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"cluster_id": "cluster-1",
+		"data-gatherer": "k8s/secrets",
+		"timestamp": "2024-06-01T12:00:00Z",
+		"data": {
+			"items": [
+				{
+					"resource": {"apiVersion": "v1", "kind": "Secret"},
+					"deleted_at": "2021-03-29T00:00:00Z"
+				}
+			]
+		},
+		"schema_version": "v2.0.0"
+	}`, string(bytes))
+
+	// Unknown data types are passed through.
+	assert.Equal(t, []byte("raw"), out[1].Data)
+	assert.Equal(t, SchemaVersion, out[1].SchemaVersion)
+}
@@ -0,0 +1,58 @@
+// Package v2 contains the v2.0.0 schema of the data readings sent by the agent,
+// and the functions to convert data readings between this schema and the
+// internal representation in the api package.
+//
+// In v2, the agent posts data readings using GatheredResources. The type of
+// DataReading.Data is not sent along with the data, so the receiver has to
+// guess it from the shape of the data.
+package v2
+
+import (
+	"encoding/json"
+
+	"github.com/jetstack/preflight/api"
+)
+
+// SchemaVersion is the value of DataReading.SchemaVersion for readings that
+// use this schema.
+const SchemaVersion = "v2.0.0"
+
+// DynamicData is the DataReading.Data returned by the k8sdynamic
+// gatherer.
+type DynamicData struct {
+	// Items is a list of GatheredResource
+	Items []*GatheredResource `json:"items"`
+}
+
+// GatheredResource wraps the raw k8s resource that is sent to the backend.
+type GatheredResource struct {
+	// Resource is a reference to a k8s object that was found by the informer
+	// should be of type unstructured.Unstructured, raw Object
+	Resource  any
+	DeletedAt api.Time
+}
+
+func (v GatheredResource) MarshalJSON() ([]byte, error) {
+	dateString := ""
+	if !v.DeletedAt.IsZero() {
+		dateString = v.DeletedAt.Format(api.TimeFormat)
+	}
+
+	data := struct {
+		Resource  any    `json:"resource"`
+		DeletedAt string `json:"deleted_at,omitempty"`
+	}{
+		Resource:  v.Resource,
+		DeletedAt: dateString,
+	}
+
+	return json.Marshal(data)
+}
+
+// DiscoveryData is the DataReading.Data returned by the k8s-discovery
+// gatherer. The internal type is used as-is.
+type DiscoveryData = api.DiscoveryData
+
+// OIDCDiscoveryData is the DataReading.Data returned by the oidc gatherer. The
+// internal type is used as-is.
+type OIDCDiscoveryData = api.OIDCDiscoveryData
@@ -0,0 +1,70 @@
+package v3
+
+import (
+	"fmt"
+
+	"github.com/jetstack/preflight/api"
+)
+
+// ConvertFromInternal converts the supplied readings to the v3 schema. The
+// supplied readings are not modified; the returned readings are shallow copies
+// whose Data has been replaced by the v3 equivalent and whose DataType has been
+// set. Data of a type unknown to this package, such as the raw bytes read by
+// the local data gatherer, is passed through unchanged without a DataType, as
+// in v2, so that one such reading doesn't prevent the others from being sent.
+func ConvertFromInternal(in []*api.DataReading) ([]*api.DataReading, error) {
+	out := make([]*api.DataReading, 0, len(in))
+	for _, reading := range in {
+		if reading == nil {
+			return nil, fmt.Errorf("programmer mistake: the DataReading must not be nil")
+		}
+		converted := *reading
+		converted.SchemaVersion = SchemaVersion
+		switch data := reading.Data.(type) {
+		case *api.DynamicData:
+			converted.DataType = api.DataTypeDynamic
+			converted.Data = convertDynamicDataFromInternal(data)
+		case *api.DiscoveryData:
+			converted.DataType = api.DataTypeDiscovery
+		case *api.OIDCDiscoveryData:
+			converted.DataType = api.DataTypeOIDCDiscovery
+		case *api.FindingsData:
+			converted.DataType = api.DataTypeFindings
+		case *api.CABundlesData:
+			converted.DataType = api.DataTypeCABundles
+		case *api.TLSProbesData:
+			converted.DataType = api.DataTypeTLSProbes
+		case *api.NodeFilesData:
+			converted.DataType = api.DataTypeNodeFiles
+		case *api.GenericData:
+			converted.DataType = api.DataTypeGeneric
+		default:
+			converted.DataType = ""
+		}
+		out = append(out, &converted)
+	}
+	return out, nil
+}
+
+func convertDynamicDataFromInternal(in *api.DynamicData) *DynamicData {
+	if in == nil {
+		return nil
+	}
+	out := &DynamicData{
+		Items: make([]*GatheredResource, 0, len(in.Items)),
+	}
+	for _, item := range in.Items {
+		out.Items = append(out.Items, &GatheredResource{
+			Resource:          item.Resource,
+			DeletedAt:         item.DeletedAt,
+			DeletionInferred:  item.DeletionInferred,
+			FirstSeenAt:       item.FirstSeenAt,
+			LastUpdatedAt:     item.LastUpdatedAt,
+			LastModifiedAt:    item.LastModifiedAt,
+			UpdateCount:       item.UpdateCount,
+			CreatedAndDeleted: item.CreatedAndDeleted,
+			ComputedFields:    item.ComputedFields,
+		})
+	}
+	return out
+}
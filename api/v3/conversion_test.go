@@ -0,0 +1,149 @@
+package v3
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/version"
+
+	"github.com/jetstack/preflight/api"
+)
+
+func TestConvertFromInternal(t *testing.T) {
+	in := []*api.DataReading{
+		{
+			DataGatherer: "k8s/secrets",
+			Timestamp:    api.Time{Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)},
+			Data: &api.DynamicData{Items: []*api.GatheredResource{
+				{Resource: map[string]any{"kind": "Secret"}},
+				{
+					Resource:       map[string]any{"kind": "Secret"},
+					FirstSeenAt:    api.Time{Time: time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)},
+					LastUpdatedAt:  api.Time{Time: time.Date(2024, 6, 1, 11, 30, 0, 0, time.UTC)},
+					LastModifiedAt: api.Time{Time: time.Date(2024, 6, 1, 11, 29, 0, 0, time.UTC)},
+					UpdateCount:    3,
+					ComputedFields: map[string]any{"owned": true},
+				},
+				{Resource: map[string]any{"kind": "Secret"}, CreatedAndDeleted: true, DeletedAt: api.Time{Time: time.Date(2024, 6, 1, 11, 0, 0, 0, time.UTC)}, DeletionInferred: true},
+			}},
+		},
+		{
+			DataGatherer: "k8s-discovery",
+			Timestamp:    api.Time{Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)},
+			Data:         &api.DiscoveryData{ClusterID: "uid", ServerVersion: &version.Info{GitVersion: "v1.33.0"}},
+		},
+		{
+			DataGatherer: "certificate-findings",
+			Timestamp:    api.Time{Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)},
+			Data: &api.FindingsData{Findings: []api.Finding{{
+				Type:     api.FindingExpired,
+				Severity: api.FindingSeverityError,
+				Message:  "expired",
+				Resource: api.ResourceReference{APIVersion: "v1", Kind: "Secret", Namespace: "default", Name: "tls"},
+				Key:      "tls.crt",
+			}}},
+		},
+		{
+			DataGatherer: "k8s-ca-bundles",
+			Timestamp:    api.Time{Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)},
+			Data: &api.CABundlesData{CABundles: []api.CABundle{{
+				Resource:     api.ResourceReference{APIVersion: "apiregistration.k8s.io/v1", Kind: "APIService", Name: "v1beta1.metrics.k8s.io"},
+				Field:        "spec.caBundle",
+				Certificates: []api.CertificateSummary{},
+			}}},
+		},
+	}
+
+	out, err := ConvertFromInternal(in)
+	require.NoError(t, err)
+
+	bytes, err := json.Marshal(out)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{
+			"data-gatherer": "k8s/secrets",
+			"timestamp": "2024-06-01T12:00:00Z",
+			"data_type": "dynamic",
+			"data": {"items": [
+				{"resource": {"kind": "Secret"}},
+				{
+					"resource": {"kind": "Secret"},
+					"first_seen_at": "2024-06-01T10:00:00Z",
+					"last_updated_at": "2024-06-01T11:30:00Z",
+					"last_modified_at": "2024-06-01T11:29:00Z",
+					"update_count": 3,
+					"computed_fields": {"owned": true}
+				},
+				{"resource": {"kind": "Secret"}, "deleted_at": "2024-06-01T11:00:00Z", "deletion_inferred": true, "created_and_deleted": true}
+			]},
+			"schema_version": "v3.0.0"
+		},
+		{
+			"data-gatherer": "k8s-discovery",
+			"timestamp": "2024-06-01T12:00:00Z",
+			"data_type": "discovery",
+			"data": {
+				"cluster_id": "uid",
+				"server_version": {
+					"major": "", "minor": "", "gitVersion": "v1.33.0", "gitCommit": "",
+					"gitTreeState": "", "buildDate": "", "goVersion": "", "compiler": "", "platform": ""
+				}
+			},
+			"schema_version": "v3.0.0"
+		},
+		{
+			"data-gatherer": "certificate-findings",
+			"timestamp": "2024-06-01T12:00:00Z",
+			"data_type": "findings",
+			"data": {"findings": [{
+				"type": "expired",
+				"severity": "error",
+				"message": "expired",
+				"resource": {"api_version": "v1", "kind": "Secret", "namespace": "default", "name": "tls"},
+				"key": "tls.crt"
+			}]},
+			"schema_version": "v3.0.0"
+		},
+		{
+			"data-gatherer": "k8s-ca-bundles",
+			"timestamp": "2024-06-01T12:00:00Z",
+			"data_type": "ca-bundles",
+			"data": {"ca_bundles": [{
+				"resource": {"api_version": "apiregistration.k8s.io/v1", "kind": "APIService", "name": "v1beta1.metrics.k8s.io"},
+				"field": "spec.caBundle",
+				"certificates": []
+			}]},
+			"schema_version": "v3.0.0"
+		}
+	]`, string(bytes))
+
+	// The readings can be decoded back to the internal types using the
+	// discriminator.
+	var decoded []*api.DataReading
+	require.NoError(t, json.Unmarshal(bytes, &decoded))
+	assert.IsType(t, &api.DynamicData{}, decoded[0].Data)
+	assert.IsType(t, &api.DiscoveryData{}, decoded[1].Data)
+	assert.Equal(t, in[2].Data, decoded[2].Data)
+	assert.Equal(t, in[3].Data, decoded[3].Data)
+}
+
+func TestConvertFromInternal_UnknownDataType(t *testing.T) {
+	in := []*api.DataReading{
+		{DataGatherer: "local", DataType: api.DataTypeGeneric, Data: []byte("raw")},
+		{DataGatherer: "k8s-discovery", Data: &api.DiscoveryData{ClusterID: "uid"}},
+	}
+
+	out, err := ConvertFromInternal(in)
+	require.NoError(t, err)
+	require.Len(t, out, 2)
+
+	// Unknown data types are passed through without a discriminator, and
+	// don't prevent the other readings from being converted.
+	assert.Equal(t, []byte("raw"), out[0].Data)
+	assert.Equal(t, api.DataType(""), out[0].DataType)
+	assert.Equal(t, SchemaVersion, out[0].SchemaVersion)
+	assert.Equal(t, api.DataTypeDiscovery, out[1].DataType)
+}
@@ -0,0 +1,106 @@
+// Package v3 contains the v3.0.0 schema of the data readings sent by the agent,
+// and the functions to convert data readings between this schema and the
+// internal representation in the api package.
+//
+// v3 adds the `data_type` discriminator to each data reading, so that the
+// receiver no longer has to guess the type of DataReading.Data from the shape
+// of the data. The data types that have not changed since v2 are shared with
+// the v2 package.
+package v3
+
+import (
+	"encoding/json"
+
+	"github.com/jetstack/preflight/api"
+	v2 "github.com/jetstack/preflight/api/v2"
+)
+
+// SchemaVersion is the value of DataReading.SchemaVersion for readings that
+// use this schema.
+const SchemaVersion = "v3.0.0"
+
+// DynamicData is the DataReading.Data returned by the k8sdynamic
+// gatherer.
+type DynamicData struct {
+	// Items is a list of GatheredResource
+	Items []*GatheredResource `json:"items"`
+}
+
+// GatheredResource wraps the raw k8s resource that is sent to the backend.
+type GatheredResource struct {
+	// Resource is a reference to a k8s object that was found by the informer
+	// should be of type unstructured.Unstructured, raw Object
+	Resource  any
+	DeletedAt api.Time
+	// DeletionInferred is true when the deletion wasn't observed, in which
+	// case DeletedAt is the time at which the deletion was noticed. It was
+	// introduced in v3.
+	DeletionInferred bool
+	// FirstSeenAt, LastUpdatedAt, LastModifiedAt, UpdateCount and
+	// CreatedAndDeleted are the change timeline of the resource. They were
+	// introduced in v3 and are omitted when unknown.
+	FirstSeenAt       api.Time
+	LastUpdatedAt     api.Time
+	LastModifiedAt    api.Time
+	UpdateCount       int
+	CreatedAndDeleted bool
+	// ComputedFields are the values derived from the resource by CEL
+	// expressions. They were introduced in v3.
+	ComputedFields map[string]any
+}
+
+func (v GatheredResource) MarshalJSON() ([]byte, error) {
+	data := struct {
+		Resource          any            `json:"resource"`
+		DeletedAt         string         `json:"deleted_at,omitempty"`
+		DeletionInferred  bool           `json:"deletion_inferred,omitempty"`
+		FirstSeenAt       string         `json:"first_seen_at,omitempty"`
+		LastUpdatedAt     string         `json:"last_updated_at,omitempty"`
+		LastModifiedAt    string         `json:"last_modified_at,omitempty"`
+		UpdateCount       int            `json:"update_count,omitempty"`
+		CreatedAndDeleted bool           `json:"created_and_deleted,omitempty"`
+		ComputedFields    map[string]any `json:"computed_fields,omitempty"`
+	}{
+		Resource:          v.Resource,
+		DeletedAt:         optionalTime(v.DeletedAt),
+		DeletionInferred:  v.DeletionInferred,
+		FirstSeenAt:       optionalTime(v.FirstSeenAt),
+		LastUpdatedAt:     optionalTime(v.LastUpdatedAt),
+		LastModifiedAt:    optionalTime(v.LastModifiedAt),
+		UpdateCount:       v.UpdateCount,
+		CreatedAndDeleted: v.CreatedAndDeleted,
+		ComputedFields:    v.ComputedFields,
+	}
+
+	return json.Marshal(data)
+}
+
+// optionalTime formats the time, or returns an empty string when the time is
+// zero so that it is omitted.
+func optionalTime(t api.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(api.TimeFormat)
+}
+
+// DiscoveryData has not changed since v2.
+type DiscoveryData = v2.DiscoveryData
+
+// OIDCDiscoveryData has not changed since v2.
+type OIDCDiscoveryData = v2.OIDCDiscoveryData
+
+// FindingsData was introduced in v3, and the internal type is used as-is.
+type FindingsData = api.FindingsData
+
+// CABundlesData was introduced in v3, and the internal type is used as-is.
+type CABundlesData = api.CABundlesData
+
+// TLSProbesData was introduced in v3, and the internal type is used as-is.
+type TLSProbesData = api.TLSProbesData
+
+// NodeFilesData was introduced in v3, and the internal type is used as-is.
+type NodeFilesData = api.NodeFilesData
+
+// GenericData was introduced in v3, and the internal type is used as-is.
+type GenericData = api.GenericData
@@ -31,4 +31,12 @@ func init() {
 		false,
 		"Prints compact output.",
 	)
+
+	echoCmd.PersistentFlags().StringVarP(
+		&echo.HMACSecretFile,
+		"hmac-secret-file",
+		"",
+		"",
+		"Path to the secret used to verify the HMAC signature of the requests sent by the agent in Webhook mode.",
+	)
 }
@@ -0,0 +1,55 @@
+#!/bin/sh
+#
+# A sample plugin for the exec data gatherer. It reports the certificates of a
+# legacy PKI as Kubernetes-like resources. A real plugin would query the PKI
+# instead of printing a fixed list.
+#
+# The contract between the agent and the plugins is defined in
+# docs/datagatherers/exec.md and tested in pkg/datagatherer/execplugin.
+
+set -eu
+
+if [ "${PREFLIGHT_EXEC_PROTOCOL_VERSION:-}" != "v1" ]; then
+  echo "unsupported protocol version \"${PREFLIGHT_EXEC_PROTOCOL_VERSION:-}\", this plugin supports \"v1\"" >&2
+  exit 1
+fi
+
+# The endpoint of the PKI is passed through the env field of the data gatherer
+# configuration, since the plugin doesn't inherit the environment of the agent.
+pki_url="${LEGACY_PKI_URL:-https://pki.example.com}"
+
+cat <<JSON
+{
+  "version": "v1",
+  "data_type": "dynamic",
+  "resources": [
+    {
+      "apiVersion": "legacy-pki.example.com/v1",
+      "kind": "Certificate",
+      "metadata": {
+        "name": "payments-gateway",
+        "annotations": {"legacy-pki.example.com/source": "${pki_url}"}
+      },
+      "spec": {
+        "commonName": "payments.example.com",
+        "serialNumber": "4f2a9c",
+        "notAfter": "2030-01-01T00:00:00Z"
+      }
+    },
+    {
+      "apiVersion": "legacy-pki.example.com/v1",
+      "kind": "Certificate",
+      "metadata": {
+        "name": "intranet",
+        "annotations": {"legacy-pki.example.com/source": "${pki_url}"}
+      },
+      "spec": {
+        "commonName": "intranet.example.com",
+        "serialNumber": "77b310",
+        "notAfter": "2026-03-01T00:00:00Z"
+      }
+    }
+  ],
+  "count": 2
+}
+JSON
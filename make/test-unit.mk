@@ -13,3 +13,9 @@ test-unit: | $(NEEDS_GO) $(NEEDS_GOTESTSUM) $(ARTIFACTS) $(NEEDS_ETCD) $(NEEDS_K
 
 	$(GO) tool cover -func=$(ARTIFACTS)/filtered.cov
 	$(GO) tool cover -html=$(ARTIFACTS)/filtered.cov -o=$(ARTIFACTS)/filtered.html
+
+.PHONY: test-race
+## Unit tests of the data gatherers with the race detector
+## @category Testing
+test-race: | $(NEEDS_GO)
+	$(GO) test -race ./pkg/datagatherer/... -ldflags $(go_preflight_ldflags)
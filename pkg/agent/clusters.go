@@ -0,0 +1,269 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/sync/errgroup"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/pkg/client"
+	"github.com/jetstack/preflight/pkg/datagatherer"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8scabundles"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdiscovery"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8stlsprobe"
+	"github.com/jetstack/preflight/pkg/datagatherer/oidc"
+)
+
+// remoteCluster gathers and uploads the data of a cluster listed in the
+// `clusters` field. Unlike with the agent's cluster, the failures don't stop
+// the agent: they are logged and shown in the agent's Pod events, and the data
+// gatherers that couldn't be instantiated, for instance because the cluster
+// was unreachable, are instantiated again on the next run.
+type remoteCluster struct {
+	cluster ClusterConfig
+
+	// config is the agent's config with the identity of the cluster.
+	config    CombinedConfig
+	dgConfigs []DataGatherer
+	opts      dataGathererOptions
+
+	// secrets is used to read the kubeconfig Secrets. It is nil when no
+	// cluster uses a Secret.
+	secrets kubernetes.Interface
+	// kubeconfigDir is where the kubeconfigs of the Secrets and of the
+	// contexts are written.
+	kubeconfigDir string
+
+	// dataGatherers is nil until the data gatherers are instantiated.
+	dataGatherers map[string]datagatherer.DataGatherer
+	// stop stops the data gatherers, and removes the kubeconfig written for
+	// them.
+	stop func()
+	// kubeconfigSecret is the content of the kubeconfig Secret used by the
+	// data gatherers. The data gatherers are instantiated again when it
+	// changes, e.g. when short-lived credentials are rotated.
+	kubeconfigSecret []byte
+}
+
+func newRemoteCluster(cluster ClusterConfig, config CombinedConfig, opts dataGathererOptions, secrets kubernetes.Interface, kubeconfigDir string) *remoteCluster {
+	config.ClusterID = cluster.ClusterID
+	config.ClusterName = cluster.ClusterName
+	config.ClusterDescription = cluster.ClusterDescription
+	config.InputPath = ""
+	return &remoteCluster{
+		cluster:       cluster,
+		config:        config,
+		dgConfigs:     config.DataGatherers,
+		opts:          opts,
+		secrets:       secrets,
+		kubeconfigDir: kubeconfigDir,
+	}
+}
+
+func (c *remoteCluster) name() string {
+	return clusterKey(c.cluster.ClusterName, c.cluster.ClusterID)
+}
+
+// gatherAndOutputData instantiates and starts the data gatherers of the
+// cluster if needed, then gathers and uploads the data of the cluster.
+func (c *remoteCluster) gatherAndOutputData(ctx context.Context, group *errgroup.Group, eventf Eventf, preflightClient client.Client) {
+	log := klog.FromContext(ctx).WithValues("cluster", c.name())
+	ctx = klog.NewContext(ctx, log)
+
+	// The Secret is read on each run, so that the rotated credentials are
+	// used as soon as the next run.
+	var kubeconfigSecret []byte
+	if c.cluster.Secret != nil {
+		var err error
+		kubeconfigSecret, err = c.cluster.readKubeconfigSecret(ctx, c.secrets)
+		switch {
+		case err != nil && c.dataGatherers == nil:
+			log.Error(err, "Failed to start the data gatherers of the cluster, will retry on the next run")
+			eventf("Warning", "ClusterErr", "cluster %s: failed to start the data gatherers: %s", c.name(), err)
+			return
+		case err != nil:
+			log.Error(err, "Failed to read the kubeconfig Secret, using the previous kubeconfig")
+			kubeconfigSecret = c.kubeconfigSecret
+		case c.dataGatherers != nil && !bytes.Equal(kubeconfigSecret, c.kubeconfigSecret):
+			log.Info("The kubeconfig Secret changed, restarting the data gatherers of the cluster")
+			c.stop()
+			c.dataGatherers = nil
+		}
+	}
+
+	if c.dataGatherers == nil {
+		if err := c.start(ctx, group, kubeconfigSecret); err != nil {
+			log.Error(err, "Failed to start the data gatherers of the cluster, will retry on the next run")
+			eventf("Warning", "ClusterErr", "cluster %s: failed to start the data gatherers: %s", c.name(), err)
+			return
+		}
+	}
+
+	if err := gatherAndOutputData(ctx, eventf, c.config, preflightClient, c.dataGatherers); err != nil {
+		log.Error(err, "Failed to gather and upload the data of the cluster")
+		eventf("Warning", "ClusterErr", "cluster %s: %s", c.name(), err)
+	}
+}
+
+// start instantiates and starts the data gatherers of the cluster.
+// kubeconfigSecret is the content of the kubeconfig Secret, if the cluster
+// uses one.
+func (c *remoteCluster) start(ctx context.Context, group *errgroup.Group, kubeconfigSecret []byte) error {
+	log := klog.FromContext(ctx)
+
+	path, err := c.cluster.kubeConfigPath(kubeconfigSecret, c.kubeconfigDir)
+	if err != nil {
+		return err
+	}
+	removeKubeconfig := func() {
+		if path != c.cluster.KubeConfigPath {
+			_ = os.Remove(path)
+		}
+	}
+	dgConfigs := clusterDataGatherers(c.dgConfigs, path)
+
+	// The data gatherers run until the kubeconfig changes.
+	runCtx, cancel := context.WithCancel(ctx)
+	dataGatherers, toStart, err := newDataGatherers(runCtx, c.config, dgConfigs, c.opts)
+	if err != nil {
+		cancel()
+		removeKubeconfig()
+		return err
+	}
+	for _, start := range toStart {
+		group.Go(func() error {
+			if err := start.dg.Run(runCtx); err != nil {
+				log.Error(err, "Failed to start data gatherer", "kind", start.dgConfig.Kind, "name", start.dgConfig.Name)
+			}
+			return nil
+		})
+	}
+	waitForCacheSync(ctx, dgConfigs, dataGatherers)
+
+	c.dataGatherers = dataGatherers
+	c.kubeconfigSecret = kubeconfigSecret
+	c.stop = func() {
+		cancel()
+		removeKubeconfig()
+	}
+	return nil
+}
+
+// clusterDataGatherers returns the Kubernetes data gatherers of the agent's
+// cluster with the kubeconfig of another cluster. The other data gatherers,
+// such as node-filesystem, only concern the agent's cluster.
+func clusterDataGatherers(dgConfigs []DataGatherer, kubeconfigPath string) []DataGatherer {
+	var res []DataGatherer
+	for _, dgConfig := range dgConfigs {
+		cfg, ok := withKubeConfigPath(dgConfig.Config, kubeconfigPath)
+		if !ok {
+			continue
+		}
+		dgConfig.Config = cfg
+		res = append(res, dgConfig)
+	}
+	return res
+}
+
+// withKubeConfigPath returns a copy of the configuration of a Kubernetes data
+// gatherer that uses the supplied kubeconfig. It returns false for the data
+// gatherers that don't use a kubeconfig.
+func withKubeConfigPath(cfg datagatherer.Config, path string) (datagatherer.Config, bool) {
+	switch cfg := cfg.(type) {
+	case *k8sdynamic.ConfigDynamic:
+		c := *cfg
+		c.KubeConfigPath = path
+		return &c, true
+	case *k8sdiscovery.ConfigDiscovery:
+		c := *cfg
+		c.KubeConfigPath = path
+		return &c, true
+	case *k8scabundles.ConfigCABundles:
+		c := *cfg
+		c.KubeConfigPath = path
+		return &c, true
+	case *k8stlsprobe.ConfigTLSProbe:
+		c := *cfg
+		c.KubeConfigPath = path
+		return &c, true
+	case *oidc.OIDCDiscovery:
+		c := *cfg
+		c.KubeConfigPath = path
+		return &c, true
+	default:
+		return nil, false
+	}
+}
+
+// readKubeconfigSecret returns the kubeconfig stored in the Secret of the
+// cluster.
+func (c ClusterConfig) readKubeconfigSecret(ctx context.Context, secrets kubernetes.Interface) ([]byte, error) {
+	secret, err := secrets.CoreV1().Secrets(c.Secret.Namespace).Get(ctx, c.Secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("while reading the kubeconfig Secret: %w", err)
+	}
+	data, ok := secret.Data[c.Secret.Key]
+	if !ok {
+		return nil, fmt.Errorf("the Secret %s/%s has no %q key", c.Secret.Namespace, c.Secret.Name, c.Secret.Key)
+	}
+	return data, nil
+}
+
+// kubeConfigPath returns the path of the kubeconfig of the cluster. When the
+// kubeconfig is read from a Secret, whose content is kubeconfigSecret, or a
+// context is selected, a kubeconfig containing only the selected context is
+// written to dir.
+func (c ClusterConfig) kubeConfigPath(kubeconfigSecret []byte, dir string) (string, error) {
+	var kubeconfig *clientcmdapi.Config
+	switch {
+	case c.Secret != nil:
+		var err error
+		kubeconfig, err = clientcmd.Load(kubeconfigSecret)
+		if err != nil {
+			return "", fmt.Errorf("while parsing the kubeconfig of the Secret %s/%s: %w", c.Secret.Namespace, c.Secret.Name, err)
+		}
+	case c.Context == "":
+		return c.KubeConfigPath, nil
+	default:
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = c.KubeConfigPath
+		var err error
+		kubeconfig, err = rules.Load()
+		if err != nil {
+			return "", fmt.Errorf("while loading the kubeconfig: %w", err)
+		}
+	}
+
+	if c.Context != "" {
+		if _, ok := kubeconfig.Contexts[c.Context]; !ok {
+			return "", fmt.Errorf("the context %q doesn't exist in the kubeconfig", c.Context)
+		}
+		kubeconfig.CurrentContext = c.Context
+	}
+	if err := clientcmdapi.MinifyConfig(kubeconfig); err != nil {
+		return "", fmt.Errorf("while selecting the context of the kubeconfig: %w", err)
+	}
+	data, err := clientcmd.Write(*kubeconfig)
+	if err != nil {
+		return "", fmt.Errorf("while encoding the kubeconfig: %w", err)
+	}
+
+	// The file is created with the permissions 0600.
+	f, err := os.CreateTemp(dir, "kubeconfig-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
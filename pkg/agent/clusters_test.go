@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/client"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdiscovery"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+	"github.com/jetstack/preflight/pkg/datagatherer/nodefs"
+)
+
+func TestClusterConfig_kubeConfigPath(t *testing.T) {
+	kubeconfig := clientcmdapi.NewConfig()
+	for _, name := range []string{"management", "workload-1"} {
+		kubeconfig.Clusters[name] = &clientcmdapi.Cluster{Server: "https://" + name + ".example.com"}
+		kubeconfig.AuthInfos[name] = &clientcmdapi.AuthInfo{Token: name + "-token"}
+		kubeconfig.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: name}
+	}
+	kubeconfig.CurrentContext = "management"
+	data, err := clientcmd.Write(*kubeconfig)
+	require.NoError(t, err)
+	kubeconfigPath := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfigPath, data, 0o600))
+
+	secrets := fake.NewClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "workload-1-kubeconfig", Namespace: "venafi"},
+		Data:       map[string][]byte{"kubeconfig": data},
+	})
+
+	// server returns the API server of the kubeconfig, which must have a
+	// single context.
+	server := func(t *testing.T, path string) string {
+		t.Helper()
+		kubeconfig, err := clientcmd.LoadFromFile(path)
+		require.NoError(t, err)
+		require.Len(t, kubeconfig.Contexts, 1)
+		restcfg, err := clientcmd.NewDefaultClientConfig(*kubeconfig, nil).ClientConfig()
+		require.NoError(t, err)
+		return restcfg.Host
+	}
+
+	tests := []struct {
+		name       string
+		cluster    ClusterConfig
+		wantServer string
+		wantErr    string
+	}{
+		{
+			name:       "context",
+			cluster:    ClusterConfig{KubeConfigPath: kubeconfigPath, Context: "workload-1"},
+			wantServer: "https://workload-1.example.com",
+		},
+		{
+			name:       "secret",
+			cluster:    ClusterConfig{Secret: &ClusterSecretConfig{Name: "workload-1-kubeconfig", Namespace: "venafi", Key: "kubeconfig"}, Context: "workload-1"},
+			wantServer: "https://workload-1.example.com",
+		},
+		{
+			name:       "secret with the current context",
+			cluster:    ClusterConfig{Secret: &ClusterSecretConfig{Name: "workload-1-kubeconfig", Namespace: "venafi", Key: "kubeconfig"}},
+			wantServer: "https://management.example.com",
+		},
+		{
+			name:    "unknown context",
+			cluster: ClusterConfig{KubeConfigPath: kubeconfigPath, Context: "workload-2"},
+			wantErr: `the context "workload-2" doesn't exist in the kubeconfig`,
+		},
+		{
+			name:    "unknown secret key",
+			cluster: ClusterConfig{Secret: &ClusterSecretConfig{Name: "workload-1-kubeconfig", Namespace: "venafi", Key: "value"}},
+			wantErr: `the Secret venafi/workload-1-kubeconfig has no "value" key`,
+		},
+		{
+			name:    "unknown secret",
+			cluster: ClusterConfig{Secret: &ClusterSecretConfig{Name: "workload-2-kubeconfig", Namespace: "venafi", Key: "kubeconfig"}},
+			wantErr: `while reading the kubeconfig Secret: secrets "workload-2-kubeconfig" not found`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var kubeconfigSecret []byte
+			var err error
+			if test.cluster.Secret != nil {
+				kubeconfigSecret, err = test.cluster.readKubeconfigSecret(t.Context(), secrets)
+			}
+			path := ""
+			if err == nil {
+				path, err = test.cluster.kubeConfigPath(kubeconfigSecret, dir)
+			}
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, dir, filepath.Dir(path))
+			assert.Equal(t, test.wantServer, server(t, path))
+		})
+	}
+
+	t.Run("the kubeconfig is used as is without context", func(t *testing.T) {
+		path, err := ClusterConfig{KubeConfigPath: kubeconfigPath}.kubeConfigPath(nil, t.TempDir())
+		require.NoError(t, err)
+		assert.Equal(t, kubeconfigPath, path)
+	})
+}
+
+func TestClusterDataGatherers(t *testing.T) {
+	dynamic := &k8sdynamic.ConfigDynamic{KubeConfigPath: "/agent/kubeconfig"}
+	dgConfigs := []DataGatherer{
+		{Kind: "k8s-dynamic", Name: "k8s/secrets", Config: dynamic},
+		{Kind: "node-filesystem", Name: "node-files", Config: &nodefs.ConfigNodeFilesystem{}},
+		{Kind: "k8s-discovery", Name: "k8s-discovery", Config: &k8sdiscovery.ConfigDiscovery{}},
+	}
+
+	got := clusterDataGatherers(dgConfigs, "/clusters/workload-1")
+	assert.Equal(t, []DataGatherer{
+		{Kind: "k8s-dynamic", Name: "k8s/secrets", Config: &k8sdynamic.ConfigDynamic{KubeConfigPath: "/clusters/workload-1"}},
+		{Kind: "k8s-discovery", Name: "k8s-discovery", Config: &k8sdiscovery.ConfigDiscovery{KubeConfigPath: "/clusters/workload-1"}},
+	}, got)
+	// The configuration of the agent's cluster is left untouched.
+	assert.Equal(t, "/agent/kubeconfig", dynamic.KubeConfigPath)
+}
+
+// The data gatherers of a cluster are instantiated again with the new
+// kubeconfig when its Secret changes, e.g. when the credentials are rotated.
+func TestRemoteCluster_KubeconfigSecretRotation(t *testing.T) {
+	kubeconfig := func(token string) []byte {
+		kubeconfig := clientcmdapi.NewConfig()
+		kubeconfig.Clusters["workload-1"] = &clientcmdapi.Cluster{Server: "https://workload-1.example.com"}
+		kubeconfig.AuthInfos["workload-1"] = &clientcmdapi.AuthInfo{Token: token}
+		kubeconfig.Contexts["workload-1"] = &clientcmdapi.Context{Cluster: "workload-1", AuthInfo: "workload-1"}
+		kubeconfig.CurrentContext = "workload-1"
+		data, err := clientcmd.Write(*kubeconfig)
+		require.NoError(t, err)
+		return data
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "workload-1-kubeconfig", Namespace: "venafi"},
+		Data:       map[string][]byte{"kubeconfig": kubeconfig("token-1")},
+	}
+	secrets := fake.NewClientset(secret)
+	dir := t.TempDir()
+	cluster := newRemoteCluster(ClusterConfig{
+		ClusterName: "workload-1",
+		Secret:      &ClusterSecretConfig{Name: "workload-1-kubeconfig", Namespace: "venafi", Key: "kubeconfig"},
+	}, CombinedConfig{SchemaVersion: "v2.0.0", BackoffMaxTime: time.Second}, dataGathererOptions{}, secrets, dir)
+	t.Cleanup(func() {
+		if cluster.stop != nil {
+			cluster.stop()
+		}
+	})
+
+	var group errgroup.Group
+	run := func() {
+		t.Helper()
+		var events []string
+		eventf := func(eventType, reason, msg string, args ...any) {
+			events = append(events, fmt.Sprintf(msg, args...))
+		}
+		cluster.gatherAndOutputData(t.Context(), &group, eventf, &fakeClient{})
+		require.Empty(t, events)
+	}
+	// token returns the token of the kubeconfig written for the cluster.
+	token := func() string {
+		t.Helper()
+		files, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		kubeconfig, err := clientcmd.LoadFromFile(filepath.Join(dir, files[0].Name()))
+		require.NoError(t, err)
+		return kubeconfig.AuthInfos["workload-1"].Token
+	}
+
+	run()
+	assert.Equal(t, "token-1", token())
+
+	secret.Data["kubeconfig"] = kubeconfig("token-2")
+	_, err := secrets.CoreV1().Secrets("venafi").Update(t.Context(), secret, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	run()
+	assert.Equal(t, "token-2", token())
+
+	// A Secret that can't be read doesn't stop the running data gatherers.
+	require.NoError(t, secrets.CoreV1().Secrets("venafi").Delete(t.Context(), secret.Name, metav1.DeleteOptions{}))
+	run()
+	assert.Equal(t, "token-2", token())
+	assert.NotNil(t, cluster.dataGatherers)
+}
+
+type fakeClient struct{}
+
+func (*fakeClient) PostDataReadingsWithOptions(context.Context, []*api.DataReading, client.Options) error {
+	return nil
+}
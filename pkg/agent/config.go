@@ -7,6 +7,8 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -17,11 +19,19 @@ import (
 	"k8s.io/client-go/rest"
 
 	"github.com/jetstack/preflight/api"
+	v2 "github.com/jetstack/preflight/api/v2"
+	v3 "github.com/jetstack/preflight/api/v3"
+	"github.com/jetstack/preflight/pkg/certfindings"
+	"github.com/jetstack/preflight/pkg/certmetrics"
 	"github.com/jetstack/preflight/pkg/client"
 	"github.com/jetstack/preflight/pkg/datagatherer"
+	"github.com/jetstack/preflight/pkg/datagatherer/execplugin"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8scabundles"
 	"github.com/jetstack/preflight/pkg/datagatherer/k8sdiscovery"
 	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8stlsprobe"
 	"github.com/jetstack/preflight/pkg/datagatherer/local"
+	"github.com/jetstack/preflight/pkg/datagatherer/nodefs"
 	"github.com/jetstack/preflight/pkg/datagatherer/oidc"
 	"github.com/jetstack/preflight/pkg/kubeconfig"
 	"github.com/jetstack/preflight/pkg/logs"
@@ -66,14 +76,50 @@ type Config struct {
 
 	// For testing purposes.
 	InputPath string `yaml:"input-path"`
-	// For testing purposes.
+	// OutputPath is the file to which the data readings are written in Local
+	// File mode. See OutputFile for writing files continuously.
 	OutputPath string `yaml:"output-path"`
 
+	// OutputFile controls how the files are written in Local File mode.
+	OutputFile *OutputFileConfig `yaml:"output-file,omitempty"`
+
+	// Webhook turns on the Webhook mode, in which the data readings are
+	// POSTed to a user-provided HTTP endpoint.
+	Webhook *WebhookConfig `yaml:"webhook,omitempty"`
+
+	// S3 turns on the S3 mode, in which the data readings are written to an
+	// S3-compatible bucket.
+	S3 *S3Config `yaml:"s3,omitempty"`
+
+	// CertificateMetrics turns on the Prometheus metrics about the
+	// certificates found in the Secrets gathered by the k8s-dynamic data
+	// gatherers. Requires --enable-metrics.
+	CertificateMetrics *CertificateMetricsConfig `yaml:"certificate-metrics,omitempty"`
+
+	// CertificateFindings turns on the validation of the certificates found
+	// in the Secrets gathered by the k8s-dynamic data gatherers. The problems
+	// found are sent as an extra data reading when schema-version is v3.0.0,
+	// since the older schema versions don't know its data type. Not supported
+	// in MachineHub mode.
+	CertificateFindings *CertificateFindingsConfig `yaml:"certificate-findings,omitempty"`
+
+	// SchemaVersion is the schema version of the data readings sent by the
+	// agent. Defaults to v2.0.0, which all the backends understand. Ignored
+	// in MachineHub mode, which uses its own snapshot format.
+	SchemaVersion string `yaml:"schema-version"`
+
 	// Skips annotation keys that match the given set of regular expressions.
 	// Example: ".*someprivateannotation.*".
 	ExcludeAnnotationKeysRegex []string `yaml:"exclude-annotation-keys-regex"`
 	// Skips label keys that match the given set of regular expressions.
 	ExcludeLabelKeysRegex []string `yaml:"exclude-label-keys-regex"`
+
+	// Clusters lists the other clusters from which the agent gathers data,
+	// for instance from a management cluster. The Kubernetes data gatherers
+	// are instantiated once for the agent's cluster and once for each of
+	// these clusters, and the data of each cluster is uploaded separately
+	// with its own cluster identity. Not supported in Local File mode.
+	Clusters []ClusterConfig `yaml:"clusters,omitempty"`
 }
 
 type Endpoint struct {
@@ -89,6 +135,163 @@ type DataGatherer struct {
 	Config   datagatherer.Config
 }
 
+// OutputFileConfig controls how the data readings are written in Local File
+// mode. By default, all the data readings are written to a single JSON file
+// that is overwritten on each run.
+type OutputFileConfig struct {
+	// Format is either "json" (default), "ndjson", or "cyclonedx". With
+	// "ndjson", each Kubernetes resource is written on its own line. With
+	// "cyclonedx", a CycloneDX CBOM of the certificates is written instead of
+	// the data readings.
+	Format string `yaml:"format"`
+
+	// Gzip compresses the files.
+	Gzip bool `yaml:"gzip"`
+
+	// Timestamped adds the time of the run to the file names instead of
+	// overwriting the same file on each run.
+	Timestamped bool `yaml:"timestamped"`
+
+	// PerGatherer writes one file per data gatherer.
+	PerGatherer bool `yaml:"per-gatherer"`
+
+	// MaxFiles is the number of runs for which the files are kept. Requires
+	// `timestamped`. Zero means no limit.
+	MaxFiles int `yaml:"max-files"`
+
+	// MaxAge is the duration after which the files are removed. Requires
+	// `timestamped`. Zero means no limit.
+	MaxAge time.Duration `yaml:"max-age"`
+}
+
+// WebhookConfig configures the Webhook mode. Only `url` is required.
+type WebhookConfig struct {
+	// URL is the endpoint to which the data readings are POSTed.
+	URL string `yaml:"url"`
+
+	// Headers are added to each request.
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// BearerTokenFile is the path to a file containing a bearer token. The
+	// file is read on each request.
+	BearerTokenFile string `yaml:"bearer-token-file,omitempty"`
+
+	// ClientCertFile and ClientKeyFile are used for mTLS.
+	ClientCertFile string `yaml:"client-cert-file,omitempty"`
+	ClientKeyFile  string `yaml:"client-key-file,omitempty"`
+
+	// HMACSecretFile is the path to a file containing the secret used to sign
+	// the requests with HMAC-SHA256. The file is read on each request.
+	HMACSecretFile string `yaml:"hmac-secret-file,omitempty"`
+
+	// CACertFile is the path to a PEM bundle of the root CAs trusted for the
+	// webhook's server certificate. Defaults to the system roots.
+	CACertFile string `yaml:"ca-cert-file,omitempty"`
+
+	// Payload is either "data-readings" (default) or "cyclonedx".
+	Payload string `yaml:"payload,omitempty"`
+}
+
+// S3Config configures the S3 mode. Only `bucket` and `region` are required.
+type S3Config struct {
+	Bucket string `yaml:"bucket"`
+	Region string `yaml:"region"`
+
+	// Endpoint is the URL of an S3-compatible API such as MinIO. Defaults to
+	// the AWS S3 endpoint of the region.
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// PathStyle puts the bucket name in the URL path rather than in the host
+	// name. Usually needed with S3-compatible APIs.
+	PathStyle bool `yaml:"path-style,omitempty"`
+
+	// KeyTemplate defaults to "{cluster}/{date}/{time}.json.gz". The object
+	// is gzipped when the key ends with ".gz".
+	KeyTemplate string `yaml:"key-template,omitempty"`
+
+	// ServerSideEncryption is either "AES256" or "aws:kms".
+	ServerSideEncryption string `yaml:"server-side-encryption,omitempty"`
+	SSEKMSKeyID          string `yaml:"sse-kms-key-id,omitempty"`
+
+	// CredentialsSource is one of "env", "file", or "web-identity". By
+	// default, the first one that is configured is used.
+	CredentialsSource string `yaml:"credentials-source,omitempty"`
+	CredentialsFile   string `yaml:"credentials-file,omitempty"`
+	Profile           string `yaml:"profile,omitempty"`
+	STSEndpoint       string `yaml:"sts-endpoint,omitempty"`
+
+	// Payload is either "data-readings" (default) or "cyclonedx".
+	Payload string `yaml:"payload,omitempty"`
+}
+
+// CertificateMetricsConfig configures the certificate metrics. Only `enabled`
+// is required.
+type CertificateMetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// IncludeNamespaces limits the metrics to the Secrets in these
+	// namespaces. Cannot be used with ExcludeNamespaces.
+	IncludeNamespaces []string `yaml:"include-namespaces,omitempty"`
+
+	// ExcludeNamespaces is a list of namespaces whose Secrets are ignored.
+	ExcludeNamespaces []string `yaml:"exclude-namespaces,omitempty"`
+
+	// MaxCertificates is the maximum number of certificates for which
+	// metrics are exported. The certificates that expire first are kept.
+	// Defaults to 5000.
+	MaxCertificates int `yaml:"max-certificates,omitempty"`
+}
+
+// CertificateFindingsConfig configures the certificate findings. Only
+// `enabled` is required.
+type CertificateFindingsConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// TrustBundleFile is the path to a PEM file containing the root
+	// certificates that the chains are verified against, in addition to the
+	// ca.crt key of each Secret.
+	TrustBundleFile string `yaml:"trust-bundle-file,omitempty"`
+
+	// Events turns on the recording of a Warning Event on the Secret for each
+	// new finding. Requires the permission to create Events in the namespaces
+	// of the Secrets.
+	Events bool `yaml:"events,omitempty"`
+}
+
+// ClusterConfig is a cluster listed in the `clusters` field. The cluster
+// identity fields are the same as the top-level ones and are required
+// according to the same rules. The kubeconfig is taken from `secret` if set,
+// or else from `kubeconfig` and `context`.
+type ClusterConfig struct {
+	ClusterID          string `yaml:"cluster_id,omitempty"`
+	ClusterName        string `yaml:"cluster_name,omitempty"`
+	ClusterDescription string `yaml:"cluster_description,omitempty"`
+
+	// KubeConfigPath is the path to a kubeconfig file. Defaults to the
+	// KUBECONFIG environment variable.
+	KubeConfigPath string `yaml:"kubeconfig,omitempty"`
+
+	// Context is the kubeconfig context to use. Defaults to the current
+	// context of the kubeconfig.
+	Context string `yaml:"context,omitempty"`
+
+	// Secret is a Secret of the agent's cluster that contains a kubeconfig.
+	// It is read when the data gatherers of the cluster are instantiated.
+	Secret *ClusterSecretConfig `yaml:"secret,omitempty"`
+}
+
+// ClusterSecretConfig refers to a Secret that contains a kubeconfig.
+type ClusterSecretConfig struct {
+	Name string `yaml:"name"`
+
+	// Namespace defaults to the namespace in which the agent is running.
+	Namespace string `yaml:"namespace,omitempty"`
+
+	// Key is the key of the kubeconfig in the Secret. Defaults to
+	// "kubeconfig".
+	Key string `yaml:"key,omitempty"`
+}
+
 type VenafiCloudConfig struct {
 	// Deprecated: UploaderID is ignored by the backend and is not needed.
 	// UploaderID is the upload ID that will be used when creating a cluster
@@ -137,9 +340,10 @@ type AgentCmdFlags struct {
 	// --input-path.
 	OneShot bool
 
-	// OutputPath (--output-path) is used for testing purposes. In conjunction
-	// with --one-shot, it allows you to write the data readings to a file
-	// instead uploading them to the Venafi Cloud API.
+	// OutputPath (--output-path) writes the data readings to a file instead
+	// uploading them to the Venafi Cloud API. It is often used with --one-shot
+	// for testing purposes; use the `output-file` config field to keep writing
+	// files on each run.
 	OutputPath string
 
 	// InputPath (--input-path) is used for testing purposes. In conjunction
@@ -266,7 +470,7 @@ func InitAgentCmdFlags(c *cobra.Command, cfg *AgentCmdFlags) {
 		"output-path",
 		"",
 		"",
-		"For testing purposes. In conjunction with --one-shot, it allows you to write the data readings to a file instead of uploading to the server.",
+		"Write the data readings to a file instead of uploading to the server. Often used with --one-shot for testing purposes. See the output-file config field for rotation and formats.",
 	)
 	c.PersistentFlags().StringVarP(
 		&cfg.InputPath,
@@ -403,9 +607,15 @@ const (
 	VenafiConnection       OutputMode = "VenafiConnection"
 	LocalFile              OutputMode = "Local File"
 	MachineHub             OutputMode = "MachineHub"
+	Webhook                OutputMode = "Webhook"
+	S3                     OutputMode = "S3"
 	NGTS                   OutputMode = "NGTS"
 )
 
+// SupportedSchemaVersions lists the schema versions that the agent is able to
+// send. See the api/v2 and api/v3 packages.
+var SupportedSchemaVersions = []string{v2.SchemaVersion, v3.SchemaVersion}
+
 // The command-line flags and the config file and some environment variables are
 // combined into this struct by ValidateAndCombineConfig.
 type CombinedConfig struct {
@@ -451,17 +661,42 @@ type CombinedConfig struct {
 	VenConnName string
 	VenConnNS   string
 
+	// SchemaVersion is the schema version the data readings are converted to
+	// before being sent. Always v2.0.0 in MachineHub mode, where the readings
+	// are not converted.
+	SchemaVersion string
+
+	// CertificateMetrics is nil unless the certificate metrics are enabled.
+	CertificateMetrics *certmetrics.Options
+
+	// CertificateFindings is nil unless the certificate findings are enabled
+	// and can be emitted, i.e. sent with schema v3 or recorded as Events.
+	CertificateFindings *certfindings.Options
+
 	// Applied to all data gatherers regardless of OutputMode.
 	ExcludeAnnotationKeysRegex []*regexp.Regexp
 	ExcludeLabelKeysRegex      []*regexp.Regexp
 
+	// Clusters are the other clusters from which data is gathered. The
+	// namespace and key of their Secrets are defaulted.
+	Clusters []ClusterConfig
+
 	// NGTS mode only.
 	TSGID         string
 	NGTSServerURL string
 
-	// Only used for testing purposes.
+	// Webhook mode only.
+	Webhook client.WebhookOptions
+
+	// S3 mode only.
+	S3 client.S3Options
+
+	// LocalFile mode only.
 	OutputPath string
-	InputPath  string
+	OutputFile client.FileOptions
+
+	// Only used for testing purposes.
+	InputPath string
 }
 
 // ValidateAndCombineConfig combines and validates the input configuration with
@@ -518,6 +753,14 @@ func ValidateAndCombineConfig(log logr.Logger, cfg Config, flags AgentCmdFlags)
 		case flags.OutputPath != "":
 			mode = LocalFile
 			reason = "--output-path was specified"
+		case cfg.Webhook != nil:
+			mode = Webhook
+			reason = "webhook was specified in the config file"
+			keysAndValues = []any{"url", cfg.Webhook.URL}
+		case cfg.S3 != nil:
+			mode = S3
+			reason = "s3 was specified in the config file"
+			keysAndValues = []any{"bucket", cfg.S3.Bucket}
 		case cfg.OutputPath != "":
 			mode = LocalFile
 			reason = "output-path was specified in the config file"
@@ -530,6 +773,8 @@ func ValidateAndCombineConfig(log logr.Logger, cfg Config, flags AgentCmdFlags)
 				" - Use --credentials-file alone if you want to use the " + string(JetstackSecureOAuth) + " mode.\n" +
 				" - Use --api-token if you want to use the " + string(JetstackSecureAPIToken) + " mode.\n" +
 				" - Use --machine-hub if you want to use the " + string(MachineHub) + " mode.\n" +
+				" - Use the webhook field in the config file for the " + string(Webhook) + " mode.\n" +
+				" - Use the s3 field in the config file for the " + string(S3) + " mode.\n" +
 				" - Use --output-path or output-path in the config file for " + string(LocalFile) + " mode.")
 		}
 
@@ -765,6 +1010,12 @@ func ValidateAndCombineConfig(log logr.Logger, cfg Config, flags AgentCmdFlags)
 			if cfg.ClusterID != "" {
 				log.Info(fmt.Sprintf(`Ignoring the cluster_id field in the config file. This field is not needed in %s mode.`, res.OutputMode))
 			}
+		case Webhook, S3:
+			// Both are optional. The cluster_id is sent in the agent metadata
+			// so that the receiver can tell clusters apart, and the S3 key
+			// template's {cluster} uses cluster_name or else cluster_id.
+			clusterID = cfg.ClusterID
+			clusterName = cfg.ClusterName
 		}
 		res.OrganizationID = organizationID
 		res.ClusterID = clusterID
@@ -845,6 +1096,238 @@ func ValidateAndCombineConfig(log logr.Logger, cfg Config, flags AgentCmdFlags)
 		}
 	}
 
+	// Validation of the `clusters` field. Each cluster is uploaded with its
+	// own identity, so the identities must be distinct from each other and
+	// from the agent's cluster.
+	switch {
+	case len(cfg.Clusters) == 0:
+	case res.OutputMode == LocalFile:
+		errs = multierror.Append(errs, fmt.Errorf("the clusters field is not supported in %s mode, the data readings of the clusters would be written to the same file", LocalFile))
+	default:
+		seen := map[string]bool{clusterKey(res.ClusterName, res.ClusterID): true}
+		for i, cluster := range cfg.Clusters {
+			prefix := fmt.Sprintf("clusters[%d]:", i)
+			var key string
+			switch res.OutputMode { // nolint:exhaustive
+			case NGTS, VenafiCloudKeypair, VenafiConnection, MachineHub:
+				if cluster.ClusterName == "" {
+					errs = multierror.Append(errs, fmt.Errorf("%s cluster_name is required in %s mode", prefix, res.OutputMode))
+				}
+				key = cluster.ClusterName
+			case JetstackSecureOAuth, JetstackSecureAPIToken:
+				if cluster.ClusterID == "" {
+					errs = multierror.Append(errs, fmt.Errorf("%s cluster_id is required in %s mode", prefix, res.OutputMode))
+				}
+				key = cluster.ClusterID
+			case Webhook, S3:
+				if cluster.ClusterName == "" && cluster.ClusterID == "" {
+					errs = multierror.Append(errs, fmt.Errorf("%s cluster_name or cluster_id is required in %s mode", prefix, res.OutputMode))
+				}
+				key = clusterKey(cluster.ClusterName, cluster.ClusterID)
+			}
+			if key != "" && seen[key] {
+				errs = multierror.Append(errs, fmt.Errorf("%s the cluster %q is configured more than once", prefix, key))
+			}
+			seen[key] = true
+
+			if cluster.Secret != nil {
+				if cluster.KubeConfigPath != "" {
+					errs = multierror.Append(errs, fmt.Errorf("%s kubeconfig and secret are mutually exclusive", prefix))
+				}
+				secret := *cluster.Secret
+				if secret.Name == "" {
+					errs = multierror.Append(errs, fmt.Errorf("%s secret.name is required", prefix))
+				}
+				if secret.Namespace == "" {
+					secret.Namespace = res.InstallNS
+				}
+				if secret.Namespace == "" {
+					errs = multierror.Append(errs, fmt.Errorf("%s secret.namespace is required when the namespace of the agent is unknown", prefix))
+				}
+				if secret.Key == "" {
+					secret.Key = "kubeconfig"
+				}
+				cluster.Secret = &secret
+			} else if cluster.KubeConfigPath == "" && cluster.Context == "" {
+				errs = multierror.Append(errs, fmt.Errorf("%s one of kubeconfig, context, or secret is required", prefix))
+			}
+			res.Clusters = append(res.Clusters, cluster)
+		}
+		if res.OutputMode == S3 && cfg.S3 != nil && cfg.S3.KeyTemplate != "" && !strings.Contains(cfg.S3.KeyTemplate, "{cluster}") {
+			errs = multierror.Append(errs, fmt.Errorf("s3.key-template must contain {cluster} when the clusters field is set"))
+		}
+	}
+
+	// Validation of the `webhook` field.
+	if cfg.Webhook != nil {
+		switch {
+		case res.OutputMode != Webhook:
+			log.Info(fmt.Sprintf("ignoring the webhook field in the config file. This field is only used in %s mode.", Webhook))
+		default:
+			u, err := url.Parse(cfg.Webhook.URL)
+			switch {
+			case cfg.Webhook.URL == "":
+				errs = multierror.Append(errs, fmt.Errorf("webhook.url is required"))
+			case err != nil || u.Hostname() == "" || (u.Scheme != "https" && u.Scheme != "http"):
+				errs = multierror.Append(errs, fmt.Errorf("webhook.url: %q is not a valid http or https URL", cfg.Webhook.URL))
+			case u.Scheme == "http":
+				log.Info("The webhook URL uses http; the data readings will be sent unencrypted.", "url", cfg.Webhook.URL)
+			}
+			if (cfg.Webhook.ClientCertFile == "") != (cfg.Webhook.ClientKeyFile == "") {
+				errs = multierror.Append(errs, fmt.Errorf("webhook.client-cert-file and webhook.client-key-file must be set together"))
+			}
+			res.Webhook = client.WebhookOptions{
+				URL:             cfg.Webhook.URL,
+				Headers:         cfg.Webhook.Headers,
+				BearerTokenFile: cfg.Webhook.BearerTokenFile,
+				ClientCertFile:  cfg.Webhook.ClientCertFile,
+				ClientKeyFile:   cfg.Webhook.ClientKeyFile,
+				HMACSecretFile:  cfg.Webhook.HMACSecretFile,
+				RootCAFile:      cfg.Webhook.CACertFile,
+				Payload:         client.PayloadFormat(cfg.Webhook.Payload),
+			}
+			if err := validatePayloadFormat(res.Webhook.Payload); err != nil {
+				errs = multierror.Append(errs, multierror.Prefix(err, "webhook.payload:"))
+			}
+		}
+	}
+
+	// Validation of the `s3` field. The key template, the server-side
+	// encryption, and the credentials are validated when creating the client.
+	if cfg.S3 != nil {
+		switch {
+		case res.OutputMode != S3:
+			log.Info(fmt.Sprintf("ignoring the s3 field in the config file. This field is only used in %s mode.", S3))
+		default:
+			if cfg.S3.Bucket == "" {
+				errs = multierror.Append(errs, fmt.Errorf("s3.bucket is required"))
+			}
+			if cfg.S3.Region == "" {
+				errs = multierror.Append(errs, fmt.Errorf("s3.region is required"))
+			}
+			keyTemplate := cfg.S3.KeyTemplate
+			if keyTemplate == "" {
+				keyTemplate = client.DefaultS3KeyTemplate
+			}
+			if strings.Contains(keyTemplate, "{cluster}") && cfg.ClusterName == "" && cfg.ClusterID == "" {
+				errs = multierror.Append(errs, fmt.Errorf("cluster_name or cluster_id is required when s3.key-template contains {cluster}"))
+			}
+			res.S3 = client.S3Options{
+				Bucket:               cfg.S3.Bucket,
+				Region:               cfg.S3.Region,
+				Endpoint:             cfg.S3.Endpoint,
+				PathStyle:            cfg.S3.PathStyle,
+				KeyTemplate:          cfg.S3.KeyTemplate,
+				ServerSideEncryption: cfg.S3.ServerSideEncryption,
+				SSEKMSKeyID:          cfg.S3.SSEKMSKeyID,
+				CredentialsSource:    client.S3CredentialsSource(cfg.S3.CredentialsSource),
+				CredentialsFile:      cfg.S3.CredentialsFile,
+				Profile:              cfg.S3.Profile,
+				STSEndpoint:          cfg.S3.STSEndpoint,
+				Payload:              client.PayloadFormat(cfg.S3.Payload),
+			}
+			if err := validatePayloadFormat(res.S3.Payload); err != nil {
+				errs = multierror.Append(errs, multierror.Prefix(err, "s3.payload:"))
+			}
+		}
+	}
+
+	// Validation of the `output-file` field.
+	if cfg.OutputFile != nil {
+		switch {
+		case res.OutputMode != LocalFile:
+			log.Info(fmt.Sprintf("ignoring the output-file field in the config file. This field is only used in %s mode.", LocalFile))
+		default:
+			opts := client.FileOptions{
+				Format:      client.FileFormat(cfg.OutputFile.Format),
+				Gzip:        cfg.OutputFile.Gzip,
+				Timestamped: cfg.OutputFile.Timestamped,
+				PerGatherer: cfg.OutputFile.PerGatherer,
+				MaxFiles:    cfg.OutputFile.MaxFiles,
+				MaxAge:      cfg.OutputFile.MaxAge,
+			}
+			switch opts.Format {
+			case "", client.FileFormatJSON, client.FileFormatNDJSON, client.FileFormatCycloneDX:
+			default:
+				errs = multierror.Append(errs, fmt.Errorf("output-file.format: %q is not supported, supported formats are: %s, %s, %s", opts.Format, client.FileFormatJSON, client.FileFormatNDJSON, client.FileFormatCycloneDX))
+			}
+			if opts.MaxFiles < 0 {
+				errs = multierror.Append(errs, fmt.Errorf("output-file.max-files: must not be negative, got %d", opts.MaxFiles))
+			}
+			if opts.MaxAge < 0 {
+				errs = multierror.Append(errs, fmt.Errorf("output-file.max-age: must not be negative, got %s", opts.MaxAge))
+			}
+			if !opts.Timestamped && (opts.MaxFiles != 0 || opts.MaxAge != 0) {
+				errs = multierror.Append(errs, fmt.Errorf("output-file.max-files and output-file.max-age require output-file.timestamped to be set"))
+			}
+			res.OutputFile = opts
+		}
+	}
+
+	// Validation of the `certificate-metrics` field.
+	if cfg.CertificateMetrics != nil && cfg.CertificateMetrics.Enabled {
+		if !flags.Prometheus {
+			errs = multierror.Append(errs, fmt.Errorf("certificate-metrics.enabled requires --enable-metrics"))
+		}
+		if len(cfg.CertificateMetrics.IncludeNamespaces) > 0 && len(cfg.CertificateMetrics.ExcludeNamespaces) > 0 {
+			errs = multierror.Append(errs, fmt.Errorf("certificate-metrics: cannot set both include-namespaces and exclude-namespaces"))
+		}
+		if cfg.CertificateMetrics.MaxCertificates < 0 {
+			errs = multierror.Append(errs, fmt.Errorf("certificate-metrics.max-certificates: must not be negative, got %d", cfg.CertificateMetrics.MaxCertificates))
+		}
+		res.CertificateMetrics = &certmetrics.Options{
+			IncludeNamespaces: cfg.CertificateMetrics.IncludeNamespaces,
+			ExcludeNamespaces: cfg.CertificateMetrics.ExcludeNamespaces,
+			MaxCertificates:   cfg.CertificateMetrics.MaxCertificates,
+		}
+	}
+
+	// Validation of the `certificate-findings` field.
+	if cfg.CertificateFindings != nil && cfg.CertificateFindings.Enabled {
+		switch {
+		case res.OutputMode == MachineHub:
+			log.Info(fmt.Sprintf("ignoring the certificate-findings field in the config file. This field is not supported in %s mode.", MachineHub))
+		case cfg.SchemaVersion != v3.SchemaVersion && !cfg.CertificateFindings.Events:
+			// The Secrets would be checked for nothing.
+			log.Info(fmt.Sprintf("ignoring the certificate-findings field in the config file. The certificate findings are only sent with schema-version %s, or recorded as Events if certificate-findings.events is true.", v3.SchemaVersion))
+		default:
+			if cfg.SchemaVersion != v3.SchemaVersion {
+				log.Info(fmt.Sprintf("the certificate findings are only sent with schema-version %s. With any other schema version, they are only recorded as Events.", v3.SchemaVersion))
+			}
+			opts := certfindings.Options{Events: cfg.CertificateFindings.Events}
+			if path := cfg.CertificateFindings.TrustBundleFile; path != "" {
+				pemData, err := os.ReadFile(path)
+				switch {
+				case err != nil:
+					errs = multierror.Append(errs, fmt.Errorf("certificate-findings.trust-bundle-file: %w", err))
+				default:
+					opts.TrustBundle = x509.NewCertPool()
+					if !opts.TrustBundle.AppendCertsFromPEM(pemData) {
+						errs = multierror.Append(errs, fmt.Errorf("certificate-findings.trust-bundle-file: no PEM-encoded certificate found in %s", path))
+					}
+				}
+			}
+			res.CertificateFindings = &opts
+		}
+	}
+
+	// Validation of the `schema-version` field.
+	{
+		schemaVersion := cfg.SchemaVersion
+		switch {
+		case res.OutputMode == MachineHub:
+			if schemaVersion != "" {
+				log.Info(fmt.Sprintf("ignoring the schema-version field in the config file. In %s mode, this field is not needed.", res.OutputMode))
+			}
+			schemaVersion = v2.SchemaVersion
+		case schemaVersion == "":
+			schemaVersion = v2.SchemaVersion
+		case !slices.Contains(SupportedSchemaVersions, schemaVersion):
+			errs = multierror.Append(errs, fmt.Errorf("schema-version %q is not supported, supported versions are: %s", schemaVersion, strings.Join(SupportedSchemaVersions, ", ")))
+		}
+		res.SchemaVersion = schemaVersion
+	}
+
 	// Validation of the config fields exclude_annotation_keys_regex and
 	// exclude_label_keys_regex.
 	{
@@ -878,6 +1361,24 @@ func ValidateAndCombineConfig(log logr.Logger, cfg Config, flags AgentCmdFlags)
 	return res, outputClient, nil
 }
 
+// clusterKey returns the cluster name, or the cluster ID when the cluster name
+// is empty. It is what tells the uploads of the clusters apart.
+func clusterKey(clusterName, clusterID string) string {
+	if clusterName != "" {
+		return clusterName
+	}
+	return clusterID
+}
+
+func validatePayloadFormat(format client.PayloadFormat) error {
+	switch format {
+	case "", client.PayloadDataReadings, client.PayloadCycloneDX:
+		return nil
+	default:
+		return fmt.Errorf("%q is not supported, supported payloads are: %s, %s", format, client.PayloadDataReadings, client.PayloadCycloneDX)
+	}
+}
+
 // Validation of --credentials-file/-k, --client-id, and --private-key-path,
 // --api-token, and creation of the client.
 //
@@ -980,7 +1481,22 @@ func validateCredsAndCreateClient(log logr.Logger, flagCredentialsPath, flagClie
 			errs = multierror.Append(errs, err)
 		}
 	case LocalFile:
-		outputClient = client.NewFileClient(cfg.OutputPath)
+		outputClient = client.NewFileClientWithOptions(cfg.OutputPath, cfg.OutputFile)
+	case Webhook:
+		var err error
+		outputClient, err = client.NewWebhookClient(metadata, cfg.Webhook)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	case S3:
+		if cfg.S3.Bucket == "" || cfg.S3.Region == "" {
+			break // Already reported by ValidateAndCombineConfig.
+		}
+		var err error
+		outputClient, err = client.NewS3Client(metadata, cfg.S3)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
 	case MachineHub:
 		var (
 			err     error
@@ -1094,6 +1610,14 @@ func (dg *DataGatherer) UnmarshalYAML(unmarshal func(any) error) error {
 		cfg = &k8sdynamic.ConfigDynamic{}
 	case "k8s-discovery":
 		cfg = &k8sdiscovery.ConfigDiscovery{}
+	case "k8s-ca-bundles":
+		cfg = &k8scabundles.ConfigCABundles{}
+	case "k8s-tls-probe":
+		cfg = &k8stlsprobe.ConfigTLSProbe{}
+	case "node-filesystem":
+		cfg = &nodefs.ConfigNodeFilesystem{}
+	case "exec":
+		cfg = &execplugin.ConfigExec{}
 	case "oidc":
 		cfg = &oidc.OIDCDiscovery{}
 	case "local":
@@ -2,8 +2,10 @@ package agent
 
 import (
 	"context"
+	"encoding/pem"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -15,6 +17,7 @@ import (
 	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/ktesting"
 
+	"github.com/jetstack/preflight/pkg/certmetrics"
 	"github.com/jetstack/preflight/pkg/client"
 	"github.com/jetstack/preflight/pkg/testutil"
 )
@@ -201,6 +204,8 @@ func Test_ValidateAndCombineConfig(t *testing.T) {
 			 - Use --credentials-file alone if you want to use the Jetstack Secure OAuth mode.
 			 - Use --api-token if you want to use the Jetstack Secure API Token mode.
 			 - Use --machine-hub if you want to use the MachineHub mode.
+			 - Use the webhook field in the config file for the Webhook mode.
+			 - Use the s3 field in the config file for the S3 mode.
 			 - Use --output-path or output-path in the config file for Local File mode.`))
 		assert.Nil(t, cl)
 	})
@@ -241,6 +246,7 @@ func Test_ValidateAndCombineConfig(t *testing.T) {
 			EndpointPath:   "api/v1/data",
 			BackoffMaxTime: 10 * time.Minute,
 			InstallNS:      "venafi",
+			SchemaVersion:  "v2.0.0",
 		}
 		require.NoError(t, err)
 		assert.Equal(t, expect, got)
@@ -282,6 +288,7 @@ func Test_ValidateAndCombineConfig(t *testing.T) {
 			ClusterName:    "legacy cluster_id as cluster name",
 			BackoffMaxTime: 99 * time.Minute,
 			InstallNS:      "venafi",
+			SchemaVersion:  "v2.0.0",
 		}
 		require.NoError(t, err)
 		assert.Equal(t, expect, got)
@@ -408,7 +415,7 @@ func Test_ValidateAndCombineConfig(t *testing.T) {
 				`)),
 			withCmdLineFlags("--credentials-file", path))
 		require.NoError(t, err)
-		assert.Equal(t, CombinedConfig{Server: "https://api.venafi.eu", Period: time.Hour, OrganizationID: "foo", ClusterID: "bar", OutputMode: JetstackSecureOAuth, BackoffMaxTime: 10 * time.Minute, InstallNS: "venafi"}, got)
+		assert.Equal(t, CombinedConfig{Server: "https://api.venafi.eu", Period: time.Hour, OrganizationID: "foo", ClusterID: "bar", OutputMode: JetstackSecureOAuth, BackoffMaxTime: 10 * time.Minute, InstallNS: "venafi", SchemaVersion: "v2.0.0"}, got)
 		assert.IsType(t, &client.OAuthClient{}, cl)
 	})
 
@@ -487,7 +494,7 @@ func Test_ValidateAndCombineConfig(t *testing.T) {
 			`)),
 			withCmdLineFlags("--client-id", "5bc7d07c-45da-11ef-a878-523f1e1d7de1", "--private-key-path", path))
 		require.NoError(t, err)
-		assert.Equal(t, CombinedConfig{Server: "https://api.venafi.eu", Period: time.Hour, OutputMode: VenafiCloudKeypair, ClusterName: "legacy cluster_id as cluster name", UploadPath: "/foo/bar", BackoffMaxTime: 10 * time.Minute, InstallNS: "venafi"}, got)
+		assert.Equal(t, CombinedConfig{Server: "https://api.venafi.eu", Period: time.Hour, OutputMode: VenafiCloudKeypair, ClusterName: "legacy cluster_id as cluster name", UploadPath: "/foo/bar", BackoffMaxTime: 10 * time.Minute, InstallNS: "venafi", SchemaVersion: "v2.0.0"}, got)
 		assert.IsType(t, &client.VenafiCloudClient{}, cl)
 	})
 
@@ -509,7 +516,7 @@ func Test_ValidateAndCombineConfig(t *testing.T) {
 			`)),
 			withCmdLineFlags("--venafi-cloud", "--credentials-file", credsPath))
 		require.NoError(t, err)
-		assert.Equal(t, CombinedConfig{Server: "https://api.venafi.eu", Period: time.Hour, OutputMode: VenafiCloudKeypair, ClusterName: "legacy cluster_id as cluster name", UploadPath: "/foo/bar", BackoffMaxTime: 10 * time.Minute, InstallNS: "venafi"}, got)
+		assert.Equal(t, CombinedConfig{Server: "https://api.venafi.eu", Period: time.Hour, OutputMode: VenafiCloudKeypair, ClusterName: "legacy cluster_id as cluster name", UploadPath: "/foo/bar", BackoffMaxTime: 10 * time.Minute, InstallNS: "venafi", SchemaVersion: "v2.0.0"}, got)
 	})
 
 	t.Run("venafi-cloud-keypair-auth: venafi-cloud.upload_path field is required", func(t *testing.T) {
@@ -598,6 +605,7 @@ func Test_ValidateAndCombineConfig(t *testing.T) {
 			VenConnNS:      "venafi",
 			InstallNS:      "venafi",
 			BackoffMaxTime: 10 * time.Minute,
+			SchemaVersion:  "v2.0.0",
 		}, got)
 		assert.IsType(t, &client.VenConnClient{}, cl)
 	})
@@ -673,6 +681,7 @@ func Test_ValidateAndCombineConfig(t *testing.T) {
 		assert.Equal(t, MachineHub, got.OutputMode)
 		assert.Equal(t, arkUsername, got.ClusterName,
 			"the ClusterName should default to the ARK_USERNAME value if the cluster_name in the config file is empty")
+		assert.Equal(t, "v2.0.0", got.SchemaVersion)
 		assert.IsType(t, &client.CyberArkClient{}, cl)
 	})
 
@@ -740,6 +749,350 @@ func Test_ValidateAndCombineConfig(t *testing.T) {
 		assert.IsType(t, &client.FileClient{}, outputClient)
 	})
 
+	t.Run("config: output-file configures the local file mode", func(t *testing.T) {
+		got, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz.ndjson
+				output-file:
+				  format: ndjson
+				  gzip: true
+				  timestamped: true
+				  per-gatherer: true
+				  max-files: 5
+				  max-age: 24h
+			`)),
+			withCmdLineFlags("--period=1h"))
+		require.NoError(t, err)
+		assert.Equal(t, client.FileOptions{
+			Format:      client.FileFormatNDJSON,
+			Gzip:        true,
+			Timestamped: true,
+			PerGatherer: true,
+			MaxFiles:    5,
+			MaxAge:      24 * time.Hour,
+		}, got.OutputFile)
+	})
+
+	t.Run("config: invalid output-file", func(t *testing.T) {
+		_, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				output-file:
+				  format: xml
+				  max-files: 5
+			`)),
+			withCmdLineFlags("--period=1h"))
+		assert.EqualError(t, err, testutil.Undent(`
+			2 errors occurred:
+				* output-file.format: "xml" is not supported, supported formats are: json, ndjson, cyclonedx
+				* output-file.max-files and output-file.max-age require output-file.timestamped to be set
+
+		`))
+	})
+
+	t.Run("config: certificate-metrics", func(t *testing.T) {
+		got, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				certificate-metrics:
+				  enabled: true
+				  include-namespaces: [team-a]
+				  max-certificates: 100
+			`)),
+			withCmdLineFlags("--period=1h", "--enable-metrics"))
+		require.NoError(t, err)
+		assert.Equal(t, &certmetrics.Options{
+			IncludeNamespaces: []string{"team-a"},
+			MaxCertificates:   100,
+		}, got.CertificateMetrics)
+	})
+
+	t.Run("config: invalid certificate-metrics", func(t *testing.T) {
+		_, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				certificate-metrics:
+				  enabled: true
+				  include-namespaces: [team-a]
+				  exclude-namespaces: [kube-system]
+				  max-certificates: -1
+			`)),
+			withCmdLineFlags("--period=1h"))
+		assert.EqualError(t, err, testutil.Undent(`
+			3 errors occurred:
+				* certificate-metrics.enabled requires --enable-metrics
+				* certificate-metrics: cannot set both include-namespaces and exclude-namespaces
+				* certificate-metrics.max-certificates: must not be negative, got -1
+
+		`))
+	})
+
+	t.Run("config: certificate-findings", func(t *testing.T) {
+		srv := httptest.NewTLSServer(nil)
+		defer srv.Close()
+		bundle := withFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+
+		got, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				certificate-findings:
+				  enabled: true
+				  trust-bundle-file: `+bundle+`
+				  events: true
+			`)),
+			withCmdLineFlags("--period=1h"))
+		require.NoError(t, err)
+		require.NotNil(t, got.CertificateFindings)
+		assert.True(t, got.CertificateFindings.Events)
+		assert.True(t, got.CertificateFindings.TrustBundle.Equal(srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs))
+	})
+
+	t.Run("config: certificate-findings are only sent with schema-version v3.0.0", func(t *testing.T) {
+		log, gotLog := recordLogs(t)
+		got, _, err := ValidateAndCombineConfig(log,
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				certificate-findings:
+				  enabled: true
+				  events: true
+			`)),
+			withCmdLineFlags("--period=1h"))
+		require.NoError(t, err)
+		require.NotNil(t, got.CertificateFindings)
+		assert.Equal(t, "v2.0.0", got.SchemaVersion)
+		assert.Contains(t, gotLog.String(), "the certificate findings are only sent with schema-version v3.0.0. With any other schema version, they are only recorded as Events.")
+
+		// Without the Events, the findings can't be emitted at all.
+		log, gotLog = recordLogs(t)
+		got, _, err = ValidateAndCombineConfig(log,
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				certificate-findings:
+				  enabled: true
+			`)),
+			withCmdLineFlags("--period=1h"))
+		require.NoError(t, err)
+		assert.Nil(t, got.CertificateFindings)
+		assert.Contains(t, gotLog.String(), "ignoring the certificate-findings field in the config file. The certificate findings are only sent with schema-version v3.0.0, or recorded as Events if certificate-findings.events is true.")
+
+		log, gotLog = recordLogs(t)
+		_, _, err = ValidateAndCombineConfig(log,
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				schema-version: v3.0.0
+				certificate-findings:
+				  enabled: true
+			`)),
+			withCmdLineFlags("--period=1h"))
+		require.NoError(t, err)
+		assert.NotContains(t, gotLog.String(), "the certificate findings are only sent")
+	})
+
+	t.Run("config: invalid certificate-findings", func(t *testing.T) {
+		_, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				schema-version: v3.0.0
+				certificate-findings:
+				  enabled: true
+				  trust-bundle-file: `+withFile(t, "not a certificate")+`
+			`)),
+			withCmdLineFlags("--period=1h"))
+		assert.ErrorContains(t, err, "certificate-findings.trust-bundle-file: no PEM-encoded certificate found in ")
+	})
+
+	t.Run("config: certificate-findings is ignored in MachineHub mode", func(t *testing.T) {
+		t.Setenv("POD_NAMESPACE", "venafi")
+		t.Setenv("KUBECONFIG", withFile(t, fakeKubeconfig))
+		t.Setenv("ARK_SUBDOMAIN", "tlspk")
+		t.Setenv("ARK_USERNAME", arkUsername)
+		t.Setenv("ARK_SECRET", "test-secret")
+		log, gotLog := recordLogs(t)
+		got, _, err := ValidateAndCombineConfig(log,
+			withConfig(testutil.Undent(`
+				certificate-findings:
+				  enabled: true
+			`)),
+			withCmdLineFlags("--period", "1m", "--machine-hub"))
+		require.NoError(t, err)
+		assert.Nil(t, got.CertificateFindings)
+		assert.Contains(t, gotLog.String(), "ignoring the certificate-findings field in the config file. This field is not supported in MachineHub mode.")
+	})
+
+	t.Run("config: webhook selects webhook mode", func(t *testing.T) {
+		log, gotLog := recordLogs(t)
+		got, outputClient, err := ValidateAndCombineConfig(log,
+			withConfig(testutil.Undent(`
+				cluster_id: my-cluster
+				webhook:
+				  url: https://collector.example.com/readings
+				  headers:
+				    X-Tenant: team-a
+				  bearer-token-file: /var/run/secrets/token
+				  hmac-secret-file: /var/run/secrets/hmac
+			`)),
+			withCmdLineFlags("--period=1h"))
+		require.NoError(t, err)
+		assert.Equal(t, Webhook, got.OutputMode)
+		assert.Equal(t, "my-cluster", got.ClusterID)
+		assert.Equal(t, client.WebhookOptions{
+			URL:             "https://collector.example.com/readings",
+			Headers:         map[string]string{"X-Tenant": "team-a"},
+			BearerTokenFile: "/var/run/secrets/token",
+			HMACSecretFile:  "/var/run/secrets/hmac",
+		}, got.Webhook)
+		assert.Equal(t, testutil.Undent(`
+			INFO Output mode selected url="https://collector.example.com/readings" mode="Webhook" reason="webhook was specified in the config file"
+		`), gotLog.String())
+		assert.IsType(t, &client.WebhookClient{}, outputClient)
+	})
+
+	t.Run("config: invalid webhook", func(t *testing.T) {
+		_, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				webhook:
+				  url: ftp://collector.example.com
+				  client-cert-file: /tls.crt
+			`)),
+			withCmdLineFlags("--period=1h"))
+		assert.EqualError(t, err, testutil.Undent(`
+			2 errors occurred:
+				* webhook.url: "ftp://collector.example.com" is not a valid http or https URL
+				* webhook.client-cert-file and webhook.client-key-file must be set together
+
+		`))
+	})
+
+	t.Run("config: s3 selects s3 mode", func(t *testing.T) {
+		t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+		got, outputClient, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				cluster_name: my-cluster
+				s3:
+				  bucket: inventory
+				  region: eu-west-1
+				  endpoint: http://minio:9000
+				  path-style: true
+				  server-side-encryption: AES256
+				  credentials-source: env
+			`)),
+			withCmdLineFlags("--period=1h"))
+		require.NoError(t, err)
+		assert.Equal(t, S3, got.OutputMode)
+		assert.Equal(t, client.S3Options{
+			Bucket:               "inventory",
+			Region:               "eu-west-1",
+			Endpoint:             "http://minio:9000",
+			PathStyle:            true,
+			ServerSideEncryption: "AES256",
+			CredentialsSource:    client.S3CredentialsEnv,
+		}, got.S3)
+		assert.IsType(t, &client.S3Client{}, outputClient)
+	})
+
+	t.Run("config: invalid s3", func(t *testing.T) {
+		_, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				s3:
+				  region: eu-west-1
+			`)),
+			withCmdLineFlags("--period=1h"))
+		assert.EqualError(t, err, testutil.Undent(`
+			2 errors occurred:
+				* s3.bucket is required
+				* cluster_name or cluster_id is required when s3.key-template contains {cluster}
+
+		`))
+	})
+
+	t.Run("config: clusters", func(t *testing.T) {
+		t.Setenv("POD_NAMESPACE", "venafi")
+		got, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				cluster_id: management
+				webhook:
+				  url: https://collector.example.com/readings
+				clusters:
+				- cluster_name: workload-1
+				  cluster_description: First workload cluster
+				  kubeconfig: /etc/kubeconfigs/all
+				  context: workload-1
+				- cluster_id: workload-2
+				  secret:
+				    name: workload-2-kubeconfig
+			`)),
+			withCmdLineFlags("--period=1h"))
+		require.NoError(t, err)
+		assert.Equal(t, []ClusterConfig{
+			{ClusterName: "workload-1", ClusterDescription: "First workload cluster", KubeConfigPath: "/etc/kubeconfigs/all", Context: "workload-1"},
+			{ClusterID: "workload-2", Secret: &ClusterSecretConfig{Name: "workload-2-kubeconfig", Namespace: "venafi", Key: "kubeconfig"}},
+		}, got.Clusters)
+	})
+
+	t.Run("config: invalid clusters", func(t *testing.T) {
+		t.Setenv("POD_NAMESPACE", "")
+		_, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				cluster_name: management
+				s3:
+				  bucket: inventory
+				  region: eu-west-1
+				  key-template: "{date}/{time}.json"
+				clusters:
+				- cluster_name: management
+				  context: management
+				- cluster_name: workload-1
+				  kubeconfig: /etc/kubeconfigs/all
+				  secret:
+				    name: workload-1-kubeconfig
+				- cluster_description: No identity
+			`)),
+			withCmdLineFlags("--period=1h"))
+		assert.EqualError(t, err, testutil.Undent(`
+			6 errors occurred:
+				* clusters[0]: the cluster "management" is configured more than once
+				* clusters[1]: kubeconfig and secret are mutually exclusive
+				* clusters[1]: secret.namespace is required when the namespace of the agent is unknown
+				* clusters[2]: cluster_name or cluster_id is required in S3 mode
+				* clusters[2]: one of kubeconfig, context, or secret is required
+				* s3.key-template must contain {cluster} when the clusters field is set
+
+		`))
+	})
+
+	t.Run("config: clusters aren't supported in LocalFile mode", func(t *testing.T) {
+		_, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				clusters:
+				- cluster_name: workload-1
+				  context: workload-1
+			`)),
+			withCmdLineFlags("--period=1h"))
+		assert.EqualError(t, err, "1 error occurred:\n\t* the clusters field is not supported in Local File mode, the data readings of the clusters would be written to the same file\n\n")
+	})
+
+	t.Run("config: schema-version selects the schema version of the data readings", func(t *testing.T) {
+		got, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				schema-version: v3.0.0
+			`)),
+			withCmdLineFlags("--period=1h"))
+		require.NoError(t, err)
+		assert.Equal(t, "v3.0.0", got.SchemaVersion)
+	})
+
+	t.Run("config: unsupported schema-version", func(t *testing.T) {
+		_, _, err := ValidateAndCombineConfig(discardLogs(),
+			withConfig(testutil.Undent(`
+				output-path: /foo/bar/baz
+				schema-version: v1
+			`)),
+			withCmdLineFlags("--period=1h"))
+		assert.EqualError(t, err, "1 error occurred:\n\t* schema-version \"v1\" is not supported, supported versions are: v2.0.0, v3.0.0\n\n")
+	})
+
 	// When --input-path is supplied, the data is being read from a local file
 	// and the agent is probably running outside the cluster and has no access
 	// to a cluster, so the environment variables which are required for
@@ -989,6 +1342,27 @@ func Test_ValidateDataGatherers(t *testing.T) {
 			  name: "k8s/secrets"
 			- kind: "k8s-discovery"
 			  name: "k8s-discovery"
+			- kind: "k8s-ca-bundles"
+			  name: "k8s-ca-bundles"
+			- kind: "k8s-tls-probe"
+			  name: "k8s-tls-probe"
+			  config:
+			    ports: [443, 8443]
+			    timeout: 2s
+			- kind: "node-filesystem"
+			  name: "node-filesystem"
+			  config:
+			    paths: ["/etc/kubernetes/pki", "/var/lib/kubelet/pki/*.crt"]
+			    host-root: /host
+			    max-file-size: 65536
+			- kind: "exec"
+			  name: "exec/legacy-pki"
+			  config:
+			    command: /usr/local/bin/legacy-pki
+			    args: ["--region", "eu-west-1"]
+			    env:
+			      LEGACY_PKI_URL: https://pki.internal
+			    timeout: 1m
 			- kind: "k8s-dynamic"
 			  name: "k8s/secrets"
 			- kind: "local"
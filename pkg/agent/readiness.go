@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/jetstack/preflight/pkg/datagatherer"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+)
+
+// readiness reports the state of the optional data gatherers, which wait for
+// their CRD to be installed. The agent is ready regardless of the CRDs, so
+// the state is only written in the body of /readyz.
+type readiness struct {
+	mu            sync.Mutex
+	dataGatherers map[string]crdStatuser
+}
+
+// crdStatuser is implemented by the k8s-dynamic data gatherers.
+type crdStatuser interface {
+	CRDStatus() (k8sdynamic.CRDStatus, bool)
+}
+
+// setDataGatherers records the optional data gatherers once instantiated.
+func (r *readiness) setDataGatherers(dataGatherers map[string]datagatherer.DataGatherer) {
+	optional := map[string]crdStatuser{}
+	for name, dg := range dataGatherers {
+		if dg, ok := dg.(crdStatuser); ok {
+			if _, ok := dg.CRDStatus(); ok {
+				optional[name] = dg
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dataGatherers = optional
+}
+
+// ServeHTTP always returns 200 OK, with one line per optional data gatherer.
+func (r *readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	var lines []string
+	for name, dg := range r.dataGatherers {
+		status, _ := dg.CRDStatus()
+		if status.Installed {
+			lines = append(lines, fmt.Sprintf("%s: CRD %s is installed, gathering %s", name, status.Name, status.GroupVersionResource))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s: waiting for CRD %s", name, status.Name))
+		}
+	}
+	r.mu.Unlock()
+	slices.Sort(lines)
+
+	w.WriteHeader(http.StatusOK)
+	for _, line := range lines {
+		_, _ = fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/jetstack/preflight/pkg/datagatherer"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+)
+
+type fakeOptionalDataGatherer struct {
+	datagatherer.DataGatherer
+	status   k8sdynamic.CRDStatus
+	optional bool
+}
+
+func (f *fakeOptionalDataGatherer) CRDStatus() (k8sdynamic.CRDStatus, bool) {
+	return f.status, f.optional
+}
+
+func TestReadiness(t *testing.T) {
+	ready := &readiness{}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ready.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w
+	}
+
+	w := get()
+	assert.Equal(t, http.StatusOK, w.Code, "the agent is ready before the data gatherers are instantiated")
+	assert.Empty(t, w.Body.String())
+
+	ready.setDataGatherers(map[string]datagatherer.DataGatherer{
+		"k8s/secrets": &fakeOptionalDataGatherer{},
+		"k8s/externalsecrets": &fakeOptionalDataGatherer{
+			optional: true,
+			status:   k8sdynamic.CRDStatus{Name: "externalsecrets.external-secrets.io"},
+		},
+		"k8s/certificates": &fakeOptionalDataGatherer{
+			optional: true,
+			status: k8sdynamic.CRDStatus{
+				Name:                 "certificates.cert-manager.io",
+				Installed:            true,
+				GroupVersionResource: schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"},
+			},
+		},
+	})
+
+	w = get()
+	assert.Equal(t, http.StatusOK, w.Code, "the agent is ready without the CRDs")
+	assert.Equal(t, "k8s/certificates: CRD certificates.cert-manager.io is installed, gathering cert-manager.io/v1, Resource=certificates\n"+
+		"k8s/externalsecrets: waiting for CRD externalsecrets.external-secrets.io\n", w.Body.String())
+}
@@ -10,7 +10,9 @@ import (
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff/v5"
@@ -31,12 +33,17 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	"github.com/jetstack/preflight/api"
+	v2 "github.com/jetstack/preflight/api/v2"
+	v3 "github.com/jetstack/preflight/api/v3"
 	"github.com/jetstack/preflight/internal/envelope"
 	"github.com/jetstack/preflight/internal/envelope/keyfetch"
 	"github.com/jetstack/preflight/internal/envelope/rsa"
+	"github.com/jetstack/preflight/pkg/certfindings"
+	"github.com/jetstack/preflight/pkg/certmetrics"
 	"github.com/jetstack/preflight/pkg/client"
 	"github.com/jetstack/preflight/pkg/datagatherer"
 	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8stlsprobe"
 	"github.com/jetstack/preflight/pkg/kubeconfig"
 	"github.com/jetstack/preflight/pkg/logs"
 	"github.com/jetstack/preflight/pkg/version"
@@ -44,14 +51,6 @@ import (
 
 var Flags AgentCmdFlags
 
-// schema version of the data sent by the agent.
-// The new default version is v2.
-// In v2 the agent posts data readings using api.gathereredResources
-// Any requests without a schema version set will be interpreted
-// as using v1 by the backend. In v1 the agent sends
-// raw resource data of unstructuredList
-const schemaVersion string = "v2.0.0"
-
 // Run starts the agent process
 func Run(cmd *cobra.Command, args []string) (returnErr error) {
 	baseCtx, cancel := context.WithCancel(cmd.Context())
@@ -92,6 +91,23 @@ func Run(cmd *cobra.Command, args []string) (returnErr error) {
 		}
 	}()
 
+	var certCollector *certmetrics.Collector
+	if config.CertificateMetrics != nil {
+		certCollector = certmetrics.NewCollector(*config.CertificateMetrics)
+	}
+
+	var certChecker *certfindings.Checker
+	if config.CertificateFindings != nil {
+		certChecker = certfindings.NewChecker(*config.CertificateFindings)
+		if config.CertificateFindings.Events {
+			certChecker.Recorder, err = newSecretEventRecorder()
+			if err != nil {
+				return fmt.Errorf("failed to create the event recorder for the certificate findings: %v", err)
+			}
+		}
+	}
+
+	ready := &readiness{}
 	{
 		server := http.NewServeMux()
 		const serverAddress = ":8081"
@@ -109,6 +125,10 @@ func Run(cmd *cobra.Command, args []string) (returnErr error) {
 		if Flags.Prometheus {
 			log.Info("Metrics endpoints enabled", "path", "/metrics")
 			prometheus.MustRegister(metricPayloadSize)
+			prometheus.MustRegister(k8sdynamic.MetricSecretMaterialRedactions)
+			if certCollector != nil {
+				prometheus.MustRegister(certCollector)
+			}
 			server.Handle("/metrics", promhttp.Handler())
 		}
 
@@ -120,10 +140,9 @@ func Run(cmd *cobra.Command, args []string) (returnErr error) {
 		server.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 		})
+		// The body lists the optional data gatherers waiting for their CRD.
 		log.Info("Readyz endpoints enabled", "path", "/readyz")
-		server.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-		})
+		server.Handle("/readyz", ready)
 
 		group.Go(func() error {
 			listenCtx := klog.NewContext(gctx, log)
@@ -179,38 +198,24 @@ func Run(cmd *cobra.Command, args []string) (returnErr error) {
 		}
 	}
 
-	dataGatherers := map[string]datagatherer.DataGatherer{}
-
-	// load datagatherer config and boot each one
-	for _, dgConfig := range config.DataGatherers {
-		kind := dgConfig.Kind
-		if dgConfig.DataPath != "" {
-			kind = "local"
-			return fmt.Errorf("running data gatherer %s of type %s as Local, data-path override present: %s", dgConfig.Name, dgConfig.Kind, dgConfig.DataPath)
-		}
-
-		newDg, err := dgConfig.Config.NewDataGatherer(gctx)
-		if err != nil {
-			return fmt.Errorf("failed to instantiate %q data gatherer  %q: %v", kind, dgConfig.Name, err)
-		}
-
-		dynDg, isDynamicGatherer := newDg.(*k8sdynamic.DataGathererDynamic)
-		if isDynamicGatherer {
-			dynDg.ExcludeAnnotKeys = append(dynDg.ExcludeAnnotKeys, config.ExcludeAnnotationKeysRegex...)
-			dynDg.ExcludeLabelKeys = append(dynDg.ExcludeLabelKeys, config.ExcludeLabelKeysRegex...)
-
-			gvr := dynDg.GVR()
+	dgOpts := dataGathererOptions{
+		encryptor:     encryptor,
+		certCollector: certCollector,
+		certChecker:   certChecker,
+	}
+	if _, isCyberArk := preflightClient.(*client.CyberArkClient); isCyberArk {
+		dgOpts.includeLastModifiedTime = true
+	}
 
-			if encryptSecrets && gvr.Resource == "secrets" && gvr.Group == "" {
-				log.Info("Secret encryption enabled for datagatherer")
-				dynDg.Encryptor = encryptor
-			}
+	dataGatherers, toStart, err := newDataGatherers(gctx, config, config.DataGatherers, dgOpts)
+	if err != nil {
+		return err
+	}
+	ready.setDataGatherers(dataGatherers)
 
-			_, isCyberArk := preflightClient.(*client.CyberArkClient)
-			if isCyberArk && gvr.Resource == "secrets" && gvr.Group == "" {
-				dynDg.IncludeLastModifiedTime = true
-			}
-		}
+	for _, start := range toStart {
+		dgConfig, newDg := start.dgConfig, start.dg
+		kind := dgConfig.Kind
 
 		log.V(logs.Debug).Info("Starting DataGatherer", "name", dgConfig.Name)
 
@@ -231,37 +236,45 @@ func Run(cmd *cobra.Command, args []string) (returnErr error) {
 		// chance to sync its cache and we will now continue as normal. We
 		// assume at the informers will either recover or the log messages
 		// above will help operators correct the issue.
-		dataGatherers[dgConfig.Name] = newDg
 	}
 
-	// Wait for 5 seconds for all informers to sync. If they fail to sync
-	// we continue (as we have no way to know if they will recover or not).
-	//
-	// bootCtx is a context with a timeout to allow the informer 5
-	// seconds to perform an initial sync. It may fail, and that's fine
-	// too, it will backoff and retry of its own accord. Initial boot
-	// will only be delayed by a max of 5 seconds.
-	bootCtx, bootCancel := context.WithTimeout(gctx, 5*time.Second)
-	defer bootCancel()
+	// The certificate findings are sent as if they came from an extra data
+	// gatherer. The Checker is fed by the Secret informers above, so it has
+	// nothing to run or sync. The findings data type was introduced in v3, so
+	// with the older schema versions only the Events are recorded.
+	if certChecker != nil && config.SchemaVersion == v3.SchemaVersion {
+		dataGatherers[certfindings.DataGathererName] = certChecker
+	}
 
-	var timedoutDGs []string
-	for _, dgConfig := range config.DataGatherers {
-		dg := dataGatherers[dgConfig.Name]
-		// wait for the informer to complete an initial sync, we do this to
-		// attempt to have an initial set of data for the first upload of
-		// the run.
-		if err := dg.WaitForCacheSync(bootCtx); err != nil {
-			// log sync failure, this might recover in future
-			if errors.Is(err, k8sdynamic.ErrCacheSyncTimeout) {
-				timedoutDGs = append(timedoutDGs, dgConfig.Name)
-			} else {
-				log.V(logs.Info).Info("Failed to sync cache for datagatherer", "kind", dgConfig.Kind, "name", dgConfig.Name, "error", err)
+	waitForCacheSync(gctx, config.DataGatherers, dataGatherers)
+
+	// The data of the other clusters is gathered and uploaded alongside the
+	// data of the agent's cluster. The certificate metrics and findings only
+	// concern the agent's cluster.
+	var clusters []*remoteCluster
+	if len(config.Clusters) > 0 {
+		kubeconfigDir, err := os.MkdirTemp("", "agent-kubeconfigs-")
+		if err != nil {
+			return fmt.Errorf("failed to create the directory for the kubeconfigs of the clusters: %v", err)
+		}
+		defer os.RemoveAll(kubeconfigDir)
+
+		var secrets kubernetes.Interface
+		if slices.ContainsFunc(config.Clusters, func(c ClusterConfig) bool { return c.Secret != nil }) {
+			secrets, err = kubeconfig.NewClientSet("")
+			if err != nil {
+				return fmt.Errorf("failed to create the client for the kubeconfig Secrets: %v", err)
 			}
 		}
+
+		clusterOpts := dgOpts
+		clusterOpts.certCollector = nil
+		clusterOpts.certChecker = nil
+		for _, cluster := range config.Clusters {
+			clusters = append(clusters, newRemoteCluster(cluster, config, clusterOpts, secrets, kubeconfigDir))
+		}
 	}
-	if len(timedoutDGs) > 0 {
-		log.V(logs.Info).Info("Skipping datagatherers for CRDs that can't be found in Kubernetes", "datagatherers", timedoutDGs)
-	}
+
 	// begin the datagathering loop, periodically sending data to the
 	// configured output using data in datagatherer caches or refreshing from
 	// APIs each cycle depending on datagatherer implementation.
@@ -269,7 +282,15 @@ func Run(cmd *cobra.Command, args []string) (returnErr error) {
 	// be cancelled, which will cause this blocking loop to exit
 	// instead of waiting for the time period.
 	for {
-		if err := gatherAndOutputData(gctx, eventf, config, preflightClient, dataGatherers); err != nil {
+		var wg sync.WaitGroup
+		for _, cluster := range clusters {
+			wg.Go(func() {
+				cluster.gatherAndOutputData(gctx, group, eventf, preflightClient)
+			})
+		}
+		err := gatherAndOutputData(gctx, eventf, config, preflightClient, dataGatherers)
+		wg.Wait()
+		if err != nil {
 			return err
 		}
 
@@ -286,6 +307,187 @@ func Run(cmd *cobra.Command, args []string) (returnErr error) {
 	return nil
 }
 
+// dataGathererOptions are the agent features wired into the data gatherers
+// when they are instantiated.
+type dataGathererOptions struct {
+	// encryptor is nil unless the secret encryption is enabled.
+	encryptor envelope.Encryptor
+	// certCollector and certChecker are nil unless the certificate metrics
+	// and findings are enabled.
+	certCollector *certmetrics.Collector
+	certChecker   *certfindings.Checker
+	// includeLastModifiedTime is set in MachineHub mode.
+	includeLastModifiedTime bool
+}
+
+// startable is a data gatherer that is instantiated but not started yet.
+type startable struct {
+	dgConfig DataGatherer
+	dg       datagatherer.DataGatherer
+}
+
+// newDataGatherers instantiates the data gatherers and wires the agent
+// features into them. The data gatherers must be started once they are all
+// instantiated. Two data gatherers may have the same name, so they are also
+// returned in order rather than only looked up in the map.
+func newDataGatherers(ctx context.Context, config CombinedConfig, dgConfigs []DataGatherer, opts dataGathererOptions) (map[string]datagatherer.DataGatherer, []startable, error) {
+	log := klog.FromContext(ctx)
+
+	dataGatherers := map[string]datagatherer.DataGatherer{}
+
+	// The Secrets gathered by the k8s-dynamic data gatherers are also fed to
+	// the TLS probes, which match them against the served certificates.
+	var (
+		secretGatherers []*k8sdynamic.DataGathererDynamic
+		tlsProbes       []*k8stlsprobe.DataGathererTLSProbe
+	)
+
+	var toStart []startable
+
+	// The k8s-dynamic data gatherers watching the same resources share their
+	// informers.
+	ctx = k8sdynamic.WithInformerRegistry(ctx, k8sdynamic.NewInformerRegistry())
+
+	// load datagatherer config and boot each one
+	for _, dgConfig := range dgConfigs {
+		kind := dgConfig.Kind
+		if dgConfig.DataPath != "" {
+			kind = "local"
+			return nil, nil, fmt.Errorf("running data gatherer %s of type %s as Local, data-path override present: %s", dgConfig.Name, dgConfig.Kind, dgConfig.DataPath)
+		}
+
+		newDg, err := dgConfig.Config.NewDataGatherer(ctx)
+		if errors.Is(err, k8sdynamic.ErrVersionNotResolved) {
+			// Like the data gatherers whose CRD can't be found, see
+			// waitForCacheSync.
+			log.V(logs.Info).Info("Skipping datagatherer whose version can't be resolved", "name", dgConfig.Name, "error", err,
+				"hint", "set optional to true in the config of the k8s-dynamic datagatherers to start them when their CRD is installed")
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to instantiate %q data gatherer  %q: %v", kind, dgConfig.Name, err)
+		}
+
+		dynDg, isDynamicGatherer := newDg.(*k8sdynamic.DataGathererDynamic)
+		if isDynamicGatherer {
+			dynDg.ExcludeAnnotKeys = append(dynDg.ExcludeAnnotKeys, config.ExcludeAnnotationKeysRegex...)
+			dynDg.ExcludeLabelKeys = append(dynDg.ExcludeLabelKeys, config.ExcludeLabelKeysRegex...)
+
+			gvr := dynDg.GVR()
+
+			if opts.encryptor != nil && gvr.Resource == "secrets" && gvr.Group == "" {
+				log.Info("Secret encryption enabled for datagatherer")
+				dynDg.Encryptor = opts.encryptor
+			}
+
+			if opts.certCollector != nil && gvr.Resource == "secrets" && gvr.Group == "" {
+				if err := dynDg.AddEventHandler(opts.certCollector); err != nil {
+					return nil, nil, fmt.Errorf("failed to add the certificate metrics to data gatherer %q: %v", dgConfig.Name, err)
+				}
+			}
+
+			if opts.certChecker != nil && gvr.Resource == "secrets" && gvr.Group == "" {
+				if err := dynDg.AddEventHandler(opts.certChecker); err != nil {
+					return nil, nil, fmt.Errorf("failed to add the certificate findings to data gatherer %q: %v", dgConfig.Name, err)
+				}
+				// The findings check that the private keys match the
+				// certificates, which is done when the Secrets are
+				// received so that the private keys aren't kept.
+				dynDg.CheckTLSKeyPairs = true
+			}
+
+			dynDg.IncludeLastModifiedTime = opts.includeLastModifiedTime
+
+			if gvr.Resource == "secrets" && gvr.Group == "" {
+				secretGatherers = append(secretGatherers, dynDg)
+			}
+		}
+
+		if probe, ok := newDg.(*k8stlsprobe.DataGathererTLSProbe); ok {
+			tlsProbes = append(tlsProbes, probe)
+		}
+
+		dataGatherers[dgConfig.Name] = newDg
+		toStart = append(toStart, startable{dgConfig: dgConfig, dg: newDg})
+	}
+
+	warnOverlappingDataGatherers(ctx, dgConfigs)
+
+	// The event handlers must be added before the data gatherers are started,
+	// and the TLS probes may be configured before the Secrets.
+	for _, probe := range tlsProbes {
+		for _, dynDg := range secretGatherers {
+			if err := dynDg.AddEventHandler(probe); err != nil {
+				return nil, nil, fmt.Errorf("failed to add the TLS probe to a Secret data gatherer: %v", err)
+			}
+		}
+	}
+
+	return dataGatherers, toStart, nil
+}
+
+// warnOverlappingDataGatherers logs the k8s-dynamic data gatherers that may
+// collect the same resources, for instance when the same resource is
+// configured twice with different selectors. Their resources are uploaded
+// twice.
+func warnOverlappingDataGatherers(ctx context.Context, dgConfigs []DataGatherer) {
+	log := klog.FromContext(ctx)
+
+	for i, a := range dgConfigs {
+		aConfig, ok := a.Config.(*k8sdynamic.ConfigDynamic)
+		if !ok {
+			continue
+		}
+		for _, b := range dgConfigs[i+1:] {
+			bConfig, ok := b.Config.(*k8sdynamic.ConfigDynamic)
+			if !ok {
+				continue
+			}
+			if reason, overlap := k8sdynamic.Overlap(aConfig, bConfig); overlap {
+				log.Info("Data gatherers overlap, the resources they both collect are uploaded twice", "first", a.Name, "second", b.Name, "reason", reason)
+			}
+		}
+	}
+}
+
+// waitForCacheSync waits for 5 seconds for all informers to sync. If they fail
+// to sync we continue (as we have no way to know if they will recover or not).
+//
+// bootCtx is a context with a timeout to allow the informer 5 seconds to
+// perform an initial sync. It may fail, and that's fine too, it will backoff
+// and retry of its own accord. Initial boot will only be delayed by a max of 5
+// seconds.
+func waitForCacheSync(ctx context.Context, dgConfigs []DataGatherer, dataGatherers map[string]datagatherer.DataGatherer) {
+	log := klog.FromContext(ctx)
+
+	bootCtx, bootCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer bootCancel()
+
+	var timedoutDGs []string
+	for _, dgConfig := range dgConfigs {
+		dg, ok := dataGatherers[dgConfig.Name]
+		if !ok {
+			// Skipped by newDataGatherers.
+			continue
+		}
+		// wait for the informer to complete an initial sync, we do this to
+		// attempt to have an initial set of data for the first upload of
+		// the run.
+		if err := dg.WaitForCacheSync(bootCtx); err != nil {
+			// log sync failure, this might recover in future
+			if errors.Is(err, k8sdynamic.ErrCacheSyncTimeout) {
+				timedoutDGs = append(timedoutDGs, dgConfig.Name)
+			} else {
+				log.V(logs.Info).Info("Failed to sync cache for datagatherer", "kind", dgConfig.Kind, "name", dgConfig.Name, "error", err)
+			}
+		}
+	}
+	if len(timedoutDGs) > 0 {
+		log.V(logs.Info).Info("Skipping datagatherers for CRDs that can't be found in Kubernetes", "datagatherers", timedoutDGs,
+			"hint", "set optional to true in the config of the k8s-dynamic datagatherers to start them when their CRD is installed")
+	}
+}
+
 // loadEncryptor sets up an encryptor for encrypting secrets. For now, it just loads a hardcoded public key
 func loadEncryptor(ctx context.Context, preflightClient client.Client) (envelope.Encryptor, error) {
 	cyberarkClient, ok := preflightClient.(*client.CyberArkClient)
@@ -352,6 +554,26 @@ func newEventf(log logr.Logger) (Eventf, error) {
 	return eventf, nil
 }
 
+// Creates an event recorder for the Secrets in which the certificate findings
+// are found. Unlike the Pod event recorder, the events are created in the
+// namespaces of the Secrets, which requires the corresponding RBAC rules.
+func newSecretEventRecorder() (record.EventRecorder, error) {
+	restcfg, err := kubeconfig.LoadRESTConfig("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+	}
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+
+	eventClient, err := kubernetes.NewForConfig(restcfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event client: %v", err)
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&clientgocorev1.EventSinkImpl{Interface: eventClient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme, corev1.EventSource{Component: "venafi-kubernetes-agent"}), nil
+}
+
 // Like Printf but for sending events to the agent's Pod object.
 type Eventf func(eventType, reason, msg string, args ...any)
 
@@ -365,6 +587,9 @@ func gatherAndOutputData(ctx context.Context, eventf Eventf, config CombinedConf
 		if err != nil {
 			return fmt.Errorf("failed to read local data file: %s", err)
 		}
+		// The internal DataReading can be decoded from any of the supported
+		// schema versions, and is converted to the configured schema version
+		// below.
 		err = json.Unmarshal(data, &readings)
 		if err != nil {
 			return fmt.Errorf("failed to unmarshal local data file: %s", err)
@@ -377,6 +602,16 @@ func gatherAndOutputData(ctx context.Context, eventf Eventf, config CombinedConf
 		}
 	}
 
+	// In MachineHub mode, the client does its own conversion of the internal
+	// data readings.
+	if config.OutputMode != MachineHub {
+		var err error
+		readings, err = convertReadings(config.SchemaVersion, readings)
+		if err != nil {
+			return fmt.Errorf("while converting data readings to schema version %s: %s", config.SchemaVersion, err)
+		}
+	}
+
 	{
 		group, ctx := errgroup.WithContext(ctx)
 
@@ -436,7 +671,7 @@ func gatherData(ctx context.Context, config CombinedConfig, dataGatherers map[st
 			DataGatherer:  k,
 			Timestamp:     api.Time{Time: time.Now()},
 			Data:          dgData,
-			SchemaVersion: schemaVersion,
+			SchemaVersion: config.SchemaVersion,
 		})
 	}
 
@@ -476,6 +711,23 @@ func postData(ctx context.Context, config CombinedConfig, preflightClient client
 	return nil
 }
 
+// convertReadings converts the internal data readings to the supplied schema
+// version.
+//
+// Any requests without a schema version set will be interpreted as using v1 by
+// the backend. In v1 the agent sent raw resource data of unstructuredList. The
+// agent no longer supports v1.
+func convertReadings(schemaVersion string, readings []*api.DataReading) ([]*api.DataReading, error) {
+	switch schemaVersion {
+	case v2.SchemaVersion:
+		return v2.ConvertFromInternal(readings)
+	case v3.SchemaVersion:
+		return v3.ConvertFromInternal(readings)
+	default:
+		return nil, fmt.Errorf("programmer mistake: unsupported schema version %q", schemaVersion)
+	}
+}
+
 // listenAndServe starts the supplied HTTP server and stops it gracefully when
 // the supplied context is cancelled.
 // It returns when the graceful server shutdown is complete or when the server
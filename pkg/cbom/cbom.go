@@ -0,0 +1,348 @@
+// Package cbom builds a CycloneDX 1.6 cryptographic bill of materials (CBOM)
+// out of the certificates found in the data readings of the k8s-dynamic data
+// gatherers. The certificates are looked up in:
+//
+//   - Secrets: the tls.crt and ca.crt keys,
+//   - OpenShift Routes: spec.tls.certificate, spec.tls.caCertificate, and
+//     spec.tls.destinationCACertificate,
+//   - Validating and mutating webhook configurations: the caBundle of each
+//     webhook.
+//
+// Each certificate becomes a "cryptographic-asset" component, along with its
+// public key and the algorithms it uses. The Kubernetes resources in which a
+// certificate was found are listed in the component's evidence.
+package cbom
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/api/reader"
+	"github.com/jetstack/preflight/pkg/version"
+)
+
+const (
+	// SpecVersion is the CycloneDX version of the BOMs.
+	SpecVersion = "1.6"
+
+	// MediaType is the media type of the JSON-encoded BOMs.
+	MediaType = "application/vnd.cyclonedx+json"
+)
+
+// Options controls the metadata of the BOM.
+type Options struct {
+	// ClusterName is the name of the cluster component in the metadata. The
+	// cluster component is omitted when empty.
+	ClusterName string
+
+	// Now is the timestamp of the BOM. Defaults to the current time.
+	Now time.Time
+}
+
+// FromDataReadings returns the CBOM of the certificates found in the data
+// readings. The readings may have been converted to any schema version. The
+// data that can't be decoded as certificates is skipped, so that a single
+// malformed Secret doesn't prevent the BOM from being produced.
+func FromDataReadings(readings []*api.DataReading, opts Options) (*BOM, error) {
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	b := newBuilder()
+	for _, reading := range readings {
+		reading, err := toInternal(reading)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := reading.Data.(*api.DynamicData); !ok {
+			continue
+		}
+		resources, err := reader.Resources(reading, reader.ExcludeDeleted)
+		if err != nil {
+			return nil, err
+		}
+		for _, resource := range resources {
+			obj, err := toUnstructured(resource.Object())
+			if err != nil {
+				return nil, fmt.Errorf("while reading %s %s/%s: %w", resource.GroupVersionKind().Kind, resource.Namespace(), resource.Name(), err)
+			}
+			location := Location(obj)
+			for _, src := range certificateSources(obj) {
+				certs, _ := reader.ParseCertificates(src.pem)
+				for _, cert := range certs {
+					b.addCertificate(cert, Occurrence{Location: location, AdditionalContext: src.field})
+				}
+			}
+		}
+	}
+
+	bom := &BOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  SpecVersion,
+		SerialNumber: "urn:uuid:" + uuid.NewString(),
+		Version:      1,
+		Metadata: Metadata{
+			Timestamp: now.UTC().Format(time.RFC3339),
+			Tools: Tools{Components: []Component{{
+				Type:    "application",
+				Name:    "venafi-kubernetes-agent",
+				Version: version.PreflightVersion,
+			}}},
+		},
+		Components: b.components(),
+	}
+	if opts.ClusterName != "" {
+		bom.Metadata.Component = &Component{Type: "platform", BOMRef: "cluster", Name: opts.ClusterName}
+	}
+	return bom, nil
+}
+
+// Location returns the location used in the evidence of the components, which
+// is the API version, kind, namespace, and name of the resource, e.g.
+// "v1/Secret/default/my-secret". The namespace is omitted for cluster-scoped
+// resources, e.g.
+// "admissionregistration.k8s.io/v1/ValidatingWebhookConfiguration/my-webhook".
+func Location(obj *unstructured.Unstructured) string {
+	parts := []string{obj.GetAPIVersion(), obj.GetKind()}
+	if ns := obj.GetNamespace(); ns != "" {
+		parts = append(parts, ns)
+	}
+	return strings.Join(append(parts, obj.GetName()), "/")
+}
+
+// toInternal turns readings that were converted to a schema version, and
+// whose data is therefore not an *api.DynamicData, back into the internal
+// types by encoding and decoding them.
+func toInternal(reading *api.DataReading) (*api.DataReading, error) {
+	switch reading.Data.(type) {
+	case *api.DynamicData, *api.DiscoveryData, *api.OIDCDiscoveryData:
+		return reading, nil
+	}
+	data, err := json.Marshal(reading)
+	if err != nil {
+		return nil, fmt.Errorf("while encoding the data reading %q: %w", reading.DataGatherer, err)
+	}
+	var internal api.DataReading
+	if err := json.Unmarshal(data, &internal); err != nil {
+		// Not a data reading that the agent knows about, so it can't
+		// contain certificates.
+		return &api.DataReading{DataGatherer: reading.DataGatherer}, nil
+	}
+	return &internal, nil
+}
+
+func toUnstructured(obj runtime.Object) (*unstructured.Unstructured, error) {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		return u, nil
+	}
+	m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: m}, nil
+}
+
+// source is PEM data found in a resource, along with the path of the field in
+// which it was found.
+type source struct {
+	field string
+	pem   []byte
+}
+
+func certificateSources(obj *unstructured.Unstructured) []source {
+	gvk := obj.GroupVersionKind()
+	var sources []source
+	switch {
+	case gvk.Group == "" && gvk.Kind == "Secret":
+		for _, key := range []string{"tls.crt", "ca.crt"} {
+			if value, found, _ := unstructured.NestedString(obj.Object, "data", key); found {
+				if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+					sources = append(sources, source{field: "data." + key, pem: decoded})
+				}
+			}
+		}
+	case gvk.Group == "route.openshift.io" && gvk.Kind == "Route":
+		for _, field := range []string{"certificate", "caCertificate", "destinationCACertificate"} {
+			if value, found, _ := unstructured.NestedString(obj.Object, "spec", "tls", field); found {
+				sources = append(sources, source{field: "spec.tls." + field, pem: []byte(value)})
+			}
+		}
+	case gvk.Group == "admissionregistration.k8s.io" && (gvk.Kind == "ValidatingWebhookConfiguration" || gvk.Kind == "MutatingWebhookConfiguration"):
+		webhooks, _, _ := unstructured.NestedSlice(obj.Object, "webhooks")
+		for i, webhook := range webhooks {
+			webhook, ok := webhook.(map[string]any)
+			if !ok {
+				continue
+			}
+			if value, found, _ := unstructured.NestedString(webhook, "clientConfig", "caBundle"); found {
+				if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+					sources = append(sources, source{field: "webhooks[" + strconv.Itoa(i) + "].clientConfig.caBundle", pem: decoded})
+				}
+			}
+		}
+	}
+	return sources
+}
+
+// builder deduplicates the components: a certificate found in several
+// resources is listed once, with one occurrence per resource.
+type builder struct {
+	byRef map[string]*Component
+}
+
+func newBuilder() *builder {
+	return &builder{byRef: map[string]*Component{}}
+}
+
+func (b *builder) addCertificate(cert *x509.Certificate, occurrence Occurrence) {
+	fingerprint := sha256.Sum256(cert.Raw)
+	ref := "certificate:" + hex.EncodeToString(fingerprint[:])
+	if existing, ok := b.byRef[ref]; ok {
+		if !slices.Contains(existing.Evidence.Occurrences, occurrence) {
+			existing.Evidence.Occurrences = append(existing.Evidence.Occurrences, occurrence)
+		}
+		return
+	}
+
+	sigAlgRef := b.addAlgorithm(cert.SignatureAlgorithm.String(), "signature", []string{"sign", "verify"}, signatureAlgorithmOIDs[cert.SignatureAlgorithm])
+	keyRef := b.addPublicKey(cert)
+
+	name := cert.Subject.CommonName
+	if name == "" {
+		name = cert.Subject.String()
+	}
+	b.byRef[ref] = &Component{
+		Type:   "cryptographic-asset",
+		BOMRef: ref,
+		Name:   name,
+		CryptoProperties: &CryptoProperties{
+			AssetType: "certificate",
+			CertificateProperties: &CertificateProperties{
+				SubjectName:           cert.Subject.String(),
+				IssuerName:            cert.Issuer.String(),
+				NotValidBefore:        cert.NotBefore.UTC().Format(time.RFC3339),
+				NotValidAfter:         cert.NotAfter.UTC().Format(time.RFC3339),
+				SignatureAlgorithmRef: sigAlgRef,
+				SubjectPublicKeyRef:   keyRef,
+				CertificateFormat:     "X.509",
+				CertificateExtension:  "pem",
+			},
+		},
+		Evidence: &Evidence{Occurrences: []Occurrence{occurrence}},
+		Properties: []Property{
+			{Name: "x509:serialNumber", Value: cert.SerialNumber.Text(16)},
+			{Name: "x509:isCA", Value: strconv.FormatBool(cert.IsCA)},
+			{Name: "x509:sha256Fingerprint", Value: hex.EncodeToString(fingerprint[:])},
+		},
+	}
+}
+
+func (b *builder) addAlgorithm(name, primitive string, functions []string, oid string) string {
+	ref := "algorithm:" + name
+	if _, ok := b.byRef[ref]; !ok {
+		b.byRef[ref] = &Component{
+			Type:   "cryptographic-asset",
+			BOMRef: ref,
+			Name:   name,
+			CryptoProperties: &CryptoProperties{
+				AssetType:           "algorithm",
+				AlgorithmProperties: &AlgorithmProperties{Primitive: primitive, CryptoFunctions: functions},
+				OID:                 oid,
+			},
+		}
+	}
+	return ref
+}
+
+func (b *builder) addPublicKey(cert *x509.Certificate) string {
+	fingerprint := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	ref := "key:" + hex.EncodeToString(fingerprint[:])
+	if _, ok := b.byRef[ref]; ok {
+		return ref
+	}
+
+	algName := cert.PublicKeyAlgorithm.String()
+	primitive := "signature"
+	if cert.PublicKeyAlgorithm == x509.RSA {
+		primitive = "pke"
+	}
+	algRef := b.addAlgorithm(algName, primitive, nil, publicKeyAlgorithmOIDs[cert.PublicKeyAlgorithm])
+
+	size := reader.KeySize(cert.PublicKey)
+	name := algName
+	if size > 0 {
+		name += "-" + strconv.Itoa(size)
+	}
+	b.byRef[ref] = &Component{
+		Type:   "cryptographic-asset",
+		BOMRef: ref,
+		Name:   name,
+		CryptoProperties: &CryptoProperties{
+			AssetType: "related-crypto-material",
+			RelatedCryptoMaterialProperties: &RelatedCryptoMaterialProperties{
+				Type:         "public-key",
+				AlgorithmRef: algRef,
+				Size:         size,
+			},
+		},
+	}
+	return ref
+}
+
+// components returns the components sorted by bom-ref so that the output is
+// stable.
+func (b *builder) components() []Component {
+	refs := make([]string, 0, len(b.byRef))
+	for ref := range b.byRef {
+		refs = append(refs, ref)
+	}
+	slices.Sort(refs)
+
+	components := make([]Component, 0, len(refs))
+	for _, ref := range refs {
+		c := b.byRef[ref]
+		if c.Evidence != nil {
+			slices.SortFunc(c.Evidence.Occurrences, func(a, b Occurrence) int {
+				return strings.Compare(a.Location+" "+a.AdditionalContext, b.Location+" "+b.AdditionalContext)
+			})
+		}
+		components = append(components, *c)
+	}
+	return components
+}
+
+var signatureAlgorithmOIDs = map[x509.SignatureAlgorithm]string{
+	x509.MD5WithRSA:       "1.2.840.113549.1.1.4",
+	x509.SHA1WithRSA:      "1.2.840.113549.1.1.5",
+	x509.SHA256WithRSA:    "1.2.840.113549.1.1.11",
+	x509.SHA384WithRSA:    "1.2.840.113549.1.1.12",
+	x509.SHA512WithRSA:    "1.2.840.113549.1.1.13",
+	x509.SHA256WithRSAPSS: "1.2.840.113549.1.1.10",
+	x509.SHA384WithRSAPSS: "1.2.840.113549.1.1.10",
+	x509.SHA512WithRSAPSS: "1.2.840.113549.1.1.10",
+	x509.ECDSAWithSHA1:    "1.2.840.10045.4.1",
+	x509.ECDSAWithSHA256:  "1.2.840.10045.4.3.2",
+	x509.ECDSAWithSHA384:  "1.2.840.10045.4.3.3",
+	x509.ECDSAWithSHA512:  "1.2.840.10045.4.3.4",
+	x509.PureEd25519:      "1.3.101.112",
+}
+
+var publicKeyAlgorithmOIDs = map[x509.PublicKeyAlgorithm]string{
+	x509.RSA:     "1.2.840.113549.1.1.1",
+	x509.ECDSA:   "1.2.840.10045.2.1",
+	x509.Ed25519: "1.3.101.112",
+}
@@ -0,0 +1,157 @@
+package cbom
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/jetstack/preflight/api"
+	v3 "github.com/jetstack/preflight/api/v3"
+	"github.com/jetstack/preflight/pkg/testutil/testcert"
+)
+
+func TestFromDataReadings(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	caCert := testcert.New(t, testcert.Options{CommonName: "ca", NotBefore: notBefore, NotAfter: notAfter, IsCA: true, RSABits: 2048})
+	leafCert := testcert.New(t, testcert.Options{CommonName: "example.com", NotBefore: notBefore, NotAfter: notAfter, Parent: caCert})
+	caPEM, leafPEM := caCert.PEM(), leafCert.PEM()
+
+	secrets := &api.DataReading{
+		DataGatherer: "k8s/secrets",
+		Data: &api.DynamicData{Items: []*api.GatheredResource{
+			{Resource: &unstructured.Unstructured{Object: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"metadata":   map[string]any{"name": "tls", "namespace": "default"},
+				"data": map[string]any{
+					"tls.crt": base64.StdEncoding.EncodeToString(append(leafPEM, caPEM...)),
+					"ca.crt":  base64.StdEncoding.EncodeToString(caPEM),
+				},
+			}}},
+			{
+				Resource: &unstructured.Unstructured{Object: map[string]any{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"metadata":   map[string]any{"name": "deleted", "namespace": "default"},
+					"data":       map[string]any{"tls.crt": base64.StdEncoding.EncodeToString(leafPEM)},
+				}},
+				DeletedAt: api.Time{Time: notBefore},
+			},
+			{Resource: &unstructured.Unstructured{Object: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"metadata":   map[string]any{"name": "garbage", "namespace": "default"},
+				"data":       map[string]any{"tls.crt": base64.StdEncoding.EncodeToString([]byte("not a certificate"))},
+			}}},
+		}},
+	}
+	routes := &api.DataReading{
+		DataGatherer: "k8s/routes",
+		Data: &api.DynamicData{Items: []*api.GatheredResource{
+			{Resource: &unstructured.Unstructured{Object: map[string]any{
+				"apiVersion": "route.openshift.io/v1",
+				"kind":       "Route",
+				"metadata":   map[string]any{"name": "web", "namespace": "apps"},
+				"spec":       map[string]any{"tls": map[string]any{"certificate": string(leafPEM)}},
+			}}},
+		}},
+	}
+	webhooks := &api.DataReading{
+		DataGatherer: "k8s/validatingwebhookconfigurations",
+		Data: &api.DynamicData{Items: []*api.GatheredResource{
+			{Resource: &admissionregistrationv1.ValidatingWebhookConfiguration{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "ValidatingWebhookConfiguration"},
+				ObjectMeta: metav1.ObjectMeta{Name: "cert-manager-webhook"},
+				Webhooks: []admissionregistrationv1.ValidatingWebhook{
+					{Name: "a", ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: caPEM}},
+				},
+			}},
+		}},
+	}
+	discovery := &api.DataReading{DataGatherer: "k8s/discovery", Data: &api.DiscoveryData{ClusterID: "uid"}}
+
+	bom, err := FromDataReadings([]*api.DataReading{discovery, secrets, routes, webhooks}, Options{ClusterName: "my-cluster", Now: notBefore})
+	require.NoError(t, err)
+
+	assert.Equal(t, "CycloneDX", bom.BOMFormat)
+	assert.Equal(t, "1.6", bom.SpecVersion)
+	assert.Regexp(t, "^urn:uuid:", bom.SerialNumber)
+	assert.Equal(t, "2024-01-01T00:00:00Z", bom.Metadata.Timestamp)
+	assert.Equal(t, &Component{Type: "platform", BOMRef: "cluster", Name: "my-cluster"}, bom.Metadata.Component)
+
+	byName := map[string]Component{}
+	for _, c := range bom.Components {
+		byName[c.Name] = c
+	}
+	// Two certificates, their two keys, and the RSA, ECDSA, and signature
+	// algorithms.
+	assert.Len(t, bom.Components, 7, "components: %v", byName)
+
+	leaf := byName["example.com"]
+	require.NotNil(t, leaf.CryptoProperties)
+	assert.Equal(t, "certificate", leaf.CryptoProperties.AssetType)
+	assert.Equal(t, &CertificateProperties{
+		SubjectName:           "CN=example.com",
+		IssuerName:            "CN=ca",
+		NotValidBefore:        "2024-01-01T00:00:00Z",
+		NotValidAfter:         "2025-01-01T00:00:00Z",
+		SignatureAlgorithmRef: "algorithm:SHA256-RSA",
+		SubjectPublicKeyRef:   leaf.CryptoProperties.CertificateProperties.SubjectPublicKeyRef,
+		CertificateFormat:     "X.509",
+		CertificateExtension:  "pem",
+	}, leaf.CryptoProperties.CertificateProperties)
+	assert.Equal(t, []Occurrence{
+		{Location: "route.openshift.io/v1/Route/apps/web", AdditionalContext: "spec.tls.certificate"},
+		{Location: "v1/Secret/default/tls", AdditionalContext: "data.tls.crt"},
+	}, leaf.Evidence.Occurrences)
+
+	ca := byName["ca"]
+	assert.Equal(t, []Occurrence{
+		{Location: "admissionregistration.k8s.io/v1/ValidatingWebhookConfiguration/cert-manager-webhook", AdditionalContext: "webhooks[0].clientConfig.caBundle"},
+		{Location: "v1/Secret/default/tls", AdditionalContext: "data.ca.crt"},
+		{Location: "v1/Secret/default/tls", AdditionalContext: "data.tls.crt"},
+	}, ca.Evidence.Occurrences)
+	assert.Contains(t, ca.Properties, Property{Name: "x509:isCA", Value: "true"})
+
+	rsaKey := byName["RSA-2048"]
+	require.NotNil(t, rsaKey.CryptoProperties)
+	assert.Equal(t, &RelatedCryptoMaterialProperties{Type: "public-key", AlgorithmRef: "algorithm:RSA", Size: 2048}, rsaKey.CryptoProperties.RelatedCryptoMaterialProperties)
+	ecKey := byName["ECDSA-256"]
+	require.NotNil(t, ecKey.CryptoProperties)
+	assert.Equal(t, 256, ecKey.CryptoProperties.RelatedCryptoMaterialProperties.Size)
+
+	sigAlg := byName["SHA256-RSA"]
+	require.NotNil(t, sigAlg.CryptoProperties)
+	assert.Equal(t, "1.2.840.113549.1.1.11", sigAlg.CryptoProperties.OID)
+	assert.Equal(t, "signature", sigAlg.CryptoProperties.AlgorithmProperties.Primitive)
+
+	t.Run("readings converted to a schema version", func(t *testing.T) {
+		converted, err := v3.ConvertFromInternal([]*api.DataReading{secrets})
+		require.NoError(t, err)
+		fromConverted, err := FromDataReadings(converted, Options{Now: notBefore})
+		require.NoError(t, err)
+		assert.Nil(t, fromConverted.Metadata.Component)
+
+		// Ignore the serial numbers, which are random.
+		fromInternal, err := FromDataReadings([]*api.DataReading{secrets}, Options{Now: notBefore})
+		require.NoError(t, err)
+		fromConverted.SerialNumber, fromInternal.SerialNumber = "", ""
+		assert.Equal(t, fromInternal, fromConverted)
+	})
+
+	t.Run("JSON encoding", func(t *testing.T) {
+		data, err := json.Marshal(bom)
+		require.NoError(t, err)
+		var decoded map[string]any
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, "cryptographic-asset", decoded["components"].([]any)[0].(map[string]any)["type"])
+	})
+}
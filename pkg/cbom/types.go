@@ -0,0 +1,87 @@
+package cbom
+
+// The types below are the subset of the CycloneDX 1.6 JSON schema used by
+// the agent. See https://cyclonedx.org/docs/1.6/json/.
+
+// BOM is a CycloneDX bill of materials.
+type BOM struct {
+	BOMFormat    string      `json:"bomFormat"`
+	SpecVersion  string      `json:"specVersion"`
+	SerialNumber string      `json:"serialNumber"`
+	Version      int         `json:"version"`
+	Metadata     Metadata    `json:"metadata"`
+	Components   []Component `json:"components"`
+}
+
+type Metadata struct {
+	Timestamp string     `json:"timestamp"`
+	Tools     Tools      `json:"tools"`
+	Component *Component `json:"component,omitempty"`
+}
+
+type Tools struct {
+	Components []Component `json:"components"`
+}
+
+// Component is either the cluster (type "platform"), the agent (type
+// "application"), or a cryptographic asset (type "cryptographic-asset").
+type Component struct {
+	Type             string            `json:"type"`
+	BOMRef           string            `json:"bom-ref,omitempty"`
+	Name             string            `json:"name"`
+	Version          string            `json:"version,omitempty"`
+	CryptoProperties *CryptoProperties `json:"cryptoProperties,omitempty"`
+	Evidence         *Evidence         `json:"evidence,omitempty"`
+	Properties       []Property        `json:"properties,omitempty"`
+}
+
+type CryptoProperties struct {
+	// AssetType is one of "algorithm", "certificate", "protocol", and
+	// "related-crypto-material".
+	AssetType                       string                           `json:"assetType"`
+	AlgorithmProperties             *AlgorithmProperties             `json:"algorithmProperties,omitempty"`
+	CertificateProperties           *CertificateProperties           `json:"certificateProperties,omitempty"`
+	RelatedCryptoMaterialProperties *RelatedCryptoMaterialProperties `json:"relatedCryptoMaterialProperties,omitempty"`
+	OID                             string                           `json:"oid,omitempty"`
+}
+
+type AlgorithmProperties struct {
+	// Primitive is, for example, "signature" or "pke".
+	Primitive       string   `json:"primitive"`
+	CryptoFunctions []string `json:"cryptoFunctions,omitempty"`
+}
+
+type CertificateProperties struct {
+	SubjectName           string `json:"subjectName"`
+	IssuerName            string `json:"issuerName"`
+	NotValidBefore        string `json:"notValidBefore"`
+	NotValidAfter         string `json:"notValidAfter"`
+	SignatureAlgorithmRef string `json:"signatureAlgorithmRef,omitempty"`
+	SubjectPublicKeyRef   string `json:"subjectPublicKeyRef,omitempty"`
+	CertificateFormat     string `json:"certificateFormat"`
+	CertificateExtension  string `json:"certificateExtension,omitempty"`
+}
+
+type RelatedCryptoMaterialProperties struct {
+	// Type is, for example, "public-key".
+	Type         string `json:"type"`
+	AlgorithmRef string `json:"algorithmRef,omitempty"`
+	Size         int    `json:"size,omitempty"`
+}
+
+// Evidence records where a cryptographic asset was found.
+type Evidence struct {
+	Occurrences []Occurrence `json:"occurrences"`
+}
+
+// Occurrence is a location where a cryptographic asset was found. See
+// Location for the format of the location.
+type Occurrence struct {
+	Location          string `json:"location"`
+	AdditionalContext string `json:"additionalContext,omitempty"`
+}
+
+type Property struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
@@ -0,0 +1,393 @@
+// Package certfindings checks the certificates stored in the Secrets watched by
+// the k8s-dynamic data gatherers and reports the problems it finds, such as
+// expired certificates, chains that don't build to a trusted root, weak keys,
+// or private keys that don't match the certificate.
+//
+// The Checker is fed by the informer events of the Secrets. The private keys
+// are dropped when the Secrets are received, so the k8s-dynamic data
+// gatherers check that they match the certificates beforehand, see
+// k8sdynamic.DataGathererDynamic.CheckTLSKeyPairs, and only the result reaches
+// the Checker.
+package certfindings
+
+import (
+	"cmp"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/api/reader"
+	"github.com/jetstack/preflight/pkg/datagatherer"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+)
+
+// DataGathererName is the name of the data reading that contains the
+// findings.
+const DataGathererName = "certificate-findings"
+
+// MinRSAKeySize is the size under which RSA keys are reported as weak.
+const MinRSAKeySize = 2048
+
+// weakSignatureAlgorithms are the signature algorithms that rely on SHA-1 or
+// MD5, for which collisions can be computed.
+var weakSignatureAlgorithms = []x509.SignatureAlgorithm{
+	x509.MD2WithRSA,
+	x509.MD5WithRSA,
+	x509.SHA1WithRSA,
+	x509.DSAWithSHA1,
+	x509.ECDSAWithSHA1,
+}
+
+// eventReasons are the reasons of the Events recorded for each type of
+// finding.
+var eventReasons = map[api.FindingType]string{
+	api.FindingExpired:                "CertificateExpired",
+	api.FindingNotYetValid:            "CertificateNotYetValid",
+	api.FindingChainOrder:             "CertificateChainOrder",
+	api.FindingUntrustedChain:         "CertificateUntrustedChain",
+	api.FindingWeakKey:                "CertificateWeakKey",
+	api.FindingWeakSignatureAlgorithm: "CertificateWeakSignatureAlgorithm",
+	api.FindingKeyMismatch:            "CertificateKeyMismatch",
+}
+
+// Options configures the Checker.
+type Options struct {
+	// TrustBundle contains the roots to which the chains may build, in
+	// addition to the certificates found in the ca.crt key of the same
+	// Secret. When nil, only the chains of the Secrets that have a ca.crt
+	// key are verified.
+	TrustBundle *x509.CertPool
+
+	// Events turns on the Kubernetes Events on the Secrets. See
+	// Checker.Recorder.
+	Events bool
+}
+
+// Checker is both a k8scache.ResourceEventHandler, to be registered on the
+// informers of the Secrets using k8sdynamic.DataGathererDynamic.AddEventHandler,
+// and a datagatherer.DataGatherer whose Fetch returns the findings as
+// api.FindingsData.
+type Checker struct {
+	opts Options
+
+	// Recorder, if non-nil, records a Warning Event on the Secret the first
+	// time each finding is reported.
+	Recorder record.EventRecorder
+
+	mu      sync.Mutex
+	secrets map[types.UID]*secret
+
+	// now is used for testing purposes.
+	now func() time.Time
+}
+
+// secret holds the certificates of a Secret. The findings that depend on the
+// time are computed on each Fetch.
+type secret struct {
+	resource api.ResourceReference
+
+	// chain contains the certificates of the tls.crt key.
+	chain []*x509.Certificate
+	// cas contains the certificates of the ca.crt key.
+	cas []*x509.Certificate
+	// keyErr is the error returned when checking that tls.key matches the
+	// certificate. Nil if the key matches or if there is no tls.key.
+	keyErr error
+
+	// reported contains the keys of the findings for which an Event was
+	// recorded.
+	reported sets.Set[string]
+}
+
+var _ k8scache.ResourceEventHandler = &Checker{}
+var _ datagatherer.DataGatherer = &Checker{}
+
+// NewChecker returns a Checker with no Secrets.
+func NewChecker(opts Options) *Checker {
+	return &Checker{
+		opts:    opts,
+		secrets: map[types.UID]*secret{},
+		now:     time.Now,
+	}
+}
+
+// OnAdd implements k8scache.ResourceEventHandler.
+func (c *Checker) OnAdd(obj any, _ bool) {
+	c.set(obj)
+}
+
+// OnUpdate implements k8scache.ResourceEventHandler.
+func (c *Checker) OnUpdate(_, newObj any) {
+	c.set(newObj)
+}
+
+// OnDelete implements k8scache.ResourceEventHandler.
+func (c *Checker) OnDelete(obj any) {
+	if tombstone, ok := obj.(k8scache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	meta, ok := obj.(interface{ GetUID() types.UID })
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.secrets, meta.GetUID())
+}
+
+func (c *Checker) set(obj any) {
+	uid, s := parseSecret(obj)
+	if uid == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s == nil {
+		delete(c.secrets, uid)
+		return
+	}
+	// The Events already recorded for the previous version of the Secret
+	// aren't recorded again.
+	if previous, ok := c.secrets[uid]; ok {
+		s.reported = previous.reported
+	}
+	c.secrets[uid] = s
+}
+
+// parseSecret returns the certificates found in the Secret. It returns a nil
+// secret when tls.crt contains no certificate, and an empty UID when the
+// object isn't a Secret.
+func parseSecret(obj any) (types.UID, *secret) {
+	var (
+		resource api.ResourceReference
+		data     func(key string) []byte
+		keyErr   func(tlsCrt []byte) error
+	)
+	switch obj := obj.(type) {
+	case *corev1.Secret:
+		resource = api.ResourceReference{APIVersion: "v1", Kind: "Secret", Namespace: obj.Namespace, Name: obj.Name, UID: string(obj.UID)}
+		data = func(key string) []byte { return obj.Data[key] }
+		keyErr = func(tlsCrt []byte) error {
+			if tlsKey := obj.Data[corev1.TLSPrivateKeyKey]; len(tlsKey) > 0 {
+				_, err := tls.X509KeyPair(tlsCrt, tlsKey)
+				return err
+			}
+			return nil
+		}
+	case *unstructured.Unstructured:
+		if obj.GetKind() != "Secret" || obj.GroupVersionKind().Group != "" {
+			return "", nil
+		}
+		resource = api.ResourceReference{APIVersion: "v1", Kind: "Secret", Namespace: obj.GetNamespace(), Name: obj.GetName(), UID: string(obj.GetUID())}
+		values, _, _ := unstructured.NestedStringMap(obj.Object, "data")
+		data = func(key string) []byte {
+			decoded, _ := base64.StdEncoding.DecodeString(values[key])
+			return decoded
+		}
+		// tls.key was compared and dropped when the Secret was received.
+		keyErr = func([]byte) error {
+			if msg, ok := obj.Object[k8sdynamic.TLSKeyPairErrorFieldName].(string); ok {
+				return errors.New(msg)
+			}
+			return nil
+		}
+	default:
+		return "", nil
+	}
+	uid := types.UID(resource.UID)
+
+	tlsCrt := data(corev1.TLSCertKey)
+	chain, _ := reader.ParseCertificates(tlsCrt)
+	if len(chain) == 0 {
+		return uid, nil
+	}
+	cas, _ := reader.ParseCertificates(data(corev1.ServiceAccountRootCAKey))
+
+	s := &secret{
+		resource: resource,
+		chain:    chain,
+		cas:      cas,
+		keyErr:   keyErr(tlsCrt),
+		reported: sets.New[string](),
+	}
+	return uid, s
+}
+
+// Run implements datagatherer.DataGatherer. The Checker is fed by the
+// informers of the k8s-dynamic data gatherers, so there is nothing to run.
+func (c *Checker) Run(ctx context.Context) error {
+	return nil
+}
+
+// WaitForCacheSync implements datagatherer.DataGatherer.
+func (c *Checker) WaitForCacheSync(ctx context.Context) error {
+	return nil
+}
+
+// Fetch returns the findings of all the Secrets as api.FindingsData, and
+// records an Event for each new finding if a Recorder is set.
+func (c *Checker) Fetch(ctx context.Context) (any, int, error) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	findings := []api.Finding{}
+	for _, s := range c.secrets {
+		secretFindings := c.check(s, now)
+		findings = append(findings, secretFindings...)
+		if c.Recorder != nil {
+			c.recordEvents(s, secretFindings)
+		}
+	}
+	slices.SortFunc(findings, func(a, b api.Finding) int {
+		return cmp.Or(
+			cmp.Compare(a.Resource.Namespace, b.Resource.Namespace),
+			cmp.Compare(a.Resource.Name, b.Resource.Name),
+			cmp.Compare(a.Key, b.Key),
+			cmp.Compare(a.Type, b.Type),
+			cmp.Compare(a.SHA256Fingerprint, b.SHA256Fingerprint),
+		)
+	})
+
+	return &api.FindingsData{Findings: findings}, len(findings), nil
+}
+
+func (c *Checker) recordEvents(s *secret, findings []api.Finding) {
+	ref := &corev1.ObjectReference{
+		APIVersion: s.resource.APIVersion,
+		Kind:       s.resource.Kind,
+		Namespace:  s.resource.Namespace,
+		Name:       s.resource.Name,
+		UID:        types.UID(s.resource.UID),
+	}
+	for _, finding := range findings {
+		key := string(finding.Type) + "/" + finding.SHA256Fingerprint
+		if s.reported.Has(key) {
+			continue
+		}
+		s.reported.Insert(key)
+		c.Recorder.Event(ref, corev1.EventTypeWarning, eventReasons[finding.Type], finding.Message)
+	}
+}
+
+// check returns the findings of the Secret at the given time.
+func (c *Checker) check(s *secret, now time.Time) []api.Finding {
+	var findings []api.Finding
+	add := func(findingType api.FindingType, severity api.FindingSeverity, cert *x509.Certificate, format string, args ...any) {
+		finding := api.Finding{
+			Type:     findingType,
+			Severity: severity,
+			Message:  fmt.Sprintf(format, args...),
+			Resource: s.resource,
+			Key:      corev1.TLSCertKey,
+		}
+		if cert != nil {
+			fingerprint := sha256.Sum256(cert.Raw)
+			finding.SerialNumber = cert.SerialNumber.Text(16)
+			finding.SHA256Fingerprint = hex.EncodeToString(fingerprint[:])
+		}
+		findings = append(findings, finding)
+	}
+
+	for i, cert := range s.chain {
+		name := describe(i, cert)
+		if now.After(cert.NotAfter) {
+			add(api.FindingExpired, api.FindingSeverityError, cert, "%s expired on %s", name, cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+		if now.Before(cert.NotBefore) {
+			add(api.FindingNotYetValid, api.FindingSeverityError, cert, "%s is not valid before %s", name, cert.NotBefore.UTC().Format(time.RFC3339))
+		}
+		if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok && pub.N.BitLen() < MinRSAKeySize {
+			add(api.FindingWeakKey, api.FindingSeverityWarning, cert, "%s has a %d-bit RSA key, the minimum is %d bits", name, pub.N.BitLen(), MinRSAKeySize)
+		}
+		// Self-signed certificates are exempt: they are trusted because they
+		// are in a trust store or pinned, and the clients don't verify their
+		// signature, so a weak one can't be exploited.
+		if slices.Contains(weakSignatureAlgorithms, cert.SignatureAlgorithm) && !slices.Equal(cert.RawIssuer, cert.RawSubject) {
+			add(api.FindingWeakSignatureAlgorithm, api.FindingSeverityWarning, cert, "%s is signed with %s", name, cert.SignatureAlgorithm)
+		}
+		if i+1 < len(s.chain) && !isIssuedBy(cert, s.chain[i+1]) {
+			add(api.FindingChainOrder, api.FindingSeverityWarning, cert, "%s is not issued by the next certificate in the chain, %s", name, describe(i+1, s.chain[i+1]))
+		}
+	}
+
+	if err := c.verify(s, now); err != nil {
+		add(api.FindingUntrustedChain, api.FindingSeverityError, nil, "the chain doesn't build to ca.crt or to the trust bundle: %s", err)
+	}
+
+	if s.keyErr != nil {
+		add(api.FindingKeyMismatch, api.FindingSeverityError, s.chain[0], "tls.key doesn't match %s: %s", describe(0, s.chain[0]), s.keyErr)
+	}
+
+	return findings
+}
+
+// verify checks that the chain builds to the ca.crt of the Secret or to the
+// trust bundle. It returns nil when there is no root to verify the chain
+// against. Expired certificates are reported separately, so they aren't
+// reported again as an untrusted chain.
+func (c *Checker) verify(s *secret, now time.Time) error {
+	if len(s.cas) == 0 && c.opts.TrustBundle == nil {
+		return nil
+	}
+
+	roots := x509.NewCertPool()
+	if c.opts.TrustBundle != nil {
+		roots = c.opts.TrustBundle.Clone()
+	}
+	for _, ca := range s.cas {
+		roots.AddCert(ca)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range s.chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := s.chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) && invalid.Reason == x509.Expired {
+		return nil
+	}
+	return err
+}
+
+// describe returns a short description of the certificate at the given
+// position in the chain for use in the messages.
+func describe(i int, cert *x509.Certificate) string {
+	return fmt.Sprintf("certificate %d (%s)", i, cert.Subject)
+}
+
+// isIssuedBy returns true if the certificate is signed by the parent. The
+// weak signature algorithms, which CheckSignatureFrom refuses, are reported
+// separately and are assumed to be valid here.
+func isIssuedBy(cert, parent *x509.Certificate) bool {
+	err := cert.CheckSignatureFrom(parent)
+	var insecure x509.InsecureAlgorithmError
+	if errors.As(err, &insecure) {
+		return slices.Equal(cert.RawIssuer, parent.RawSubject)
+	}
+	return err == nil
+}
@@ -0,0 +1,221 @@
+package certfindings
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+	"github.com/jetstack/preflight/pkg/testutil/testcert"
+)
+
+func TestChecker(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	notBefore, notAfter := now.Add(-24*time.Hour), now.Add(24*time.Hour)
+
+	root := testcert.New(t, testcert.Options{CommonName: "root", NotBefore: notBefore, NotAfter: notAfter, IsCA: true})
+	intermediate := testcert.New(t, testcert.Options{CommonName: "intermediate", NotBefore: notBefore, NotAfter: notAfter, IsCA: true, Parent: root})
+	leaf := testcert.New(t, testcert.Options{CommonName: "leaf", NotBefore: notBefore, NotAfter: notAfter, Parent: intermediate})
+	otherRoot := testcert.New(t, testcert.Options{CommonName: "other-root", NotBefore: notBefore, NotAfter: notAfter, IsCA: true})
+
+	check := func(t *testing.T, opts Options, secrets ...any) []api.Finding {
+		t.Helper()
+		c := NewChecker(opts)
+		c.now = func() time.Time { return now }
+		for _, s := range secrets {
+			c.OnAdd(s, true)
+		}
+		data, count, err := c.Fetch(t.Context())
+		require.NoError(t, err)
+		findings := data.(*api.FindingsData).Findings
+		assert.Len(t, findings, count)
+		return findings
+	}
+
+	types := func(findings []api.Finding) []api.FindingType {
+		var got []api.FindingType
+		for _, f := range findings {
+			got = append(got, f.Type)
+		}
+		return got
+	}
+
+	t.Run("valid chain", func(t *testing.T) {
+		findings := check(t, Options{}, tlsSecret("tls", map[string][]byte{
+			"tls.crt": testcert.Chain(leaf, intermediate),
+			"tls.key": leaf.KeyPEM(t),
+			"ca.crt":  testcert.Chain(root),
+		}))
+		assert.Empty(t, findings)
+		assert.NotNil(t, findings, "the findings must be encoded as an empty array")
+	})
+
+	t.Run("expired and not yet valid certificates", func(t *testing.T) {
+		expired := testcert.New(t, testcert.Options{CommonName: "expired", NotBefore: now.Add(-48 * time.Hour), NotAfter: now.Add(-24 * time.Hour), Parent: intermediate})
+		future := testcert.New(t, testcert.Options{CommonName: "future", NotBefore: now.Add(24 * time.Hour), NotAfter: now.Add(48 * time.Hour), Parent: intermediate})
+		findings := check(t, Options{},
+			tlsSecret("expired", map[string][]byte{"tls.crt": testcert.Chain(expired, intermediate), "ca.crt": testcert.Chain(root)}),
+			tlsSecret("future", map[string][]byte{"tls.crt": testcert.Chain(future, intermediate)}),
+		)
+		// The expired certificate isn't reported again as an untrusted chain.
+		require.Equal(t, []api.FindingType{api.FindingExpired, api.FindingNotYetValid}, types(findings))
+		assert.Equal(t, api.Finding{
+			Type:              api.FindingExpired,
+			Severity:          api.FindingSeverityError,
+			Message:           "certificate 0 (CN=expired) expired on 2024-05-31T00:00:00Z",
+			Resource:          api.ResourceReference{APIVersion: "v1", Kind: "Secret", Namespace: "default", Name: "expired", UID: "uid-expired"},
+			Key:               "tls.crt",
+			SerialNumber:      expired.Certificate.SerialNumber.Text(16),
+			SHA256Fingerprint: findings[0].SHA256Fingerprint,
+		}, findings[0])
+		assert.Len(t, findings[0].SHA256Fingerprint, 64)
+		assert.Equal(t, "certificate 0 (CN=future) is not valid before 2024-06-02T00:00:00Z", findings[1].Message)
+	})
+
+	t.Run("chain order", func(t *testing.T) {
+		findings := check(t, Options{}, tlsSecret("tls", map[string][]byte{
+			"tls.crt": testcert.Chain(intermediate, leaf),
+			"ca.crt":  testcert.Chain(root),
+		}))
+		// The chain builds once reordered, so only the order is reported.
+		require.Equal(t, []api.FindingType{api.FindingChainOrder}, types(findings))
+		assert.Equal(t, "certificate 0 (CN=intermediate) is not issued by the next certificate in the chain, certificate 1 (CN=leaf)", findings[0].Message)
+	})
+
+	t.Run("untrusted chain", func(t *testing.T) {
+		findings := check(t, Options{}, tlsSecret("tls", map[string][]byte{
+			"tls.crt": testcert.Chain(leaf, intermediate),
+			"ca.crt":  testcert.Chain(otherRoot),
+		}))
+		require.Equal(t, []api.FindingType{api.FindingUntrustedChain}, types(findings))
+		assert.Empty(t, findings[0].SHA256Fingerprint)
+		assert.Contains(t, findings[0].Message, "the chain doesn't build to ca.crt or to the trust bundle: x509: certificate signed by unknown authority")
+	})
+
+	t.Run("trust bundle", func(t *testing.T) {
+		secret := tlsSecret("tls", map[string][]byte{"tls.crt": testcert.Chain(leaf, intermediate)})
+
+		// Without ca.crt or trust bundle, the chain isn't verified.
+		assert.Empty(t, check(t, Options{}, secret))
+
+		bundle := x509.NewCertPool()
+		bundle.AddCert(root.Certificate)
+		assert.Empty(t, check(t, Options{TrustBundle: bundle}, secret))
+
+		otherBundle := x509.NewCertPool()
+		otherBundle.AddCert(otherRoot.Certificate)
+		assert.Equal(t, []api.FindingType{api.FindingUntrustedChain}, types(check(t, Options{TrustBundle: otherBundle}, secret)))
+	})
+
+	t.Run("weak key and signature algorithm", func(t *testing.T) {
+		weakRoot := testcert.New(t, testcert.Options{CommonName: "weak-root", NotBefore: notBefore, NotAfter: notAfter, IsCA: true, RSABits: 1024, SignatureAlgorithm: x509.SHA1WithRSA})
+		weakLeaf := testcert.New(t, testcert.Options{CommonName: "weak-leaf", NotBefore: notBefore, NotAfter: notAfter, Parent: weakRoot, SignatureAlgorithm: x509.SHA1WithRSA})
+		findings := check(t, Options{}, tlsSecret("tls", map[string][]byte{"tls.crt": testcert.Chain(weakLeaf, weakRoot)}))
+		// The SHA-1 signature of the self-signed root doesn't matter.
+		require.Equal(t, []api.FindingType{api.FindingWeakKey, api.FindingWeakSignatureAlgorithm}, types(findings))
+		assert.Equal(t, "certificate 1 (CN=weak-root) has a 1024-bit RSA key, the minimum is 2048 bits", findings[0].Message)
+		assert.Equal(t, "certificate 0 (CN=weak-leaf) is signed with SHA1-RSA", findings[1].Message)
+		assert.Equal(t, api.FindingSeverityWarning, findings[0].Severity)
+	})
+
+	t.Run("SHA-1 self-signed certificate", func(t *testing.T) {
+		selfSigned := testcert.New(t, testcert.Options{CommonName: "self-signed", NotBefore: notBefore, NotAfter: notAfter, RSABits: 2048, SignatureAlgorithm: x509.SHA1WithRSA})
+		require.Equal(t, x509.SHA1WithRSA, selfSigned.Certificate.SignatureAlgorithm)
+		findings := check(t, Options{}, tlsSecret("tls", map[string][]byte{
+			"tls.crt": testcert.Chain(selfSigned),
+			"tls.key": selfSigned.KeyPEM(t),
+		}))
+		assert.Empty(t, findings)
+	})
+
+	t.Run("key mismatch", func(t *testing.T) {
+		findings := check(t, Options{}, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "typed", UID: "uid-typed"},
+			Data: map[string][]byte{
+				"tls.crt": testcert.Chain(leaf, intermediate),
+				"tls.key": otherRoot.KeyPEM(t),
+			},
+		})
+		require.Equal(t, []api.FindingType{api.FindingKeyMismatch}, types(findings))
+		assert.Equal(t, "tls.key doesn't match certificate 0 (CN=leaf): tls: private key does not match public key", findings[0].Message)
+	})
+
+	t.Run("key mismatch found when the Secret was received", func(t *testing.T) {
+		secret := tlsSecret("tls", map[string][]byte{"tls.crt": testcert.Chain(leaf, intermediate)})
+		secret.Object[k8sdynamic.TLSKeyPairErrorFieldName] = "tls: private key does not match public key"
+		findings := check(t, Options{}, secret)
+		require.Equal(t, []api.FindingType{api.FindingKeyMismatch}, types(findings))
+		assert.Equal(t, "tls.key doesn't match certificate 0 (CN=leaf): tls: private key does not match public key", findings[0].Message)
+	})
+
+	t.Run("Secrets without certificates and deleted Secrets", func(t *testing.T) {
+		c := NewChecker(Options{})
+		c.now = func() time.Time { return now }
+		expired := testcert.New(t, testcert.Options{CommonName: "expired", NotBefore: now.Add(-48 * time.Hour), NotAfter: now.Add(-24 * time.Hour)})
+		secret := tlsSecret("tls", map[string][]byte{"tls.crt": testcert.Chain(expired)})
+		c.OnAdd(tlsSecret("opaque", map[string][]byte{"password": []byte("secret")}), true)
+		c.OnAdd(secret, true)
+
+		data, count, err := c.Fetch(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Len(t, data.(*api.FindingsData).Findings, 1)
+
+		c.OnDelete(k8scache.DeletedFinalStateUnknown{Key: "default/tls", Obj: secret})
+		_, count, err = c.Fetch(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("events are recorded once per finding", func(t *testing.T) {
+		recorder := record.NewFakeRecorder(10)
+		c := NewChecker(Options{Events: true})
+		c.Recorder = recorder
+		c.now = func() time.Time { return now }
+
+		expired := testcert.New(t, testcert.Options{CommonName: "expired", NotBefore: now.Add(-48 * time.Hour), NotAfter: now.Add(-24 * time.Hour)})
+		secret := tlsSecret("tls", map[string][]byte{"tls.crt": testcert.Chain(expired)})
+		c.OnAdd(secret, true)
+		_, _, err := c.Fetch(t.Context())
+		require.NoError(t, err)
+
+		// An update of the Secret that doesn't change the findings doesn't
+		// record the Event again.
+		c.OnUpdate(secret, secret)
+		_, _, err = c.Fetch(t.Context())
+		require.NoError(t, err)
+
+		close(recorder.Events)
+		var events []string
+		for e := range recorder.Events {
+			events = append(events, e)
+		}
+		assert.Equal(t, []string{
+			"Warning CertificateExpired certificate 0 (CN=expired) expired on 2024-05-31T00:00:00Z",
+		}, events)
+	})
+}
+
+func tlsSecret(name string, data map[string][]byte) *unstructured.Unstructured {
+	encoded := map[string]any{}
+	for k, v := range data {
+		encoded[k] = base64.StdEncoding.EncodeToString(v)
+	}
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]any{"uid": "uid-" + name, "namespace": "default", "name": name},
+		"type":       "kubernetes.io/tls",
+		"data":       encoded,
+	}}
+}
@@ -0,0 +1,333 @@
+// Package certmetrics exposes Prometheus metrics about the certificates stored
+// in the Secrets watched by the k8s-dynamic data gatherers. The metrics are
+// computed from the informer events rather than by listing the Secrets on
+// each scrape, so they come at no extra cost for the Kubernetes API server.
+package certmetrics
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	k8scache "k8s.io/client-go/tools/cache"
+
+	"github.com/jetstack/preflight/api/reader"
+)
+
+// DefaultMaxCertificates is the number of certificates for which metrics are
+// exported when Options.MaxCertificates is zero.
+const DefaultMaxCertificates = 5000
+
+// SecretKeys are the keys of the Secret data in which certificates are looked
+// for. They are the keys retained by the k8s-dynamic data gatherer.
+var SecretKeys = []string{corev1.TLSCertKey, corev1.ServiceAccountRootCAKey}
+
+var (
+	certLabels  = []string{"namespace", "secret", "key", "serial", "fingerprint"}
+	chainLabels = []string{"namespace", "secret", "key"}
+
+	notAfterDesc = prometheus.NewDesc(
+		"jscp_agent_certificate_not_after_timestamp_seconds",
+		"The time after which the certificate expires, in seconds since the Unix epoch.",
+		certLabels, nil,
+	)
+	expiryDaysDesc = prometheus.NewDesc(
+		"jscp_agent_certificate_expiry_days",
+		"The number of days until the certificate expires. Negative once the certificate has expired.",
+		certLabels, nil,
+	)
+	keySizeDesc = prometheus.NewDesc(
+		"jscp_agent_certificate_key_size_bits",
+		"The size of the certificate's public key, in bits.",
+		append(slices.Clone(certLabels), "key_algorithm"), nil,
+	)
+	selfSignedDesc = prometheus.NewDesc(
+		"jscp_agent_certificate_self_signed",
+		"1 if the certificate is self-signed, 0 otherwise.",
+		certLabels, nil,
+	)
+	chainLengthDesc = prometheus.NewDesc(
+		"jscp_agent_certificate_chain_length",
+		"The number of certificates found under the key of the Secret.",
+		chainLabels, nil,
+	)
+	droppedDesc = prometheus.NewDesc(
+		"jscp_agent_certificate_metrics_dropped",
+		"The number of certificates for which no metrics are exported because of the max-certificates limit.",
+		nil, nil,
+	)
+)
+
+// Options controls which certificates the Collector exports metrics for.
+type Options struct {
+	// IncludeNamespaces, if not empty, limits the metrics to the Secrets in
+	// these namespaces.
+	IncludeNamespaces []string
+
+	// ExcludeNamespaces is a list of namespaces whose Secrets are ignored.
+	ExcludeNamespaces []string
+
+	// MaxCertificates limits the number of certificates for which metrics
+	// are exported, to bound the cardinality of the metrics. The certificates
+	// that expire first are kept. Defaults to DefaultMaxCertificates.
+	MaxCertificates int
+}
+
+// Collector is a prometheus.Collector that is fed by the informer events of
+// the Secrets. Register it as an event handler on the informers using
+// k8sdynamic.DataGathererDynamic.AddEventHandler.
+type Collector struct {
+	opts Options
+
+	mu      sync.RWMutex
+	secrets map[types.UID]*secret
+
+	// now is used for testing purposes.
+	now func() time.Time
+}
+
+// secret holds what is needed to compute the metrics of a Secret, so that the
+// Secret itself isn't retained.
+type secret struct {
+	namespace string
+	name      string
+	keys      []secretKey
+}
+
+type secretKey struct {
+	key   string
+	certs []certificate
+}
+
+type certificate struct {
+	serial       string
+	fingerprint  string
+	notAfter     time.Time
+	keyAlgorithm string
+	keySize      int
+	selfSigned   bool
+}
+
+var _ prometheus.Collector = &Collector{}
+var _ k8scache.ResourceEventHandler = &Collector{}
+
+// NewCollector returns a Collector with no Secrets.
+func NewCollector(opts Options) *Collector {
+	if opts.MaxCertificates == 0 {
+		opts.MaxCertificates = DefaultMaxCertificates
+	}
+	return &Collector{
+		opts:    opts,
+		secrets: map[types.UID]*secret{},
+		now:     time.Now,
+	}
+}
+
+// OnAdd implements k8scache.ResourceEventHandler.
+func (c *Collector) OnAdd(obj any, _ bool) {
+	c.set(obj)
+}
+
+// OnUpdate implements k8scache.ResourceEventHandler.
+func (c *Collector) OnUpdate(_, newObj any) {
+	c.set(newObj)
+}
+
+// OnDelete implements k8scache.ResourceEventHandler.
+func (c *Collector) OnDelete(obj any) {
+	if tombstone, ok := obj.(k8scache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	meta, ok := obj.(interface{ GetUID() types.UID })
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.secrets, meta.GetUID())
+}
+
+func (c *Collector) set(obj any) {
+	uid, s := c.parseSecret(obj)
+	if uid == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s == nil {
+		delete(c.secrets, uid)
+		return
+	}
+	c.secrets[uid] = s
+}
+
+// parseSecret returns the certificates found in the Secret. It returns a nil
+// secret when the Secret is filtered out or has no certificates, and an empty
+// UID when the object isn't a Secret.
+func (c *Collector) parseSecret(obj any) (types.UID, *secret) {
+	var (
+		uid             types.UID
+		namespace, name string
+		data            func(key string) []byte
+	)
+	switch obj := obj.(type) {
+	case *corev1.Secret:
+		uid, namespace, name = obj.UID, obj.Namespace, obj.Name
+		data = func(key string) []byte { return obj.Data[key] }
+	case *unstructured.Unstructured:
+		if obj.GetKind() != "Secret" || obj.GroupVersionKind().Group != "" {
+			return "", nil
+		}
+		uid, namespace, name = obj.GetUID(), obj.GetNamespace(), obj.GetName()
+		values, _, _ := unstructured.NestedStringMap(obj.Object, "data")
+		data = func(key string) []byte {
+			decoded, _ := base64.StdEncoding.DecodeString(values[key])
+			return decoded
+		}
+	default:
+		return "", nil
+	}
+
+	if !c.includesNamespace(namespace) {
+		return uid, nil
+	}
+
+	s := &secret{namespace: namespace, name: name}
+	for _, key := range SecretKeys {
+		pemData := data(key)
+		if len(pemData) == 0 {
+			continue
+		}
+		// Invalid certificates are ignored: the metrics are about the
+		// certificates that can be parsed, and the error would be repeated
+		// on every event.
+		certs, _ := reader.ParseCertificates(pemData)
+		if len(certs) == 0 {
+			continue
+		}
+		sk := secretKey{key: key}
+		for _, cert := range certs {
+			sk.certs = append(sk.certs, newCertificate(cert))
+		}
+		s.keys = append(s.keys, sk)
+	}
+	if len(s.keys) == 0 {
+		return uid, nil
+	}
+	return uid, s
+}
+
+func (c *Collector) includesNamespace(namespace string) bool {
+	if len(c.opts.IncludeNamespaces) > 0 && !slices.Contains(c.opts.IncludeNamespaces, namespace) {
+		return false
+	}
+	return !slices.Contains(c.opts.ExcludeNamespaces, namespace)
+}
+
+func newCertificate(cert *x509.Certificate) certificate {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return certificate{
+		serial:       cert.SerialNumber.Text(16),
+		fingerprint:  hex.EncodeToString(fingerprint[:]),
+		notAfter:     cert.NotAfter,
+		keyAlgorithm: cert.PublicKeyAlgorithm.String(),
+		keySize:      reader.KeySize(cert.PublicKey),
+		selfSigned:   isSelfSigned(cert),
+	}
+}
+
+// isSelfSigned checks the signature directly rather than with
+// CheckSignatureFrom, which rejects the self-signed certificates that aren't
+// CAs.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- notAfterDesc
+	ch <- expiryDaysDesc
+	ch <- keySizeDesc
+	ch <- selfSignedDesc
+	ch <- chainLengthDesc
+	ch <- droppedDesc
+}
+
+// labelledCertificate is a certificate along with the labels of its metrics.
+type labelledCertificate struct {
+	certificate
+	labels []string
+}
+
+// chain is the number of certificates found under a key of a Secret.
+type chain struct {
+	labels []string
+	length int
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	now := c.now()
+
+	c.mu.RLock()
+	var certs []labelledCertificate
+	var chains []chain
+	for _, s := range c.secrets {
+		for _, sk := range s.keys {
+			labels := []string{s.namespace, s.name, sk.key}
+			chains = append(chains, chain{labels: labels, length: len(sk.certs)})
+			for _, cert := range sk.certs {
+				certs = append(certs, labelledCertificate{
+					certificate: cert,
+					labels:      append(slices.Clone(labels), cert.serial, cert.fingerprint),
+				})
+			}
+		}
+	}
+	c.mu.RUnlock()
+
+	// The same certificate may appear twice under the same key, e.g. when a
+	// chain is repeated. The metrics must have unique label values.
+	slices.SortFunc(certs, func(a, b labelledCertificate) int {
+		return cmp.Or(a.notAfter.Compare(b.notAfter), slices.Compare(a.labels, b.labels))
+	})
+	certs = slices.CompactFunc(certs, func(a, b labelledCertificate) bool {
+		return slices.Equal(a.labels, b.labels)
+	})
+
+	dropped := 0
+	if len(certs) > c.opts.MaxCertificates {
+		dropped = len(certs) - c.opts.MaxCertificates
+		certs = certs[:c.opts.MaxCertificates]
+	}
+
+	for _, cert := range certs {
+		ch <- prometheus.MustNewConstMetric(notAfterDesc, prometheus.GaugeValue, float64(cert.notAfter.Unix()), cert.labels...)
+		ch <- prometheus.MustNewConstMetric(expiryDaysDesc, prometheus.GaugeValue, cert.notAfter.Sub(now).Hours()/24, cert.labels...)
+		ch <- prometheus.MustNewConstMetric(keySizeDesc, prometheus.GaugeValue, float64(cert.keySize), append(slices.Clone(cert.labels), cert.keyAlgorithm)...)
+		selfSigned := 0.0
+		if cert.selfSigned {
+			selfSigned = 1
+		}
+		ch <- prometheus.MustNewConstMetric(selfSignedDesc, prometheus.GaugeValue, selfSigned, cert.labels...)
+	}
+	// The chain lengths aren't limited since there are far fewer of them than
+	// certificates.
+	slices.SortFunc(chains, func(a, b chain) int { return slices.Compare(a.labels, b.labels) })
+	chains = slices.CompactFunc(chains, func(a, b chain) bool { return slices.Equal(a.labels, b.labels) })
+	for _, chain := range chains {
+		ch <- prometheus.MustNewConstMetric(chainLengthDesc, prometheus.GaugeValue, float64(chain.length), chain.labels...)
+	}
+	ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.GaugeValue, float64(dropped))
+}
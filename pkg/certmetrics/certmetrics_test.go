@@ -0,0 +1,179 @@
+package certmetrics
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	k8scache "k8s.io/client-go/tools/cache"
+
+	"github.com/jetstack/preflight/pkg/testutil/testcert"
+)
+
+func TestCollector(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ca := testcert.New(t, testcert.Options{SerialNumber: 1, CommonName: "ca", NotAfter: now.Add(365 * 24 * time.Hour), IsCA: true})
+	leaf := testcert.New(t, testcert.Options{SerialNumber: 2, CommonName: "leaf", NotAfter: now.Add(10 * 24 * time.Hour), Parent: ca})
+	caPEM, leafPEM := ca.PEM(), leaf.PEM()
+
+	newCollector := func(opts Options) *Collector {
+		c := NewCollector(opts)
+		c.now = func() time.Time { return now }
+		return c
+	}
+
+	t.Run("unstructured and typed Secrets", func(t *testing.T) {
+		c := newCollector(Options{})
+		c.OnAdd(unstructuredSecret("uid-1", "team-a", "web", map[string][]byte{
+			"tls.crt": append(slices.Clone(leafPEM), caPEM...),
+			"ca.crt":  caPEM,
+			"tls.key": []byte("ignored"),
+		}), true)
+		c.OnAdd(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{UID: "uid-2", Namespace: "team-b", Name: "ca"},
+			Data:       map[string][]byte{"ca.crt": caPEM},
+		}, true)
+
+		got := collect(t, c)
+		leaf := `namespace="team-a",secret="web",key="tls.crt",serial="2"`
+		for metric, value := range map[string]float64{
+			"jscp_agent_certificate_not_after_timestamp_seconds{" + leaf + "}":         float64(now.Add(10 * 24 * time.Hour).Unix()),
+			"jscp_agent_certificate_expiry_days{" + leaf + "}":                         10,
+			"jscp_agent_certificate_key_size_bits{" + leaf + `,key_algorithm="ECDSA"}`: 256,
+			"jscp_agent_certificate_self_signed{" + leaf + "}":                         0,
+
+			`jscp_agent_certificate_self_signed{namespace="team-a",secret="web",key="tls.crt",serial="1"}`: 1,
+			`jscp_agent_certificate_self_signed{namespace="team-a",secret="web",key="ca.crt",serial="1"}`:  1,
+			`jscp_agent_certificate_self_signed{namespace="team-b",secret="ca",key="ca.crt",serial="1"}`:   1,
+
+			`jscp_agent_certificate_chain_length{namespace="team-a",secret="web",key="tls.crt"}`: 2,
+			`jscp_agent_certificate_chain_length{namespace="team-a",secret="web",key="ca.crt"}`:  1,
+			`jscp_agent_certificate_chain_length{namespace="team-b",secret="ca",key="ca.crt"}`:   1,
+
+			"jscp_agent_certificate_metrics_dropped": 0,
+		} {
+			assert.Contains(t, got, metric)
+			assert.Equal(t, value, got[metric], metric)
+		}
+		// Four metrics for each of the four certificates, three chain
+		// lengths, and the dropped count.
+		assert.Len(t, got, 4*4+3+1)
+	})
+
+	t.Run("update and delete", func(t *testing.T) {
+		c := newCollector(Options{})
+		secret := unstructuredSecret("uid-1", "team-a", "web", map[string][]byte{"tls.crt": leafPEM})
+		c.OnAdd(secret, true)
+		assert.Len(t, collect(t, c), 4+1+1)
+
+		// The certificate was removed from the Secret.
+		c.OnUpdate(secret, unstructuredSecret("uid-1", "team-a", "web", map[string][]byte{"tls.crt": []byte("garbage")}))
+		assert.Len(t, collect(t, c), 1)
+
+		c.OnUpdate(secret, secret)
+		assert.Len(t, collect(t, c), 4+1+1)
+
+		c.OnDelete(k8scache.DeletedFinalStateUnknown{Key: "team-a/web", Obj: secret})
+		assert.Len(t, collect(t, c), 1)
+	})
+
+	t.Run("namespace filters", func(t *testing.T) {
+		c := newCollector(Options{IncludeNamespaces: []string{"team-a", "kube-system"}, ExcludeNamespaces: []string{"kube-system"}})
+		c.OnAdd(unstructuredSecret("uid-1", "team-a", "web", map[string][]byte{"tls.crt": leafPEM}), true)
+		c.OnAdd(unstructuredSecret("uid-2", "team-b", "web", map[string][]byte{"tls.crt": leafPEM}), true)
+		c.OnAdd(unstructuredSecret("uid-3", "kube-system", "web", map[string][]byte{"tls.crt": leafPEM}), true)
+
+		got := collect(t, c)
+		assert.Contains(t, got, `jscp_agent_certificate_chain_length{namespace="team-a",secret="web",key="tls.crt"}`)
+		assert.Len(t, got, 4+1+1)
+	})
+
+	t.Run("max-certificates keeps the certificates that expire first", func(t *testing.T) {
+		c := newCollector(Options{MaxCertificates: 1})
+		c.OnAdd(unstructuredSecret("uid-1", "team-a", "ca", map[string][]byte{"ca.crt": caPEM}), true)
+		c.OnAdd(unstructuredSecret("uid-2", "team-a", "web", map[string][]byte{"tls.crt": leafPEM}), true)
+
+		got := collect(t, c)
+		assert.Equal(t, 1.0, got["jscp_agent_certificate_metrics_dropped"])
+		assert.Contains(t, got, `jscp_agent_certificate_expiry_days{namespace="team-a",secret="web",key="tls.crt",serial="2"}`)
+		assert.NotContains(t, got, `jscp_agent_certificate_expiry_days{namespace="team-a",secret="ca",key="ca.crt",serial="1"}`)
+		// The chain lengths aren't limited.
+		assert.Len(t, got, 4+2+1)
+	})
+
+	t.Run("objects that aren't Secrets are ignored", func(t *testing.T) {
+		c := newCollector(Options{})
+		c.OnAdd(&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]any{"uid": "uid-1", "namespace": "team-a", "name": "web"},
+			"data":       map[string]any{"tls.crt": base64.StdEncoding.EncodeToString(leafPEM)},
+		}}, true)
+		assert.Len(t, collect(t, c), 1)
+	})
+}
+
+// collect returns the value of each metric, keyed by the metric name followed
+// by its labels in the order of the Desc, e.g. `name{a="b",c="d"}`. The
+// fingerprint label is omitted since it is random. The pedantic registry
+// checks that the metrics are consistent with their Desc.
+func collect(t *testing.T, c *Collector) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(c))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	got := map[string]float64{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "fingerprint" {
+					continue
+				}
+				labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+			// The labels are sorted by name, so they are put back in the
+			// order of the Desc for readability.
+			slices.SortFunc(labels, func(a, b string) int {
+				return labelOrder(a) - labelOrder(b)
+			})
+			name := family.GetName()
+			if len(labels) > 0 {
+				name += "{" + strings.Join(labels, ",") + "}"
+			}
+			got[name] = m.GetGauge().GetValue()
+		}
+	}
+	return got
+}
+
+func labelOrder(label string) int {
+	name := label[:strings.Index(label, "=")]
+	return slices.Index([]string{"namespace", "secret", "key", "serial", "key_algorithm"}, name)
+}
+
+func unstructuredSecret(uid types.UID, namespace, name string, data map[string][]byte) *unstructured.Unstructured {
+	encoded := map[string]any{}
+	for k, v := range data {
+		encoded[k] = base64.StdEncoding.EncodeToString(v)
+	}
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]any{"uid": string(uid), "namespace": namespace, "name": name},
+		"type":       "kubernetes.io/tls",
+		"data":       encoded,
+	}}
+}
@@ -42,6 +42,18 @@ type (
 	}
 )
 
+// agentMetadataForCluster returns the agent metadata with the supplied cluster
+// ID. The agent metadata is created with the ID of the agent's cluster, but
+// the agent may also upload the data of other clusters.
+func agentMetadataForCluster(agentMetadata *api.AgentMetadata, clusterID string) *api.AgentMetadata {
+	if agentMetadata == nil || clusterID == "" || clusterID == agentMetadata.ClusterID {
+		return agentMetadata
+	}
+	metadata := *agentMetadata
+	metadata.ClusterID = clusterID
+	return &metadata
+}
+
 func fullURL(baseURL, path string) string {
 	base := baseURL
 	for strings.HasSuffix(base, "/") {
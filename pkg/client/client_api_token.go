@@ -56,7 +56,7 @@ func (c *APITokenClient) PostDataReadingsWithOptions(ctx context.Context, readin
 // viewing in the user-interface.
 func (c *APITokenClient) postDataReadings(ctx context.Context, orgID, clusterID string, readings []*api.DataReading) error {
 	payload := api.DataReadingsPost{
-		AgentMetadata:  c.agentMetadata,
+		AgentMetadata:  agentMetadataForCluster(c.agentMetadata, clusterID),
 		DataGatherTime: time.Now().UTC(),
 		DataReadings:   readings,
 	}
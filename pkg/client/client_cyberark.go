@@ -75,10 +75,9 @@ func (o *CyberArkClient) PostDataReadingsWithOptions(ctx context.Context, readin
 		return err
 	}
 
-	snapshot := baseSnapshotFromOptions(opts)
-
-	if err := convertDataReadings(defaultExtractorFunctions, readings, &snapshot); err != nil {
-		return fmt.Errorf("while converting data readings: %s", err)
+	snapshot, err := SnapshotFromDataReadings(readings, opts)
+	if err != nil {
+		return err
 	}
 
 	// Minimize the snapshot to reduce size and improve privacy
@@ -115,6 +114,18 @@ func baseSnapshotFromOptions(opts Options) dataupload.Snapshot {
 	}
 }
 
+// SnapshotFromDataReadings converts the supplied data readings into the
+// snapshot format expected by CyberArk, without minimizing it. The readings
+// must have been produced by the "ark/" data gatherers, e.g. those read back
+// from an --output-path file using the api/reader package.
+func SnapshotFromDataReadings(readings []*api.DataReading, opts Options) (dataupload.Snapshot, error) {
+	snapshot := baseSnapshotFromOptions(opts)
+	if err := convertDataReadings(defaultExtractorFunctions, readings, &snapshot); err != nil {
+		return dataupload.Snapshot{}, fmt.Errorf("while converting data readings: %s", err)
+	}
+	return snapshot, nil
+}
+
 // extractOIDCFromReading converts the opaque data from a OIDCDiscoveryData
 // data reading to allow access to the OIDC fields within.
 func extractOIDCFromReading(reading *api.DataReading, target *dataupload.Snapshot) error {
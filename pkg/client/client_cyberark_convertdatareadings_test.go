@@ -254,6 +254,21 @@ func TestExtractResourceListFromReading(t *testing.T) {
 			expectError: `programmer mistake: the DynamicData items must have Resource type runtime.Object. ` +
 				`This item (0) has Resource type *api.DiscoveryData`,
 		},
+		{
+			name: "deleted item with wrong resource type is skipped",
+			reading: &api.DataReading{
+				DataGatherer: "ark/namespaces",
+				Data: &api.DynamicData{
+					Items: []*api.GatheredResource{
+						{
+							DeletedAt: api.Time{Time: time.Now()},
+							Resource:  &api.DiscoveryData{},
+						},
+					},
+				},
+			},
+			expectedNumItems: 0,
+		},
 		{
 			name: "happy path",
 			reading: &api.DataReading{
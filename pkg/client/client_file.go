@@ -1,37 +1,355 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	"k8s.io/klog/v2"
 
 	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/cbom"
 )
 
-// FileClient writes the supplied readings to a file, in JSON format.
+// FileFormat is the format of the files written by FileClient.
+type FileFormat string
+
+const (
+	// FileFormatJSON writes the data readings as a JSON array. It is the
+	// format accepted by --input-path and by the api/reader package.
+	FileFormatJSON FileFormat = "json"
+
+	// FileFormatNDJSON writes one JSON object per line. Readings that contain
+	// Kubernetes resources are split into one line per resource so that log
+	// shippers such as Fluent Bit can forward each resource as a record. It
+	// can be read back with the api/reader package.
+	FileFormatNDJSON FileFormat = "ndjson"
+
+	// FileFormatCycloneDX writes a CycloneDX cryptographic bill of materials
+	// of the certificates found in the data readings. See the cbom package.
+	FileFormatCycloneDX FileFormat = "cyclonedx"
+)
+
+// timestampLayout is used in the names of the timestamped files. It sorts
+// lexicographically and doesn't contain colons, which aren't allowed in file
+// names on some platforms.
+const timestampLayout = "20060102T150405Z"
+
+// FileOptions controls how FileClient writes the data readings. The zero value
+// writes all the readings to a single JSON file that is overwritten on each
+// run.
+type FileOptions struct {
+	// Format defaults to FileFormatJSON.
+	Format FileFormat
+
+	// Gzip compresses the files. The ".gz" extension is added to the file
+	// names if not already present.
+	Gzip bool
+
+	// Timestamped adds the time of the run to the file names so that each run
+	// writes new files instead of overwriting the previous ones. For example,
+	// the path /out/readings.json becomes /out/readings-20240601T120000Z.json.
+	Timestamped bool
+
+	// PerGatherer writes one file per data gatherer, with the name of the data
+	// gatherer added to the file name, e.g. /out/readings-k8s-secrets.json.
+	PerGatherer bool
+
+	// MaxFiles is the number of runs to keep when Timestamped is set; the
+	// files of the older runs are removed. With PerGatherer, the files written
+	// in the same run count as one. Zero means no limit.
+	MaxFiles int
+
+	// MaxAge removes the files of the runs older than MaxAge when Timestamped
+	// is set. Zero means no limit.
+	MaxAge time.Duration
+}
+
+// FileClient writes the supplied readings to files. Each file is written to a
+// temporary file first and then renamed so that readers never see a partially
+// written file.
 type FileClient struct {
 	path string
+	opts FileOptions
+
+	// now is used for testing purposes.
+	now func() time.Time
 }
 
+// NewFileClient returns a client that writes the data readings to a single
+// JSON file, overwriting it on each run.
 func NewFileClient(path string) Client {
+	return NewFileClientWithOptions(path, FileOptions{})
+}
+
+// NewFileClientWithOptions returns a client that writes the data readings to
+// the given path using the given options. When Timestamped or PerGatherer is
+// set, the path is used as a template for the file names.
+func NewFileClientWithOptions(path string, opts FileOptions) Client {
+	if opts.Format == "" {
+		opts.Format = FileFormatJSON
+	}
 	return &FileClient{
 		path: path,
+		opts: opts,
+		now:  time.Now,
 	}
 }
 
-func (o *FileClient) PostDataReadingsWithOptions(ctx context.Context, readings []*api.DataReading, _ Options) error {
+func (o *FileClient) PostDataReadingsWithOptions(ctx context.Context, readings []*api.DataReading, opts Options) error {
 	log := klog.FromContext(ctx)
-	data, err := json.MarshalIndent(readings, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %s", err)
+	now := o.now().UTC()
+
+	files := map[string][]*api.DataReading{}
+	if o.opts.PerGatherer {
+		for _, reading := range readings {
+			name := o.fileName(now, reading.DataGatherer)
+			files[name] = append(files[name], reading)
+		}
+	} else {
+		files[o.fileName(now, "")] = readings
 	}
-	err = os.WriteFile(o.path, data, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write file: %s", err)
+
+	// Sorted so that the files are always written in the same order.
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		data, err := o.encode(files[name], opts, now)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(name, data); err != nil {
+			return fmt.Errorf("failed to write file: %s", err)
+		}
+		log.Info("Data saved to local file", "outputPath", name)
+	}
+
+	if o.opts.Timestamped && (o.opts.MaxFiles > 0 || o.opts.MaxAge > 0) {
+		removed, err := o.removeOldFiles(now)
+		if err != nil {
+			return fmt.Errorf("while removing old files: %s", err)
+		}
+		for _, name := range removed {
+			log.V(2).Info("Removed old local file", "path", name)
+		}
+	}
+	return nil
+}
+
+// fileName returns the name of the file to write for the given run and data
+// gatherer. The data gatherer is ignored unless PerGatherer is set.
+func (o *FileClient) fileName(now time.Time, gatherer string) string {
+	dir, stem, ext := o.splitPath()
+	name := stem
+	if o.opts.Timestamped {
+		name += "-" + now.Format(timestampLayout)
+	}
+	if o.opts.PerGatherer {
+		name += "-" + sanitizeFileName(gatherer)
+	}
+	return filepath.Join(dir, name+ext)
+}
+
+// splitPath splits the configured path into the directory, the file name
+// without extension, and the extension, including the ".gz" suffix when Gzip
+// is set.
+func (o *FileClient) splitPath() (dir, stem, ext string) {
+	dir, base := filepath.Split(o.path)
+	base = strings.TrimSuffix(base, ".gz")
+	ext = filepath.Ext(base)
+	stem = strings.TrimSuffix(base, ext)
+	if o.opts.Gzip {
+		ext += ".gz"
+	}
+	return dir, stem, ext
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sanitizeFileName turns a data gatherer name such as "k8s/secrets" into
+// something that can be used in a file name, such as "k8s-secrets".
+func sanitizeFileName(s string) string {
+	return strings.Trim(unsafeFileNameChars.ReplaceAllString(s, "-"), "-")
+}
+
+func (o *FileClient) encode(readings []*api.DataReading, opts Options, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if o.opts.Gzip {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+
+	switch o.opts.Format {
+	case FileFormatNDJSON:
+		if err := writeNDJSON(w, readings); err != nil {
+			return nil, err
+		}
+	case FileFormatCycloneDX:
+		bom, err := cbom.FromDataReadings(readings, cbom.Options{ClusterName: clusterNameFromOptions(opts), Now: now})
+		if err != nil {
+			return nil, fmt.Errorf("while building the CBOM: %s", err)
+		}
+		data, err := json.MarshalIndent(bom, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal JSON: %s", err)
+		}
+		_, _ = w.Write(data)
+	default:
+		data, err := json.MarshalIndent(readings, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal JSON: %s", err)
+		}
+		_, _ = w.Write(data)
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return nil, fmt.Errorf("while compressing: %s", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// ndjsonLine is a line written in the NDJSON format. Exactly one of Item and
+// Data is set: Item is set for each resource of the readings that contain
+// Kubernetes resources, and Data is set for the other readings.
+type ndjsonLine struct {
+	ClusterID     string          `json:"cluster_id,omitempty"`
+	DataGatherer  string          `json:"data-gatherer"`
+	Timestamp     api.Time        `json:"timestamp"`
+	DataType      api.DataType    `json:"data_type,omitempty"`
+	SchemaVersion string          `json:"schema_version"`
+	Item          json.RawMessage `json:"item,omitempty"`
+	Data          json.RawMessage `json:"data,omitempty"`
+}
+
+// writeNDJSON writes the readings one line per resource. The readings may have
+// been converted to any schema version, so the resources are found by looking
+// for the "items" array in the JSON representation of the data rather than by
+// looking at the Go type.
+func writeNDJSON(w io.Writer, readings []*api.DataReading) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, reading := range readings {
+		data, err := json.Marshal(reading.Data)
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %s", err)
+		}
+		line := ndjsonLine{
+			ClusterID:     reading.ClusterID,
+			DataGatherer:  reading.DataGatherer,
+			Timestamp:     reading.Timestamp,
+			DataType:      reading.DataType,
+			SchemaVersion: reading.SchemaVersion,
+		}
+
+		var withItems struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		if json.Unmarshal(data, &withItems) != nil || withItems.Items == nil {
+			line.Data = data
+			if err := enc.Encode(line); err != nil {
+				return fmt.Errorf("failed to marshal JSON: %s", err)
+			}
+			continue
+		}
+		for _, item := range withItems.Items {
+			line.Item = item
+			if err := enc.Encode(line); err != nil {
+				return fmt.Errorf("failed to marshal JSON: %s", err)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// writeFileAtomic writes the data to a hidden temporary file in the same
+// directory and renames it to the given name. The temporary file is hidden so
+// that globs such as "*.json" used by log shippers don't match it.
+func writeFileAtomic(name string, data []byte) error {
+	dir, base := filepath.Split(name)
+	tmp := filepath.Join(dir, "."+base+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return err
 	}
-	log.Info("Data saved to local file", "outputPath", o.path)
 	return nil
 }
+
+// removeOldFiles removes the timestamped files of the runs that are beyond
+// MaxFiles or older than MaxAge. The files that don't match the file name
+// template are left alone. Returns the names of the removed files.
+func (o *FileClient) removeOldFiles(now time.Time) ([]string, error) {
+	dir, stem, ext := o.splitPath()
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := stem + "-"
+	runs := map[time.Time][]string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		if len(rest) < len(timestampLayout) {
+			continue
+		}
+		ts, err := time.Parse(timestampLayout, rest[:len(timestampLayout)])
+		if err != nil {
+			continue
+		}
+		runs[ts] = append(runs[ts], filepath.Join(dir, name))
+	}
+
+	timestamps := make([]time.Time, 0, len(runs))
+	for ts := range runs {
+		timestamps = append(timestamps, ts)
+	}
+	// Newest first.
+	slices.SortFunc(timestamps, func(a, b time.Time) int { return b.Compare(a) })
+
+	var removed []string
+	for i, ts := range timestamps {
+		tooMany := o.opts.MaxFiles > 0 && i >= o.opts.MaxFiles
+		tooOld := o.opts.MaxAge > 0 && now.Sub(ts) > o.opts.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		// Never remove the files that were just written.
+		if ts.Equal(now.Truncate(time.Second)) {
+			continue
+		}
+		for _, name := range runs[ts] {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+			removed = append(removed, name)
+		}
+	}
+	return removed, nil
+}
@@ -1,17 +1,24 @@
 package client
 
 import (
+	"bufio"
+	"compress/gzip"
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/ktesting"
 
 	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/api/reader"
+	"github.com/jetstack/preflight/pkg/cbom"
 )
 
 func TestFileClient_PostDataReadingsWithOptions(t *testing.T) {
@@ -50,7 +57,7 @@ func TestFileClient_PostDataReadingsWithOptions(t *testing.T) {
 			name:          "no-such-file-or-directory",
 			path:          "{tmp}/no-such-folder/data.json",
 			readings:      []*api.DataReading{},
-			expectedError: "failed to write file: open {tmp}/no-such-folder/data.json: no such file or directory",
+			expectedError: "failed to write file: open {tmp}/no-such-folder/.data.json.tmp: no such file or directory",
 			expectedJSON:  "[]",
 		},
 	}
@@ -80,3 +87,132 @@ func TestFileClient_PostDataReadingsWithOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestFileClient_Options(t *testing.T) {
+	readings := []*api.DataReading{
+		{
+			DataGatherer:  "k8s/discovery",
+			Data:          &api.DiscoveryData{ClusterID: "cluster-uid"},
+			SchemaVersion: "v2.0.0",
+		},
+		{
+			DataGatherer: "k8s/secrets",
+			Data: &api.DynamicData{Items: []*api.GatheredResource{
+				{Resource: &unstructured.Unstructured{Object: map[string]any{"apiVersion": "v1", "kind": "Secret", "metadata": map[string]any{"name": "s1"}}}},
+				{Resource: &unstructured.Unstructured{Object: map[string]any{"apiVersion": "v1", "kind": "Secret", "metadata": map[string]any{"name": "s2"}}}},
+			}},
+			SchemaVersion: "v2.0.0",
+		},
+	}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	newClient := func(path string, opts FileOptions) *FileClient {
+		c := NewFileClientWithOptions(path, opts).(*FileClient)
+		c.now = func() time.Time { return now }
+		return c
+	}
+
+	t.Run("timestamped and per-gatherer", func(t *testing.T) {
+		ctx := klog.NewContext(t.Context(), ktesting.NewLogger(t, ktesting.DefaultConfig))
+		dir := t.TempDir()
+		c := newClient(dir+"/readings.json", FileOptions{Timestamped: true, PerGatherer: true})
+		require.NoError(t, c.PostDataReadingsWithOptions(ctx, readings, Options{}))
+
+		assert.Equal(t, []string{
+			"readings-20240601T120000Z-k8s-discovery.json",
+			"readings-20240601T120000Z-k8s-secrets.json",
+		}, dirNames(t, dir))
+
+		got, err := reader.ReadFile(dir + "/readings-20240601T120000Z-k8s-secrets.json")
+		require.NoError(t, err)
+		require.Len(t, got, 1)
+		assert.Equal(t, "k8s/secrets", got[0].DataGatherer)
+	})
+
+	t.Run("gzip and ndjson", func(t *testing.T) {
+		ctx := klog.NewContext(t.Context(), ktesting.NewLogger(t, ktesting.DefaultConfig))
+		dir := t.TempDir()
+		c := newClient(dir+"/readings.ndjson", FileOptions{Format: FileFormatNDJSON, Gzip: true})
+		require.NoError(t, c.PostDataReadingsWithOptions(ctx, readings, Options{}))
+		assert.Equal(t, []string{"readings.ndjson.gz"}, dirNames(t, dir))
+
+		f, err := os.Open(dir + "/readings.ndjson.gz")
+		require.NoError(t, err)
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		require.NoError(t, err)
+
+		var lines []string
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		require.NoError(t, scanner.Err())
+		require.Len(t, lines, 3)
+		assert.JSONEq(t, `{"data-gatherer":"k8s/discovery","timestamp":"0001-01-01T00:00:00Z","schema_version":"v2.0.0","data":{"cluster_id":"cluster-uid","server_version":null}}`, lines[0])
+		assert.JSONEq(t, `{"data-gatherer":"k8s/secrets","timestamp":"0001-01-01T00:00:00Z","schema_version":"v2.0.0","item":{"resource":{"apiVersion":"v1","kind":"Secret","metadata":{"name":"s1"}}}}`, lines[1])
+		assert.JSONEq(t, `{"data-gatherer":"k8s/secrets","timestamp":"0001-01-01T00:00:00Z","schema_version":"v2.0.0","item":{"resource":{"apiVersion":"v1","kind":"Secret","metadata":{"name":"s2"}}}}`, lines[2])
+
+		// The lines of the resources are grouped back into data readings.
+		got, err := reader.ReadFile(dir + "/readings.ndjson.gz")
+		require.NoError(t, err)
+		require.Len(t, got, 2)
+		assert.IsType(t, &api.DiscoveryData{}, got[0].Data)
+		objects, err := reader.Objects(got[1])
+		require.NoError(t, err)
+		assert.Len(t, objects, 2)
+	})
+
+	t.Run("cyclonedx", func(t *testing.T) {
+		ctx := klog.NewContext(t.Context(), ktesting.NewLogger(t, ktesting.DefaultConfig))
+		dir := t.TempDir()
+		c := newClient(dir+"/cbom.json", FileOptions{Format: FileFormatCycloneDX})
+		require.NoError(t, c.PostDataReadingsWithOptions(ctx, readings, Options{ClusterName: "my-cluster"}))
+
+		data, err := os.ReadFile(dir + "/cbom.json")
+		require.NoError(t, err)
+		var bom cbom.BOM
+		require.NoError(t, json.Unmarshal(data, &bom))
+		assert.Equal(t, "CycloneDX", bom.BOMFormat)
+		assert.Equal(t, "my-cluster", bom.Metadata.Component.Name)
+		assert.Equal(t, "2024-06-01T12:00:00Z", bom.Metadata.Timestamp)
+		assert.Empty(t, bom.Components)
+	})
+
+	t.Run("retention by count and age", func(t *testing.T) {
+		ctx := klog.NewContext(t.Context(), ktesting.NewLogger(t, ktesting.DefaultConfig))
+		dir := t.TempDir()
+		for _, name := range []string{
+			"readings-20240601T080000Z.json", // Too old.
+			"readings-20240601T100000Z.json", // Beyond the max number of files.
+			"readings-20240601T110000Z.json",
+			"readings-20240601T113000Z.json",
+			"readings-latest.json", // Doesn't match the template.
+			"other-20240601T080000Z.json",
+		} {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("[]"), 0644))
+		}
+
+		c := newClient(dir+"/readings.json", FileOptions{Timestamped: true, MaxFiles: 3, MaxAge: 3 * time.Hour})
+		require.NoError(t, c.PostDataReadingsWithOptions(ctx, readings, Options{}))
+
+		assert.Equal(t, []string{
+			"other-20240601T080000Z.json",
+			"readings-20240601T110000Z.json",
+			"readings-20240601T113000Z.json",
+			"readings-20240601T120000Z.json",
+			"readings-latest.json",
+		}, dirNames(t, dir))
+	})
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
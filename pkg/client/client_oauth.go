@@ -111,7 +111,7 @@ func (c *OAuthClient) PostDataReadingsWithOptions(ctx context.Context, readings
 // viewing in the user-interface.
 func (c *OAuthClient) postDataReadings(ctx context.Context, orgID, clusterID string, readings []*api.DataReading) error {
 	payload := api.DataReadingsPost{
-		AgentMetadata:  c.agentMetadata,
+		AgentMetadata:  agentMetadataForCluster(c.agentMetadata, clusterID),
 		DataGatherTime: time.Now().UTC(),
 		DataReadings:   readings,
 	}
@@ -0,0 +1,237 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/transport"
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/version"
+)
+
+// DefaultS3KeyTemplate is the object key used when S3Options.KeyTemplate is
+// empty.
+const DefaultS3KeyTemplate = "{cluster}/{date}/{time}.json.gz"
+
+// S3Options configures the S3Client. Bucket and Region are required.
+type S3Options struct {
+	Bucket string
+	Region string
+
+	// Endpoint is the base URL of the S3-compatible API, e.g.
+	// https://minio.example.com:9000. Defaults to the AWS S3 endpoint of the
+	// region.
+	Endpoint string
+
+	// PathStyle puts the bucket in the path (https://host/bucket/key) instead
+	// of the host name (https://bucket.host/key). Most S3-compatible servers,
+	// such as MinIO, need it.
+	PathStyle bool
+
+	// KeyTemplate is the object key. The placeholders {cluster}, {date}
+	// (2006-01-02), {time} (150405), and {timestamp} (20060102T150405Z) are
+	// replaced on each upload; times are in UTC. The object is gzipped when
+	// the key ends with ".gz". Defaults to DefaultS3KeyTemplate.
+	KeyTemplate string
+
+	// ServerSideEncryption is either empty, "AES256", or "aws:kms".
+	ServerSideEncryption string
+
+	// SSEKMSKeyID is the KMS key used when ServerSideEncryption is "aws:kms".
+	// The bucket's default key is used when empty.
+	SSEKMSKeyID string
+
+	// CredentialsSource tells where to find the credentials. See the
+	// S3CredentialsSource constants.
+	CredentialsSource S3CredentialsSource
+
+	// CredentialsFile and Profile are used with S3CredentialsFile. They
+	// default to AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials, and to
+	// AWS_PROFILE or "default".
+	CredentialsFile string
+	Profile         string
+
+	// STSEndpoint is used with S3CredentialsWebIdentity. Defaults to the
+	// regional AWS STS endpoint.
+	STSEndpoint string
+
+	// Payload defaults to PayloadDataReadings.
+	Payload PayloadFormat
+}
+
+// The S3Client type is a Client implementation that writes the data readings,
+// as an api.DataReadingsPost, to an object in an S3-compatible bucket. The
+// requests are signed with AWS Signature Version 4.
+type S3Client struct {
+	agentMetadata *api.AgentMetadata
+	opts          S3Options
+	endpoint      *url.URL
+	credentials   s3CredentialsProvider
+	client        *http.Client
+
+	// now is used for testing purposes.
+	now func() time.Time
+}
+
+var s3KeyPlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+var s3KeyPlaceholders = []string{"{cluster}", "{date}", "{time}", "{timestamp}"}
+
+// NewS3Client returns a client that uploads the data readings to the bucket
+// configured in the options. Does not do any network call.
+func NewS3Client(agentMetadata *api.AgentMetadata, opts S3Options) (*S3Client, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("cannot create S3Client: the bucket cannot be empty")
+	}
+	if opts.Region == "" {
+		return nil, fmt.Errorf("cannot create S3Client: the region cannot be empty")
+	}
+	if opts.KeyTemplate == "" {
+		opts.KeyTemplate = DefaultS3KeyTemplate
+	}
+	for _, placeholder := range s3KeyPlaceholder.FindAllString(opts.KeyTemplate, -1) {
+		if !slices.Contains(s3KeyPlaceholders, placeholder) {
+			return nil, fmt.Errorf("cannot create S3Client: unknown placeholder %s in the key template, supported placeholders are: %s", placeholder, strings.Join(s3KeyPlaceholders, ", "))
+		}
+	}
+	switch opts.ServerSideEncryption {
+	case "", "AES256", "aws:kms":
+	default:
+		return nil, fmt.Errorf("cannot create S3Client: server-side encryption %q is not supported, supported values are: AES256, aws:kms", opts.ServerSideEncryption)
+	}
+	if opts.SSEKMSKeyID != "" && opts.ServerSideEncryption != "aws:kms" {
+		return nil, fmt.Errorf("cannot create S3Client: the KMS key ID can only be used with the aws:kms server-side encryption")
+	}
+
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", opts.Region)
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Hostname() == "" {
+		return nil, fmt.Errorf("cannot create S3Client: the endpoint %q is not a valid URL", endpoint)
+	}
+
+	httpClient := &http.Client{
+		Timeout:   time.Minute,
+		Transport: transport.DebugWrappers(http.DefaultTransport),
+	}
+	creds, err := newS3CredentialsProvider(opts, httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create S3Client: %w", err)
+	}
+
+	return &S3Client{
+		agentMetadata: agentMetadata,
+		opts:          opts,
+		endpoint:      endpointURL,
+		credentials:   creds,
+		client:        httpClient,
+		now:           time.Now,
+	}, nil
+}
+
+// PostDataReadingsWithOptions uploads the data readings to a new object. The
+// {cluster} placeholder is replaced with opts.ClusterName, or opts.ClusterID
+// when the cluster name is empty.
+func (c *S3Client) PostDataReadingsWithOptions(ctx context.Context, readings []*api.DataReading, opts Options) error {
+	now := c.now().UTC()
+
+	cluster := clusterNameFromOptions(opts)
+	if cluster == "" && strings.Contains(c.opts.KeyTemplate, "{cluster}") {
+		return fmt.Errorf("programmer mistake: the cluster name or cluster ID cannot be left empty when the key template contains {cluster}")
+	}
+	key := strings.NewReplacer(
+		"{cluster}", cluster,
+		"{date}", now.Format("2006-01-02"),
+		"{time}", now.Format("150405"),
+		"{timestamp}", now.Format(amzDateLayout),
+	).Replace(c.opts.KeyTemplate)
+
+	data, contentType, err := encodePayload(c.opts.Payload, c.agentMetadata, readings, opts, now)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(key, ".gz") {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, _ = gz.Write(data)
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("while compressing: %s", err)
+		}
+		data = buf.Bytes()
+		contentType = "application/gzip"
+	}
+
+	objectURL := *c.endpoint
+	objectPath := "/" + key
+	if c.opts.PathStyle {
+		objectPath = "/" + c.opts.Bucket + objectPath
+	} else {
+		objectURL.Host = c.opts.Bucket + "." + objectURL.Host
+	}
+	objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + objectPath
+	objectURL.RawPath = awsURIEncode(objectURL.Path, false)
+
+	klog.FromContext(ctx).V(2).Info(
+		"uploading data readings",
+		"url", objectURL.String(),
+		"data_readings_count", len(readings),
+		"data_size_bytes", len(data),
+	)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	checksum := sha256.Sum256(data)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(checksum[:]))
+	req.Header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(checksum[:]))
+	if c.opts.ServerSideEncryption != "" {
+		req.Header.Set("X-Amz-Server-Side-Encryption", c.opts.ServerSideEncryption)
+	}
+	if c.opts.SSEKMSKeyID != "" {
+		req.Header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", c.opts.SSEKMSKeyID)
+	}
+	version.SetUserAgent(req)
+
+	creds, err := c.credentials.retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("while retrieving the AWS credentials: %w", err)
+	}
+	if err := signV4(req, creds, c.opts.Region, "s3", now); err != nil {
+		return err
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if code := res.StatusCode; code < 200 || code >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 500))
+		if len(body) == 0 {
+			body = []byte(`<empty body>`)
+		}
+		return fmt.Errorf("received response with status code %d: %s", code, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
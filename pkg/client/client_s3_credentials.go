@@ -0,0 +1,268 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jetstack/preflight/pkg/version"
+)
+
+// S3CredentialsSource tells the S3Client where to find the AWS credentials.
+type S3CredentialsSource string
+
+const (
+	// S3CredentialsAuto uses the first source that is configured, in this
+	// order: environment variables, web identity, credentials file.
+	S3CredentialsAuto S3CredentialsSource = ""
+
+	// S3CredentialsEnv reads AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+	// the optional AWS_SESSION_TOKEN.
+	S3CredentialsEnv S3CredentialsSource = "env"
+
+	// S3CredentialsFile reads a shared credentials file, i.e., the INI file
+	// usually found at ~/.aws/credentials.
+	S3CredentialsFile S3CredentialsSource = "file"
+
+	// S3CredentialsWebIdentity exchanges the token found in the file
+	// AWS_WEB_IDENTITY_TOKEN_FILE for temporary credentials for the role
+	// AWS_ROLE_ARN, which is how IAM Roles for Service Accounts (IRSA) works.
+	S3CredentialsWebIdentity S3CredentialsSource = "web-identity"
+)
+
+type s3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+type s3CredentialsProvider interface {
+	retrieve(ctx context.Context) (s3Credentials, error)
+}
+
+// newS3CredentialsProvider returns the provider for the given source. The
+// environment variables are looked up when the provider is created, but the
+// credentials themselves are read on each call to retrieve so that rotated
+// credentials are picked up.
+func newS3CredentialsProvider(opts S3Options, httpClient *http.Client) (s3CredentialsProvider, error) {
+	source := opts.CredentialsSource
+	if source == S3CredentialsAuto {
+		switch {
+		case os.Getenv("AWS_ACCESS_KEY_ID") != "":
+			source = S3CredentialsEnv
+		case os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "":
+			source = S3CredentialsWebIdentity
+		default:
+			source = S3CredentialsFile
+		}
+	}
+
+	switch source {
+	case S3CredentialsEnv:
+		return envS3Credentials{}, nil
+	case S3CredentialsFile:
+		path := opts.CredentialsFile
+		if path == "" {
+			path = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+		}
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("while looking for the AWS credentials file: %w", err)
+			}
+			path = filepath.Join(home, ".aws", "credentials")
+		}
+		profile := opts.Profile
+		if profile == "" {
+			profile = os.Getenv("AWS_PROFILE")
+		}
+		if profile == "" {
+			profile = "default"
+		}
+		return fileS3Credentials{path: path, profile: profile}, nil
+	case S3CredentialsWebIdentity:
+		p := &webIdentityS3Credentials{
+			roleARN:     os.Getenv("AWS_ROLE_ARN"),
+			tokenFile:   os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"),
+			sessionName: os.Getenv("AWS_ROLE_SESSION_NAME"),
+			stsEndpoint: opts.STSEndpoint,
+			httpClient:  httpClient,
+			now:         time.Now,
+		}
+		if p.roleARN == "" || p.tokenFile == "" {
+			return nil, fmt.Errorf("the AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE environment variables must be set to use web identity credentials")
+		}
+		if p.sessionName == "" {
+			p.sessionName = "venafi-kubernetes-agent"
+		}
+		if p.stsEndpoint == "" {
+			p.stsEndpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", opts.Region)
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown credentials source %q, supported sources are: %s, %s, %s", source, S3CredentialsEnv, S3CredentialsFile, S3CredentialsWebIdentity)
+	}
+}
+
+type envS3Credentials struct{}
+
+func (envS3Credentials) retrieve(context.Context) (s3Credentials, error) {
+	creds := s3Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return s3Credentials{}, fmt.Errorf("the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables must be set")
+	}
+	return creds, nil
+}
+
+type fileS3Credentials struct {
+	path    string
+	profile string
+}
+
+func (f fileS3Credentials) retrieve(context.Context) (s3Credentials, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("while reading the AWS credentials file: %w", err)
+	}
+
+	var creds s3Credentials
+	found := false
+	inProfile := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == f.profile
+			found = found || inProfile
+			continue
+		}
+		if !inProfile {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return s3Credentials{}, fmt.Errorf("while reading the AWS credentials file: %w", err)
+	}
+	if !found {
+		return s3Credentials{}, fmt.Errorf("profile %q not found in the AWS credentials file %s", f.profile, f.path)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return s3Credentials{}, fmt.Errorf("profile %q in the AWS credentials file %s must contain aws_access_key_id and aws_secret_access_key", f.profile, f.path)
+	}
+	return creds, nil
+}
+
+// webIdentityS3Credentials calls the STS AssumeRoleWithWebIdentity API and
+// caches the temporary credentials until shortly before they expire.
+type webIdentityS3Credentials struct {
+	roleARN     string
+	tokenFile   string
+	sessionName string
+	stsEndpoint string
+	httpClient  *http.Client
+
+	// now is used for testing purposes.
+	now func() time.Time
+
+	mu      sync.Mutex
+	cached  s3Credentials
+	expires time.Time
+}
+
+// webIdentityRefreshMargin is how long before their expiry the cached
+// credentials are refreshed.
+const webIdentityRefreshMargin = 5 * time.Minute
+
+func (w *webIdentityS3Credentials) retrieve(ctx context.Context) (s3Credentials, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cached.AccessKeyID != "" && w.now().Add(webIdentityRefreshMargin).Before(w.expires) {
+		return w.cached, nil
+	}
+
+	token, err := readSecretFile(w.tokenFile)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("while reading the web identity token: %w", err)
+	}
+
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", w.roleARN)
+	form.Set("RoleSessionName", w.sessionName)
+	form.Set("WebIdentityToken", string(token))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.stsEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	version.SetUserAgent(req)
+
+	res, err := w.httpClient.Do(req)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("while calling AssumeRoleWithWebIdentity: %w", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("while calling AssumeRoleWithWebIdentity: %w", err)
+	}
+	if code := res.StatusCode; code < 200 || code >= 300 {
+		return s3Credentials{}, fmt.Errorf("while calling AssumeRoleWithWebIdentity: received response with status code %d. Body: [%s]", code, bytes.TrimSpace(body))
+	}
+
+	var parsed struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &parsed); err != nil {
+		return s3Credentials{}, fmt.Errorf("while parsing the AssumeRoleWithWebIdentity response: %w", err)
+	}
+	if parsed.Credentials.AccessKeyID == "" {
+		return s3Credentials{}, fmt.Errorf("while parsing the AssumeRoleWithWebIdentity response: no credentials found")
+	}
+
+	w.cached = s3Credentials{
+		AccessKeyID:     parsed.Credentials.AccessKeyID,
+		SecretAccessKey: parsed.Credentials.SecretAccessKey,
+		SessionToken:    parsed.Credentials.SessionToken,
+	}
+	w.expires = parsed.Credentials.Expiration
+	return w.cached, nil
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"k8s.io/client-go/transport"
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/version"
+	"github.com/jetstack/preflight/pkg/webhooksig"
+)
+
+// WebhookOptions configures the WebhookClient. Only URL is required.
+type WebhookOptions struct {
+	// URL is the URL to which the data readings are POSTed.
+	URL string
+
+	// Headers are added to each request.
+	Headers map[string]string
+
+	// BearerTokenFile is the path to a file containing a token sent in the
+	// Authorization header. The file is read on each request so that rotated
+	// tokens, such as projected service account tokens, are picked up.
+	BearerTokenFile string
+
+	// ClientCertFile and ClientKeyFile are the paths to a PEM-encoded client
+	// certificate and private key used for mTLS. Both must be set together.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// HMACSecretFile is the path to a file containing the secret used to sign
+	// the requests. The file is read on each request. See webhooksig.Sign.
+	HMACSecretFile string
+
+	// RootCAFile is the path to a PEM bundle of the root CAs trusted for the
+	// webhook's server certificate. The system roots are used when empty.
+	RootCAFile string
+
+	// Payload defaults to PayloadDataReadings.
+	Payload PayloadFormat
+}
+
+// The WebhookClient type is a Client implementation used to POST the data
+// readings to a user-provided HTTP endpoint.
+type WebhookClient struct {
+	agentMetadata *api.AgentMetadata
+	opts          WebhookOptions
+	client        *http.Client
+
+	// now is used for testing purposes.
+	now func() time.Time
+}
+
+// NewWebhookClient returns a client that POSTs the data readings, by default as
+// an api.DataReadingsPost, to the URL configured in the options. The client
+// certificate and the root CAs are loaded once when the client is created.
+func NewWebhookClient(agentMetadata *api.AgentMetadata, opts WebhookOptions) (*WebhookClient, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("cannot create WebhookClient: the URL cannot be empty")
+	}
+	if (opts.ClientCertFile == "") != (opts.ClientKeyFile == "") {
+		return nil, fmt.Errorf("cannot create WebhookClient: the client certificate and the client key must be provided together")
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.RootCAFile != "" {
+		pemData, err := os.ReadFile(opts.RootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("while reading the root CAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("while reading the root CAs: no PEM-encoded certificate found in %s", opts.RootCAFile)
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}
+	if opts.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("while loading the client certificate: %w", err)
+		}
+		tr.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &WebhookClient{
+		agentMetadata: agentMetadata,
+		opts:          opts,
+		client: &http.Client{
+			Timeout:   time.Minute,
+			Transport: transport.DebugWrappers(tr),
+		},
+		now: time.Now,
+	}, nil
+}
+
+// PostDataReadingsWithOptions POSTs the data readings to the webhook. The
+// Options are only used for the cluster name of the CycloneDX payload.
+func (c *WebhookClient) PostDataReadingsWithOptions(ctx context.Context, readings []*api.DataReading, opts Options) error {
+	data, contentType, err := encodePayload(c.opts.Payload, c.agentMetadata, readings, opts, c.now().UTC())
+	if err != nil {
+		return err
+	}
+
+	klog.FromContext(ctx).V(2).Info(
+		"uploading data readings",
+		"url", c.opts.URL,
+		"data_readings_count", len(readings),
+		"data_size_bytes", len(data),
+	)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.opts.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range c.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", contentType)
+	version.SetUserAgent(req)
+
+	if c.opts.BearerTokenFile != "" {
+		token, err := readSecretFile(c.opts.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("while reading the bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	if c.opts.HMACSecretFile != "" {
+		secret, err := readSecretFile(c.opts.HMACSecretFile)
+		if err != nil {
+			return fmt.Errorf("while reading the HMAC secret: %w", err)
+		}
+		timestamp := strconv.FormatInt(c.now().Unix(), 10)
+		req.Header.Set(webhooksig.TimestampHeader, timestamp)
+		req.Header.Set(webhooksig.SignatureHeader, webhooksig.Sign(secret, timestamp, data))
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if code := res.StatusCode; code < 200 || code >= 300 {
+		errorContent := ""
+		body, err := io.ReadAll(res.Body)
+		if err == nil {
+			errorContent = string(body)
+		}
+
+		return fmt.Errorf("received response with status code %d. Body: [%s]", code, errorContent)
+	}
+
+	return nil
+}
+
+// readSecretFile reads a token or a secret from a file, ignoring the trailing
+// newline that editors and `kubectl create secret --from-file` often leave.
+func readSecretFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\r\n")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return data, nil
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/testutil/testcert"
+	"github.com/jetstack/preflight/pkg/webhooksig"
+)
+
+func TestWebhookClient_PostDataReadingsWithOptions(t *testing.T) {
+	log := ktesting.NewLogger(t, ktesting.DefaultConfig)
+	ctx := klog.NewContext(t.Context(), log)
+	dir := t.TempDir()
+
+	clientCertFile, clientKeyFile, clientCAPool := writeClientCert(t, dir)
+	tokenFile := writeFile(t, dir, "token", "token-1\n")
+	secretFile := writeFile(t, dir, "secret", "hmac-secret")
+
+	var gotReq *http.Request
+	var gotBody []byte
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotReq = r
+		gotBody, _ = io.ReadAll(r.Body)
+		if err := webhooksig.Verify([]byte("hmac-secret"), r.Header, gotBody, time.Now(), time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAPool}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	rootCAFile := writeFile(t, dir, "ca.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+
+	opts := WebhookOptions{
+		URL:             srv.URL + "/readings",
+		Headers:         map[string]string{"X-Tenant": "team-a"},
+		BearerTokenFile: tokenFile,
+		ClientCertFile:  clientCertFile,
+		ClientKeyFile:   clientKeyFile,
+		HMACSecretFile:  secretFile,
+		RootCAFile:      rootCAFile,
+	}
+
+	t.Run("success", func(t *testing.T) {
+		c, err := NewWebhookClient(&api.AgentMetadata{Version: "test"}, opts)
+		require.NoError(t, err)
+
+		err = c.PostDataReadingsWithOptions(ctx, []*api.DataReading{{DataGatherer: "dummy", Data: &api.DiscoveryData{ClusterID: "uid"}}}, Options{})
+		require.NoError(t, err)
+
+		assert.Equal(t, "/readings", gotReq.URL.Path)
+		assert.Equal(t, "Bearer token-1", gotReq.Header.Get("Authorization"))
+		assert.Equal(t, "team-a", gotReq.Header.Get("X-Tenant"))
+		assert.Equal(t, "application/json", gotReq.Header.Get("Content-Type"))
+
+		var payload api.DataReadingsPost
+		require.NoError(t, json.Unmarshal(gotBody, &payload))
+		require.Len(t, payload.DataReadings, 1)
+		assert.Equal(t, "dummy", payload.DataReadings[0].DataGatherer)
+	})
+
+	t.Run("the agent metadata has the cluster ID of the upload", func(t *testing.T) {
+		c, err := NewWebhookClient(&api.AgentMetadata{Version: "test", ClusterID: "management"}, opts)
+		require.NoError(t, err)
+
+		err = c.PostDataReadingsWithOptions(ctx, []*api.DataReading{{DataGatherer: "dummy", Data: &api.DiscoveryData{ClusterID: "uid"}}}, Options{ClusterID: "workload-1"})
+		require.NoError(t, err)
+
+		var payload api.DataReadingsPost
+		require.NoError(t, json.Unmarshal(gotBody, &payload))
+		assert.Equal(t, &api.AgentMetadata{Version: "test", ClusterID: "workload-1"}, payload.AgentMetadata)
+	})
+
+	t.Run("rotated bearer token is picked up", func(t *testing.T) {
+		c, err := NewWebhookClient(&api.AgentMetadata{}, opts)
+		require.NoError(t, err)
+		writeFile(t, dir, "token", "token-2")
+
+		require.NoError(t, c.PostDataReadingsWithOptions(ctx, nil, Options{}))
+		assert.Equal(t, "Bearer token-2", gotReq.Header.Get("Authorization"))
+	})
+
+	t.Run("wrong HMAC secret", func(t *testing.T) {
+		wrongOpts := opts
+		wrongOpts.HMACSecretFile = writeFile(t, dir, "wrong-secret", "wrong")
+		c, err := NewWebhookClient(&api.AgentMetadata{}, wrongOpts)
+		require.NoError(t, err)
+
+		err = c.PostDataReadingsWithOptions(ctx, nil, Options{})
+		assert.EqualError(t, err, "received response with status code 401. Body: [the signature doesn't match\n]")
+	})
+
+	t.Run("missing client certificate", func(t *testing.T) {
+		noCertOpts := opts
+		noCertOpts.ClientCertFile, noCertOpts.ClientKeyFile = "", ""
+		c, err := NewWebhookClient(&api.AgentMetadata{}, noCertOpts)
+		require.NoError(t, err)
+
+		err = c.PostDataReadingsWithOptions(ctx, nil, Options{})
+		assert.Error(t, err)
+	})
+
+	t.Run("untrusted server", func(t *testing.T) {
+		noCAOpts := opts
+		noCAOpts.RootCAFile = ""
+		c, err := NewWebhookClient(&api.AgentMetadata{}, noCAOpts)
+		require.NoError(t, err)
+
+		err = c.PostDataReadingsWithOptions(ctx, nil, Options{})
+		assert.ErrorContains(t, err, "certificate signed by unknown authority")
+	})
+}
+
+func TestNewWebhookClient_Errors(t *testing.T) {
+	_, err := NewWebhookClient(nil, WebhookOptions{})
+	assert.EqualError(t, err, "cannot create WebhookClient: the URL cannot be empty")
+
+	_, err = NewWebhookClient(nil, WebhookOptions{URL: "https://example.com", ClientCertFile: "tls.crt"})
+	assert.EqualError(t, err, "cannot create WebhookClient: the client certificate and the client key must be provided together")
+
+	caFile := writeFile(t, t.TempDir(), "ca.crt", "not a PEM")
+	_, err = NewWebhookClient(nil, WebhookOptions{URL: "https://example.com", RootCAFile: caFile})
+	assert.EqualError(t, err, "while reading the root CAs: no PEM-encoded certificate found in "+caFile)
+}
+
+// writeClientCert writes a self-signed client certificate and its key to the
+// given directory and returns their paths and a pool containing the
+// certificate.
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	cert := testcert.New(t, testcert.Options{
+		CommonName:  "agent",
+		IsCA:        true,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	pool = x509.NewCertPool()
+	pool.AddCert(cert.Certificate)
+	certFile = writeFile(t, dir, "tls.crt", string(cert.PEM()))
+	keyFile = writeFile(t, dir, "tls.key", string(cert.KeyPEM(t)))
+	return certFile, keyFile, pool
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/cbom"
+)
+
+// PayloadFormat is the format of the body sent by the WebhookClient and the
+// S3Client.
+type PayloadFormat string
+
+const (
+	// PayloadDataReadings sends an api.DataReadingsPost. It is the default.
+	PayloadDataReadings PayloadFormat = "data-readings"
+
+	// PayloadCycloneDX sends a CycloneDX cryptographic bill of materials of
+	// the certificates found in the data readings. See the cbom package.
+	PayloadCycloneDX PayloadFormat = "cyclonedx"
+)
+
+// encodePayload returns the body to send for the given format along with its
+// content type. The empty format is PayloadDataReadings.
+func encodePayload(format PayloadFormat, agentMetadata *api.AgentMetadata, readings []*api.DataReading, opts Options, now time.Time) ([]byte, string, error) {
+	switch format {
+	case "", PayloadDataReadings:
+		data, err := json.Marshal(api.DataReadingsPost{
+			AgentMetadata:  agentMetadataForCluster(agentMetadata, opts.ClusterID),
+			DataGatherTime: now,
+			DataReadings:   readings,
+		})
+		return data, "application/json", err
+	case PayloadCycloneDX:
+		bom, err := cbom.FromDataReadings(readings, cbom.Options{ClusterName: clusterNameFromOptions(opts), Now: now})
+		if err != nil {
+			return nil, "", fmt.Errorf("while building the CBOM: %w", err)
+		}
+		data, err := json.Marshal(bom)
+		return data, cbom.MediaType, err
+	default:
+		return nil, "", fmt.Errorf("programmer mistake: unknown payload format %q", format)
+	}
+}
+
+// clusterNameFromOptions returns the cluster name, or the cluster ID when the
+// cluster name is empty.
+func clusterNameFromOptions(opts Options) string {
+	if opts.ClusterName != "" {
+		return opts.ClusterName
+	}
+	return opts.ClusterID
+}
@@ -0,0 +1,229 @@
+// Package execplugin implements a data gatherer that runs an external program,
+// called a plugin, and sends the resources it writes to its standard output.
+// It lets in-house inventory sources, such as a legacy PKI or the load
+// balancers of a cloud provider, go through the same pipeline as the
+// Kubernetes resources. The contract between the agent and the plugins is
+// defined by Output and DecodeOutput.
+package execplugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/datagatherer"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+	"github.com/jetstack/preflight/pkg/logs"
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+
+	// stderrSize is the number of bytes at the end of the standard error of a
+	// plugin that are kept, and included in the logs and the error messages.
+	stderrSize = 1024
+
+	// maxStdoutSize is the maximum size of the standard output of a plugin.
+	// The plugin is killed when it writes more, so that a faulty plugin can't
+	// exhaust the memory of the agent.
+	maxStdoutSize = 64 << 20
+)
+
+// ConfigExec contains the configuration for the exec data-gatherer.
+type ConfigExec struct {
+	// Command is the path to the plugin, or its name if it is in the PATH of
+	// the agent.
+	Command string `yaml:"command"`
+	// Args are the arguments passed to the plugin.
+	Args []string `yaml:"args"`
+	// Env is the environment of the plugin. The plugin doesn't inherit the
+	// environment of the agent, which may contain credentials, except for
+	// PATH.
+	Env map[string]string `yaml:"env"`
+	// Timeout is the maximum duration of each run of the plugin. Defaults to
+	// 30s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// UnmarshalYAML unmarshals the ConfigExec.
+func (c *ConfigExec) UnmarshalYAML(unmarshal func(any) error) error {
+	aux := struct {
+		Command string            `yaml:"command"`
+		Args    []string          `yaml:"args"`
+		Env     map[string]string `yaml:"env"`
+		Timeout time.Duration     `yaml:"timeout"`
+	}{}
+	err := unmarshal(&aux)
+	if err != nil {
+		return err
+	}
+
+	c.Command = aux.Command
+	c.Args = aux.Args
+	c.Env = aux.Env
+	c.Timeout = aux.Timeout
+
+	return nil
+}
+
+// validate validates the configuration.
+func (c *ConfigExec) validate() error {
+	var errs []string
+	if c.Command == "" {
+		errs = append(errs, "invalid command: must not be empty")
+	}
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Sprintf("invalid timeout: must not be negative, got %s", c.Timeout))
+	}
+	if _, ok := c.Env[ProtocolVersionEnv]; ok {
+		errs = append(errs, fmt.Sprintf("invalid env: %s is set by the agent", ProtocolVersionEnv))
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// NewDataGatherer constructs a new instance of the exec data-gatherer.
+func (c *ConfigExec) NewDataGatherer(ctx context.Context) (datagatherer.DataGatherer, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	env := []string{ProtocolVersionEnv + "=" + ProtocolVersion}
+	if path, ok := os.LookupEnv("PATH"); ok {
+		if _, overridden := c.Env["PATH"]; !overridden {
+			env = append(env, "PATH="+path)
+		}
+	}
+	for k, v := range c.Env {
+		env = append(env, k+"="+v)
+	}
+	slices.Sort(env)
+
+	g := &DataGathererExec{
+		command:       c.Command,
+		args:          c.Args,
+		env:           env,
+		timeout:       c.Timeout,
+		maxStdoutSize: maxStdoutSize,
+	}
+	if g.timeout == 0 {
+		g.timeout = defaultTimeout
+	}
+	return g, nil
+}
+
+var errStdoutTooLong = errors.New("the output of the plugin is too long")
+
+// DataGathererExec stores the config for an exec datagatherer.
+type DataGathererExec struct {
+	command string
+	args    []string
+	env     []string
+	timeout time.Duration
+	// maxStdoutSize is a field rather than the constant so that the tests
+	// can lower it.
+	maxStdoutSize int64
+}
+
+var _ datagatherer.DataGatherer = &DataGathererExec{}
+
+func (g *DataGathererExec) Run(ctx context.Context) error {
+	// no async functionality, see Fetch
+	return nil
+}
+
+func (g *DataGathererExec) WaitForCacheSync(ctx context.Context) error {
+	// no async functionality, see Fetch
+	return nil
+}
+
+// Fetch runs the plugin and returns the resources it wrote to its standard
+// output, as api.DynamicData or api.GenericData depending on the data type
+// chosen by the plugin. An error is returned if the plugin times out, exits
+// with a non-zero status, writes more than 64 MiB, reports errors, or doesn't
+// conform to the protocol.
+func (g *DataGathererExec) Fetch(ctx context.Context) (any, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	// The standard output is read through a pipe rather than written to a
+	// buffer so that its size can be capped.
+	stdoutReader, stdoutWriter := io.Pipe()
+	type readResult struct {
+		data    []byte
+		tooLong bool
+	}
+	read := make(chan readResult, 1)
+	go func() {
+		data, _ := io.ReadAll(io.LimitReader(stdoutReader, g.maxStdoutSize+1))
+		if int64(len(data)) > g.maxStdoutSize {
+			// Kill the plugin, and make its next writes fail.
+			cancel()
+			_ = stdoutReader.CloseWithError(errStdoutTooLong)
+			read <- readResult{tooLong: true}
+			return
+		}
+		read <- readResult{data: data}
+	}()
+
+	stderr := &tailWriter{size: stderrSize}
+	cmd := exec.CommandContext(ctx, g.command, g.args...)
+	cmd.Env = g.env
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderr
+	// Don't wait forever for the processes started by the plugin that
+	// inherited its standard output.
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	_ = stdoutWriter.Close()
+	stdout := <-read
+	log := klog.FromContext(ctx).V(logs.Debug)
+	log.Info("Ran the exec plugin", "command", g.command, "duration", time.Since(start), "stderr", stderr.String())
+	switch {
+	case stdout.tooLong:
+		return nil, -1, fmt.Errorf("plugin %s failed: its output is larger than %d bytes", g.command, g.maxStdoutSize)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return nil, -1, fmt.Errorf("plugin %s timed out after %s", g.command, g.timeout)
+	case err != nil && len(stderr.buf) > 0:
+		return nil, -1, fmt.Errorf("plugin %s failed: %v: %s", g.command, err, stderr)
+	case err != nil:
+		return nil, -1, fmt.Errorf("plugin %s failed: %v", g.command, err)
+	}
+
+	out, err := DecodeOutput(bytes.NewReader(stdout.data))
+	if err != nil {
+		return nil, -1, fmt.Errorf("plugin %s: %v", g.command, err)
+	}
+
+	if out.DataType == DataTypeGeneric {
+		return &api.GenericData{Resources: out.Resources}, out.Count, nil
+	}
+	items := make([]*api.GatheredResource, 0, len(out.Resources))
+	for _, resource := range out.Resources {
+		// The plugins may write Secrets, e.g. read from a vault, which are
+		// redacted like the ones of the k8s-dynamic data gatherers.
+		obj := &unstructured.Unstructured{Object: resource}
+		if err := k8sdynamic.RedactResource(obj); err != nil {
+			return nil, -1, fmt.Errorf("plugin %s: %v", g.command, err)
+		}
+		items = append(items, &api.GatheredResource{Resource: obj})
+	}
+	return &api.DynamicData{Items: items}, out.Count, nil
+}
@@ -0,0 +1,159 @@
+package execplugin
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/jetstack/preflight/api"
+)
+
+// The test binary acts as a plugin when TEST_PLUGIN_OUTPUT is set. It writes
+// TEST_PLUGIN_STDERR to its standard error, sleeps for TEST_PLUGIN_SLEEP,
+// writes TEST_PLUGIN_OUTPUT to its standard output, and exits with
+// TEST_PLUGIN_EXIT_CODE.
+func TestMain(m *testing.M) {
+	output, ok := os.LookupEnv("TEST_PLUGIN_OUTPUT")
+	if !ok {
+		os.Exit(m.Run())
+	}
+	fmt.Fprint(os.Stderr, os.Getenv("TEST_PLUGIN_STDERR"))
+	if sleep, err := time.ParseDuration(os.Getenv("TEST_PLUGIN_SLEEP")); err == nil {
+		time.Sleep(sleep)
+	}
+	fmt.Print(output)
+	code, _ := strconv.Atoi(os.Getenv("TEST_PLUGIN_EXIT_CODE"))
+	os.Exit(code)
+}
+
+func TestFetch(t *testing.T) {
+	testBinary, err := os.Executable()
+	require.NoError(t, err)
+
+	fetch := func(t *testing.T, cfg ConfigExec) (any, int, error) {
+		t.Helper()
+		cfg.Command = testBinary
+		dg, err := cfg.NewDataGatherer(t.Context())
+		require.NoError(t, err)
+		return dg.Fetch(t.Context())
+	}
+
+	t.Run("dynamic resources", func(t *testing.T) {
+		data, count, err := fetch(t, ConfigExec{Env: map[string]string{
+			"TEST_PLUGIN_OUTPUT": `{"version": "v1", "resources": [{"apiVersion": "example.com/v1", "kind": "Certificate", "metadata": {"name": "a"}}], "count": 1}`,
+		}})
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, &api.DynamicData{Items: []*api.GatheredResource{{
+			Resource: &unstructured.Unstructured{Object: map[string]any{"apiVersion": "example.com/v1", "kind": "Certificate", "metadata": map[string]any{"name": "a"}}},
+		}}}, data)
+	})
+
+	t.Run("generic resources", func(t *testing.T) {
+		data, count, err := fetch(t, ConfigExec{Env: map[string]string{
+			"TEST_PLUGIN_OUTPUT": `{"version": "v1", "data_type": "generic", "resources": [{"id": "lb-1"}, {"id": "lb-2"}], "count": 2}`,
+		}})
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+		assert.Equal(t, &api.GenericData{Resources: []map[string]any{{"id": "lb-1"}, {"id": "lb-2"}}}, data)
+	})
+
+	t.Run("non-zero exit status", func(t *testing.T) {
+		_, _, err := fetch(t, ConfigExec{Env: map[string]string{
+			"TEST_PLUGIN_OUTPUT":    "",
+			"TEST_PLUGIN_STDERR":    "cannot reach the PKI\n",
+			"TEST_PLUGIN_EXIT_CODE": "3",
+		}})
+		assert.EqualError(t, err, fmt.Sprintf("plugin %s failed: exit status 3: cannot reach the PKI", testBinary))
+	})
+
+	t.Run("only the end of the standard error is kept", func(t *testing.T) {
+		_, _, err := fetch(t, ConfigExec{Env: map[string]string{
+			"TEST_PLUGIN_OUTPUT":    "",
+			"TEST_PLUGIN_STDERR":    strings.Repeat("a", 2*stderrSize) + "cannot reach the PKI\n",
+			"TEST_PLUGIN_EXIT_CODE": "3",
+		}})
+		assert.EqualError(t, err, fmt.Sprintf("plugin %s failed: exit status 3: ...%scannot reach the PKI", testBinary, strings.Repeat("a", stderrSize-len("cannot reach the PKI\n"))))
+	})
+
+	t.Run("Secrets are redacted", func(t *testing.T) {
+		data, _, err := fetch(t, ConfigExec{Env: map[string]string{
+			"TEST_PLUGIN_OUTPUT": `{"version": "v1", "resources": [{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "a", "managedFields": [{"manager": "vault"}]}, "data": {"tls.crt": "Y2VydA==", "tls.key": "a2V5"}}], "count": 1}`,
+		}})
+		require.NoError(t, err)
+		assert.Equal(t, &api.DynamicData{Items: []*api.GatheredResource{{
+			Resource: &unstructured.Unstructured{Object: map[string]any{"apiVersion": "v1", "kind": "Secret", "metadata": map[string]any{"name": "a"}, "data": map[string]any{"tls.crt": "Y2VydA=="}}},
+		}}}, data)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		_, _, err := fetch(t, ConfigExec{Timeout: 100 * time.Millisecond, Env: map[string]string{
+			"TEST_PLUGIN_OUTPUT": `{"version": "v1", "resources": [], "count": 0}`,
+			"TEST_PLUGIN_SLEEP":  "10s",
+		}})
+		assert.EqualError(t, err, fmt.Sprintf("plugin %s timed out after 100ms", testBinary))
+	})
+
+	t.Run("output too long", func(t *testing.T) {
+		dg, err := (&ConfigExec{Command: testBinary, Env: map[string]string{
+			"TEST_PLUGIN_OUTPUT": `{"version": "v1", "resources": [], "count": 0}`,
+		}}).NewDataGatherer(t.Context())
+		require.NoError(t, err)
+		dg.(*DataGathererExec).maxStdoutSize = 10
+		_, _, err = dg.Fetch(t.Context())
+		assert.EqualError(t, err, fmt.Sprintf("plugin %s failed: its output is larger than 10 bytes", testBinary))
+	})
+
+	t.Run("protocol errors", func(t *testing.T) {
+		_, _, err := fetch(t, ConfigExec{Env: map[string]string{
+			"TEST_PLUGIN_OUTPUT": `{"version": "v1", "resources": [], "count": 0, "errors": ["access denied"]}`,
+		}})
+		assert.EqualError(t, err, fmt.Sprintf("plugin %s: the plugin reported errors: access denied", testBinary))
+	})
+
+	t.Run("the environment of the agent isn't inherited", func(t *testing.T) {
+		t.Setenv("TEST_PLUGIN_OUTPUT", `{"version": "v1", "resources": [], "count": 0}`)
+		// Without TEST_PLUGIN_OUTPUT, the test binary runs the tests, none
+		// here, and writes PASS instead of the protocol output.
+		_, _, err := fetch(t, ConfigExec{Args: []string{"-test.run=^$"}})
+		assert.EqualError(t, err, fmt.Sprintf("plugin %s: failed to decode the plugin output: invalid character 'P' looking for beginning of value", testBinary))
+	})
+
+	t.Run("missing command", func(t *testing.T) {
+		dg, err := (&ConfigExec{Command: "does-not-exist"}).NewDataGatherer(t.Context())
+		require.NoError(t, err)
+		_, _, err = dg.Fetch(t.Context())
+		assert.EqualError(t, err, `plugin does-not-exist failed: exec: "does-not-exist": executable file not found in $PATH`)
+	})
+}
+
+// TestSamplePlugin checks that the sample plugin conforms to the protocol.
+func TestSamplePlugin(t *testing.T) {
+	dg, err := (&ConfigExec{
+		Command: "../../../examples/exec-plugin/legacy-pki.sh",
+		Env:     map[string]string{"LEGACY_PKI_URL": "https://pki.internal"},
+	}).NewDataGatherer(t.Context())
+	require.NoError(t, err)
+
+	data, count, err := dg.Fetch(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	items := data.(*api.DynamicData).Items
+	require.Len(t, items, 2)
+	cert := items[0].Resource.(*unstructured.Unstructured)
+	assert.Equal(t, "Certificate", cert.GetKind())
+	assert.Equal(t, "payments-gateway", cert.GetName())
+	assert.Equal(t, "https://pki.internal", cert.GetAnnotations()["legacy-pki.example.com/source"])
+}
+
+func TestValidate(t *testing.T) {
+	err := (&ConfigExec{Timeout: -time.Second, Env: map[string]string{ProtocolVersionEnv: "v2"}}).validate()
+	assert.EqualError(t, err, "invalid command: must not be empty, invalid timeout: must not be negative, got -1s, invalid env: PREFLIGHT_EXEC_PROTOCOL_VERSION is set by the agent")
+}
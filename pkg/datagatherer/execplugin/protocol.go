@@ -0,0 +1,158 @@
+package execplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+const (
+	// ProtocolVersion is the version of the protocol spoken by the agent. It
+	// is passed to the plugins in the PREFLIGHT_EXEC_PROTOCOL_VERSION
+	// environment variable, and the plugins must write it in the version
+	// field of their output.
+	ProtocolVersion = "v1"
+
+	// ProtocolVersionEnv is the environment variable that contains the
+	// ProtocolVersion.
+	ProtocolVersionEnv = "PREFLIGHT_EXEC_PROTOCOL_VERSION"
+
+	// DataTypeDynamic means that the resources are Kubernetes-like
+	// resources, with an apiVersion, a kind, and a metadata.name. They are
+	// sent like the resources gathered by the k8s-dynamic data gatherers.
+	DataTypeDynamic = "dynamic"
+	// DataTypeGeneric means that the resources are arbitrary JSON objects.
+	DataTypeGeneric = "generic"
+)
+
+// Output is what a plugin writes to its standard output, as a single JSON
+// object.
+type Output struct {
+	// Version must be ProtocolVersion.
+	Version string `json:"version"`
+	// DataType is either DataTypeDynamic (default) or DataTypeGeneric.
+	DataType string `json:"data_type,omitempty"`
+	// Resources are the gathered resources.
+	Resources []map[string]any `json:"resources"`
+	// Count is the number of resources. It lets the agent detect a truncated
+	// output.
+	Count int `json:"count"`
+	// Errors are the errors encountered by the plugin. When there is at least
+	// one error, the resources are discarded and the gathering fails.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// DecodeOutput decodes and validates the output of a plugin. Plugin authors
+// can use it to check that their plugin conforms to the protocol.
+func DecodeOutput(r io.Reader) (*Output, error) {
+	// The resources are decoded separately so that their integers are
+	// decoded as int64 rather than float64, like the Kubernetes resources.
+	var wire struct {
+		Output
+		Resources []json.RawMessage `json:"resources"`
+	}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&wire); err != nil {
+		return nil, fmt.Errorf("failed to decode the plugin output: %v", err)
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decode the plugin output: unexpected data after the JSON object")
+	}
+	out := wire.Output
+	if wire.Resources != nil {
+		out.Resources = make([]map[string]any, 0, len(wire.Resources))
+	}
+	for i, raw := range wire.Resources {
+		var resource map[string]any
+		if err := utiljson.Unmarshal(raw, &resource); err != nil || resource == nil {
+			return nil, fmt.Errorf("failed to decode the plugin output: resource %d is not a JSON object", i)
+		}
+		out.Resources = append(out.Resources, resource)
+	}
+
+	if out.Version != ProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %q, the agent supports %q", out.Version, ProtocolVersion)
+	}
+	if len(out.Errors) > 0 {
+		return nil, fmt.Errorf("the plugin reported errors: %s", strings.Join(out.Errors, ", "))
+	}
+	if out.Resources == nil {
+		return nil, fmt.Errorf("the resources field is missing")
+	}
+	if out.Count != len(out.Resources) {
+		return nil, fmt.Errorf("the count is %d but %d resources were received", out.Count, len(out.Resources))
+	}
+
+	switch out.DataType {
+	case "":
+		out.DataType = DataTypeDynamic
+		fallthrough
+	case DataTypeDynamic:
+		for i, resource := range out.Resources {
+			if err := validateDynamicResource(resource); err != nil {
+				return nil, fmt.Errorf("resource %d: %v", i, err)
+			}
+		}
+	case DataTypeGeneric:
+	default:
+		return nil, fmt.Errorf("unsupported data type %q, must be %q or %q", out.DataType, DataTypeDynamic, DataTypeGeneric)
+	}
+
+	return &out, nil
+}
+
+func validateDynamicResource(resource map[string]any) error {
+	var missing []string
+	for _, field := range []string{"apiVersion", "kind"} {
+		if s, _ := resource[field].(string); s == "" {
+			missing = append(missing, field)
+		}
+	}
+	metadata, _ := resource["metadata"].(map[string]any)
+	if name, _ := metadata["name"].(string); name == "" {
+		missing = append(missing, "metadata.name")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// tailWriter keeps the last size bytes written to it, so that the standard
+// error of a plugin, which is only used in the logs and the error messages,
+// doesn't grow without bound.
+type tailWriter struct {
+	size      int
+	buf       []byte
+	truncated bool
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > w.size {
+		p = p[len(p)-w.size:]
+		w.truncated = true
+	}
+	if over := len(w.buf) + len(p) - w.size; over > 0 {
+		w.buf = w.buf[:copy(w.buf, w.buf[over:])]
+		w.truncated = true
+	}
+	w.buf = append(w.buf, p...)
+	return n, nil
+}
+
+// String returns the end of the output, prefixed with "..." if the beginning
+// was dropped.
+func (w *tailWriter) String() string {
+	s := string(bytes.TrimSpace(w.buf))
+	if w.truncated {
+		return "..." + s
+	}
+	return s
+}
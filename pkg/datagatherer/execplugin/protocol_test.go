@@ -0,0 +1,115 @@
+package execplugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDecodeOutput defines the contract between the agent and the plugins: the
+// outputs a plugin may write, and the ones that make the gathering fail.
+func TestDecodeOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    *Output
+		wantErr string
+	}{
+		{
+			name:   "dynamic resources",
+			output: `{"version": "v1", "data_type": "dynamic", "resources": [{"apiVersion": "example.com/v1", "kind": "Certificate", "metadata": {"name": "a"}, "spec": {"size": 2048}}], "count": 1}`,
+			want: &Output{Version: "v1", DataType: DataTypeDynamic, Count: 1, Resources: []map[string]any{
+				{"apiVersion": "example.com/v1", "kind": "Certificate", "metadata": map[string]any{"name": "a"}, "spec": map[string]any{"size": int64(2048)}},
+			}},
+		},
+		{
+			name:   "the data type defaults to dynamic",
+			output: `{"version": "v1", "resources": [], "count": 0}`,
+			want:   &Output{Version: "v1", DataType: DataTypeDynamic, Resources: []map[string]any{}},
+		},
+		{
+			name:   "generic resources",
+			output: "{\"version\": \"v1\", \"data_type\": \"generic\", \"resources\": [{\"id\": \"lb-1\", \"port\": 443}], \"count\": 1}\n",
+			want:   &Output{Version: "v1", DataType: DataTypeGeneric, Count: 1, Resources: []map[string]any{{"id": "lb-1", "port": int64(443)}}},
+		},
+		{
+			name:    "unsupported version",
+			output:  `{"version": "v2", "resources": [], "count": 0}`,
+			wantErr: `unsupported protocol version "v2", the agent supports "v1"`,
+		},
+		{
+			name:    "missing version",
+			output:  `{"resources": [], "count": 0}`,
+			wantErr: `unsupported protocol version "", the agent supports "v1"`,
+		},
+		{
+			name:    "errors",
+			output:  `{"version": "v1", "resources": [{"id": "lb-1"}], "count": 1, "errors": ["region eu-west-1: access denied", "region us-east-1: timeout"]}`,
+			wantErr: "the plugin reported errors: region eu-west-1: access denied, region us-east-1: timeout",
+		},
+		{
+			name:    "truncated resources",
+			output:  `{"version": "v1", "data_type": "generic", "resources": [{"id": "lb-1"}], "count": 2}`,
+			wantErr: "the count is 2 but 1 resources were received",
+		},
+		{
+			name:    "missing resources",
+			output:  `{"version": "v1", "count": 0}`,
+			wantErr: "the resources field is missing",
+		},
+		{
+			name:    "resource that isn't an object",
+			output:  `{"version": "v1", "data_type": "generic", "resources": ["lb-1"], "count": 1}`,
+			wantErr: "failed to decode the plugin output: resource 0 is not a JSON object",
+		},
+		{
+			name:    "dynamic resource without name",
+			output:  `{"version": "v1", "resources": [{"apiVersion": "example.com/v1", "metadata": {}}], "count": 1}`,
+			wantErr: "resource 0: missing kind, metadata.name",
+		},
+		{
+			name:    "unknown data type",
+			output:  `{"version": "v1", "data_type": "raw", "resources": [], "count": 0}`,
+			wantErr: `unsupported data type "raw", must be "dynamic" or "generic"`,
+		},
+		{
+			name:    "unknown field",
+			output:  `{"version": "v1", "resources": [], "count": 0, "items": []}`,
+			wantErr: `failed to decode the plugin output: json: unknown field "items"`,
+		},
+		{
+			name:    "several JSON objects",
+			output:  `{"version": "v1", "resources": [], "count": 0}{}`,
+			wantErr: "failed to decode the plugin output: unexpected data after the JSON object",
+		},
+		{
+			name:    "empty output",
+			output:  "",
+			wantErr: "failed to decode the plugin output: EOF",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := DecodeOutput(strings.NewReader(test.output))
+			if test.wantErr != "" {
+				assert.EqualError(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestTailWriter(t *testing.T) {
+	w := &tailWriter{size: 8}
+	_, _ = w.Write([]byte("abc"))
+	assert.Equal(t, "abc", w.String())
+	_, _ = w.Write([]byte("defgh\n"))
+	assert.Equal(t, "...bcdefgh", w.String())
+	_, _ = w.Write([]byte("0123456789"))
+	assert.Equal(t, "...23456789", w.String())
+	assert.Len(t, w.buf, 8)
+}
@@ -0,0 +1,348 @@
+// Package k8scabundles implements a data gatherer that extracts the CA bundles
+// embedded in Kubernetes resources: the webhook configurations, the
+// APIServices, the CRD conversion webhooks, and the targets of the
+// trust-manager Bundles. These bundles are base64-encoded in the resources,
+// which makes an expired CA easy to miss until the API server stops trusting
+// the webhook.
+package k8scabundles
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/api/reader"
+	"github.com/jetstack/preflight/pkg/datagatherer"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+	"github.com/jetstack/preflight/pkg/kubeconfig"
+	"github.com/jetstack/preflight/pkg/logs"
+)
+
+var (
+	validatingWebhooksGVR = schema.GroupVersionResource{Group: "admissionregistration.k8s.io", Version: "v1", Resource: "validatingwebhookconfigurations"}
+	mutatingWebhooksGVR   = schema.GroupVersionResource{Group: "admissionregistration.k8s.io", Version: "v1", Resource: "mutatingwebhookconfigurations"}
+	apiServicesGVR        = schema.GroupVersionResource{Group: "apiregistration.k8s.io", Version: "v1", Resource: "apiservices"}
+	crdsGVR               = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+	bundlesGVR            = schema.GroupVersionResource{Group: "trust.cert-manager.io", Version: "v1alpha1", Resource: "bundles"}
+	configMapsGVR         = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	secretsGVR            = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+)
+
+// bundleLabel is the label set by trust-manager on the target ConfigMaps and
+// Secrets of a Bundle. Its value is the name of the Bundle.
+const bundleLabel = "trust.cert-manager.io/bundle"
+
+// bundleIndex is the name of the index of the targets by Bundle name.
+const bundleIndex = "bundle"
+
+// ConfigCABundles contains the configuration for the k8s-ca-bundles
+// data-gatherer.
+type ConfigCABundles struct {
+	// KubeConfigPath is the path to the kubeconfig file. If empty, will assume it runs in-cluster.
+	KubeConfigPath string `yaml:"kubeconfig"`
+}
+
+// UnmarshalYAML unmarshals the ConfigCABundles.
+func (c *ConfigCABundles) UnmarshalYAML(unmarshal func(any) error) error {
+	aux := struct {
+		KubeConfigPath string `yaml:"kubeconfig"`
+	}{}
+	err := unmarshal(&aux)
+	if err != nil {
+		return err
+	}
+
+	c.KubeConfigPath = aux.KubeConfigPath
+
+	return nil
+}
+
+// NewDataGatherer constructs a new instance of the k8s-ca-bundles
+// data-gatherer. The trust-manager Bundles are only watched when the cluster
+// serves the trust.cert-manager.io API.
+func (c *ConfigCABundles) NewDataGatherer(ctx context.Context) (datagatherer.DataGatherer, error) {
+	cl, err := kubeconfig.NewDynamicClient(c.KubeConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	discoveryClient, err := kubeconfig.NewDiscoveryClient(c.KubeConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	trustManager, err := servesBundles(discoveryClient)
+	if err != nil {
+		return nil, err
+	}
+	return newDataGathererWithClient(cl, trustManager), nil
+}
+
+func servesBundles(cl discovery.DiscoveryInterface) (bool, error) {
+	_, err := cl.ServerResourcesForGroupVersion(bundlesGVR.GroupVersion().String())
+	switch {
+	case apierrors.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("while checking if the cluster serves %s: %v", bundlesGVR.GroupVersion(), err)
+	}
+	return true, nil
+}
+
+// newDataGathererWithClient creates the data gatherer. The trust-manager
+// Bundles and their targets are watched when trustManager is true. Only the
+// ConfigMaps and Secrets that have the bundleLabel are watched.
+func newDataGathererWithClient(cl dynamic.Interface, trustManager bool) *DataGathererCABundles {
+	g := &DataGathererCABundles{cl: cl, now: time.Now}
+	if !trustManager {
+		return g
+	}
+
+	g.bundlesFactory = dynamicinformer.NewDynamicSharedInformerFactory(cl, 60*time.Second)
+	g.bundles = g.bundlesFactory.ForResource(bundlesGVR).Informer()
+	g.targetsFactory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(cl, 60*time.Second, metav1.NamespaceAll, func(opts *metav1.ListOptions) {
+		opts.LabelSelector = bundleLabel
+	})
+	g.configMaps = g.targetsFactory.ForResource(configMapsGVR).Informer()
+	g.secrets = g.targetsFactory.ForResource(secretsGVR).Informer()
+	for _, informer := range []k8scache.SharedIndexInformer{g.configMaps, g.secrets} {
+		// The informers haven't been started, so adding an indexer can't
+		// fail.
+		_ = informer.AddIndexers(k8scache.Indexers{bundleIndex: indexByBundle})
+	}
+	return g
+}
+
+func indexByBundle(obj any) ([]string, error) {
+	meta, ok := obj.(metav1.Object)
+	if !ok {
+		return nil, nil
+	}
+	if name, ok := meta.GetLabels()[bundleLabel]; ok {
+		return []string{name}, nil
+	}
+	return nil, nil
+}
+
+// DataGathererCABundles stores the config for a k8s-ca-bundles datagatherer.
+type DataGathererCABundles struct {
+	cl  dynamic.Interface
+	now func() time.Time
+
+	// The factories and informers are nil when the cluster doesn't serve the
+	// trust-manager Bundles.
+	bundlesFactory dynamicinformer.DynamicSharedInformerFactory
+	targetsFactory dynamicinformer.DynamicSharedInformerFactory
+	bundles        k8scache.SharedIndexInformer
+	configMaps     k8scache.SharedIndexInformer
+	secrets        k8scache.SharedIndexInformer
+}
+
+var _ datagatherer.DataGatherer = &DataGathererCABundles{}
+
+// Run starts the informers of the trust-manager Bundles and their targets.
+func (g *DataGathererCABundles) Run(ctx context.Context) error {
+	if g.bundles == nil {
+		return nil
+	}
+	g.bundlesFactory.Start(ctx.Done())
+	g.targetsFactory.Start(ctx.Done())
+	return nil
+}
+
+// WaitForCacheSync waits for the informers' caches to sync. It returns
+// k8sdynamic.ErrCacheSyncTimeout on timeout, so that the agent handles it as
+// for the k8s-dynamic data gatherers.
+func (g *DataGathererCABundles) WaitForCacheSync(ctx context.Context) error {
+	if g.bundles == nil {
+		return nil
+	}
+	if !k8scache.WaitForCacheSync(ctx.Done(), g.bundles.HasSynced, g.configMaps.HasSynced, g.secrets.HasSynced) {
+		return k8sdynamic.ErrCacheSyncTimeout
+	}
+	return nil
+}
+
+// Fetch lists the resources that embed CA bundles and parses the bundles. The
+// resources whose API isn't served by the cluster are skipped. The
+// trust-manager Bundles and their targets are read from the informers' caches.
+func (g *DataGathererCABundles) Fetch(ctx context.Context) (any, int, error) {
+	data := &api.CABundlesData{CABundles: []api.CABundle{}}
+	for _, source := range []struct {
+		gvr     schema.GroupVersionResource
+		extract func(context.Context, *unstructured.Unstructured) ([]api.CABundle, error)
+	}{
+		{validatingWebhooksGVR, g.webhookBundles},
+		{mutatingWebhooksGVR, g.webhookBundles},
+		{apiServicesGVR, g.apiServiceBundles},
+		{crdsGVR, g.crdBundles},
+	} {
+		list, err := g.cl.Resource(source.gvr).List(ctx, metav1.ListOptions{})
+		if apierrors.IsNotFound(err) {
+			klog.FromContext(ctx).V(logs.Debug).Info("Skipping CA bundles of a resource that isn't served", "resource", source.gvr.String())
+			continue
+		}
+		if err != nil {
+			return nil, -1, fmt.Errorf("failed to list %s: %v", source.gvr.String(), err)
+		}
+		for i := range list.Items {
+			bundles, err := source.extract(ctx, &list.Items[i])
+			if err != nil {
+				return nil, -1, err
+			}
+			data.CABundles = append(data.CABundles, bundles...)
+		}
+	}
+
+	if g.bundles != nil {
+		for _, obj := range sortedObjects(g.bundles.GetStore().List()) {
+			data.CABundles = append(data.CABundles, g.trustManagerBundles(obj)...)
+		}
+	}
+	return data, len(data.CABundles), nil
+}
+
+// sortedObjects returns the unstructured objects sorted by namespace and name,
+// so that the order doesn't depend on the informer's cache.
+func sortedObjects(objs []any) []*unstructured.Unstructured {
+	out := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			out = append(out, u)
+		}
+	}
+	slices.SortFunc(out, func(a, b *unstructured.Unstructured) int {
+		return strings.Compare(a.GetNamespace()+"/"+a.GetName(), b.GetNamespace()+"/"+b.GetName())
+	})
+	return out
+}
+
+// webhookBundles returns the CA bundle of each webhook of a validating or
+// mutating webhook configuration.
+func (g *DataGathererCABundles) webhookBundles(_ context.Context, obj *unstructured.Unstructured) ([]api.CABundle, error) {
+	webhooks, _, _ := unstructured.NestedSlice(obj.Object, "webhooks")
+	var bundles []api.CABundle
+	for _, webhook := range webhooks {
+		webhook, ok := webhook.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(webhook, "name")
+		encoded, _, _ := unstructured.NestedString(webhook, "clientConfig", "caBundle")
+		if bundle, ok := g.bundle(obj, fmt.Sprintf("webhooks[%s].clientConfig.caBundle", name), encoded); ok {
+			bundles = append(bundles, bundle)
+		}
+	}
+	return bundles, nil
+}
+
+func (g *DataGathererCABundles) apiServiceBundles(_ context.Context, obj *unstructured.Unstructured) ([]api.CABundle, error) {
+	encoded, _, _ := unstructured.NestedString(obj.Object, "spec", "caBundle")
+	if bundle, ok := g.bundle(obj, "spec.caBundle", encoded); ok {
+		return []api.CABundle{bundle}, nil
+	}
+	return nil, nil
+}
+
+func (g *DataGathererCABundles) crdBundles(_ context.Context, obj *unstructured.Unstructured) ([]api.CABundle, error) {
+	encoded, _, _ := unstructured.NestedString(obj.Object, "spec", "conversion", "webhook", "clientConfig", "caBundle")
+	if bundle, ok := g.bundle(obj, "spec.conversion.webhook.clientConfig.caBundle", encoded); ok {
+		return []api.CABundle{bundle}, nil
+	}
+	return nil, nil
+}
+
+// trustManagerBundles returns the CA bundle written by trust-manager to the
+// target ConfigMap or Secret of a Bundle. The target has the name of the
+// Bundle and is identical in every namespace, so only the first one found is
+// parsed.
+func (g *DataGathererCABundles) trustManagerBundles(obj *unstructured.Unstructured) []api.CABundle {
+	var bundles []api.CABundle
+	for _, target := range []struct {
+		kind     string
+		informer k8scache.SharedIndexInformer
+	}{
+		{"configMap", g.configMaps},
+		{"secret", g.secrets},
+	} {
+		key, found, _ := unstructured.NestedString(obj.Object, "spec", "target", target.kind, "key")
+		if !found || key == "" {
+			continue
+		}
+		items, _ := target.informer.GetIndexer().ByIndex(bundleIndex, obj.GetName())
+		for _, item := range sortedObjects(items) {
+			if item.GetName() != obj.GetName() {
+				continue
+			}
+			field := fmt.Sprintf("%s[%s/%s].data[%s]", target.kind, item.GetNamespace(), item.GetName(), key)
+			data, _, _ := unstructured.NestedString(item.Object, "data", key)
+			switch {
+			case data == "":
+			case target.kind == "configMap":
+				// Unlike Secrets, ConfigMaps store the PEM data as is.
+				bundles = append(bundles, g.parseBundle(obj, field, []byte(data)))
+			default:
+				if bundle, ok := g.bundle(obj, field, data); ok {
+					bundles = append(bundles, bundle)
+				}
+			}
+			break
+		}
+	}
+	return bundles
+}
+
+// bundle parses the base64-encoded PEM bundle found in the given field of the
+// resource. It returns false if the bundle is empty.
+func (g *DataGathererCABundles) bundle(obj *unstructured.Unstructured, field, encoded string) (api.CABundle, bool) {
+	if encoded == "" {
+		return api.CABundle{}, false
+	}
+	pemData, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		bundle := g.parseBundle(obj, field, nil)
+		bundle.Error = fmt.Sprintf("failed to decode the bundle: %v", err)
+		return bundle, true
+	}
+	return g.parseBundle(obj, field, pemData), true
+}
+
+// parseBundle parses the PEM bundle found in the given field of the resource.
+func (g *DataGathererCABundles) parseBundle(obj *unstructured.Unstructured, field string, pemData []byte) api.CABundle {
+	bundle := api.CABundle{
+		Resource: api.ResourceReference{
+			APIVersion: obj.GetAPIVersion(),
+			Kind:       obj.GetKind(),
+			Namespace:  obj.GetNamespace(),
+			Name:       obj.GetName(),
+			UID:        string(obj.GetUID()),
+		},
+		Field:        field,
+		Certificates: []api.CertificateSummary{},
+	}
+
+	certs, err := reader.ParseCertificates(pemData)
+	switch {
+	case err != nil:
+		bundle.Error = err.Error()
+	case len(certs) == 0:
+		bundle.Error = "no PEM-encoded certificate found"
+	}
+	now := g.now()
+	for _, cert := range certs {
+		bundle.Certificates = append(bundle.Certificates, reader.Summarize(cert, now))
+	}
+	return bundle
+}
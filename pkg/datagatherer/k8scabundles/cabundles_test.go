@@ -0,0 +1,176 @@
+package k8scabundles
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/testutil/testcert"
+)
+
+func TestFetch(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	validCA := testcert.New(t, testcert.Options{CommonName: "valid", NotAfter: now.Add(24 * time.Hour), IsCA: true}).PEM()
+	expiredCA := testcert.New(t, testcert.Options{CommonName: "expired", NotAfter: now.Add(-24 * time.Hour), IsCA: true}).PEM()
+	b64 := func(pemData []byte) string { return base64.StdEncoding.EncodeToString(pemData) }
+
+	objects := []runtime.Object{
+		obj("admissionregistration.k8s.io/v1", "ValidatingWebhookConfiguration", "", "cert-manager-webhook", map[string]any{
+			"webhooks": []any{
+				map[string]any{"name": "webhook.cert-manager.io", "clientConfig": map[string]any{"caBundle": b64(append(validCA, expiredCA...))}},
+				// Webhooks without caBundle use the system trust store.
+				map[string]any{"name": "no-ca-bundle.example.com", "clientConfig": map[string]any{"url": "https://example.com"}},
+			},
+		}),
+		obj("admissionregistration.k8s.io/v1", "MutatingWebhookConfiguration", "", "broken", map[string]any{
+			"webhooks": []any{
+				map[string]any{"name": "broken.example.com", "clientConfig": map[string]any{"caBundle": b64([]byte("not a certificate"))}},
+			},
+		}),
+		obj("apiregistration.k8s.io/v1", "APIService", "", "v1beta1.metrics.k8s.io", map[string]any{
+			"spec": map[string]any{"caBundle": b64(expiredCA)},
+		}),
+		// Local APIServices have no caBundle.
+		obj("apiregistration.k8s.io/v1", "APIService", "", "v1.apps", map[string]any{
+			"spec": map[string]any{"group": "apps"},
+		}),
+		obj("apiextensions.k8s.io/v1", "CustomResourceDefinition", "", "foos.example.com", map[string]any{
+			"spec": map[string]any{"conversion": map[string]any{
+				"strategy": "Webhook",
+				"webhook":  map[string]any{"clientConfig": map[string]any{"caBundle": b64(validCA)}},
+			}},
+		}),
+		obj("trust.cert-manager.io/v1alpha1", "Bundle", "", "trust-bundle", map[string]any{
+			"spec": map[string]any{"target": map[string]any{"configMap": map[string]any{"key": "ca.pem"}}},
+		}),
+		obj("v1", "ConfigMap", "team-a", "trust-bundle", map[string]any{
+			"metadata": map[string]any{"labels": map[string]any{bundleLabel: "trust-bundle"}},
+			"data":     map[string]any{"ca.pem": string(validCA)},
+		}),
+		obj("v1", "ConfigMap", "team-a", "other", map[string]any{
+			"data": map[string]any{"ca.pem": string(expiredCA)},
+		}),
+	}
+
+	start := func(t *testing.T, cl dynamic.Interface, trustManager bool) *DataGathererCABundles {
+		t.Helper()
+		g := newDataGathererWithClient(cl, trustManager)
+		g.now = func() time.Time { return now }
+		require.NoError(t, g.Run(t.Context()))
+		require.NoError(t, g.WaitForCacheSync(t.Context()))
+		return g
+	}
+
+	t.Run("all sources", func(t *testing.T) {
+		g := start(t, newClient(objects...), true)
+		data, count, err := g.Fetch(t.Context())
+		require.NoError(t, err)
+		bundles := data.(*api.CABundlesData).CABundles
+		assert.Equal(t, 5, count)
+		require.Len(t, bundles, 5)
+
+		webhook := bundles[0]
+		assert.Equal(t, api.ResourceReference{
+			APIVersion: "admissionregistration.k8s.io/v1",
+			Kind:       "ValidatingWebhookConfiguration",
+			Name:       "cert-manager-webhook",
+			UID:        "uid-cert-manager-webhook",
+		}, webhook.Resource)
+		assert.Equal(t, "webhooks[webhook.cert-manager.io].clientConfig.caBundle", webhook.Field)
+		assert.Empty(t, webhook.Error)
+		require.Len(t, webhook.Certificates, 2)
+		assert.Equal(t, "CN=valid", webhook.Certificates[0].Subject)
+		assert.Equal(t, "CN=valid", webhook.Certificates[0].Issuer)
+		assert.Len(t, webhook.Certificates[0].SHA256Fingerprint, 64)
+		assert.Equal(t, now.Add(24*time.Hour), webhook.Certificates[0].NotAfter.Time)
+		assert.False(t, webhook.Certificates[0].Expired)
+		assert.True(t, webhook.Certificates[1].Expired)
+
+		assert.Equal(t, "MutatingWebhookConfiguration", bundles[1].Resource.Kind)
+		assert.Equal(t, "no PEM-encoded certificate found", bundles[1].Error)
+		assert.Empty(t, bundles[1].Certificates)
+
+		assert.Equal(t, "APIService", bundles[2].Resource.Kind)
+		assert.Equal(t, "spec.caBundle", bundles[2].Field)
+		assert.True(t, bundles[2].Certificates[0].Expired)
+
+		assert.Equal(t, "CustomResourceDefinition", bundles[3].Resource.Kind)
+		assert.Equal(t, "spec.conversion.webhook.clientConfig.caBundle", bundles[3].Field)
+
+		assert.Equal(t, api.ResourceReference{
+			APIVersion: "trust.cert-manager.io/v1alpha1",
+			Kind:       "Bundle",
+			Name:       "trust-bundle",
+			UID:        "uid-trust-bundle",
+		}, bundles[4].Resource)
+		assert.Equal(t, "configMap[team-a/trust-bundle].data[ca.pem]", bundles[4].Field)
+		require.Len(t, bundles[4].Certificates, 1)
+		assert.Equal(t, "CN=valid", bundles[4].Certificates[0].Subject)
+	})
+
+	t.Run("trust-manager isn't installed", func(t *testing.T) {
+		g := start(t, newClient(objects...), false)
+		data, count, err := g.Fetch(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, 4, count)
+		for _, bundle := range data.(*api.CABundlesData).CABundles {
+			assert.NotEqual(t, "Bundle", bundle.Resource.Kind)
+		}
+	})
+
+	t.Run("resources that aren't served are skipped", func(t *testing.T) {
+		cl := newClient()
+		cl.PrependReactor("list", "customresourcedefinitions", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrors.NewNotFound(schema.GroupResource{Group: "apiextensions.k8s.io", Resource: "customresourcedefinitions"}, "")
+		})
+		g := start(t, cl, false)
+		data, count, err := g.Fetch(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, 0, count)
+		assert.NotNil(t, data.(*api.CABundlesData).CABundles, "the bundles must be encoded as an empty array")
+	})
+
+	t.Run("other errors are returned", func(t *testing.T) {
+		cl := newClient()
+		cl.PrependReactor("list", "apiservices", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "apiregistration.k8s.io", Resource: "apiservices"}, "", nil)
+		})
+		g := start(t, cl, false)
+		_, _, err := g.Fetch(t.Context())
+		assert.ErrorContains(t, err, "failed to list apiregistration.k8s.io/v1, Resource=apiservices: ")
+	})
+}
+
+func newClient(objects ...runtime.Object) *fake.FakeDynamicClient {
+	return fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		validatingWebhooksGVR: "UnstructuredList",
+		mutatingWebhooksGVR:   "UnstructuredList",
+		apiServicesGVR:        "UnstructuredList",
+		crdsGVR:               "UnstructuredList",
+		bundlesGVR:            "UnstructuredList",
+		configMapsGVR:         "UnstructuredList",
+		secretsGVR:            "UnstructuredList",
+	}, objects...)
+}
+
+func obj(apiVersion, kind, namespace, name string, fields map[string]any) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: fields}
+	u.SetAPIVersion(apiVersion)
+	u.SetKind(kind)
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	u.SetUID(types.UID("uid-" + name))
+	return u
+}
@@ -6,7 +6,11 @@ import (
 
 	"github.com/go-logr/logr"
 	"github.com/pmylund/go-cache"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	k8scache "k8s.io/client-go/tools/cache"
 
 	"github.com/jetstack/preflight/api"
 )
@@ -44,9 +48,7 @@ func logCacheUpdateFailure(log logr.Logger, obj any, operation string) {
 func onAdd(log logr.Logger, obj any, dgCache *cache.Cache) {
 	item, ok := obj.(cacheResource)
 	if ok {
-		cacheObject := &api.GatheredResource{
-			Resource: obj,
-		}
+		cacheObject := updateCacheGatheredResource(string(item.GetUID()), obj, dgCache)
 		dgCache.Set(string(item.GetUID()), cacheObject, cache.DefaultExpiration)
 		return
 	}
@@ -56,10 +58,18 @@ func onAdd(log logr.Logger, obj any, dgCache *cache.Cache) {
 // onUpdate handles the informer update events, replacing the old object with the new one
 // if it's present in the data gatherer's cache, (if the object isn't present, it gets added).
 // The cache key is the uid of the object
+//
+// The informers periodically resync, which calls onUpdate with an unchanged
+// object. Only the updates that change the resource version are recorded in
+// the change timeline of the object.
 func onUpdate(log logr.Logger, oldObj, newObj any, dgCache *cache.Cache) {
 	item, ok := oldObj.(cacheResource)
 	if ok {
 		cacheObject := updateCacheGatheredResource(string(item.GetUID()), newObj, dgCache)
+		if resourceVersion(oldObj) != resourceVersion(newObj) || resourceVersion(newObj) == "" {
+			cacheObject.LastUpdatedAt = api.Time{Time: clock.now()}
+			cacheObject.UpdateCount++
+		}
 		dgCache.Set(string(item.GetUID()), cacheObject, cache.DefaultExpiration)
 		return
 	}
@@ -69,11 +79,25 @@ func onUpdate(log logr.Logger, oldObj, newObj any, dgCache *cache.Cache) {
 // onDelete handles the informer deletion events, updating the object's properties with the deletion
 // time of the object (but not removing the object from the cache).
 // The cache key is the uid of the object
+//
+// When the watch misses the deletion, e.g. while disconnected, the informer
+// notices it when relisting and passes a DeletedFinalStateUnknown tombstone
+// holding the last known state of the object. The deletion is then recorded
+// as inferred, and the deletion time is when it was noticed.
 func onDelete(log logr.Logger, obj any, dgCache *cache.Cache) {
+	inferred := false
+	if tombstone, ok := obj.(k8scache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+		inferred = true
+	}
 	item, ok := obj.(cacheResource)
 	if ok {
 		cacheObject := updateCacheGatheredResource(string(item.GetUID()), obj, dgCache)
-		cacheObject.DeletedAt = api.Time{Time: clock.now()}
+		// Keep the time at which the deletion was first seen.
+		if cacheObject.DeletedAt.IsZero() {
+			cacheObject.DeletedAt = api.Time{Time: clock.now()}
+			cacheObject.DeletionInferred = inferred
+		}
 		dgCache.Set(string(item.GetUID()), cacheObject, cache.DefaultExpiration)
 		return
 	}
@@ -82,18 +106,76 @@ func onDelete(log logr.Logger, obj any, dgCache *cache.Cache) {
 
 // creates a new updated instance of a cache object, with the resource
 // argument. If the object is present in the cache it fetches the object's
-// properties.
+// properties, so that a deleted object stays deleted: the UIDs are never
+// reused. The change timeline of the object is carried over, and starts when
+// the object isn't in the cache yet.
 func updateCacheGatheredResource(cacheKey string, resource any, dgCache *cache.Cache) *api.GatheredResource {
 	// updated cache object
 	cacheObject := &api.GatheredResource{
-		Resource: resource,
+		Resource:       resource,
+		FirstSeenAt:    api.Time{Time: clock.now()},
+		LastModifiedAt: lastModifiedAt(resource),
 	}
 	// update the object's properties, if it's already in the cache
 	if o, ok := dgCache.Get(cacheKey); ok {
-		deletedAt := o.(*api.GatheredResource).DeletedAt
-		if deletedAt.IsZero() && !deletedAt.IsZero() {
-			cacheObject.DeletedAt = deletedAt
+		cached := o.(*api.GatheredResource)
+		if !cached.DeletedAt.IsZero() {
+			cacheObject.DeletedAt = cached.DeletedAt
+			cacheObject.DeletionInferred = cached.DeletionInferred
+		}
+		cacheObject.FirstSeenAt = cached.FirstSeenAt
+		cacheObject.LastUpdatedAt = cached.LastUpdatedAt
+		cacheObject.UpdateCount = cached.UpdateCount
+		if cacheObject.LastModifiedAt.IsZero() {
+			cacheObject.LastModifiedAt = cached.LastModifiedAt
 		}
 	}
 	return cacheObject
 }
+
+// resourceVersion returns the resource version of the object, or an empty
+// string if it has none.
+func resourceVersion(obj any) string {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return accessor.GetResourceVersion()
+}
+
+// lastModifiedAt returns the most recent time found in the managedFields of
+// the object. The managedFields of the unstructured objects are dropped at
+// ingest, after their most recent time was set as _lastModifiedTime, so
+// _lastModifiedTime is used when there are no managedFields. The time is zero
+// when unknown.
+func lastModifiedAt(obj any) api.Time {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return api.Time{}
+	}
+	var latest time.Time
+	for _, entry := range accessor.GetManagedFields() {
+		if entry.Time != nil && entry.Time.After(latest) {
+			latest = entry.Time.Time
+		}
+	}
+	if u, ok := obj.(*unstructured.Unstructured); ok && latest.IsZero() {
+		if value, ok := u.Object[lastModifiedTimeFieldName].(string); ok {
+			latest, _ = time.Parse(time.RFC3339, value)
+		}
+	}
+	return api.Time{Time: latest.UTC()}
+}
+
+// snapshotGatheredResource returns a deep copy of a cached resource, which can
+// be redacted without modifying the cache, the informers' stores, or the
+// objects seen by the event handlers.
+func snapshotGatheredResource(cacheObject *api.GatheredResource) (*api.GatheredResource, error) {
+	resource, ok := cacheObject.Resource.(runtime.Object)
+	if !ok {
+		return nil, fmt.Errorf("failed to copy cached resource: %T is not a runtime.Object", cacheObject.Resource)
+	}
+	snapshot := *cacheObject
+	snapshot.Resource = resource.DeepCopyObject()
+	return &snapshot, nil
+}
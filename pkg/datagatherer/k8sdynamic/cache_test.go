@@ -7,7 +7,9 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/pmylund/go-cache"
 	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	k8scache "k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2/ktesting"
 
 	"github.com/jetstack/preflight/api"
@@ -15,11 +17,19 @@ import (
 
 func makeGatheredResource(obj runtime.Object, deletedAt api.Time) *api.GatheredResource {
 	return &api.GatheredResource{
-		Resource:  obj,
-		DeletedAt: deletedAt,
+		Resource:    obj,
+		DeletedAt:   deletedAt,
+		FirstSeenAt: api.Time{Time: clock.now()},
 	}
 }
 
+func makeUpdatedGatheredResource(obj runtime.Object) *api.GatheredResource {
+	resource := makeGatheredResource(obj, api.Time{})
+	resource.LastUpdatedAt = api.Time{Time: clock.now()}
+	resource.UpdateCount = 1
+	return resource
+}
+
 func TestOnAddCache(t *testing.T) {
 	tcs := map[string]struct {
 		inputObjects []runtime.Object
@@ -83,18 +93,9 @@ func TestOnAddCache(t *testing.T) {
 			},
 			eventFunc: onUpdate,
 			expected: []*api.GatheredResource{
-				makeGatheredResource(
-					getObject("foobar/v1", "Foo", "testfoo", "testns1", false),
-					api.Time{},
-				),
-				makeGatheredResource(
-					getObject("v1", "Service", "testservice", "testns1", false),
-					api.Time{},
-				),
-				makeGatheredResource(
-					getObject("foobar/v1", "NotFoo", "notfoo", "testns1", false),
-					api.Time{},
-				),
+				makeUpdatedGatheredResource(getObject("foobar/v1", "Foo", "testfoo", "testns1", false)),
+				makeUpdatedGatheredResource(getObject("v1", "Service", "testservice", "testns1", false)),
+				makeUpdatedGatheredResource(getObject("foobar/v1", "NotFoo", "notfoo", "testns1", false)),
 			},
 		},
 	}
@@ -146,3 +147,118 @@ func TestNoneCache(t *testing.T) {
 	onUpdate(log, &notCachable{}, nil, nil)
 	onDelete(log, &notCachable{}, nil)
 }
+
+func TestOnDeleteCache(t *testing.T) {
+	log := ktesting.NewLogger(t, ktesting.NewConfig(ktesting.Verbosity(10)))
+	deletedAt := api.Time{Time: clock.now()}
+	firstSeenAt := api.Time{Time: clock.now()}
+	get := func(dgCache *cache.Cache, uid string) *api.GatheredResource {
+		t.Helper()
+		o, ok := dgCache.Get(uid)
+		require.True(t, ok)
+		return o.(*api.GatheredResource)
+	}
+
+	t.Run("observed deletion", func(t *testing.T) {
+		dgCache := cache.New(5*time.Minute, 30*time.Second)
+		obj := getObject("v1", "Secret", "a", "testns", false)
+		onAdd(log, obj, dgCache)
+		onDelete(log, obj, dgCache)
+		require.Equal(t, &api.GatheredResource{Resource: obj, DeletedAt: deletedAt, FirstSeenAt: firstSeenAt}, get(dgCache, "a1"))
+	})
+
+	t.Run("the tombstones are unwrapped and the deletion is inferred", func(t *testing.T) {
+		dgCache := cache.New(5*time.Minute, 30*time.Second)
+		obj := getObject("v1", "Secret", "a", "testns", false)
+		onAdd(log, obj, dgCache)
+		onDelete(log, k8scache.DeletedFinalStateUnknown{Key: "testns/a", Obj: obj}, dgCache)
+		require.Equal(t, &api.GatheredResource{Resource: obj, DeletedAt: deletedAt, DeletionInferred: true, FirstSeenAt: firstSeenAt}, get(dgCache, "a1"))
+	})
+
+	t.Run("the first-seen deletion is kept", func(t *testing.T) {
+		dgCache := cache.New(5*time.Minute, 30*time.Second)
+		obj := getObject("v1", "Secret", "a", "testns", false)
+		onAdd(log, obj, dgCache)
+		onDelete(log, obj, dgCache)
+
+		later := getObject("v1", "Secret", "a", "testns1", false)
+		clock = &laterTime{}
+		t.Cleanup(func() { clock = &fakeTime{} })
+		onUpdate(log, obj, later, dgCache)
+		onDelete(log, k8scache.DeletedFinalStateUnknown{Key: "testns1/a", Obj: later}, dgCache)
+		require.Equal(t, &api.GatheredResource{
+			Resource:      later,
+			DeletedAt:     deletedAt,
+			FirstSeenAt:   firstSeenAt,
+			LastUpdatedAt: api.Time{Time: clock.now()},
+			UpdateCount:   1,
+		}, get(dgCache, "a1"))
+	})
+
+	t.Run("tombstone of a non-cachable object", func(t *testing.T) {
+		onDelete(log, k8scache.DeletedFinalStateUnknown{Key: "testns/a"}, nil)
+	})
+}
+
+func TestCacheTimeline(t *testing.T) {
+	log := ktesting.NewLogger(t, ktesting.NewConfig(ktesting.Verbosity(10)))
+	firstSeenAt := api.Time{Time: clock.now()}
+	withVersion := func(name, resourceVersion string, managedFieldsTimes ...string) *unstructured.Unstructured {
+		obj := getObject("v1", "Secret", name, "testns", false)
+		obj.SetResourceVersion(resourceVersion)
+		var managedFields []any
+		for _, t := range managedFieldsTimes {
+			managedFields = append(managedFields, map[string]any{"manager": "kubectl", "time": t})
+		}
+		if len(managedFields) > 0 {
+			require.NoError(t, unstructured.SetNestedSlice(obj.Object, managedFields, "metadata", "managedFields"))
+		}
+		return obj
+	}
+
+	t.Run("the resyncs aren't updates", func(t *testing.T) {
+		dgCache := cache.New(5*time.Minute, 30*time.Second)
+		obj := withVersion("a", "1")
+		onAdd(log, obj, dgCache)
+		onUpdate(log, obj, obj, dgCache)
+		cached, _ := dgCache.Get("a1")
+		require.Equal(t, &api.GatheredResource{Resource: obj, FirstSeenAt: firstSeenAt}, cached)
+	})
+
+	t.Run("the updates are counted", func(t *testing.T) {
+		dgCache := cache.New(5*time.Minute, 30*time.Second)
+		v1 := withVersion("a", "1", "2024-06-01T10:00:00Z")
+		v2 := withVersion("a", "2", "2024-06-01T10:00:00Z", "2024-06-01T11:00:00Z")
+		v3 := withVersion("a", "3")
+		onAdd(log, v1, dgCache)
+		clock = &laterTime{}
+		t.Cleanup(func() { clock = &fakeTime{} })
+		onUpdate(log, v1, v2, dgCache)
+		onUpdate(log, v2, v3, dgCache)
+		cached, _ := dgCache.Get("a1")
+		require.Equal(t, &api.GatheredResource{
+			Resource:      v3,
+			FirstSeenAt:   firstSeenAt,
+			LastUpdatedAt: api.Time{Time: clock.now()},
+			// v3 has no managedFields, so the last known time is kept
+			LastModifiedAt: api.Time{Time: time.Date(2024, 6, 1, 11, 0, 0, 0, time.UTC)},
+			UpdateCount:    2,
+		}, cached)
+	})
+
+	t.Run("the last modified time set at ingest is used", func(t *testing.T) {
+		dgCache := cache.New(5*time.Minute, 30*time.Second)
+		obj := withVersion("a", "1")
+		obj.Object[lastModifiedTimeFieldName] = "2024-06-01T12:00:00Z"
+		onAdd(log, obj, dgCache)
+		cached, _ := dgCache.Get("a1")
+		require.Equal(t, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), cached.(*api.GatheredResource).LastModifiedAt.Time)
+	})
+}
+
+// laterTime is a clock an hour after fakeTime.
+type laterTime struct{}
+
+func (*laterTime) now() time.Time {
+	return (&fakeTime{}).now().Add(time.Hour)
+}
@@ -0,0 +1,262 @@
+package k8sdynamic
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/ext"
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/logs"
+)
+
+// celCostLimit bounds the cost of each evaluation of a CEL expression, so
+// that an expensive expression, e.g. nested comprehensions over large lists,
+// can't stall the data gathering. The evaluations exceeding it fail.
+const celCostLimit = 1_000_000
+
+// ComputedField is a value derived from each resource by a CEL expression.
+type ComputedField struct {
+	// Name is the key of the value in the computed fields of the resource.
+	Name string `yaml:"name"`
+	// Expression is the CEL expression computing the value, e.g.
+	// `object.metadata.name + '.' + object.metadata.namespace`.
+	Expression string `yaml:"expression"`
+}
+
+// celEnv is the environment of the CEL expressions, in which `object` is the
+// resource.
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		ext.Strings(),
+	)
+})
+
+// compileCEL parses and type-checks the expression. A filter must evaluate to
+// a bool, which is only known at runtime when the expression depends on the
+// fields of the object.
+func compileCEL(expression string, filter bool) (cel.Program, error) {
+	env, err := celEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if filter && !ast.OutputType().IsExactType(cel.BoolType) && !ast.OutputType().IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("must evaluate to a bool, not %s", ast.OutputType())
+	}
+	return env.Program(ast, cel.CostLimit(celCostLimit), cel.InterruptCheckFrequency(100))
+}
+
+// resourceExpressions are the compiled filters and computed fields of a data
+// gatherer.
+type resourceExpressions struct {
+	filters  []cel.Program
+	computed []computedProgram
+}
+
+type computedProgram struct {
+	name    string
+	program cel.Program
+}
+
+// compileExpressions compiles the filters and computed fields of the config.
+// It returns nil expressions if there are none, and an error per invalid
+// expression or computed field name.
+func (c *ConfigDynamic) compileExpressions() (*resourceExpressions, []string) {
+	if len(c.Filters) == 0 && len(c.ComputedFields) == 0 {
+		return nil, nil
+	}
+	var errs []string
+	var e resourceExpressions
+	for i, filter := range c.Filters {
+		program, err := compileCEL(filter, true)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid filters[%d]: %s", i, err))
+			continue
+		}
+		e.filters = append(e.filters, program)
+	}
+
+	var names []string
+	for i, field := range c.ComputedFields {
+		switch {
+		case field.Name == "":
+			errs = append(errs, fmt.Sprintf("invalid computed-fields[%d]: name must not be empty", i))
+		case slices.Contains(names, field.Name):
+			errs = append(errs, fmt.Sprintf("invalid computed-fields[%d]: duplicate name %q", i, field.Name))
+		}
+		names = append(names, field.Name)
+
+		program, err := compileCEL(field.Expression, false)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid computed-fields[%d]: %s", i, err))
+			continue
+		}
+		e.computed = append(e.computed, computedProgram{name: field.Name, program: program})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return &e, nil
+}
+
+// applyExpressions drops the resources rejected by the filters and sets the
+// computed fields of the others. The resources must be copies of the cached
+// resources, since the computed fields are set on them. An evaluation error
+// drops the resource for a filter, and omits the field for a computed field;
+// the errors are logged once per call.
+func (g *DataGathererDynamic) applyExpressions(ctx context.Context, items []*api.GatheredResource) []*api.GatheredResource {
+	e := g.expressions
+	if e == nil {
+		return items
+	}
+	var failures int
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+		failures++
+	}
+
+	items = slices.DeleteFunc(items, func(item *api.GatheredResource) bool {
+		object, err := g.celObject(item.Resource)
+		if err != nil {
+			fail(err)
+			return true
+		}
+		activation := map[string]any{"object": object}
+
+		for _, filter := range e.filters {
+			out, _, err := filter.Eval(activation)
+			if err != nil {
+				fail(err)
+				return true
+			}
+			if out != types.True {
+				if _, ok := out.(types.Bool); !ok {
+					fail(fmt.Errorf("filter evaluated to %s instead of a bool", out.Type()))
+				}
+				return true
+			}
+		}
+
+		for _, field := range e.computed {
+			out, _, err := field.program.Eval(activation)
+			if err != nil {
+				fail(fmt.Errorf("computed field %q: %w", field.name, err))
+				continue
+			}
+			value, err := out.ConvertToNative(reflect.TypeFor[*structpb.Value]())
+			if err != nil {
+				fail(fmt.Errorf("computed field %q: %w", field.name, err))
+				continue
+			}
+			if item.ComputedFields == nil {
+				item.ComputedFields = map[string]any{}
+			}
+			item.ComputedFields[field.name] = value.(*structpb.Value).AsInterface()
+		}
+		return false
+	})
+
+	if failures > 0 {
+		klog.FromContext(ctx).V(logs.Debug).Info("Failed to evaluate CEL expressions", "failures", failures, "firstError", firstErr)
+	}
+	return items
+}
+
+// celObject returns the resource as seen by the CEL expressions: its fields
+// without the excluded annotation and label keys, the fields of RedactFields,
+// the Secret data that are only kept in memory for the encryption or the event
+// handlers, and the fields of the Routes that aren't in RouteSelectedFields,
+// which must not end up in the computed fields.
+func (g *DataGathererDynamic) celObject(resource any) (map[string]any, error) {
+	var object map[string]any
+	switch resource := resource.(type) {
+	case *unstructured.Unstructured:
+		object = maps.Clone(resource.Object)
+	case runtime.Object:
+		var err error
+		object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(resource)
+		if err != nil {
+			return nil, err
+		}
+		// The typed objects of the informers have no TypeMeta, which is only
+		// set again by redactList, after the expressions are evaluated.
+		if _, ok := object["kind"]; !ok {
+			gvks, _, err := scheme.Scheme.ObjectKinds(resource)
+			if err != nil {
+				return nil, err
+			}
+			for _, gvk := range gvks {
+				if gvk.Kind != "" && gvk.Version != "" && gvk.Version != runtime.APIVersionInternal {
+					object["apiVersion"], object["kind"] = gvk.GroupVersion().String(), gvk.Kind
+					break
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported resource type %T", resource)
+	}
+
+	if metadata, ok := object["metadata"].(map[string]any); ok {
+		metadata = maps.Clone(metadata)
+		for field, patterns := range map[string][]*regexp.Regexp{"annotations": g.ExcludeAnnotKeys, "labels": g.ExcludeLabelKeys} {
+			if values, ok := metadata[field].(map[string]any); ok {
+				values = maps.Clone(values)
+				maps.DeleteFunc(values, func(key string, _ any) bool {
+					return slices.ContainsFunc(patterns, func(p *regexp.Regexp) bool { return p.MatchString(key) })
+				})
+				metadata[field] = values
+			}
+		}
+		object["metadata"] = metadata
+		// The metadata and annotations are copies, from which the redacted
+		// fields can be removed.
+		for _, field := range RedactFields {
+			unstructured.RemoveNestedField(object, field...)
+		}
+	}
+
+	if object["kind"] == "Secret" && object["apiVersion"] == "v1" {
+		if data, ok := object["data"].(map[string]any); ok {
+			data = maps.Clone(data)
+			maps.DeleteFunc(data, func(key string, _ any) bool {
+				return !slices.ContainsFunc(SecretSelectedFields, func(field FieldPath) bool {
+					return len(field) == 2 && field[0] == "data" && field[1] == key
+				})
+			})
+			object["data"] = data
+		}
+	}
+
+	// As in redactList, only the allow-listed fields of the Routes are
+	// kept, since spec.tls.key holds a private key. Select copies the
+	// selected fields into a new object.
+	if apiVersion, _ := object["apiVersion"].(string); object["kind"] == "Route" && strings.HasPrefix(apiVersion, "route.openshift.io/") {
+		route := &unstructured.Unstructured{Object: object}
+		if err := Select(RouteSelectedFields, route); err != nil {
+			return nil, err
+		}
+		object = route.Object
+	}
+	return object, nil
+}
@@ -0,0 +1,126 @@
+package k8sdynamic
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/jetstack/preflight/api/reader"
+)
+
+const certificatesFieldName = "_certificates"
+
+// setCertificates parses the certificate chain stored in the tls.crt key of a
+// TLS or Opaque Secret and sets the metadata of each certificate, in the order
+// of the chain, as a top-level synthetic field on the resource. This spares the
+// consumers of the data readings from decoding and parsing tls.crt themselves.
+// The field isn't set when no certificate can be parsed. This function does
+// not check that the given resource is actually a Secret; that is the caller's
+// responsibility.
+func setCertificates(resource *unstructured.Unstructured) {
+	secretType, _, _ := unstructured.NestedString(resource.Object, "type")
+	switch corev1.SecretType(secretType) {
+	case corev1.SecretTypeTLS, corev1.SecretTypeOpaque, "":
+	default:
+		return
+	}
+
+	encoded, found, err := unstructured.NestedString(resource.Object, "data", corev1.TLSCertKey)
+	if err != nil || !found {
+		return
+	}
+	pemData, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+	// The certificates parsed before an invalid one are kept.
+	certs, _ := reader.ParseCertificates(pemData)
+	if len(certs) == 0 {
+		return
+	}
+
+	var metadata []any
+	for _, cert := range certs {
+		metadata = append(metadata, certificateMetadata(cert))
+	}
+	_ = unstructured.SetNestedSlice(resource.Object, metadata, certificatesFieldName)
+}
+
+// certificateMetadata returns the metadata of the certificate using only the
+// types allowed in unstructured objects.
+func certificateMetadata(cert *x509.Certificate) map[string]any {
+	fingerprint := sha256.Sum256(cert.Raw)
+	metadata := map[string]any{
+		"subject":            cert.Subject.String(),
+		"issuer":             cert.Issuer.String(),
+		"serialNumber":       cert.SerialNumber.Text(16),
+		"sha256Fingerprint":  hex.EncodeToString(fingerprint[:]),
+		"notBefore":          cert.NotBefore.UTC().Format(time.RFC3339),
+		"notAfter":           cert.NotAfter.UTC().Format(time.RFC3339),
+		"publicKeyAlgorithm": cert.PublicKeyAlgorithm.String(),
+		"publicKeySize":      int64(reader.KeySize(cert.PublicKey)),
+		"signatureAlgorithm": cert.SignatureAlgorithm.String(),
+		"isCA":               cert.IsCA,
+	}
+
+	var sans []any
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	if len(sans) > 0 {
+		metadata["subjectAlternativeNames"] = sans
+	}
+
+	var usages []any
+	for _, usage := range cert.ExtKeyUsage {
+		usages = append(usages, extKeyUsageName(usage))
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		usages = append(usages, oid.String())
+	}
+	if len(usages) > 0 {
+		metadata["extKeyUsages"] = usages
+	}
+
+	return metadata
+}
+
+// extKeyUsageNames uses the names of RFC 5280 and of the OpenSSL short names
+// for the other usages.
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:                            "any",
+	x509.ExtKeyUsageServerAuth:                     "serverAuth",
+	x509.ExtKeyUsageClientAuth:                     "clientAuth",
+	x509.ExtKeyUsageCodeSigning:                    "codeSigning",
+	x509.ExtKeyUsageEmailProtection:                "emailProtection",
+	x509.ExtKeyUsageIPSECEndSystem:                 "ipsecEndSystem",
+	x509.ExtKeyUsageIPSECTunnel:                    "ipsecTunnel",
+	x509.ExtKeyUsageIPSECUser:                      "ipsecUser",
+	x509.ExtKeyUsageTimeStamping:                   "timeStamping",
+	x509.ExtKeyUsageOCSPSigning:                    "OCSPSigning",
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     "msSGC",
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      "nsSGC",
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "msCodeCom",
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "msKernelCodeSigning",
+}
+
+func extKeyUsageName(usage x509.ExtKeyUsage) string {
+	if name, ok := extKeyUsageNames[usage]; ok {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,115 @@
+package k8sdynamic
+
+import (
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/testutil/testcert"
+)
+
+func TestSetCertificates(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ca := testcert.New(t, testcert.Options{
+		SerialNumber: 1,
+		CommonName:   "ca",
+		Organization: []string{"Example"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(365 * 24 * time.Hour),
+		IsCA:         true,
+	})
+	leaf := testcert.New(t, testcert.Options{
+		SerialNumber: 0xabc,
+		CommonName:   "example.com",
+		DNSNames:     []string{"example.com", "www.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("10.0.0.1")},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(90 * 24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		Parent:       ca,
+		Curve:        elliptic.P384(),
+	})
+	chain := testcert.Chain(leaf, ca)
+
+	secret := func(secretType string, tlsCrt []byte) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]any{"name": "example", "namespace": "default"},
+			"type":       secretType,
+			"data": map[string]any{
+				"tls.crt": base64.StdEncoding.EncodeToString(tlsCrt),
+				"tls.key": "c2VjcmV0",
+			},
+		}}
+	}
+
+	t.Run("TLS Secret", func(t *testing.T) {
+		resource := secret("kubernetes.io/tls", chain)
+		setCertificates(resource)
+
+		certs, found, err := unstructured.NestedSlice(resource.Object, certificatesFieldName)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Len(t, certs, 2)
+
+		leaf := certs[0].(map[string]any)
+		assert.Equal(t, "CN=example.com", leaf["subject"])
+		assert.Equal(t, "CN=ca,O=Example", leaf["issuer"])
+		assert.Equal(t, "abc", leaf["serialNumber"])
+		assert.Len(t, leaf["sha256Fingerprint"], 64)
+		assert.Equal(t, "2024-01-01T00:00:00Z", leaf["notBefore"])
+		assert.Equal(t, "2024-03-31T00:00:00Z", leaf["notAfter"])
+		assert.Equal(t, "ECDSA", leaf["publicKeyAlgorithm"])
+		assert.Equal(t, int64(384), leaf["publicKeySize"])
+		assert.Equal(t, "ECDSA-SHA256", leaf["signatureAlgorithm"])
+		assert.Equal(t, false, leaf["isCA"])
+		assert.Equal(t, []any{"DNS:example.com", "DNS:www.example.com", "IP:10.0.0.1"}, leaf["subjectAlternativeNames"])
+		assert.Equal(t, []any{"serverAuth", "clientAuth"}, leaf["extKeyUsages"])
+
+		ca := certs[1].(map[string]any)
+		assert.Equal(t, true, ca["isCA"])
+		assert.NotContains(t, ca, "subjectAlternativeNames")
+		assert.NotContains(t, ca, "extKeyUsages")
+
+		// The field must be deep-copyable, like any unstructured field.
+		assert.Equal(t, resource, resource.DeepCopy())
+	})
+
+	t.Run("Opaque Secret", func(t *testing.T) {
+		resource := secret("Opaque", chain)
+		setCertificates(resource)
+		certs, _, _ := unstructured.NestedSlice(resource.Object, certificatesFieldName)
+		assert.Len(t, certs, 2)
+	})
+
+	t.Run("other Secret types are ignored", func(t *testing.T) {
+		resource := secret("kubernetes.io/service-account-token", chain)
+		setCertificates(resource)
+		assert.NotContains(t, resource.Object, certificatesFieldName)
+	})
+
+	t.Run("no certificate", func(t *testing.T) {
+		resource := secret("kubernetes.io/tls", []byte("not a certificate"))
+		setCertificates(resource)
+		assert.NotContains(t, resource.Object, certificatesFieldName)
+	})
+
+	t.Run("the field is kept by redactList", func(t *testing.T) {
+		g := &DataGathererDynamic{IncludeCertificates: true}
+		resource := secret("kubernetes.io/tls", chain)
+		require.NoError(t, g.redactList(t.Context(), []*api.GatheredResource{{Resource: resource}}))
+
+		certs, _, _ := unstructured.NestedSlice(resource.Object, certificatesFieldName)
+		assert.Len(t, certs, 2)
+		assert.NotContains(t, resource.Object["data"], "tls.key")
+	})
+}
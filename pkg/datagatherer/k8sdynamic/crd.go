@@ -0,0 +1,389 @@
+package k8sdynamic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pmylund/go-cache"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/logs"
+)
+
+// autoVersion is the version of the resource-type that is resolved to the
+// preferred version of the resource served by the API server.
+const autoVersion = "auto"
+
+var crdsGVR = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// ErrVersionNotResolved is returned by NewDataGatherer when the version auto
+// of a data gatherer that isn't optional can't be resolved, because the API
+// group isn't served or the discovery failed. Use errors.Is to check for it.
+var ErrVersionNotResolved = errors.New("failed to resolve version auto")
+
+// resolveVersion returns the GVR with its version replaced by the preferred
+// version of the group, or by the first other version of the group serving
+// the resource. The versions whose resources can't be discovered are skipped.
+func resolveVersion(cl discovery.DiscoveryInterface, gvr schema.GroupVersionResource) (schema.GroupVersionResource, error) {
+	groups, err := cl.ServerGroups()
+	if err != nil {
+		return gvr, fmt.Errorf("%w: failed to discover the API groups: %v", ErrVersionNotResolved, err)
+	}
+	var errs []error
+	for _, group := range groups.Groups {
+		if group.Name != gvr.Group {
+			continue
+		}
+		versions := []string{group.PreferredVersion.Version}
+		for _, v := range group.Versions {
+			if !slices.Contains(versions, v.Version) {
+				versions = append(versions, v.Version)
+			}
+		}
+		for _, v := range versions {
+			gv := schema.GroupVersion{Group: gvr.Group, Version: v}
+			resources, err := cl.ServerResourcesForGroupVersion(gv.String())
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to discover the resources of %s: %v", gv, err))
+				continue
+			}
+			if slices.ContainsFunc(resources.APIResources, func(r metav1.APIResource) bool { return r.Name == gvr.Resource }) {
+				gvr.Version = v
+				return gvr, nil
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return gvr, fmt.Errorf("%w: %v", ErrVersionNotResolved, errors.Join(errs...))
+	}
+	return gvr, fmt.Errorf("%w: no version of the API group %q serves %q, set optional to wait for its CRD", ErrVersionNotResolved, gvr.Group, gvr.Resource)
+}
+
+// CRDStatus is the state of the CRD of an optional data gatherer.
+type CRDStatus struct {
+	// Name is the name of the CRD, e.g. certificates.cert-manager.io.
+	Name string
+	// Installed is true when the CRD is established and serves the
+	// configured version.
+	Installed bool
+	// GroupVersionResource is the resource gathered while the CRD is
+	// installed, with the version resolved.
+	GroupVersionResource schema.GroupVersionResource
+}
+
+// crdWatch is the state of an optional data gatherer, which only gathers the
+// resources while their CRD is installed. The resources are gathered by an
+// inner data gatherer, created when the CRD is installed and stopped when it
+// is removed. Its informers aren't shared through the registry, since they
+// are stopped with the CRD.
+type crdWatch struct {
+	config   ConfigDynamic
+	client   dynamic.Interface
+	informer k8scache.SharedIndexInformer
+	// changed is notified by the event handlers of the CRD informer.
+	changed chan struct{}
+	// handlers are the event handlers added with AddEventHandler, which are
+	// added to each inner data gatherer.
+	handlers []k8scache.ResourceEventHandler
+
+	mu     sync.Mutex
+	status CRDStatus
+	// inner gathers the resources. It is kept once stopped, so that the
+	// resources are reported as deleted until they expire from its cache.
+	inner  *DataGathererDynamic
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// crdName returns the name of the CRD defining the resource.
+func crdName(gvr schema.GroupVersionResource) string {
+	return gvr.Resource + "." + gvr.Group
+}
+
+// newOptionalDataGatherer returns a data gatherer that watches the CRD of the
+// resource and gathers the resources while the CRD is installed.
+func (c *ConfigDynamic) newOptionalDataGatherer(ctx context.Context, cl dynamic.Interface) (*DataGathererDynamic, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	registry := informerRegistryFrom(ctx)
+	name := crdName(c.GroupVersionResource)
+	informer, err := registry.informer(ctx, informerKey{
+		dynamicClient: cl,
+		gvr:           crdsGVR,
+		fieldSelector: "metadata.name=" + name,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	watch := &crdWatch{
+		config:   *c,
+		client:   cl,
+		informer: informer,
+		changed:  make(chan struct{}, 1),
+		status:   CRDStatus{Name: name},
+	}
+	notify := func() {
+		select {
+		case watch.changed <- struct{}{}:
+		default:
+		}
+	}
+	_, err = informer.AddEventHandler(k8scache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { notify() },
+		UpdateFunc: func(any, any) { notify() },
+		DeleteFunc: func(any) { notify() },
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataGathererDynamic{
+		groupVersionResource: c.GroupVersionResource,
+		registry:             registry,
+		crd:                  watch,
+		IncludeCertificates:  c.IncludeCertificates,
+	}, nil
+}
+
+// CRDStatus returns the state of the CRD of an optional data gatherer, or
+// false if the data gatherer isn't optional.
+func (g *DataGathererDynamic) CRDStatus() (CRDStatus, bool) {
+	if g.crd == nil {
+		return CRDStatus{}, false
+	}
+	g.crd.mu.Lock()
+	defer g.crd.mu.Unlock()
+	return g.crd.status, true
+}
+
+// runOptional runs the CRD informer and starts or stops the inner data
+// gatherer whenever the CRD changes, until the context is done.
+func (g *DataGathererDynamic) runOptional(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() { errs <- g.registry.run(ctx, g.crd.informer) }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			g.stopInner(ctx, true)
+			return <-errs
+		case <-g.crd.changed:
+			g.reconcileCRD(ctx)
+		}
+	}
+}
+
+// reconcileCRD starts the inner data gatherer when the CRD is installed, and
+// stops it when the CRD is removed or no longer serves the version.
+func (g *DataGathererDynamic) reconcileCRD(ctx context.Context) {
+	log := klog.FromContext(ctx).WithValues("crd", g.crd.status.Name)
+	obj, _, err := g.crd.informer.GetStore().GetByKey(g.crd.status.Name)
+	if err != nil {
+		log.Error(err, "Failed to get the CRD from the informer")
+		return
+	}
+	var gvr schema.GroupVersionResource
+	crd, ok := obj.(*unstructured.Unstructured)
+	if ok {
+		gvr, ok = servedVersion(crd, g.crd.config.GroupVersionResource)
+	}
+
+	g.crd.mu.Lock()
+	current := g.crd.status
+	g.crd.mu.Unlock()
+	if current.Installed && ok && current.GroupVersionResource == gvr {
+		return
+	}
+
+	switch {
+	case current.Installed && ok:
+		// The resources are carried over to the data gatherer of the new
+		// version.
+		log.Info("CRD version changed, restarting the data gatherer", "groupVersionResource", current.GroupVersionResource)
+		g.stopInner(ctx, false)
+	case current.Installed:
+		log.Info("CRD removed, stopping the data gatherer", "groupVersionResource", current.GroupVersionResource)
+		g.stopInner(ctx, true)
+	}
+	if !ok {
+		log.V(logs.Debug).Info("Waiting for the CRD to be installed")
+		return
+	}
+
+	log.Info("CRD installed, starting the data gatherer", "groupVersionResource", gvr)
+	if err := g.startInner(ctx, gvr); err != nil {
+		log.Error(err, "Failed to start the data gatherer")
+	}
+}
+
+// servedVersion returns the GVR with the version served by the CRD: the
+// configured version, or the preferred version for version auto. It returns
+// false when the CRD isn't established or doesn't serve the version.
+func servedVersion(crd *unstructured.Unstructured, gvr schema.GroupVersionResource) (schema.GroupVersionResource, bool) {
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	if !slices.ContainsFunc(conditions, func(c any) bool {
+		condition, _ := c.(map[string]any)
+		return condition["type"] == "Established" && condition["status"] == "True"
+	}) {
+		return gvr, false
+	}
+
+	var served []string
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		v, _ := v.(map[string]any)
+		if name, _ := v["name"].(string); name != "" && v["served"] == true {
+			served = append(served, name)
+		}
+	}
+	if gvr.Version != autoVersion {
+		return gvr, slices.Contains(served, gvr.Version)
+	}
+	if len(served) == 0 {
+		return gvr, false
+	}
+	// The preferred version of a CRD is the one with the highest priority,
+	// e.g. v1 over v1beta2, as for the API discovery.
+	slices.SortFunc(served, func(a, b string) int {
+		return version.CompareKubeAwareVersionStrings(b, a)
+	})
+	gvr.Version = served[0]
+	return gvr, true
+}
+
+// startInner creates and runs the inner data gatherer for the GVR.
+func (g *DataGathererDynamic) startInner(ctx context.Context, gvr schema.GroupVersionResource) error {
+	config := g.crd.config
+	config.GroupVersionResource = gvr
+	innerCtx, cancel := context.WithCancel(WithInformerRegistry(ctx, NewInformerRegistry()))
+	dg, err := config.newDataGathererWithClient(innerCtx, g.crd.client, nil)
+	if err != nil {
+		cancel()
+		return err
+	}
+	inner := dg.(*DataGathererDynamic)
+	// Carry over the resources of the previous inner data gatherer, e.g.
+	// when the CRD is reinstalled before the next Fetch, so that the
+	// deletions recorded by stopInner are still reported.
+	g.crd.mu.Lock()
+	previous := g.crd.inner
+	g.crd.mu.Unlock()
+	if previous != nil {
+		previous.fetchMu.Lock()
+		copyCache(inner.cache, previous.cache)
+		inner.fetchedUpdateCounts = previous.fetchedUpdateCounts
+		inner.periodStart = previous.periodStart
+		previous.fetchMu.Unlock()
+	}
+	inner.ExcludeAnnotKeys = g.ExcludeAnnotKeys
+	inner.ExcludeLabelKeys = g.ExcludeLabelKeys
+	inner.Encryptor = g.Encryptor
+	inner.IncludeLastModifiedTime = g.IncludeLastModifiedTime
+	inner.CheckTLSKeyPairs = g.CheckTLSKeyPairs
+	inner.IncludeCertificates = g.IncludeCertificates
+	for _, handler := range g.crd.handlers {
+		if err := inner.AddEventHandler(handler); err != nil {
+			cancel()
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := inner.Run(innerCtx); err != nil {
+			klog.FromContext(ctx).Error(err, "Data gatherer stopped", "groupVersionResource", gvr)
+		}
+	}()
+
+	g.crd.mu.Lock()
+	defer g.crd.mu.Unlock()
+	g.crd.inner, g.crd.cancel, g.crd.done = inner, cancel, done
+	g.crd.status.Installed = true
+	g.crd.status.GroupVersionResource = gvr
+	return nil
+}
+
+// copyCache copies the items of src to dst, with the time they have left
+// before they expire.
+func copyCache(dst, src *cache.Cache) {
+	for key, item := range src.Items() {
+		ttl := cache.NoExpiration
+		if item.Expiration > 0 {
+			ttl = time.Until(time.Unix(0, item.Expiration))
+			if ttl <= 0 {
+				// Expired since Items was called.
+				continue
+			}
+		}
+		dst.Set(key, item.Object, ttl)
+	}
+}
+
+// stopInner stops the inner data gatherer, if running. When the CRD is
+// removed, the resources are deleted with it, so they are all marked as
+// deleted.
+func (g *DataGathererDynamic) stopInner(ctx context.Context, removed bool) {
+	g.crd.mu.Lock()
+	inner, cancel, done := g.crd.inner, g.crd.cancel, g.crd.done
+	g.crd.cancel, g.crd.done = nil, nil
+	g.crd.status.Installed = false
+	g.crd.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+	if !removed {
+		return
+	}
+
+	log := klog.FromContext(ctx)
+	for _, item := range inner.cache.Items() {
+		cacheObject := item.Object.(*api.GatheredResource)
+		onDelete(log, k8scache.DeletedFinalStateUnknown{Obj: cacheObject.Resource}, inner.cache)
+	}
+}
+
+// fetchOptional returns the resources of the inner data gatherer, or no
+// resources if the CRD was never installed.
+func (g *DataGathererDynamic) fetchOptional(ctx context.Context) (any, int, error) {
+	g.crd.mu.Lock()
+	inner := g.crd.inner
+	g.crd.mu.Unlock()
+	if inner == nil {
+		return &api.DynamicData{Items: []*api.GatheredResource{}}, 0, nil
+	}
+	return inner.Fetch(ctx)
+}
+
+// waitForOptionalCacheSync waits for the CRD informer to sync, and for the
+// inner data gatherer when the CRD is installed. A missing CRD isn't an
+// error.
+func (g *DataGathererDynamic) waitForOptionalCacheSync(ctx context.Context) error {
+	if !k8scache.WaitForCacheSync(ctx.Done(), g.crd.informer.HasSynced) {
+		return ErrCacheSyncTimeout
+	}
+	g.crd.mu.Lock()
+	inner := g.crd.inner
+	installed := g.crd.status.Installed
+	g.crd.mu.Unlock()
+	if inner == nil || !installed {
+		return nil
+	}
+	return inner.WaitForCacheSync(ctx)
+}
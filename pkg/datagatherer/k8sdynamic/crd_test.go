@@ -0,0 +1,284 @@
+package k8sdynamic
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pmylund/go-cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/jetstack/preflight/api"
+)
+
+var certificatesGVR = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+
+func newCRD(name, group, resource string, established bool, versions ...map[string]any) *unstructured.Unstructured {
+	var specVersions []any
+	for _, v := range versions {
+		specVersions = append(specVersions, v)
+	}
+	status := "False"
+	if established {
+		status = "True"
+	}
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"metadata":   map[string]any{"name": name, "uid": name},
+		"spec": map[string]any{
+			"group":    group,
+			"names":    map[string]any{"plural": resource},
+			"versions": specVersions,
+		},
+		"status": map[string]any{
+			"conditions": []any{map[string]any{"type": "Established", "status": status}},
+		},
+	}}
+}
+
+func served(name string) map[string]any {
+	return map[string]any{"name": name, "served": true, "storage": false}
+}
+
+func TestResolveVersion(t *testing.T) {
+	cl := &fakediscovery.FakeDiscovery{Fake: &k8stesting.Fake{Resources: []*metav1.APIResourceList{
+		{GroupVersion: "networking.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "ingresses"}}},
+		{GroupVersion: "example.com/v2", APIResources: []metav1.APIResource{{Name: "widgets"}}},
+		{GroupVersion: "example.com/v1", APIResources: []metav1.APIResource{{Name: "widgets"}, {Name: "gadgets"}}},
+	}}}
+
+	tests := map[string]struct {
+		gvr         schema.GroupVersionResource
+		expected    string
+		expectedErr string
+	}{
+		"preferred version": {
+			gvr:      schema.GroupVersionResource{Group: "networking.k8s.io", Version: "auto", Resource: "ingresses"},
+			expected: "v1",
+		},
+		"the first version of the group is preferred": {
+			gvr:      schema.GroupVersionResource{Group: "example.com", Version: "auto", Resource: "widgets"},
+			expected: "v2",
+		},
+		"resource only served by another version": {
+			gvr:      schema.GroupVersionResource{Group: "example.com", Version: "auto", Resource: "gadgets"},
+			expected: "v1",
+		},
+		"group not served": {
+			gvr:         schema.GroupVersionResource{Group: "cert-manager.io", Version: "auto", Resource: "certificates"},
+			expectedErr: `failed to resolve version auto: no version of the API group "cert-manager.io" serves "certificates", set optional to wait for its CRD`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			gvr, err := resolveVersion(cl, tc.gvr)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, gvr.Version)
+		})
+	}
+
+	t.Run("versions that can't be discovered are skipped", func(t *testing.T) {
+		cl := &fakediscovery.FakeDiscovery{Fake: &k8stesting.Fake{Resources: cl.Resources}}
+		calls := 0
+		cl.PrependReactor("get", "resource", func(k8stesting.Action) (bool, runtime.Object, error) {
+			calls++
+			// The preferred version, v2, is discovered first.
+			if calls == 1 {
+				return true, nil, errors.New("connection refused")
+			}
+			return false, nil, nil
+		})
+		gvr, err := resolveVersion(cl, schema.GroupVersionResource{Group: "example.com", Version: "auto", Resource: "widgets"})
+		require.NoError(t, err)
+		assert.Equal(t, "v1", gvr.Version)
+	})
+
+	t.Run("discovery errors", func(t *testing.T) {
+		cl := &fakediscovery.FakeDiscovery{Fake: &k8stesting.Fake{Resources: cl.Resources}}
+		cl.PrependReactor("get", "resource", func(k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("connection refused")
+		})
+		_, err := resolveVersion(cl, schema.GroupVersionResource{Group: "networking.k8s.io", Version: "auto", Resource: "ingresses"})
+		assert.ErrorIs(t, err, ErrVersionNotResolved)
+		assert.EqualError(t, err, "failed to resolve version auto: failed to discover the resources of networking.k8s.io/v1: connection refused")
+	})
+}
+
+func TestCopyCache(t *testing.T) {
+	src := cache.New(5*time.Minute, 0)
+	src.Set("default", "a", cache.DefaultExpiration)
+	src.Set("permanent", "b", cache.NoExpiration)
+	src.Set("expired", "c", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	dst := cache.New(time.Minute, 0)
+	copyCache(dst, src)
+	items := dst.Items()
+	assert.Len(t, items, 2)
+	assert.Equal(t, int64(0), items["permanent"].Expiration)
+	remaining := time.Until(time.Unix(0, items["default"].Expiration))
+	assert.True(t, remaining > 4*time.Minute && remaining <= 5*time.Minute, "remaining %s", remaining)
+}
+
+func TestServedVersion(t *testing.T) {
+	auto := schema.GroupVersionResource{Group: "cert-manager.io", Version: "auto", Resource: "certificates"}
+	tests := map[string]struct {
+		crd             *unstructured.Unstructured
+		gvr             schema.GroupVersionResource
+		expectedVersion string
+		expectedOK      bool
+	}{
+		"served version": {
+			crd:             newCRD("certificates.cert-manager.io", "cert-manager.io", "certificates", true, served("v1")),
+			gvr:             certificatesGVR,
+			expectedVersion: "v1",
+			expectedOK:      true,
+		},
+		"version not served": {
+			crd: newCRD("certificates.cert-manager.io", "cert-manager.io", "certificates", true,
+				served("v1alpha2"), map[string]any{"name": "v1", "served": false}),
+			gvr: certificatesGVR,
+		},
+		"not established": {
+			crd: newCRD("certificates.cert-manager.io", "cert-manager.io", "certificates", false, served("v1")),
+			gvr: certificatesGVR,
+		},
+		"auto picks the version with the highest priority": {
+			crd: newCRD("certificates.cert-manager.io", "cert-manager.io", "certificates", true,
+				served("v1alpha2"), served("v1"), served("v1beta1"), map[string]any{"name": "v2", "served": false}),
+			gvr:             auto,
+			expectedVersion: "v1",
+			expectedOK:      true,
+		},
+		"auto without served versions": {
+			crd: newCRD("certificates.cert-manager.io", "cert-manager.io", "certificates", true),
+			gvr: auto,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			gvr, ok := servedVersion(tc.crd, tc.gvr)
+			assert.Equal(t, tc.expectedOK, ok)
+			if ok {
+				assert.Equal(t, tc.expectedVersion, gvr.Version)
+			}
+		})
+	}
+}
+
+func TestOptionalDataGatherer(t *testing.T) {
+	certificate := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "cert-manager.io/v1",
+		"kind":       "Certificate",
+		"metadata":   map[string]any{"name": "example", "namespace": "default", "uid": "example"},
+	}}
+	cl := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			crdsGVR:         "CustomResourceDefinitionList",
+			certificatesGVR: "CertificateList",
+		},
+		certificate,
+	)
+	ctx := WithInformerRegistry(t.Context(), NewInformerRegistry())
+	config := ConfigDynamic{
+		GroupVersionResource: schema.GroupVersionResource{Group: "cert-manager.io", Version: "auto", Resource: "certificates"},
+		Optional:             true,
+	}
+	dg, err := config.newOptionalDataGatherer(ctx, cl)
+	require.NoError(t, err)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	wg.Go(func() { assert.NoError(t, dg.Run(runCtx)) })
+
+	fetch := func(t assert.TestingT) []*api.GatheredResource {
+		data, count, err := dg.Fetch(ctx)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		items := data.(*api.DynamicData).Items
+		assert.Len(t, items, count)
+		return items
+	}
+
+	t.Run("the missing CRD isn't a cache sync timeout", func(t *testing.T) {
+		syncCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		require.NoError(t, dg.WaitForCacheSync(syncCtx))
+		status, ok := dg.CRDStatus()
+		require.True(t, ok)
+		assert.Equal(t, CRDStatus{Name: "certificates.cert-manager.io"}, status)
+		assert.Empty(t, fetch(t))
+	})
+
+	t.Run("the data gatherer starts when the CRD is installed", func(t *testing.T) {
+		crd := newCRD("certificates.cert-manager.io", "cert-manager.io", "certificates", true, served("v1"))
+		_, err := cl.Resource(crdsGVR).Create(ctx, crd, metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		assert.EventuallyWithT(t, func(t *assert.CollectT) {
+			status, _ := dg.CRDStatus()
+			assert.Equal(t, CRDStatus{Name: "certificates.cert-manager.io", Installed: true, GroupVersionResource: certificatesGVR}, status)
+			items := fetch(t)
+			if assert.Len(t, items, 1) {
+				assert.Equal(t, "example", items[0].Resource.(*unstructured.Unstructured).GetName())
+				assert.True(t, items[0].DeletedAt.IsZero())
+			}
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("the resources are deleted with the CRD", func(t *testing.T) {
+		require.NoError(t, cl.Resource(crdsGVR).Delete(ctx, "certificates.cert-manager.io", metav1.DeleteOptions{}))
+
+		assert.EventuallyWithT(t, func(t *assert.CollectT) {
+			status, _ := dg.CRDStatus()
+			assert.False(t, status.Installed)
+			items := fetch(t)
+			if assert.Len(t, items, 1) {
+				assert.False(t, items[0].DeletedAt.IsZero())
+				assert.True(t, items[0].DeletionInferred)
+			}
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("the deletions are still reported once the CRD is reinstalled", func(t *testing.T) {
+		require.NoError(t, cl.Resource(certificatesGVR).Namespace("default").Delete(ctx, "example", metav1.DeleteOptions{}))
+		other := certificate.DeepCopy()
+		other.SetName("other")
+		other.SetUID("other")
+		_, err := cl.Resource(certificatesGVR).Namespace("default").Create(ctx, other, metav1.CreateOptions{})
+		require.NoError(t, err)
+		crd := newCRD("certificates.cert-manager.io", "cert-manager.io", "certificates", true, served("v1"))
+		_, err = cl.Resource(crdsGVR).Create(ctx, crd, metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		assert.EventuallyWithT(t, func(t *assert.CollectT) {
+			status, _ := dg.CRDStatus()
+			assert.True(t, status.Installed)
+			deleted := map[string]bool{}
+			for _, item := range fetch(t) {
+				deleted[item.Resource.(*unstructured.Unstructured).GetName()] = !item.DeletedAt.IsZero()
+			}
+			assert.Equal(t, map[string]bool{"example": true, "other": false}, deleted)
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
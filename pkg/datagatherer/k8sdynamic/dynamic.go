@@ -40,6 +40,7 @@ import (
 	"regexp"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pmylund/go-cache"
@@ -47,14 +48,15 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -64,20 +66,29 @@ import (
 	"github.com/jetstack/preflight/api"
 	"github.com/jetstack/preflight/internal/envelope"
 	"github.com/jetstack/preflight/pkg/datagatherer"
-	"github.com/jetstack/preflight/pkg/kubeconfig"
-	"github.com/jetstack/preflight/pkg/logs"
 )
 
 // ConfigDynamic contains the configuration for the data-gatherer.
 type ConfigDynamic struct {
 	// KubeConfigPath is the path to the kubeconfig file. If empty, will assume it runs in-cluster.
 	KubeConfigPath string `yaml:"kubeconfig"`
-	// GroupVersionResource identifies the resource type to gather.
+	// GroupVersionResource identifies the resource type to gather. The
+	// version may be `auto`, which is resolved to the preferred version
+	// served by the API server.
 	GroupVersionResource schema.GroupVersionResource
-	// ExcludeNamespaces is a list of namespaces to exclude.
+	// Optional, if true, only gathers the resources while their CRD is
+	// installed. The CRD is watched, so the data gatherer starts when the
+	// CRD is installed and stops when it is removed.
+	Optional bool `yaml:"optional"`
+	// ExcludeNamespaces is a list of namespaces to exclude. The entries may
+	// be globs, such as `team-*`, or regular expressions enclosed in slashes.
 	ExcludeNamespaces []string `yaml:"exclude-namespaces"`
-	// IncludeNamespaces is a list of namespaces to include.
+	// IncludeNamespaces is a list of namespaces to include. The entries may
+	// be globs, such as `team-*`, or regular expressions enclosed in slashes.
 	IncludeNamespaces []string `yaml:"include-namespaces"`
+	// NamespaceSelector is a label selector that the namespaces must match,
+	// in addition to IncludeNamespaces and ExcludeNamespaces.
+	NamespaceSelector string `yaml:"namespace-selector"`
 	// FieldSelectors is a list of field selectors to use when listing this resource
 	FieldSelectors []string `yaml:"field-selectors"`
 	// LabelSelectors is a list of label selectors to use when listing this resource
@@ -86,6 +97,16 @@ type ConfigDynamic struct {
 	ExcludeAnnotationKeysRegex []string `yaml:"excludeAnnotationKeysRegex"`
 	// ExcludeLabelKeysRegex is a list of regular expressions to exclude.
 	ExcludeLabelKeysRegex []string `yaml:"excludeLabelKeysRegex"`
+	// IncludeCertificates adds the parsed metadata of the certificates found
+	// in tls.crt as _certificates on TLS and Opaque Secrets.
+	IncludeCertificates bool `yaml:"include-certificates"`
+	// Filters is a list of CEL expressions, such as
+	// `object.type == 'kubernetes.io/tls'`, that the resources must all
+	// satisfy to be gathered.
+	Filters []string `yaml:"filters"`
+	// ComputedFields are values derived from each resource by CEL
+	// expressions, and added to the gathered resources.
+	ComputedFields []ComputedField `yaml:"computed-fields"`
 }
 
 // UnmarshalYAML unmarshals the ConfigDynamic resolving GroupVersionResource.
@@ -97,12 +118,17 @@ func (c *ConfigDynamic) UnmarshalYAML(unmarshal func(any) error) error {
 			Version  string `yaml:"version"`
 			Resource string `yaml:"resource"`
 		} `yaml:"resource-type"`
-		ExcludeNamespaces          []string `yaml:"exclude-namespaces"`
-		IncludeNamespaces          []string `yaml:"include-namespaces"`
-		FieldSelectors             []string `yaml:"field-selectors"`
-		LabelSelectors             []string `yaml:"label-selectors"`
-		ExcludeAnnotationKeysRegex []string `yaml:"excludeAnnotationKeysRegex"`
-		ExcludeLabelKeysRegex      []string `yaml:"excludeLabelKeysRegex"`
+		Optional                   bool            `yaml:"optional"`
+		ExcludeNamespaces          []string        `yaml:"exclude-namespaces"`
+		IncludeNamespaces          []string        `yaml:"include-namespaces"`
+		NamespaceSelector          string          `yaml:"namespace-selector"`
+		FieldSelectors             []string        `yaml:"field-selectors"`
+		LabelSelectors             []string        `yaml:"label-selectors"`
+		ExcludeAnnotationKeysRegex []string        `yaml:"excludeAnnotationKeysRegex"`
+		ExcludeLabelKeysRegex      []string        `yaml:"excludeLabelKeysRegex"`
+		IncludeCertificates        bool            `yaml:"include-certificates"`
+		Filters                    []string        `yaml:"filters"`
+		ComputedFields             []ComputedField `yaml:"computed-fields"`
 	}{}
 	err := unmarshal(&aux)
 	if err != nil {
@@ -113,18 +139,30 @@ func (c *ConfigDynamic) UnmarshalYAML(unmarshal func(any) error) error {
 	c.GroupVersionResource.Group = aux.ResourceType.Group
 	c.GroupVersionResource.Version = aux.ResourceType.Version
 	c.GroupVersionResource.Resource = aux.ResourceType.Resource
+	c.Optional = aux.Optional
 	c.ExcludeNamespaces = aux.ExcludeNamespaces
 	c.IncludeNamespaces = aux.IncludeNamespaces
+	c.NamespaceSelector = aux.NamespaceSelector
 	c.FieldSelectors = aux.FieldSelectors
 	c.LabelSelectors = aux.LabelSelectors
 	c.ExcludeAnnotationKeysRegex = aux.ExcludeAnnotationKeysRegex
 	c.ExcludeLabelKeysRegex = aux.ExcludeLabelKeysRegex
+	c.IncludeCertificates = aux.IncludeCertificates
+	c.Filters = aux.Filters
+	c.ComputedFields = aux.ComputedFields
 
 	return nil
 }
 
 // validate validates the configuration.
 func (c *ConfigDynamic) validate() error {
+	_, err := c.validateAndCompile()
+	return err
+}
+
+// validateAndCompile validates the configuration and returns the compiled CEL
+// expressions, or nil if there are none.
+func (c *ConfigDynamic) validateAndCompile() (*resourceExpressions, error) {
 	var errs []string
 	if len(c.ExcludeNamespaces) > 0 && len(c.IncludeNamespaces) > 0 {
 		errs = append(errs, "cannot set excluded and included namespaces")
@@ -134,6 +172,26 @@ func (c *ConfigDynamic) validate() error {
 		errs = append(errs, "invalid configuration: GroupVersionResource.Resource cannot be empty")
 	}
 
+	if c.Optional && c.GroupVersionResource.Group == "" {
+		errs = append(errs, "invalid configuration: optional requires the group of a CRD")
+	}
+
+	for i, entry := range c.IncludeNamespaces {
+		if err := validateNamespaceEntry(entry); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid include-namespaces[%d]: %s", i, err))
+		}
+	}
+
+	for i, entry := range c.ExcludeNamespaces {
+		if err := validateNamespaceEntry(entry); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid exclude-namespaces[%d]: %s", i, err))
+		}
+	}
+
+	if _, err := labels.Parse(c.NamespaceSelector); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid namespace selector: %s", err))
+	}
+
 	for i, fieldSelectorString := range c.FieldSelectors {
 		if fieldSelectorString == "" {
 			errs = append(errs, fmt.Sprintf("invalid field selector %d: must not be empty", i))
@@ -166,11 +224,14 @@ func (c *ConfigDynamic) validate() error {
 		}
 	}
 
+	expressions, exprErrs := c.compileExpressions()
+	errs = append(errs, exprErrs...)
+
 	if len(errs) > 0 {
-		return errors.New(strings.Join(errs, ", "))
+		return nil, errors.New(strings.Join(errs, ", "))
 	}
 
-	return nil
+	return expressions, nil
 }
 
 // sharedInformerFunc creates a SharedIndexInformer given a SharedInformerFactory
@@ -215,19 +276,48 @@ var kubernetesNativeResources = map[schema.GroupVersionResource]sharedInformerFu
 	batchv1.SchemeGroupVersion.WithResource("jobs"): func(sharedFactory informers.SharedInformerFactory) k8scache.SharedIndexInformer {
 		return sharedFactory.Batch().V1().Jobs().Informer()
 	},
+	corev1.SchemeGroupVersion.WithResource("namespaces"): func(sharedFactory informers.SharedInformerFactory) k8scache.SharedIndexInformer {
+		return sharedFactory.Core().V1().Namespaces().Informer()
+	},
 }
 
 // NewDataGatherer constructs a new instance of the generic K8s data-gatherer for the provided
 func (c *ConfigDynamic) NewDataGatherer(ctx context.Context) (datagatherer.DataGatherer, error) {
+	registry := informerRegistryFrom(ctx)
+	ctx = WithInformerRegistry(ctx, registry)
+	if c.Optional {
+		// The CRDs are never native resources.
+		cl, err := registry.dynamicClient(c.KubeConfigPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.newOptionalDataGatherer(ctx, cl)
+	}
+
+	if c.GroupVersionResource.Version == autoVersion {
+		cl, err := registry.discoveryClient(c.KubeConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		gvr, err := resolveVersion(cl, c.GroupVersionResource)
+		if err != nil {
+			return nil, err
+		}
+		resolved := *c
+		resolved.GroupVersionResource = gvr
+		c = &resolved
+	}
+
 	if isNativeResource(c.GroupVersionResource) {
-		clientset, err := kubeconfig.NewClientSet(c.KubeConfigPath)
+		clientset, err := registry.clientset(c.KubeConfigPath)
 		if err != nil {
 			return nil, err
 		}
 
 		return c.newDataGathererWithClient(ctx, nil, clientset)
 	} else {
-		cl, err := kubeconfig.NewDynamicClient(c.KubeConfigPath)
+		cl, err := registry.dynamicClient(c.KubeConfigPath)
 		if err != nil {
 			return nil, err
 		}
@@ -238,11 +328,12 @@ func (c *ConfigDynamic) NewDataGatherer(ctx context.Context) (datagatherer.DataG
 
 func (c *ConfigDynamic) newDataGathererWithClient(ctx context.Context, cl dynamic.Interface, clientset kubernetes.Interface) (datagatherer.DataGatherer, error) {
 	log := klog.FromContext(ctx)
-	if err := c.validate(); err != nil {
+	expressions, err := c.validateAndCompile()
+	if err != nil {
 		return nil, err
 	}
 	// init shared informer for selected namespaces
-	fieldSelector := generateExcludedNamespacesFieldSelector(c.ExcludeNamespaces)
+	fieldSelector := generateExcludedNamespacesFieldSelector(literalNamespaces(c.ExcludeNamespaces))
 
 	// Add any custom field selectors to the excluded namespaces selector
 	// The selectors have already been validated, so it is safe to use
@@ -268,66 +359,65 @@ func (c *ConfigDynamic) newDataGathererWithClient(ctx context.Context, cl dynami
 	// init cache to store gathered resources
 	dgCache := cache.New(5*time.Minute, 30*time.Second)
 
+	registry := informerRegistryFrom(ctx)
+	namespaceFilter, err := c.newNamespaceFilter(ctx, registry, cl, clientset)
+	if err != nil {
+		return nil, err
+	}
+
 	newDataGatherer := &DataGathererDynamic{
 		groupVersionResource: c.GroupVersionResource,
 		fieldSelector:        fieldSelector.String(),
 		labelSelector:        labelSelector.String(),
 		namespaces:           c.IncludeNamespaces,
+		namespaceFilter:      namespaceFilter,
 		cache:                dgCache,
+		registry:             registry,
+		expressions:          expressions,
+		periodStart:          clock.now(),
+		IncludeCertificates:  c.IncludeCertificates,
+	}
+	if newDataGatherer.namespaceFilter != nil {
+		// The included namespaces are matched by the namespace filter.
+		newDataGatherer.namespaces = nil
 	}
 
-	// In order to reduce memory usage that might come from using Dynamic Informers
-	// * https://github.com/kyverno/kyverno/issues/1832#issuecomment-968782166
-	// * https://github.com/kubernetes/client-go/issues/832
-	// * https://github.com/kubernetes/client-go/issues/871
-	// we use SharedIndexInformer for known resources, these informers have less of an impact on the
-	// memory usage. Dynamic datagatheres will use them for some of the native resources instead of
-	// dynamic informers.
-
-	if informerFunc, ok := kubernetesNativeResources[c.GroupVersionResource]; ok {
-		factory := informers.NewSharedInformerFactoryWithOptions(clientset,
-			// TODO(wallrj): This causes all resources to be relisted every 1
-			// minute which will cause unnecessary load on the apiserver.
-			60*time.Second,
-			informers.WithNamespace(metav1.NamespaceAll),
-			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
-				options.FieldSelector = fieldSelector.String()
-				options.LabelSelector = labelSelector.String()
-			}),
-		)
-		newDataGatherer.informer = informerFunc(factory)
-	} else {
-		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(
-			cl,
-			// TODO(wallrj): This causes all resources to be relisted every 1
-			// minute which will cause unnecessary load on the apiserver.
-			60*time.Second,
-			metav1.NamespaceAll,
-			func(options *metav1.ListOptions) {
-				options.FieldSelector = fieldSelector.String()
-				options.LabelSelector = labelSelector.String()
+	// With include-namespaces, one informer is started per namespace so that
+	// the agent only needs namespaced Roles and doesn't cache the resources
+	// of the other namespaces. The informers are shared with the other data
+	// gatherers of the registry watching the same resources.
+	for _, namespace := range c.informerNamespaces() {
+		informer, err := registry.informer(ctx, informerKey{
+			dynamicClient: cl,
+			clientset:     clientset,
+			gvr:           c.GroupVersionResource,
+			namespace:     namespace,
+			fieldSelector: canonicalFieldSelector(fieldSelector),
+			labelSelector: labelSelector.String(),
+		}, newDataGatherer)
+		if err != nil {
+			return nil, err
+		}
+
+		registration, err := informer.AddEventHandlerWithOptions(k8scache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj any) {
+				onAdd(log, obj, dgCache)
 			},
-		)
-		newDataGatherer.informer = factory.ForResource(c.GroupVersionResource).Informer()
-	}
-
-	registration, err := newDataGatherer.informer.AddEventHandlerWithOptions(k8scache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj any) {
-			onAdd(log, obj, dgCache)
-		},
-		UpdateFunc: func(oldObj, newObj any) {
-			onUpdate(log, oldObj, newObj, dgCache)
-		},
-		DeleteFunc: func(obj any) {
-			onDelete(log, obj, dgCache)
-		},
-	}, k8scache.HandlerOptions{
-		Logger: &log,
-	})
-	if err != nil {
-		return nil, err
+			UpdateFunc: func(oldObj, newObj any) {
+				onUpdate(log, oldObj, newObj, dgCache)
+			},
+			DeleteFunc: func(obj any) {
+				onDelete(log, obj, dgCache)
+			},
+		}, k8scache.HandlerOptions{
+			Logger: &log,
+		})
+		if err != nil {
+			return nil, err
+		}
+		newDataGatherer.informers = append(newDataGatherer.informers, informer)
+		newDataGatherer.registrations = append(newDataGatherer.registrations, registration)
 	}
-	newDataGatherer.registration = registration
 
 	for _, r := range c.ExcludeAnnotationKeysRegex {
 		compiled, err := regexp.Compile(r)
@@ -361,6 +451,11 @@ type DataGathererDynamic struct {
 	// This field *must* be omitted when the groupVersionResource refers to a
 	// non-namespaced resource.
 	namespaces []string
+	// namespaceFilter, if non-nil, selects the namespaces of the resources
+	// returned when include-namespaces or exclude-namespaces contain
+	// patterns, or when namespace-selector is set. The informers then watch
+	// all the namespaces.
+	namespaceFilter *namespaceFilter
 	// fieldSelector is a field selector string used to filter resources
 	// returned by the Kubernetes API.
 	// https://kubernetes.io/docs/concepts/overview/working-with-objects/field-selectors/
@@ -371,9 +466,31 @@ type DataGathererDynamic struct {
 	// cache holds all resources watched by the data gatherer, default object expiry time 5 minutes
 	// 30 seconds purge time https://pkg.go.dev/github.com/patrickmn/go-cache
 	cache *cache.Cache
-	// informer watches the events around the targeted resource and updates the cache
-	informer     k8scache.SharedIndexInformer
-	registration k8scache.ResourceEventHandlerRegistration
+	// informers watch the events around the targeted resource and update the
+	// cache. There is one informer per included namespace, or a single
+	// cluster-wide informer.
+	informers     []k8scache.SharedIndexInformer
+	registrations []k8scache.ResourceEventHandlerRegistration
+	// registry runs the informers, which may be shared with other data
+	// gatherers.
+	registry *InformerRegistry
+	// crd is set when the data gatherer is optional, in which case the
+	// resources are gathered by an inner data gatherer while the CRD is
+	// installed.
+	crd *crdWatch
+	// expressions, if non-nil, are the CEL filters and computed fields
+	// applied to the resources by Fetch.
+	expressions *resourceExpressions
+
+	// fetchMu serializes Fetch, which computes the change timeline of the
+	// resources since the previous Fetch.
+	fetchMu sync.Mutex
+	// fetchedUpdateCounts are the update counts of the cached resources, by
+	// UID, at the previous Fetch.
+	fetchedUpdateCounts map[types.UID]int
+	// periodStart is the time of the previous Fetch, or the time at which the
+	// data gatherer was created.
+	periodStart time.Time
 
 	ExcludeAnnotKeys []*regexp.Regexp
 	ExcludeLabelKeys []*regexp.Regexp
@@ -383,39 +500,71 @@ type DataGathererDynamic struct {
 	Encryptor envelope.Encryptor
 
 	// IncludeLastModifiedTime, if true, extracts the most recent time from
-	// metadata.managedFields and includes it as _lastModifiedTime on Secrets.
+	// metadata.managedFields and includes it as LastModifiedAt on all the
+	// gathered resources. It is also included as _lastModifiedTime on the
+	// resources that aren't decoded into typed objects, such as the Secrets.
 	IncludeLastModifiedTime bool
+
+	// CheckTLSKeyPairs, if true, checks that tls.key matches tls.crt when the
+	// Secrets are received, before tls.key is dropped, and sets the error as
+	// TLSKeyPairErrorFieldName for the event handlers. The private keys
+	// aren't kept in memory, unless Encryptor is set.
+	CheckTLSKeyPairs bool
+
+	// IncludeCertificates, if true, parses the certificates found in tls.crt
+	// and includes their metadata as _certificates on TLS and Opaque Secrets.
+	IncludeCertificates bool
 }
 
 func (g *DataGathererDynamic) GVR() schema.GroupVersionResource {
 	return g.groupVersionResource
 }
 
+// AddEventHandler registers an additional event handler on the informers, for
+// example to compute metrics from the watched resources. It must be called
+// before Run. The objects passed to the handler are shared with the informers'
+// caches and must not be modified.
+func (g *DataGathererDynamic) AddEventHandler(handler k8scache.ResourceEventHandler) error {
+	if g.crd != nil {
+		g.crd.handlers = append(g.crd.handlers, handler)
+		return nil
+	}
+	for _, informer := range g.informers {
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Run starts the dynamic data gatherer's informers for resource collection.
 // Returns error if the data gatherer informer wasn't initialized, Run blocks
 // until the stopCh is closed.
 func (g *DataGathererDynamic) Run(ctx context.Context) error {
-	log := klog.FromContext(ctx)
-	if g.informer == nil {
-		return fmt.Errorf("informer was not initialized, impossible to start")
+	if g.crd != nil {
+		return g.runOptional(ctx)
 	}
 
-	// attach WatchErrorHandler, it needs to be set before starting an informer
-	err := g.informer.SetWatchErrorHandler(func(r *k8scache.Reflector, err error) {
-		if strings.Contains(fmt.Sprintf("%s", err), "the server could not find the requested resource") {
-			log.V(logs.Debug).Info("Server missing resource for datagatherer", "groupVersionResource", g.groupVersionResource)
-		} else {
-			log.Info("datagatherer informer has failed and is backing off", "groupVersionResource", g.groupVersionResource, "reason", err)
-		}
-	})
-	if err != nil {
-		return fmt.Errorf("failed to SetWatchErrorHandler on informer: %s", err)
+	if len(g.informers) == 0 {
+		return fmt.Errorf("informer was not initialized, impossible to start")
 	}
 
-	// start shared informer
-	g.informer.RunWithContext(ctx)
+	// start shared informers, the WatchErrorHandler is attached by the
+	// registry when the informers are created
+	informers := slices.Clone(g.informers)
+	if g.namespaceFilter != nil && g.namespaceFilter.informer != nil {
+		informers = append(informers, g.namespaceFilter.informer)
+	}
+	errs := make([]error, len(informers))
+	var wg sync.WaitGroup
+	for i, informer := range informers {
+		wg.Go(func() {
+			errs[i] = g.registry.run(ctx, informer)
+		})
+	}
+	wg.Wait()
 
-	return nil
+	return errors.Join(errs...)
 }
 
 var ErrCacheSyncTimeout = fmt.Errorf("timed out waiting for Kubernetes cache to sync")
@@ -424,8 +573,19 @@ var ErrCacheSyncTimeout = fmt.Errorf("timed out waiting for Kubernetes cache to
 // collecting the resources. Use errors.Is(err, ErrCacheSyncTimeout) to check if
 // the cache sync failed.
 func (g *DataGathererDynamic) WaitForCacheSync(ctx context.Context) error {
+	if g.crd != nil {
+		return g.waitForOptionalCacheSync(ctx)
+	}
+
+	var hasSynced []k8scache.InformerSynced
+	for _, registration := range g.registrations {
+		hasSynced = append(hasSynced, registration.HasSynced)
+	}
+	if g.namespaceFilter != nil && g.namespaceFilter.informer != nil {
+		hasSynced = append(hasSynced, g.namespaceFilter.informer.HasSynced)
+	}
 	// Don't use WaitForNamedCacheSync, since we don't want to log extra messages.
-	if !k8scache.WaitForCacheSync(ctx.Done(), g.registration.HasSynced) {
+	if !k8scache.WaitForCacheSync(ctx.Done(), hasSynced...) {
 		return ErrCacheSyncTimeout
 	}
 
@@ -433,11 +593,23 @@ func (g *DataGathererDynamic) WaitForCacheSync(ctx context.Context) error {
 }
 
 // Fetch will fetch the requested data from the apiserver, or return an error
-// if fetching the data fails.
+// if fetching the data fails. The returned resources are copies of the cached
+// resources, which Fetch never modifies.
+//
+// The UpdateCount and CreatedAndDeleted fields of the returned resources cover
+// the period since the previous Fetch, i.e. usually since the previous upload.
 func (g *DataGathererDynamic) Fetch(ctx context.Context) (any, int, error) {
 	if g.groupVersionResource.String() == "" {
 		return nil, -1, fmt.Errorf("resource type must be specified")
 	}
+	if g.crd != nil {
+		return g.fetchOptional(ctx)
+	}
+
+	g.fetchMu.Lock()
+	defer g.fetchMu.Unlock()
+	periodEnd := clock.now()
+	updateCounts := make(map[types.UID]int, g.cache.ItemCount())
 
 	var items = []*api.GatheredResource{}
 
@@ -453,8 +625,9 @@ func (g *DataGathererDynamic) Fetch(ctx context.Context) (any, int, error) {
 		// filter cache items by namespace
 		cacheObject := item.Object.(*api.GatheredResource)
 		if resource, ok := cacheObject.Resource.(cacheResource); ok {
+			updateCounts[resource.GetUID()] = cacheObject.UpdateCount
 			namespace := resource.GetNamespace()
-			if isIncludedNamespace(namespace, fetchNamespaces) {
+			if isIncludedNamespace(namespace, fetchNamespaces) && g.namespaceFilter.matches(namespace) {
 				items = append(items, cacheObject)
 			}
 			continue
@@ -464,17 +637,53 @@ func (g *DataGathererDynamic) Fetch(ctx context.Context) (any, int, error) {
 
 	items = g.excludeResources(items)
 
+	// The cached resources are shared with the informers' stores, the event
+	// handlers and the other data gatherers sharing the informers, so they
+	// are copied before being redacted.
+	for i, item := range items {
+		snapshot, err := snapshotGatheredResource(item)
+		if err != nil {
+			return nil, -1, err
+		}
+		g.setPeriodTimeline(snapshot)
+		items[i] = snapshot
+	}
+
+	// The CEL expressions see the resources before they are redacted, but
+	// without the Secret data and the excluded keys.
+	items = g.applyExpressions(ctx, items)
+
 	// Redact Secret data (which may include encrypting it if enabled)
 	err := g.redactList(ctx, items)
 	if err != nil {
 		return nil, -1, err
 	}
 
+	g.fetchedUpdateCounts = updateCounts
+	g.periodStart = periodEnd
+
 	return &api.DynamicData{
 		Items: items,
 	}, len(items), nil
 }
 
+// setPeriodTimeline turns the update count of the resource since it was
+// cached into the count since the previous Fetch, and sets CreatedAndDeleted
+// when the resource was deleted after being created since the previous Fetch.
+func (g *DataGathererDynamic) setPeriodTimeline(item *api.GatheredResource) {
+	accessor, err := meta.Accessor(item.Resource)
+	if err != nil {
+		return
+	}
+	// The count restarts when the resource expires from the cache and is
+	// added again.
+	if fetched := g.fetchedUpdateCounts[accessor.GetUID()]; fetched <= item.UpdateCount {
+		item.UpdateCount -= fetched
+	}
+	created := accessor.GetCreationTimestamp()
+	item.CreatedAndDeleted = !item.DeletedAt.IsZero() && !g.periodStart.IsZero() && !created.IsZero() && !created.Time.Before(g.periodStart)
+}
+
 // excludeResources drops any resource whose annotation or label keys match the
 // configured exclusion patterns. This is distinct from redactList, which strips
 // matching keys from kept resources.
@@ -521,6 +730,8 @@ func anyKeyMatches(m map[string]string, patterns []*regexp.Regexp) bool {
 // However, if keepSecretData is true (i.e., encryption is enabled), secret data is NOT redacted
 // so it can be encrypted later in the upload pipeline.
 // For Route resources, only the fields related to CA certificate and policy are retained.
+// The secret material found in the string fields of all resources, such as
+// private keys and tokens, is replaced by redaction markers.
 // TODO(wallrj): A short coming of the current allow-list implementation is that
 // you have to specify absolute fields paths. It is not currently possible to
 // select all metadata with: `{metadata}`. This means that the metadata for
@@ -533,6 +744,10 @@ func (g *DataGathererDynamic) redactList(ctx context.Context, list []*api.Gather
 	}
 
 	for i := range list {
+		if !g.IncludeLastModifiedTime {
+			list[i].LastModifiedAt = api.Time{}
+		}
+
 		if item, ok := list[i].Resource.(*unstructured.Unstructured); ok {
 			// Determine the kind of items in case this is a generic 'mixed' list.
 			gvks, _, err := scheme.Scheme.ObjectKinds(item)
@@ -542,6 +757,14 @@ func (g *DataGathererDynamic) redactList(ctx context.Context, list []*api.Gather
 
 			resource := item
 
+			if g.IncludeLastModifiedTime {
+				setLastModifiedTime(resource)
+			} else {
+				// set at ingest for another data gatherer sharing the
+				// informer
+				unstructured.RemoveNestedField(resource.Object, lastModifiedTimeFieldName)
+			}
+
 			// Redact item if it is a Secret or a Route.
 			for _, gvk := range gvks {
 				// secret object
@@ -559,8 +782,8 @@ func (g *DataGathererDynamic) redactList(ctx context.Context, list []*api.Gather
 						}
 					}
 
-					if g.IncludeLastModifiedTime {
-						setLastModifiedTime(resource)
+					if g.IncludeCertificates {
+						setCertificates(resource)
 					}
 
 					// Redact to only selected fields
@@ -581,6 +804,8 @@ func (g *DataGathererDynamic) redactList(ctx context.Context, list []*api.Gather
 			RemoveUnstructuredKeys(g.ExcludeAnnotKeys, resource, "metadata", "annotations")
 			RemoveUnstructuredKeys(g.ExcludeLabelKeys, resource, "metadata", "labels")
 
+			g.redactSecretMaterial(ctx, list[i])
+
 			continue
 		}
 
@@ -615,6 +840,8 @@ func (g *DataGathererDynamic) redactList(ctx context.Context, list []*api.Gather
 				break
 			}
 
+			g.redactSecretMaterial(ctx, list[i])
+
 			continue
 		}
 	}
@@ -791,6 +1018,19 @@ func generateExcludedNamespacesFieldSelector(excludeNamespaces []string) fields.
 	return fields.AndSelectors(selectors...)
 }
 
+// informerNamespaces returns the namespaces in which an informer is started:
+// each of the included namespaces, or all the namespaces when none is
+// included, when one of them is the empty string, or when the namespaces are
+// selected dynamically.
+func (c *ConfigDynamic) informerNamespaces() []string {
+	if len(c.IncludeNamespaces) == 0 || slices.Contains(c.IncludeNamespaces, metav1.NamespaceAll) || c.HasDynamicNamespaces() {
+		return []string{metav1.NamespaceAll}
+	}
+	namespaces := slices.Clone(c.IncludeNamespaces)
+	slices.Sort(namespaces)
+	return slices.Compact(namespaces)
+}
+
 func isIncludedNamespace(namespace string, namespaces []string) bool {
 	if namespaces[0] == metav1.NamespaceAll {
 		return true
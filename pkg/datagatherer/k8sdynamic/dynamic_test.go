@@ -17,6 +17,7 @@ import (
 
 	"github.com/lestrrat-go/jwx/v3/jwa"
 	"github.com/lestrrat-go/jwx/v3/jwe"
+	"github.com/pmylund/go-cache"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
@@ -30,6 +31,7 @@ import (
 	"k8s.io/client-go/informers"
 	fakeclientset "k8s.io/client-go/kubernetes/fake"
 	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2/ktesting"
 
 	"github.com/jetstack/preflight/api"
 	"github.com/jetstack/preflight/internal/envelope"
@@ -169,11 +171,11 @@ func TestNewDataGathererWithClientAndDynamicInformer(t *testing.T) {
 	if gatherer.cache == nil {
 		t.Errorf("unexpected cache value: %v", nil)
 	}
-	if gatherer.informer == nil {
-		t.Errorf("unexpected resource informer value: %v", nil)
+	if len(gatherer.informers) != 1 {
+		t.Errorf("expected 1 informer, got %d", len(gatherer.informers))
 	}
-	if gatherer.registration == nil {
-		t.Errorf("unexpected resource event handler registration value: %v", nil)
+	if len(gatherer.registrations) != 1 {
+		t.Errorf("expected 1 event handler registration, got %d", len(gatherer.registrations))
 	}
 	if !reflect.DeepEqual(gatherer.fieldSelector, expected.fieldSelector) {
 		t.Errorf("expected %v, got %v", expected.fieldSelector, gatherer.fieldSelector)
@@ -218,17 +220,81 @@ func TestNewDataGathererWithClientAndSharedIndexInformer(t *testing.T) {
 	if gatherer.cache == nil {
 		t.Errorf("unexpected cache value: %v", nil)
 	}
-	if gatherer.informer == nil {
-		t.Errorf("unexpected resource informer value: %v", nil)
+	if len(gatherer.informers) != 1 {
+		t.Errorf("expected 1 informer, got %d", len(gatherer.informers))
 	}
-	if gatherer.registration == nil {
-		t.Errorf("unexpected event handler registration value: %v", nil)
+	if len(gatherer.registrations) != 1 {
+		t.Errorf("expected 1 event handler registration, got %d", len(gatherer.registrations))
 	}
 	if !reflect.DeepEqual(gatherer.labelSelector, expected.labelSelector) {
 		t.Errorf("expected %v, got %v", expected.labelSelector, gatherer.labelSelector)
 	}
 }
 
+// With include-namespaces, the resources are listed and watched in each of the
+// included namespaces rather than cluster-wide, so that namespaced Roles are
+// enough.
+func TestDynamicGatherer_IncludeNamespacesInformers(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "secrets"}
+	cl := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "UnstructuredList"},
+		getObject("v1", "Secret", "secret-a", "a", false),
+		getObject("v1", "Secret", "secret-b", "b", false),
+		getObject("v1", "Secret", "secret-c", "c", false),
+	)
+	config := ConfigDynamic{
+		GroupVersionResource: gvr,
+		IncludeNamespaces:    []string{"b", "a", "b"},
+	}
+	dg, err := config.newDataGathererWithClient(t.Context(), cl, nil)
+	require.NoError(t, err)
+	assert.Len(t, dg.(*DataGathererDynamic).informers, 2)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() { done <- dg.Run(ctx) }()
+	require.NoError(t, dg.WaitForCacheSync(ctx))
+
+	data, count, err := dg.Fetch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	var names []string
+	for _, item := range data.(*api.DynamicData).Items {
+		names = append(names, item.Resource.(*unstructured.Unstructured).GetName())
+	}
+	assert.ElementsMatch(t, []string{"secret-a", "secret-b"}, names)
+
+	var listed []string
+	for _, action := range cl.Actions() {
+		if action.GetVerb() == "list" {
+			listed = append(listed, action.GetNamespace())
+		}
+	}
+	assert.ElementsMatch(t, []string{"a", "b"}, listed)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestInformerNamespaces(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ConfigDynamic
+		want   []string
+	}{
+		{"all namespaces", ConfigDynamic{}, []string{""}},
+		{"empty namespace", ConfigDynamic{IncludeNamespaces: []string{"a", ""}}, []string{""}},
+		{"included namespaces", ConfigDynamic{IncludeNamespaces: []string{"b", "a", "b"}}, []string{"a", "b"}},
+		{"pattern", ConfigDynamic{IncludeNamespaces: []string{"a", "team-*"}}, []string{""}},
+		{"namespace selector", ConfigDynamic{IncludeNamespaces: []string{"a"}, NamespaceSelector: "env=prod"}, []string{""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, test.config.informerNamespaces())
+		})
+	}
+}
+
 func TestUnmarshalDynamicConfig(t *testing.T) {
 	textCfg := `
 kubeconfig: "/home/someone/.kube/config"
@@ -249,6 +315,13 @@ field-selectors:
 label-selectors:
 - conjur.org/name=conjur-connect-configmap
 - app=my-app
+include-certificates: true
+optional: true
+filters:
+- has(object.metadata.ownerReferences)
+computed-fields:
+- name: owner
+  expression: object.metadata.ownerReferences[0].name
 `
 
 	expectedGVR := schema.GroupVersionResource{
@@ -299,6 +372,18 @@ label-selectors:
 	if got, want := cfg.LabelSelectors, expectedLabelSelectors; !reflect.DeepEqual(got, want) {
 		t.Errorf("LabelSelectors does not match: got=%+v want=%+v", got, want)
 	}
+	if !cfg.IncludeCertificates {
+		t.Errorf("IncludeCertificates does not match: got=false want=true")
+	}
+	if !cfg.Optional {
+		t.Errorf("Optional does not match: got=false want=true")
+	}
+	if got, want := cfg.Filters, []string{"has(object.metadata.ownerReferences)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Filters does not match: got=%+v want=%+v", got, want)
+	}
+	if got, want := cfg.ComputedFields, []ComputedField{{Name: "owner", Expression: "object.metadata.ownerReferences[0].name"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ComputedFields does not match: got=%+v want=%+v", got, want)
+	}
 }
 func TestUnmarshalDynamicConfig_ExclusionRegex(t *testing.T) {
 	// Verify that the per-gatherer excludeAnnotationKeysRegex and
@@ -351,6 +436,42 @@ func TestConfigDynamicValidate(t *testing.T) {
 			},
 			ExpectedError: "cannot set excluded and included namespaces",
 		},
+		{
+			Config: ConfigDynamic{
+				GroupVersionResource: schema.GroupVersionResource{
+					Group:    "",
+					Version:  "auto",
+					Resource: "secrets",
+				},
+				Optional: true,
+			},
+			ExpectedError: "invalid configuration: optional requires the group of a CRD",
+		},
+		{
+			Config: ConfigDynamic{
+				GroupVersionResource: schema.GroupVersionResource{
+					Group:    "",
+					Version:  "v1",
+					Resource: "secrets",
+				},
+				Filters: []string{"size(object.data)", "object.kind == 'Secret'"},
+				ComputedFields: []ComputedField{
+					{Name: "type", Expression: "object.type"},
+					{Name: "type", Expression: "object.type"},
+					{Expression: "1"},
+				},
+			},
+			ExpectedError: "invalid filters[0]: must evaluate to a bool, not int, " +
+				"invalid computed-fields[1]: duplicate name \"type\", " +
+				"invalid computed-fields[2]: name must not be empty",
+		},
+		{
+			Config: ConfigDynamic{
+				GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "secrets"},
+				ComputedFields:       []ComputedField{{Name: "type", Expression: "object.type +"}},
+			},
+			ExpectedError: "invalid computed-fields[0]: ERROR: <input>:1:14: Syntax error",
+		},
 		{
 			Config: ConfigDynamic{
 				GroupVersionResource: schema.GroupVersionResource{
@@ -387,6 +508,27 @@ func TestConfigDynamicValidate(t *testing.T) {
 			},
 			ExpectedError: "invalid excludeLabelKeysRegex[0]",
 		},
+		{
+			Config: ConfigDynamic{
+				GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "secrets"},
+				IncludeNamespaces:    []string{"team-a", "/^team-(a$/"},
+			},
+			ExpectedError: "invalid include-namespaces[1]: error parsing regexp",
+		},
+		{
+			Config: ConfigDynamic{
+				GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "secrets"},
+				ExcludeNamespaces:    []string{"team-[a"},
+			},
+			ExpectedError: "invalid exclude-namespaces[0]: syntax error in pattern",
+		},
+		{
+			Config: ConfigDynamic{
+				GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "secrets"},
+				NamespaceSelector:    "env in (prod",
+			},
+			ExpectedError: "invalid namespace selector: ",
+		},
 	}
 
 	for _, test := range tests {
@@ -1100,6 +1242,69 @@ func TestExcludeAnnotKeys_ExcludesResourcesFromUpload(t *testing.T) {
 	}
 }
 
+func TestDynamicGatherer_FetchTimeline(t *testing.T) {
+	log := ktesting.NewLogger(t, ktesting.NewConfig(ktesting.Verbosity(10)))
+	configMap := func(name, resourceVersion string, created time.Time) *unstructured.Unstructured {
+		obj := getObject("v1", "ConfigMap", name, "testns", false)
+		obj.SetResourceVersion(resourceVersion)
+		obj.SetCreationTimestamp(metav1.NewTime(created))
+		obj.SetManagedFields([]metav1.ManagedFieldsEntry{{
+			Manager: "kubectl",
+			Time:    &metav1.Time{Time: created},
+		}})
+		return obj
+	}
+	fetch := func(t *testing.T, dg *DataGathererDynamic) map[string]*api.GatheredResource {
+		t.Helper()
+		res, _, err := dg.Fetch(t.Context())
+		require.NoError(t, err)
+		items := map[string]*api.GatheredResource{}
+		for _, item := range res.(*api.DynamicData).Items {
+			items[item.Resource.(*unstructured.Unstructured).GetName()] = item
+		}
+		return items
+	}
+
+	dgCache := cache.New(5*time.Minute, 30*time.Second)
+	dg := &DataGathererDynamic{
+		groupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "configmaps"},
+		cache:                dgCache,
+		periodStart:          clock.now(),
+	}
+
+	old := configMap("old", "1", clock.now().Add(-24*time.Hour))
+	transient := configMap("transient", "1", clock.now().Add(time.Minute))
+	onAdd(log, old, dgCache)
+	onAdd(log, transient, dgCache)
+	onUpdate(log, old, configMap("old", "2", clock.now().Add(-24*time.Hour)), dgCache)
+	onUpdate(log, old, configMap("old", "3", clock.now().Add(-24*time.Hour)), dgCache)
+	onDelete(log, transient, dgCache)
+
+	clock = &laterTime{}
+	t.Cleanup(func() { clock = &fakeTime{} })
+
+	items := fetch(t, dg)
+	assert.Equal(t, 2, items["old"].UpdateCount)
+	assert.False(t, items["old"].CreatedAndDeleted)
+	assert.Equal(t, 0, items["transient"].UpdateCount)
+	assert.True(t, items["transient"].CreatedAndDeleted)
+	// the last modified time is only included when enabled
+	assert.True(t, items["old"].LastModifiedAt.IsZero())
+	assert.NotContains(t, items["old"].Resource.(*unstructured.Unstructured).Object, lastModifiedTimeFieldName)
+
+	onUpdate(log, old, configMap("old", "4", clock.now()), dgCache)
+	dg.IncludeLastModifiedTime = true
+
+	items = fetch(t, dg)
+	assert.Equal(t, 1, items["old"].UpdateCount, "the update count starts again after each Fetch")
+	assert.Equal(t, api.Time{Time: clock.now().UTC()}, items["old"].LastModifiedAt)
+	assert.Equal(t, clock.now().UTC().Format(time.RFC3339), items["old"].Resource.(*unstructured.Unstructured).Object[lastModifiedTimeFieldName])
+	assert.False(t, items["transient"].CreatedAndDeleted, "the transient resource was created before the previous Fetch")
+
+	cached, _ := dgCache.Get("old1")
+	assert.Equal(t, 3, cached.(*api.GatheredResource).UpdateCount, "Fetch must not modify the cache")
+}
+
 func TestDynamicGathererNativeResources_Fetch(t *testing.T) {
 	// start a k8s client
 	// init the datagatherer's informer with the client
@@ -1129,7 +1334,8 @@ func TestDynamicGathererNativeResources_Fetch(t *testing.T) {
 			},
 			expected: []*api.GatheredResource{
 				{
-					Resource: &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "testns", UID: "uid-testpod1"}},
+					Resource:    &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "testns", UID: "uid-testpod1"}},
+					FirstSeenAt: api.Time{Time: clock.now()},
 				},
 			},
 		},
@@ -1148,8 +1354,9 @@ func TestDynamicGathererNativeResources_Fetch(t *testing.T) {
 			},
 			expected: []*api.GatheredResource{
 				{
-					Resource:  &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testfoo", Namespace: "testns", UID: "uid-testfoo1"}},
-					DeletedAt: api.Time{Time: clock.now()},
+					Resource:    &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testfoo", Namespace: "testns", UID: "uid-testfoo1"}},
+					FirstSeenAt: api.Time{Time: clock.now()},
+					DeletedAt:   api.Time{Time: clock.now()},
 				},
 			},
 		},
@@ -1164,10 +1371,12 @@ func TestDynamicGathererNativeResources_Fetch(t *testing.T) {
 			},
 			expected: []*api.GatheredResource{
 				{
-					Resource: &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "testns", UID: "uid-testpod1"}},
+					Resource:    &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "testns", UID: "uid-testpod1"}},
+					FirstSeenAt: api.Time{Time: clock.now()},
 				},
 				{
-					Resource: &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "testns2", UID: "uid-testpod2"}},
+					Resource:    &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "testns2", UID: "uid-testpod2"}},
+					FirstSeenAt: api.Time{Time: clock.now()},
 				},
 			},
 		},
@@ -1182,10 +1391,12 @@ func TestDynamicGathererNativeResources_Fetch(t *testing.T) {
 			},
 			expected: []*api.GatheredResource{
 				{
-					Resource: &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "testns", UID: "uid-testpod1"}},
+					Resource:    &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "testns", UID: "uid-testpod1"}},
+					FirstSeenAt: api.Time{Time: clock.now()},
 				},
 				{
-					Resource: &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "testns2", UID: "uid-testpod2"}},
+					Resource:    &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "testns2", UID: "uid-testpod2"}},
+					FirstSeenAt: api.Time{Time: clock.now()},
 				},
 			},
 		},
@@ -1204,12 +1415,14 @@ func TestDynamicGathererNativeResources_Fetch(t *testing.T) {
 			},
 			expected: []*api.GatheredResource{
 				{
-					Resource:  &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "testns1", UID: "uid-testpod1"}},
-					DeletedAt: api.Time{Time: clock.now()},
+					Resource:    &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "testns1", UID: "uid-testpod1"}},
+					FirstSeenAt: api.Time{Time: clock.now()},
+					DeletedAt:   api.Time{Time: clock.now()},
 				},
 				{
-					Resource:  &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "testns2", UID: "uid-testpod2"}},
-					DeletedAt: api.Time{Time: clock.now()},
+					Resource:    &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "testns2", UID: "uid-testpod2"}},
+					FirstSeenAt: api.Time{Time: clock.now()},
+					DeletedAt:   api.Time{Time: clock.now()},
 				},
 			},
 		},
@@ -1228,10 +1441,16 @@ func TestDynamicGathererNativeResources_Fetch(t *testing.T) {
 			},
 			expected: []*api.GatheredResource{
 				{
-					Resource: &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "testns1", UID: "uid-testpod1", Labels: map[string]string{"foo": "newlabel"}}},
+					Resource:      &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod1", Namespace: "testns1", UID: "uid-testpod1", Labels: map[string]string{"foo": "newlabel"}}},
+					FirstSeenAt:   api.Time{Time: clock.now()},
+					LastUpdatedAt: api.Time{Time: clock.now()},
+					UpdateCount:   1,
 				},
 				{
-					Resource: &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "testns2", UID: "uid-testpod2", Labels: map[string]string{"foo": "newlabel"}}},
+					Resource:      &corev1.Pod{TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}, ObjectMeta: metav1.ObjectMeta{Name: "testpod2", Namespace: "testns2", UID: "uid-testpod2", Labels: map[string]string{"foo": "newlabel"}}},
+					FirstSeenAt:   api.Time{Time: clock.now()},
+					LastUpdatedAt: api.Time{Time: clock.now()},
+					UpdateCount:   1,
 				},
 			},
 		},
@@ -1277,6 +1496,7 @@ func TestDynamicGathererNativeResources_Fetch(t *testing.T) {
 							UID:       "uid-testfoo1",
 						},
 					},
+					FirstSeenAt: api.Time{Time: clock.now()},
 				},
 			},
 		},
@@ -1295,10 +1515,10 @@ func TestDynamicGathererNativeResources_Fetch(t *testing.T) {
 				&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p3", UID: "p3", Namespace: "n1", Labels: map[string]string{"super-secret-label": "bar"}}},
 			},
 			expected: []*api.GatheredResource{
-				{Resource: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p0", UID: "p0", Namespace: "n1", Annotations: map[string]string{"normal-annot": "bar"}}, TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}}},
-				{Resource: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p1", UID: "p1", Namespace: "n1", Labels: map[string]string{"normal-label": "bar"}}, TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}}},
-				{Resource: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p2", UID: "p2", Namespace: "n1", Annotations: map[string]string{}}, TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}}},
-				{Resource: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p3", UID: "p3", Namespace: "n1", Labels: map[string]string{}}, TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}}},
+				{Resource: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p0", UID: "p0", Namespace: "n1", Annotations: map[string]string{"normal-annot": "bar"}}, TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}}, FirstSeenAt: api.Time{Time: clock.now()}},
+				{Resource: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p1", UID: "p1", Namespace: "n1", Labels: map[string]string{"normal-label": "bar"}}, TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}}, FirstSeenAt: api.Time{Time: clock.now()}},
+				{Resource: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p2", UID: "p2", Namespace: "n1", Annotations: map[string]string{}}, TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}}, FirstSeenAt: api.Time{Time: clock.now()}},
+				{Resource: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p3", UID: "p3", Namespace: "n1", Labels: map[string]string{}}, TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"}}, FirstSeenAt: api.Time{Time: clock.now()}},
 			},
 		},
 	}
@@ -31,6 +31,7 @@ var SecretSelectedFields = []FieldPath{
 	{"data", "ca.crt"},
 	{"data", "conjur-map"},
 	{lastModifiedTimeFieldName},
+	{certificatesFieldName},
 }
 
 // RouteSelectedFields is the list of fields sent from OpenShift Route objects to the
@@ -68,6 +69,7 @@ var RouteSelectedFields = []FieldPath{
 	{"spec", "tls", "insecureEdgeTerminationPolicy"},
 	{"spec", "wildcardPolicy"},
 	{"status"},
+	{lastModifiedTimeFieldName},
 }
 
 // RedactFields are removed from all objects.
@@ -114,3 +116,23 @@ func Redact(fields []FieldPath, resource *unstructured.Unstructured) {
 		unstructured.RemoveNestedField(resource.Object, field...)
 	}
 }
+
+// RedactResource applies the redaction of the k8s-dynamic data gatherers to a
+// resource gathered by other means, such as a manifest file: the Secrets and
+// the OpenShift Routes are reduced to SecretSelectedFields and
+// RouteSelectedFields, and the RedactFields are removed from all resources.
+func RedactResource(resource *unstructured.Unstructured) error {
+	gvk := resource.GroupVersionKind()
+	switch {
+	case gvk.Kind == "Secret" && gvk.Group == "":
+		if err := Select(SecretSelectedFields, resource); err != nil {
+			return err
+		}
+	case gvk.Kind == "Route" && gvk.Group == "route.openshift.io":
+		if err := Select(RouteSelectedFields, resource); err != nil {
+			return err
+		}
+	}
+	Redact(RedactFields, resource)
+	return nil
+}
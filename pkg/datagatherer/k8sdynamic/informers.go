@@ -0,0 +1,329 @@
+package k8sdynamic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/pkg/kubeconfig"
+	"github.com/jetstack/preflight/pkg/logs"
+)
+
+// InformerRegistry shares the Kubernetes clients and the informers between
+// the k8s-dynamic data gatherers. The data gatherers that watch the same
+// resource with the same namespace and selectors, for instance because the
+// same config appears twice, use a single informer, i.e. a single watch and a
+// single copy of the resources in memory. Each data gatherer still registers
+// its own event handlers on the informer, and so has its own cache, filters
+// and redaction.
+//
+// The registry is passed to the data gatherers with WithInformerRegistry. The
+// data gatherers instantiated without a registry don't share anything.
+type InformerRegistry struct {
+	mu        sync.Mutex
+	clients   map[string]*clients
+	informers map[informerKey]*sharedInformer
+	// byInformer looks up the sharedInformer of the informers returned by
+	// informer.
+	byInformer map[k8scache.SharedIndexInformer]*sharedInformer
+}
+
+// NewInformerRegistry returns an empty InformerRegistry.
+func NewInformerRegistry() *InformerRegistry {
+	return &InformerRegistry{
+		clients:    map[string]*clients{},
+		informers:  map[informerKey]*sharedInformer{},
+		byInformer: map[k8scache.SharedIndexInformer]*sharedInformer{},
+	}
+}
+
+type informerRegistryKey struct{}
+
+// WithInformerRegistry returns a context that makes the data gatherers
+// instantiated with NewDataGatherer share their informers through the
+// registry.
+func WithInformerRegistry(ctx context.Context, registry *InformerRegistry) context.Context {
+	return context.WithValue(ctx, informerRegistryKey{}, registry)
+}
+
+// informerRegistryFrom returns the registry of the context, or a new registry
+// when there is none.
+func informerRegistryFrom(ctx context.Context) *InformerRegistry {
+	if registry, ok := ctx.Value(informerRegistryKey{}).(*InformerRegistry); ok {
+		return registry
+	}
+	return NewInformerRegistry()
+}
+
+// clients are the Kubernetes clients of a kubeconfig. They are created
+// lazily, since the native resources only need the clientset.
+type clients struct {
+	dynamic   dynamic.Interface
+	clientset kubernetes.Interface
+	discovery discovery.DiscoveryInterface
+}
+
+// dynamicClient returns the dynamic client of the kubeconfig, shared by the
+// data gatherers of the registry.
+func (r *InformerRegistry) dynamicClient(kubeconfigPath string) (dynamic.Interface, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.clientsLocked(kubeconfigPath)
+	if c.dynamic == nil {
+		cl, err := kubeconfig.NewDynamicClient(kubeconfigPath)
+		if err != nil {
+			return nil, err
+		}
+		c.dynamic = cl
+	}
+	return c.dynamic, nil
+}
+
+// clientset returns the clientset of the kubeconfig, shared by the data
+// gatherers of the registry.
+func (r *InformerRegistry) clientset(kubeconfigPath string) (kubernetes.Interface, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.clientsLocked(kubeconfigPath)
+	if c.clientset == nil {
+		clientset, err := kubeconfig.NewClientSet(kubeconfigPath)
+		if err != nil {
+			return nil, err
+		}
+		c.clientset = clientset
+	}
+	return c.clientset, nil
+}
+
+// discoveryClient returns the discovery client of the kubeconfig, shared by
+// the data gatherers of the registry.
+func (r *InformerRegistry) discoveryClient(kubeconfigPath string) (discovery.DiscoveryInterface, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.clientsLocked(kubeconfigPath)
+	if c.discovery == nil {
+		cl, err := kubeconfig.NewDiscoveryClient(kubeconfigPath)
+		if err != nil {
+			return nil, err
+		}
+		c.discovery = cl
+	}
+	return c.discovery, nil
+}
+
+func (r *InformerRegistry) clientsLocked(kubeconfigPath string) *clients {
+	c, ok := r.clients[kubeconfigPath]
+	if !ok {
+		c = &clients{}
+		r.clients[kubeconfigPath] = c
+	}
+	return c
+}
+
+// informerKey identifies the resources watched by an informer. The clients
+// are part of the key so that the informers of different clusters, or of
+// different fake clients in the tests, are never shared.
+type informerKey struct {
+	dynamicClient dynamic.Interface
+	clientset     kubernetes.Interface
+
+	gvr       schema.GroupVersionResource
+	namespace string
+	// fieldSelector and labelSelector are in a canonical form, so that the
+	// same selectors written in a different order share the informer.
+	fieldSelector string
+	labelSelector string
+}
+
+// sharedInformer is an informer of the registry. It is started by the first
+// data gatherer that runs it.
+type sharedInformer struct {
+	informer k8scache.SharedIndexInformer
+	// users are the data gatherers whose resources come from the informer.
+	// Their needs decide what the informer keeps in memory.
+	users []*DataGathererDynamic
+
+	mu      sync.Mutex
+	running bool
+}
+
+// informer returns the informer of the resources selected by the key,
+// creating it if needed. user is the data gatherer whose resources come from
+// the informer, or nil if the informer is only used to look up other objects,
+// such as the labels of the namespaces.
+func (r *InformerRegistry) informer(ctx context.Context, key informerKey, user *DataGathererDynamic) (k8scache.SharedIndexInformer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if shared, ok := r.informers[key]; ok {
+		if user != nil {
+			shared.users = append(shared.users, user)
+		}
+		return shared.informer, nil
+	}
+
+	informer := newInformer(key)
+	log := klog.FromContext(ctx)
+	err := informer.SetWatchErrorHandler(func(r *k8scache.Reflector, err error) {
+		if strings.Contains(fmt.Sprintf("%s", err), "the server could not find the requested resource") {
+			log.V(logs.Debug).Info("Server missing resource for datagatherer", "groupVersionResource", key.gvr)
+		} else {
+			log.Info("datagatherer informer has failed and is backing off", "groupVersionResource", key.gvr, "reason", err)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to SetWatchErrorHandler on informer: %s", err)
+	}
+
+	shared := &sharedInformer{informer: informer}
+	if user != nil {
+		shared.users = append(shared.users, user)
+	}
+	r.informers[key] = shared
+	r.byInformer[informer] = shared
+	return informer, nil
+}
+
+// run runs the informer until the context is done. The informer is only
+// started once: the other data gatherers sharing it just wait. The data
+// gatherers must all be configured before the first of them runs, since the
+// resources are redacted at ingest according to their needs.
+func (r *InformerRegistry) run(ctx context.Context, informer k8scache.SharedIndexInformer) error {
+	r.mu.Lock()
+	shared := r.byInformer[informer]
+	r.mu.Unlock()
+
+	shared.mu.Lock()
+	if shared.running {
+		shared.mu.Unlock()
+		<-ctx.Done()
+		return nil
+	}
+	shared.running = true
+	shared.mu.Unlock()
+
+	// the transform needs to be set before starting an informer
+	if err := informer.SetTransform(newIngestTransform(ingestOptionsOf(shared.users))); err != nil {
+		return fmt.Errorf("failed to SetTransform on informer: %s", err)
+	}
+	informer.RunWithContext(ctx)
+	return nil
+}
+
+// newInformer creates the informer of the key. We use SharedIndexInformer for
+// the known resources when a clientset is available, since these informers
+// have less of an impact on the memory usage than the dynamic informers:
+// * https://github.com/kyverno/kyverno/issues/1832#issuecomment-968782166
+// * https://github.com/kubernetes/client-go/issues/832
+// * https://github.com/kubernetes/client-go/issues/871
+func newInformer(key informerKey) k8scache.SharedIndexInformer {
+	tweakListOptions := func(options *metav1.ListOptions) {
+		options.FieldSelector = key.fieldSelector
+		options.LabelSelector = key.labelSelector
+	}
+	if informerFunc, ok := kubernetesNativeResources[key.gvr]; ok && key.clientset != nil {
+		factory := informers.NewSharedInformerFactoryWithOptions(key.clientset,
+			// TODO(wallrj): This causes all resources to be relisted every 1
+			// minute which will cause unnecessary load on the apiserver.
+			60*time.Second,
+			informers.WithNamespace(key.namespace),
+			informers.WithTweakListOptions(tweakListOptions),
+		)
+		return informerFunc(factory)
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(
+		key.dynamicClient,
+		// TODO(wallrj): This causes all resources to be relisted every 1
+		// minute which will cause unnecessary load on the apiserver.
+		60*time.Second,
+		key.namespace,
+		tweakListOptions,
+	)
+	return factory.ForResource(key.gvr).Informer()
+}
+
+// canonicalFieldSelector returns the terms of the field selector sorted. The
+// order of the terms doesn't change the selected resources.
+func canonicalFieldSelector(selector fields.Selector) string {
+	var terms []string
+	for _, r := range selector.Requirements() {
+		operator := r.Operator
+		if operator == selection.DoubleEquals {
+			operator = selection.Equals
+		}
+		terms = append(terms, r.Field+string(operator)+fields.EscapeValue(r.Value))
+	}
+	slices.Sort(terms)
+	return strings.Join(slices.Compact(terms), ",")
+}
+
+// Overlap returns a reason when the two configs may collect some of the same
+// resources, which are then uploaded twice. The identical configs share their
+// informers but still upload their resources separately. The configs must have
+// been validated.
+func Overlap(a, b *ConfigDynamic) (string, bool) {
+	if a.KubeConfigPath != b.KubeConfigPath || a.GroupVersionResource != b.GroupVersionResource {
+		return "", false
+	}
+	if !a.mayShareNamespace(b) || !b.mayShareNamespace(a) {
+		return "", false
+	}
+	if a.selection() == b.selection() {
+		return fmt.Sprintf("both collect the same %s", a.GroupVersionResource.Resource), true
+	}
+	return fmt.Sprintf("both may collect some of the same %s", a.GroupVersionResource.Resource), true
+}
+
+// mayShareNamespace returns false when c only includes namespace names and
+// none of them is selected by the names and patterns of other. The namespace
+// selectors aren't taken into account since the labels aren't known in
+// advance.
+func (c *ConfigDynamic) mayShareNamespace(other *ConfigDynamic) bool {
+	if len(c.IncludeNamespaces) == 0 || slices.Contains(c.IncludeNamespaces, metav1.NamespaceAll) || slices.ContainsFunc(c.IncludeNamespaces, isNamespacePattern) {
+		return true
+	}
+	include, exclude := other.namespaceMatchers()
+	names := &namespaceFilter{include: include, exclude: exclude}
+	return slices.ContainsFunc(c.IncludeNamespaces, names.matches)
+}
+
+// selection returns a canonical form of the namespaces, selectors and
+// filters of the config. It is JSON-encoded, since the namespace patterns
+// and the filters may contain any separator.
+func (c *ConfigDynamic) selection() string {
+	sorted := func(values []string) []string {
+		values = append([]string{}, values...)
+		slices.Sort(values)
+		return slices.Compact(values)
+	}
+
+	var fieldSelectors []fields.Selector
+	for _, s := range c.FieldSelectors {
+		fieldSelectors = append(fieldSelectors, fields.ParseSelectorOrDie(s))
+	}
+
+	selection, _ := json.Marshal([]any{
+		sorted(c.IncludeNamespaces),
+		sorted(c.ExcludeNamespaces),
+		c.NamespaceSelector,
+		canonicalFieldSelector(fields.AndSelectors(fieldSelectors...)),
+		sorted(c.LabelSelectors),
+		sorted(c.Filters),
+	})
+	return string(selection)
+}
@@ -0,0 +1,175 @@
+package k8sdynamic
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/datagatherer"
+)
+
+func TestInformerRegistry_SharedInformers(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "secrets"}
+	cl := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "UnstructuredList"},
+		getObjectAnnot("v1", "Secret", "secret-a", "a", nil, map[string]any{"app": "a", "tier": "web"}),
+		getObjectAnnot("v1", "Secret", "secret-b", "b", nil, map[string]any{"app": "b"}),
+	)
+	ctx := WithInformerRegistry(t.Context(), NewInformerRegistry())
+	newDg := func(t *testing.T, config ConfigDynamic) *DataGathererDynamic {
+		t.Helper()
+		config.GroupVersionResource = gvr
+		dg, err := config.newDataGathererWithClient(ctx, cl, nil)
+		require.NoError(t, err)
+		return dg.(*DataGathererDynamic)
+	}
+
+	all := newDg(t, ConfigDynamic{ExcludeAnnotationKeysRegex: []string{"^a$"}})
+	allAgain := newDg(t, ConfigDynamic{})
+	web := newDg(t, ConfigDynamic{LabelSelectors: []string{"tier=web", "app=a"}})
+	webAgain := newDg(t, ConfigDynamic{LabelSelectors: []string{"app=a,tier=web"}})
+	b := newDg(t, ConfigDynamic{LabelSelectors: []string{"app=b"}})
+
+	assert.Same(t, all.informers[0], allAgain.informers[0])
+	assert.Same(t, web.informers[0], webAgain.informers[0])
+	assert.NotSame(t, all.informers[0], web.informers[0])
+	assert.NotSame(t, web.informers[0], b.informers[0])
+
+	t.Run("without a registry, the informers aren't shared", func(t *testing.T) {
+		config := ConfigDynamic{GroupVersionResource: gvr}
+		dg, err := config.newDataGathererWithClient(t.Context(), cl, nil)
+		require.NoError(t, err)
+		assert.NotSame(t, all.informers[0], dg.(*DataGathererDynamic).informers[0])
+	})
+
+	runCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	dgs := []*DataGathererDynamic{all, allAgain, web, webAgain, b}
+	for _, dg := range dgs {
+		wg.Go(func() { assert.NoError(t, dg.Run(runCtx)) })
+	}
+	for _, dg := range dgs {
+		require.NoError(t, dg.WaitForCacheSync(runCtx))
+	}
+
+	// Each data gatherer has its own cache, filled by the shared informer.
+	names := func(t *testing.T, dg datagatherer.DataGatherer) []string {
+		t.Helper()
+		data, _, err := dg.Fetch(runCtx)
+		require.NoError(t, err)
+		var names []string
+		for _, item := range data.(*api.DynamicData).Items {
+			names = append(names, item.Resource.(*unstructured.Unstructured).GetName())
+		}
+		return names
+	}
+	assert.ElementsMatch(t, []string{"secret-a", "secret-b"}, names(t, all))
+	assert.ElementsMatch(t, []string{"secret-a", "secret-b"}, names(t, allAgain))
+	assert.ElementsMatch(t, []string{"secret-a"}, names(t, web))
+	assert.ElementsMatch(t, []string{"secret-a"}, names(t, webAgain))
+	assert.ElementsMatch(t, []string{"secret-b"}, names(t, b))
+
+	// A single list for each of the 3 distinct informers.
+	var lists int
+	for _, action := range cl.Actions() {
+		if action.GetVerb() == "list" {
+			lists++
+		}
+	}
+	assert.Equal(t, 3, lists)
+
+	cancel()
+	wg.Wait()
+}
+
+func TestCanonicalFieldSelector(t *testing.T) {
+	parse := func(s string) fields.Selector {
+		return fields.ParseSelectorOrDie(s)
+	}
+	assert.Equal(t, "", canonicalFieldSelector(fields.Everything()))
+	assert.Equal(t, "metadata.namespace!=kube-system,type=kubernetes.io/tls", canonicalFieldSelector(parse("type==kubernetes.io/tls,metadata.namespace!=kube-system")))
+	assert.Equal(t,
+		canonicalFieldSelector(parse("a=1,b!=2")),
+		canonicalFieldSelector(fields.AndSelectors(parse("b!=2"), parse("a=1"), parse("a=1"))),
+	)
+}
+
+func TestOverlap(t *testing.T) {
+	secrets := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	tests := []struct {
+		name       string
+		a, b       ConfigDynamic
+		wantReason string
+	}{
+		{
+			name:       "identical",
+			a:          ConfigDynamic{GroupVersionResource: secrets, FieldSelectors: []string{"type=a", "type!=b"}},
+			b:          ConfigDynamic{GroupVersionResource: secrets, FieldSelectors: []string{"type!=b", "type=a"}},
+			wantReason: "both collect the same secrets",
+		},
+		{
+			name:       "different label selectors",
+			a:          ConfigDynamic{GroupVersionResource: secrets, LabelSelectors: []string{"app=a"}},
+			b:          ConfigDynamic{GroupVersionResource: secrets, LabelSelectors: []string{"tier=web"}},
+			wantReason: "both may collect some of the same secrets",
+		},
+		{
+			name:       "different filters",
+			a:          ConfigDynamic{GroupVersionResource: secrets, Filters: []string{"object.type == 'kubernetes.io/tls'"}},
+			b:          ConfigDynamic{GroupVersionResource: secrets},
+			wantReason: "both may collect some of the same secrets",
+		},
+		{
+			name:       "filters containing the separator of the selectors",
+			a:          ConfigDynamic{GroupVersionResource: secrets, Filters: []string{"object.type == 'a'", "object.type == 'b'"}},
+			b:          ConfigDynamic{GroupVersionResource: secrets, Filters: []string{"object.type == 'a';object.type == 'b'"}},
+			wantReason: "both may collect some of the same secrets",
+		},
+		{
+			name:       "included namespace matching a pattern",
+			a:          ConfigDynamic{GroupVersionResource: secrets, IncludeNamespaces: []string{"team-a"}},
+			b:          ConfigDynamic{GroupVersionResource: secrets, IncludeNamespaces: []string{"team-*"}},
+			wantReason: "both may collect some of the same secrets",
+		},
+		{
+			name: "different resources",
+			a:    ConfigDynamic{GroupVersionResource: secrets},
+			b:    ConfigDynamic{GroupVersionResource: pods},
+		},
+		{
+			name: "different clusters",
+			a:    ConfigDynamic{GroupVersionResource: secrets},
+			b:    ConfigDynamic{GroupVersionResource: secrets, KubeConfigPath: "/clusters/workload-1"},
+		},
+		{
+			name: "disjoint included namespaces",
+			a:    ConfigDynamic{GroupVersionResource: secrets, IncludeNamespaces: []string{"a", "b"}},
+			b:    ConfigDynamic{GroupVersionResource: secrets, IncludeNamespaces: []string{"c"}},
+		},
+		{
+			name: "included namespace excluded by the other",
+			a:    ConfigDynamic{GroupVersionResource: secrets, IncludeNamespaces: []string{"kube-system"}},
+			b:    ConfigDynamic{GroupVersionResource: secrets, ExcludeNamespaces: []string{"kube-*"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reason, overlap := Overlap(&test.a, &test.b)
+			assert.Equal(t, test.wantReason != "", overlap)
+			assert.Equal(t, test.wantReason, reason)
+			reason, overlap = Overlap(&test.b, &test.a)
+			assert.Equal(t, test.wantReason != "", overlap)
+			assert.Equal(t, test.wantReason, reason)
+		})
+	}
+}
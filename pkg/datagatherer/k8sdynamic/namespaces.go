@@ -0,0 +1,168 @@
+package k8sdynamic
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+// A namespace pattern is an entry of include-namespaces or exclude-namespaces
+// that matches several namespaces. It is either a regular expression enclosed
+// in slashes, such as `/^team-(a|b)$/`, or a glob, such as `team-*`. The other
+// entries are namespace names.
+
+// isNamespacePattern returns true if the entry is a regular expression or a
+// glob rather than a namespace name. Namespace names can't contain the special
+// characters of the globs nor slashes.
+func isNamespacePattern(entry string) bool {
+	return isNamespaceRegex(entry) || strings.ContainsAny(entry, "*?[")
+}
+
+func isNamespaceRegex(entry string) bool {
+	return len(entry) >= 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/")
+}
+
+// validateNamespaceEntry returns an error if the entry is an invalid pattern.
+func validateNamespaceEntry(entry string) error {
+	switch {
+	case isNamespaceRegex(entry):
+		_, err := regexp.Compile(entry[1 : len(entry)-1])
+		return err
+	case isNamespacePattern(entry):
+		_, err := path.Match(entry, "")
+		return err
+	default:
+		return nil
+	}
+}
+
+// namespaceMatcher matches a namespace name against an entry of
+// include-namespaces or exclude-namespaces.
+type namespaceMatcher func(namespace string) bool
+
+// newNamespaceMatcher expects an entry validated with validateNamespaceEntry.
+func newNamespaceMatcher(entry string) namespaceMatcher {
+	switch {
+	case isNamespaceRegex(entry):
+		re := regexp.MustCompile(entry[1 : len(entry)-1])
+		return re.MatchString
+	case isNamespacePattern(entry):
+		return func(namespace string) bool {
+			ok, _ := path.Match(entry, namespace)
+			return ok
+		}
+	default:
+		return func(namespace string) bool { return namespace == entry }
+	}
+}
+
+// literalNamespaces returns the entries that are namespace names.
+func literalNamespaces(entries []string) []string {
+	return slices.DeleteFunc(slices.Clone(entries), isNamespacePattern)
+}
+
+// namespaceFilter selects the namespaces by name, by pattern, and by label
+// selector. It is evaluated each time the resources are fetched, so the
+// namespaces that are created or relabelled are picked up without a restart.
+// The labels of the namespaces are read from a Namespace informer.
+type namespaceFilter struct {
+	// include is empty when all the namespaces are included.
+	include []namespaceMatcher
+	exclude []namespaceMatcher
+
+	// selector and informer are nil when namespace-selector isn't set.
+	selector labels.Selector
+	informer k8scache.SharedIndexInformer
+}
+
+// newNamespaceFilter returns nil when the namespaces can be selected with the
+// informers' namespaces and field selectors alone, i.e. when neither patterns
+// nor a namespace selector are used. The config must have been validated.
+func (c *ConfigDynamic) newNamespaceFilter(ctx context.Context, registry *InformerRegistry, cl dynamic.Interface, clientset kubernetes.Interface) (*namespaceFilter, error) {
+	if !c.HasDynamicNamespaces() {
+		return nil, nil
+	}
+
+	f := &namespaceFilter{}
+	f.include, f.exclude = c.namespaceMatchers()
+
+	if c.NamespaceSelector != "" {
+		f.selector, _ = labels.Parse(c.NamespaceSelector)
+		var err error
+		f.informer, err = registry.informer(ctx, informerKey{
+			dynamicClient: cl,
+			clientset:     clientset,
+			gvr:           corev1.SchemeGroupVersion.WithResource("namespaces"),
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// namespaceMatchers returns the matchers of the included and excluded
+// namespaces. include is empty when all the namespaces are included.
+func (c *ConfigDynamic) namespaceMatchers() (include, exclude []namespaceMatcher) {
+	for _, entry := range c.IncludeNamespaces {
+		if entry == metav1.NamespaceAll {
+			include = nil
+			break
+		}
+		include = append(include, newNamespaceMatcher(entry))
+	}
+	for _, entry := range c.ExcludeNamespaces {
+		if entry == "" {
+			continue
+		}
+		exclude = append(exclude, newNamespaceMatcher(entry))
+	}
+	return include, exclude
+}
+
+// HasDynamicNamespaces returns true if the namespaces can't be known in
+// advance, in which case the resources are watched in all the namespaces and
+// filtered with a namespaceFilter.
+func (c *ConfigDynamic) HasDynamicNamespaces() bool {
+	return c.NamespaceSelector != "" ||
+		slices.ContainsFunc(c.IncludeNamespaces, isNamespacePattern) ||
+		slices.ContainsFunc(c.ExcludeNamespaces, isNamespacePattern)
+}
+
+// matches returns true if the resources of the namespace are selected. A nil
+// filter matches all the namespaces. Cluster-scoped resources, whose namespace
+// is empty, only match when no namespace is included and no namespace
+// selector is set.
+func (f *namespaceFilter) matches(namespace string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include) > 0 && !slices.ContainsFunc(f.include, func(m namespaceMatcher) bool { return m(namespace) }) {
+		return false
+	}
+	if slices.ContainsFunc(f.exclude, func(m namespaceMatcher) bool { return m(namespace) }) {
+		return false
+	}
+	if f.selector == nil {
+		return true
+	}
+	obj, exists, err := f.informer.GetStore().GetByKey(namespace)
+	if err != nil || !exists {
+		return false
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	return f.selector.Matches(labels.Set(accessor.GetLabels()))
+}
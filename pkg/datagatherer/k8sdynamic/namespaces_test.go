@@ -0,0 +1,157 @@
+package k8sdynamic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+
+	"github.com/jetstack/preflight/api"
+)
+
+func TestNewNamespaceMatcher(t *testing.T) {
+	tests := []struct {
+		entry     string
+		matches   []string
+		noMatches []string
+	}{
+		{entry: "team-a", matches: []string{"team-a"}, noMatches: []string{"team-ab", "team-b"}},
+		{entry: "team-*", matches: []string{"team-a", "team-"}, noMatches: []string{"teams", "my-team-a"}},
+		{entry: "team-?", matches: []string{"team-a"}, noMatches: []string{"team-ab"}},
+		{entry: "team-[ab]", matches: []string{"team-a", "team-b"}, noMatches: []string{"team-c"}},
+		{entry: "/^team-(a|b)$/", matches: []string{"team-a", "team-b"}, noMatches: []string{"team-c", "team-ab"}},
+		{entry: "/prod/", matches: []string{"prod", "payments-prod-1"}, noMatches: []string{"staging"}},
+	}
+	for _, test := range tests {
+		t.Run(test.entry, func(t *testing.T) {
+			require.NoError(t, validateNamespaceEntry(test.entry))
+			m := newNamespaceMatcher(test.entry)
+			for _, namespace := range test.matches {
+				assert.True(t, m(namespace), namespace)
+			}
+			for _, namespace := range test.noMatches {
+				assert.False(t, m(namespace), namespace)
+			}
+		})
+	}
+}
+
+func TestLiteralNamespaces(t *testing.T) {
+	entries := []string{"kube-system", "team-*", "/^prod-/", "default"}
+	assert.Equal(t, []string{"kube-system", "default"}, literalNamespaces(entries))
+	assert.Len(t, entries, 4, "the entries must be left untouched")
+}
+
+func TestNamespaceFilter_Matches(t *testing.T) {
+	var nilFilter *namespaceFilter
+	assert.True(t, nilFilter.matches("anything"))
+
+	tests := []struct {
+		name      string
+		config    ConfigDynamic
+		matches   []string
+		noMatches []string
+	}{
+		{
+			name:      "included patterns",
+			config:    ConfigDynamic{IncludeNamespaces: []string{"kube-system", "team-*"}},
+			matches:   []string{"kube-system", "team-a"},
+			noMatches: []string{"default", ""},
+		},
+		{
+			name:      "excluded patterns",
+			config:    ConfigDynamic{ExcludeNamespaces: []string{"kube-*", "/-sandbox$/"}},
+			matches:   []string{"default", "team-a", ""},
+			noMatches: []string{"kube-system", "team-a-sandbox"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := test.config.newNamespaceFilter(t.Context(), NewInformerRegistry(), nil, nil)
+			require.NoError(t, err)
+			require.NotNil(t, f)
+			for _, namespace := range test.matches {
+				assert.True(t, f.matches(namespace), namespace)
+			}
+			for _, namespace := range test.noMatches {
+				assert.False(t, f.matches(namespace), namespace)
+			}
+		})
+	}
+
+	t.Run("literal namespaces don't need a filter", func(t *testing.T) {
+		f, err := (&ConfigDynamic{IncludeNamespaces: []string{"a", "b"}}).newNamespaceFilter(t.Context(), NewInformerRegistry(), nil, nil)
+		require.NoError(t, err)
+		assert.Nil(t, f)
+	})
+}
+
+func getNamespace(name string, labels map[string]any) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata": map[string]any{
+			"name":   name,
+			"labels": labels,
+		},
+	}}
+}
+
+func TestDynamicGatherer_NamespaceSelector(t *testing.T) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	namespacesGVR := schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	cl := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			gvr:           "UnstructuredList",
+			namespacesGVR: "UnstructuredList",
+		},
+		getNamespace("team-a", map[string]any{"env": "prod"}),
+		getNamespace("team-b", map[string]any{"env": "dev"}),
+		getNamespace("other", map[string]any{"env": "prod"}),
+		getObject("v1", "Secret", "secret-a", "team-a", false),
+		getObject("v1", "Secret", "secret-b", "team-b", false),
+		getObject("v1", "Secret", "secret-other", "other", false),
+	)
+	config := ConfigDynamic{
+		GroupVersionResource: gvr,
+		IncludeNamespaces:    []string{"team-*"},
+		NamespaceSelector:    "env=prod",
+	}
+	require.NoError(t, config.validate())
+	dg, err := config.newDataGathererWithClient(t.Context(), cl, nil)
+	require.NoError(t, err)
+	assert.Len(t, dg.(*DataGathererDynamic).informers, 1)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() { done <- dg.Run(ctx) }()
+	require.NoError(t, dg.WaitForCacheSync(ctx))
+
+	fetchNames := func(t require.TestingT) []string {
+		data, _, err := dg.Fetch(ctx)
+		require.NoError(t, err)
+		var names []string
+		for _, item := range data.(*api.DynamicData).Items {
+			names = append(names, item.Resource.(*unstructured.Unstructured).GetName())
+		}
+		return names
+	}
+	assert.ElementsMatch(t, []string{"secret-a"}, fetchNames(t))
+
+	// The namespaces that are relabelled are picked up without a restart.
+	_, err = cl.Resource(namespacesGVR).Update(ctx, getNamespace("team-b", map[string]any{"env": "prod"}), metav1.UpdateOptions{})
+	require.NoError(t, err)
+	assert.EventuallyWithT(t, func(t *assert.CollectT) {
+		assert.ElementsMatch(t, []string{"secret-a", "secret-b"}, fetchNames(t))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+}
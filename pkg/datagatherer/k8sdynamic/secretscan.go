@@ -0,0 +1,245 @@
+package k8sdynamic
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/logs"
+)
+
+// MetricSecretMaterialRedactions counts the secret material found and
+// redacted in the string fields of the gathered resources. It is incremented
+// at each Fetch, so a resource holding secret material is counted at each
+// upload until it is fixed.
+var MetricSecretMaterialRedactions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "jscp",
+		Subsystem: "agent",
+		Name:      "secret_material_redactions_total",
+		Help:      "The number of secret values, such as private keys and tokens, redacted from the string fields of the gathered resources.",
+	}, []string{"type", "resource"})
+
+// secretMaterialRule detects a type of secret material in a string.
+type secretMaterialRule struct {
+	// kind is the type of secret material, used in the redaction marker and
+	// as the label of the metric.
+	kind string
+	// hints are substrings of which one must be present for the pattern to
+	// be matched, so that most strings are skipped without running the
+	// regular expression.
+	hints []string
+	// foldHints makes the hints match regardless of case, for the patterns
+	// that are case-insensitive. The hints must then be lower-case.
+	foldHints bool
+	// pattern matches the secret material. If it has a subexpression named
+	// secret, only that part of the match is redacted.
+	pattern *regexp.Regexp
+	// only, if non-nil, must match the string for the pattern to be matched.
+	only *regexp.Regexp
+}
+
+// secretMaterialRules are the types of secret material redacted from the
+// string fields of all the resources. The rules for private keys come first
+// so that the JWTs and keys found inside a redacted PEM block aren't counted
+// twice.
+var secretMaterialRules = []secretMaterialRule{
+	{
+		// PEM private keys, e.g. PKCS #1, PKCS #8, SEC 1 and OpenSSH keys,
+		// including the ones with escaped newlines inside JSON strings.
+		kind:    "private-key",
+		hints:   []string{"PRIVATE KEY-----"},
+		pattern: regexp.MustCompile(`-----BEGIN ([A-Z0-9 ]+ )?PRIVATE KEY-----[\s\S]*?-----END ([A-Z0-9 ]+ )?PRIVATE KEY-----`),
+	},
+	{
+		// The header and payload of a JWT are base64url-encoded JSON
+		// objects, which start with eyJ.
+		kind:    "jwt",
+		hints:   []string{"eyJ"},
+		pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]+`),
+	},
+	{
+		kind:    "aws-access-key",
+		hints:   []string{"AKIA", "ASIA"},
+		pattern: regexp.MustCompile(`\b(AKIA|ASIA)[A-Z0-9]{16}\b`),
+	},
+	{
+		kind:      "aws-secret-access-key",
+		hints:     []string{"aws_secret_access_key", "secretaccesskey"},
+		foldHints: true,
+		pattern:   regexp.MustCompile(`(?i)(aws_secret_access_key|secretaccesskey)"?\s*[:=]\s*"?(?P<secret>[A-Za-z0-9/+]{40})\b`),
+	},
+	{
+		kind:    "gcp-api-key",
+		hints:   []string{"AIza"},
+		pattern: regexp.MustCompile(`\bAIza[A-Za-z0-9_-]{35}\b`),
+	},
+	{
+		kind:    "azure-storage-key",
+		hints:   []string{"AccountKey="},
+		pattern: regexp.MustCompile(`AccountKey=(?P<secret>[A-Za-z0-9/+]{86}==)`),
+	},
+	{
+		// The credentials of the users of a kubeconfig, in YAML or JSON.
+		// The certificates and the other fields are kept.
+		kind:    "kubeconfig-credential",
+		hints:   []string{"Config"},
+		only:    regexp.MustCompile(`(?m)^\s*"?kind"?\s*:\s*"?Config\b`),
+		pattern: regexp.MustCompile(`"?\b(token|client-key-data|password|id-token|refresh-token|access-token|client-secret)"?\s*:\s*"?(?P<secret>[^\s",}]+)`),
+	},
+}
+
+// redactSecretMaterial redacts the secret material found in the string fields
+// of the resource and in its computed fields, and counts it in
+// MetricSecretMaterialRedactions. The resource must be a copy of the cached
+// resource.
+func (g *DataGathererDynamic) redactSecretMaterial(ctx context.Context, item *api.GatheredResource) {
+	groupResource := g.groupVersionResource.GroupResource().String()
+	var kinds []string
+	found := func(kind string) {
+		MetricSecretMaterialRedactions.WithLabelValues(kind, groupResource).Inc()
+		kinds = append(kinds, kind)
+	}
+
+	if resource, ok := item.Resource.(*unstructured.Unstructured); ok {
+		redactUnstructuredSecretMaterial(resource.Object, found)
+	} else {
+		redactTypedSecretMaterial(reflect.ValueOf(item.Resource), found)
+	}
+	redactUnstructuredSecretMaterial(item.ComputedFields, found)
+
+	if len(kinds) == 0 {
+		return
+	}
+	log := klog.FromContext(ctx).V(logs.Debug)
+	if accessor, err := meta.Accessor(item.Resource); err == nil {
+		log = log.WithValues("namespace", accessor.GetNamespace(), "name", accessor.GetName())
+	}
+	log.Info("Redacted secret material", "resource", groupResource, "types", kinds)
+}
+
+// redactionMarker returns the string replacing secret material of the given
+// type.
+func redactionMarker(kind string) string {
+	return "[REDACTED:" + kind + "]"
+}
+
+// redactString returns the string with the secret material replaced
+// by redaction markers, and calls found for each replacement.
+func redactString(s string, found func(kind string)) string {
+	for _, rule := range secretMaterialRules {
+		hinted := s
+		if rule.foldHints {
+			hinted = strings.ToLower(s)
+		}
+		if !containsAny(hinted, rule.hints) || (rule.only != nil && !rule.only.MatchString(s)) {
+			continue
+		}
+		secret := rule.pattern.SubexpIndex("secret")
+		matches := rule.pattern.FindAllStringSubmatchIndex(s, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			if secret >= 0 {
+				start, end = m[2*secret], m[2*secret+1]
+			}
+			// The value may have been redacted by a previous rule.
+			if strings.HasPrefix(s[start:end], "[REDACTED:") {
+				continue
+			}
+			b.WriteString(s[last:start])
+			b.WriteString(redactionMarker(rule.kind))
+			last = end
+			found(rule.kind)
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+	return s
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactUnstructuredSecretMaterial redacts the secret material from the
+// string values of an unstructured object or JSON value, in place.
+func redactUnstructuredSecretMaterial(value any, found func(kind string)) any {
+	switch value := value.(type) {
+	case string:
+		return redactString(value, found)
+	case map[string]any:
+		for k, v := range value {
+			value[k] = redactUnstructuredSecretMaterial(v, found)
+		}
+	case []any:
+		for i, v := range value {
+			value[i] = redactUnstructuredSecretMaterial(v, found)
+		}
+	}
+	return value
+}
+
+var bytesType = reflect.TypeFor[[]byte]()
+
+// redactTypedSecretMaterial redacts the secret material from the exported
+// string and []byte fields of a typed object, in place. The object must be a
+// copy that isn't shared.
+func redactTypedSecretMaterial(v reflect.Value, found func(kind string)) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			redactTypedSecretMaterial(v.Elem(), found)
+		}
+	case reflect.Interface:
+		// Only the values pointed to by an interface can be modified.
+		if !v.IsNil() && v.Elem().Kind() == reflect.Pointer {
+			redactTypedSecretMaterial(v.Elem(), found)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				redactTypedSecretMaterial(v.Field(i), found)
+			}
+		}
+	case reflect.Slice:
+		if v.Type() == bytesType {
+			if redacted := redactString(string(v.Bytes()), found); redacted != string(v.Bytes()) && v.CanSet() {
+				v.SetBytes([]byte(redacted))
+			}
+			return
+		}
+		for i := range v.Len() {
+			redactTypedSecretMaterial(v.Index(i), found)
+		}
+	case reflect.Map:
+		// The map values aren't addressable, so they are redacted in a copy.
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(iter.Value().Type()).Elem()
+			value.Set(iter.Value())
+			redactTypedSecretMaterial(value, found)
+			v.SetMapIndex(iter.Key(), value)
+		}
+	case reflect.String:
+		if redacted := redactString(v.String(), found); redacted != v.String() && v.CanSet() {
+			v.SetString(redacted)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package k8sdynamic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	k8scache "k8s.io/client-go/tools/cache"
+
+	"github.com/jetstack/preflight/api"
+)
+
+// The tests of this file are meant to be run with the race detector, see
+// `make test-race`.
+
+var secretsGVR = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+func newSnapshotSecret(name string, generation int) *unstructured.Unstructured {
+	secret := getSecret(name, "default", map[string]any{
+		"tls.crt": "Y2VydA==",
+	}, true, false)
+	secret.SetAnnotations(map[string]string{"generation": fmt.Sprint(generation)})
+	secret.SetFinalizers([]string{"example.com/finalizer"})
+	secret.SetManagedFields([]metav1.ManagedFieldsEntry{{
+		Manager:   "kubectl",
+		Operation: metav1.ManagedFieldsOperationUpdate,
+		Time:      &metav1.Time{Time: time.Date(2026, 5, 19, 17, 6, 59, 0, time.UTC)},
+	}})
+	return secret
+}
+
+// startSharedGatherers starts data gatherers sharing an informer, with
+// different redaction settings: only the first one includes
+// _lastModifiedTime.
+func startSharedGatherers(t *testing.T, cl *fake.FakeDynamicClient) []*DataGathererDynamic {
+	t.Helper()
+	ctx := WithInformerRegistry(t.Context(), NewInformerRegistry())
+	var dgs []*DataGathererDynamic
+	for _, includeLastModifiedTime := range []bool{true, false} {
+		dg, err := (&ConfigDynamic{GroupVersionResource: secretsGVR}).newDataGathererWithClient(ctx, cl, nil)
+		require.NoError(t, err)
+		dynDg := dg.(*DataGathererDynamic)
+		dynDg.IncludeLastModifiedTime = includeLastModifiedTime
+		dgs = append(dgs, dynDg)
+	}
+	require.Same(t, dgs[0].informers[0], dgs[1].informers[0])
+
+	runCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	for _, dg := range dgs {
+		wg.Go(func() { assert.NoError(t, dg.Run(runCtx)) })
+	}
+	for _, dg := range dgs {
+		require.NoError(t, dg.WaitForCacheSync(runCtx))
+	}
+	return dgs
+}
+
+func TestDynamicGatherer_FetchDoesNotModifyTheCache(t *testing.T) {
+	cl := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{secretsGVR: "UnstructuredList"},
+		newSnapshotSecret("example", 1),
+	)
+	dgs := startSharedGatherers(t, cl)
+
+	// The second data gatherer removes the _lastModifiedTime that the
+	// first one needs, and both remove the finalizers.
+	for range 2 {
+		for i, dg := range dgs {
+			data, count, err := dg.Fetch(t.Context())
+			require.NoError(t, err)
+			require.Equal(t, 1, count)
+			secret := data.(*api.DynamicData).Items[0].Resource.(*unstructured.Unstructured)
+			assert.Empty(t, secret.GetFinalizers())
+			if i == 0 {
+				assert.Equal(t, "2026-05-19T17:06:59Z", secret.Object[lastModifiedTimeFieldName])
+			} else {
+				assert.NotContains(t, secret.Object, lastModifiedTimeFieldName)
+			}
+		}
+	}
+
+	stored := dgs[0].informers[0].GetStore().List()
+	require.Len(t, stored, 1)
+	secret := stored[0].(*unstructured.Unstructured)
+	assert.Equal(t, []string{"example.com/finalizer"}, secret.GetFinalizers())
+	assert.Equal(t, "2026-05-19T17:06:59Z", secret.Object[lastModifiedTimeFieldName])
+}
+
+// readHandler reads the objects passed to the event handlers, as the
+// certificate metrics and findings do.
+type readHandler struct{}
+
+func (readHandler) OnAdd(obj any, _ bool)  { _, _ = json.Marshal(obj) }
+func (readHandler) OnUpdate(_, newObj any) { _, _ = json.Marshal(newObj) }
+func (readHandler) OnDelete(obj any)       { _, _ = json.Marshal(obj) }
+
+var _ k8scache.ResourceEventHandler = readHandler{}
+
+func TestDynamicGatherer_ConcurrentFetchAndWatchEvents(t *testing.T) {
+	cl := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{secretsGVR: "UnstructuredList"},
+	)
+	dgs := startSharedGatherers(t, cl)
+	// AddEventHandler is supported on running informers too.
+	for _, dg := range dgs {
+		require.NoError(t, dg.AddEventHandler(readHandler{}))
+	}
+
+	const secrets = 20
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		secretsClient := cl.Resource(secretsGVR).Namespace("default")
+		for i := range secrets {
+			name := fmt.Sprintf("secret-%d", i)
+			_, err := secretsClient.Create(t.Context(), newSnapshotSecret(name, 1), metav1.CreateOptions{})
+			assert.NoError(t, err)
+			_, err = secretsClient.Update(t.Context(), newSnapshotSecret(name, 2), metav1.UpdateOptions{})
+			assert.NoError(t, err)
+			if i%2 == 0 {
+				assert.NoError(t, secretsClient.Delete(t.Context(), name, metav1.DeleteOptions{}))
+			}
+		}
+	})
+	for _, dg := range dgs {
+		for range 2 {
+			wg.Go(func() {
+				for range 50 {
+					data, _, err := dg.Fetch(t.Context())
+					if !assert.NoError(t, err) {
+						return
+					}
+					_, err = json.Marshal(data)
+					assert.NoError(t, err)
+				}
+			})
+		}
+	}
+	wg.Wait()
+
+	assert.EventuallyWithT(t, func(t *assert.CollectT) {
+		data, count, err := dgs[0].Fetch(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, secrets, count)
+		var deleted int
+		for _, item := range data.(*api.DynamicData).Items {
+			secret := item.Resource.(*unstructured.Unstructured)
+			assert.Equal(t, map[string]string{"generation": "2"}, secret.GetAnnotations())
+			if !item.DeletedAt.IsZero() {
+				deleted++
+			}
+		}
+		assert.Equal(t, secrets/2, deleted)
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,137 @@
+package k8sdynamic
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+// ingestOptions are the needs of the data gatherers sharing an informer,
+// which decide what the informer keeps in memory.
+type ingestOptions struct {
+	// keepSecretData keeps the whole data of the Secrets, e.g. to encrypt
+	// it when the data is fetched.
+	keepSecretData bool
+	// checkTLSKeyPairs sets TLSKeyPairErrorFieldName on the Secrets before
+	// their tls.key is dropped.
+	checkTLSKeyPairs bool
+	// lastModifiedTime keeps the most recent time of the managedFields: it
+	// is set as _lastModifiedTime on the unstructured objects before the
+	// managedFields are dropped, and the managedFields of the typed objects
+	// are reduced to that time.
+	lastModifiedTime bool
+}
+
+// ingestOptionsOf merges the needs of the data gatherers sharing an informer.
+func ingestOptionsOf(dgs []*DataGathererDynamic) ingestOptions {
+	var opts ingestOptions
+	for _, g := range dgs {
+		opts.keepSecretData = opts.keepSecretData || g.Encryptor != nil
+		opts.lastModifiedTime = opts.lastModifiedTime || g.IncludeLastModifiedTime
+		opts.checkTLSKeyPairs = opts.checkTLSKeyPairs || g.CheckTLSKeyPairs
+	}
+	return opts
+}
+
+// newIngestTransform returns the transform of an informer, which redacts the
+// resources when they are received from the API server rather than when they
+// are fetched. That way, the managedFields, the last-applied annotations and
+// the sensitive Secret data never stay in the memory of the agent, which
+// lowers the memory usage and limits what a core dump or a heap profile could
+// leak. Fetch still redacts the resources, since the data gatherers sharing
+// an informer may need more data than they upload.
+//
+// The transform is idempotent, as required by client-go.
+func newIngestTransform(opts ingestOptions) k8scache.TransformFunc {
+	return func(obj any) (any, error) {
+		switch obj := obj.(type) {
+		case *unstructured.Unstructured:
+			if opts.lastModifiedTime {
+				setLastModifiedTime(obj)
+			}
+			gvk := obj.GroupVersionKind()
+			switch {
+			case gvk.Kind == "Secret" && gvk.Group == "":
+				if opts.checkTLSKeyPairs {
+					setTLSKeyPairError(obj)
+				}
+				if !opts.keepSecretData {
+					selectSecretData(obj)
+				}
+			case gvk.Kind == "Route" && gvk.Group == "route.openshift.io":
+				if err := Select(RouteSelectedFields, obj); err != nil {
+					return nil, err
+				}
+			}
+			Redact(RedactFields, obj)
+		case metav1.ObjectMetaAccessor:
+			meta := obj.GetObjectMeta()
+			if opts.lastModifiedTime {
+				meta.SetManagedFields(latestManagedFieldsTime(meta.GetManagedFields()))
+			} else {
+				meta.SetManagedFields(nil)
+			}
+			delete(meta.GetAnnotations(), "kubectl.kubernetes.io/last-applied-configuration")
+		}
+		return obj, nil
+	}
+}
+
+// TLSKeyPairErrorFieldName is the field set on the Secrets whose tls.key
+// doesn't match tls.crt, by the data gatherers with CheckTLSKeyPairs. It holds
+// the error, so that the event handlers can report the mismatch without the
+// private key. Like the rest of the Secret data, it is never uploaded.
+const TLSKeyPairErrorFieldName = "_tlsKeyPairError"
+
+// setTLSKeyPairError sets TLSKeyPairErrorFieldName when tls.key doesn't match
+// tls.crt. The Secrets without tls.key are left as they are, so that the
+// transform stays idempotent once tls.key is dropped.
+func setTLSKeyPairError(secret *unstructured.Unstructured) {
+	data, _, _ := unstructured.NestedStringMap(secret.Object, "data")
+	tlsKey, _ := base64.StdEncoding.DecodeString(data[corev1.TLSPrivateKeyKey])
+	if len(tlsKey) == 0 {
+		return
+	}
+	tlsCrt, _ := base64.StdEncoding.DecodeString(data[corev1.TLSCertKey])
+	if _, err := tls.X509KeyPair(tlsCrt, tlsKey); err != nil {
+		secret.Object[TLSKeyPairErrorFieldName] = err.Error()
+	} else {
+		delete(secret.Object, TLSKeyPairErrorFieldName)
+	}
+}
+
+// selectSecretData removes the keys of the Secret data that aren't in
+// SecretSelectedFields.
+func selectSecretData(secret *unstructured.Unstructured) {
+	data, ok := secret.Object["data"].(map[string]any)
+	if !ok {
+		return
+	}
+	for key := range data {
+		if !slices.ContainsFunc(SecretSelectedFields, func(field FieldPath) bool {
+			return len(field) == 2 && field[0] == "data" && field[1] == key
+		}) {
+			delete(data, key)
+		}
+	}
+}
+
+// latestManagedFieldsTime reduces the managedFields to a single entry holding
+// their most recent time, or to none if they have no time.
+func latestManagedFieldsTime(entries []metav1.ManagedFieldsEntry) []metav1.ManagedFieldsEntry {
+	var latest *metav1.Time
+	for _, entry := range entries {
+		if entry.Time != nil && (latest == nil || entry.Time.After(latest.Time)) {
+			latest = entry.Time
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	return []metav1.ManagedFieldsEntry{{Time: latest}}
+}
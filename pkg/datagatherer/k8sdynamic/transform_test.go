@@ -0,0 +1,206 @@
+package k8sdynamic
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+
+	"github.com/jetstack/preflight/pkg/testutil/testcert"
+)
+
+func newIngestSecret() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]any{
+			"name":      "example",
+			"namespace": "default",
+			"uid":       "uid-1",
+			"annotations": map[string]any{
+				"kubectl.kubernetes.io/last-applied-configuration": `{"data":{"tls.key":"secret"}}`,
+				"team": "a",
+			},
+			"managedFields": []any{
+				map[string]any{"manager": "kubectl", "operation": "Apply", "time": "2025-01-10T10:00:00Z"},
+				map[string]any{"manager": "kubectl", "operation": "Update", "time": "2026-05-19T17:06:59Z"},
+			},
+		},
+		"type": "kubernetes.io/tls",
+		"data": map[string]any{
+			"tls.crt":  "Y2VydA==",
+			"tls.key":  "a2V5",
+			"ca.crt":   "Y2E=",
+			"password": "aHVudGVyMg==",
+		},
+	}}
+}
+
+func TestIngestTransform(t *testing.T) {
+	t.Run("secret", func(t *testing.T) {
+		obj, err := newIngestTransform(ingestOptions{lastModifiedTime: true})(newIngestSecret())
+		require.NoError(t, err)
+		secret := obj.(*unstructured.Unstructured)
+		assert.Equal(t, map[string]any{"tls.crt": "Y2VydA==", "ca.crt": "Y2E="}, secret.Object["data"])
+		assert.Equal(t, "2026-05-19T17:06:59Z", secret.Object[lastModifiedTimeFieldName])
+		assert.Equal(t, map[string]string{"team": "a"}, secret.GetAnnotations())
+		assert.Nil(t, secret.GetManagedFields())
+
+		// The transform is idempotent.
+		again, err := newIngestTransform(ingestOptions{lastModifiedTime: true})(secret.DeepCopy())
+		require.NoError(t, err)
+		assert.Equal(t, secret, again)
+	})
+
+	t.Run("secret without _lastModifiedTime", func(t *testing.T) {
+		obj, err := newIngestTransform(ingestOptions{})(newIngestSecret())
+		require.NoError(t, err)
+		assert.NotContains(t, obj.(*unstructured.Unstructured).Object, lastModifiedTimeFieldName)
+	})
+
+	t.Run("secret with the TLS key pair checked", func(t *testing.T) {
+		cert := testcert.New(t, testcert.Options{CommonName: "example"})
+		other := testcert.New(t, testcert.Options{CommonName: "other"})
+		transform := newIngestTransform(ingestOptions{checkTLSKeyPairs: true})
+		secretWithKey := func(key []byte) *unstructured.Unstructured {
+			secret := newIngestSecret()
+			secret.Object["data"] = map[string]any{
+				"tls.crt": base64.StdEncoding.EncodeToString(cert.PEM()),
+				"tls.key": base64.StdEncoding.EncodeToString(key),
+			}
+			return secret
+		}
+
+		obj, err := transform(secretWithKey(cert.KeyPEM(t)))
+		require.NoError(t, err)
+		secret := obj.(*unstructured.Unstructured)
+		assert.NotContains(t, secret.Object, TLSKeyPairErrorFieldName)
+		assert.Equal(t, map[string]any{"tls.crt": base64.StdEncoding.EncodeToString(cert.PEM())}, secret.Object["data"])
+
+		obj, err = transform(secretWithKey(other.KeyPEM(t)))
+		require.NoError(t, err)
+		secret = obj.(*unstructured.Unstructured)
+		assert.Equal(t, "tls: private key does not match public key", secret.Object[TLSKeyPairErrorFieldName])
+		assert.NotContains(t, secret.Object["data"], "tls.key")
+
+		// The transform is idempotent, although tls.key was dropped.
+		again, err := transform(secret.DeepCopy())
+		require.NoError(t, err)
+		assert.Equal(t, secret, again)
+	})
+
+	t.Run("secret with the data kept for the encryption", func(t *testing.T) {
+		obj, err := newIngestTransform(ingestOptions{keepSecretData: true})(newIngestSecret())
+		require.NoError(t, err)
+		assert.Len(t, obj.(*unstructured.Unstructured).Object["data"], 4)
+	})
+
+	t.Run("route", func(t *testing.T) {
+		route := &unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "route.openshift.io/v1",
+			"kind":       "Route",
+			"metadata":   map[string]any{"name": "example", "namespace": "default"},
+			"spec": map[string]any{
+				"host": "example.com",
+				"tls":  map[string]any{"termination": "edge", "key": "private"},
+			},
+		}}
+		obj, err := newIngestTransform(ingestOptions{})(route)
+		require.NoError(t, err)
+		spec := obj.(*unstructured.Unstructured).Object["spec"]
+		assert.Equal(t, map[string]any{"host": "example.com", "tls": map[string]any{"termination": "edge"}}, spec)
+	})
+
+	t.Run("other resources with _lastModifiedTime", func(t *testing.T) {
+		configMap := &unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]any{
+				"name": "example",
+				"managedFields": []any{
+					map[string]any{"manager": "kubectl", "operation": "Update", "time": "2026-05-19T17:06:59Z"},
+				},
+			},
+		}}
+		obj, err := newIngestTransform(ingestOptions{lastModifiedTime: true})(configMap)
+		require.NoError(t, err)
+		assert.Equal(t, "2026-05-19T17:06:59Z", obj.(*unstructured.Unstructured).Object[lastModifiedTimeFieldName])
+		assert.Nil(t, obj.(*unstructured.Unstructured).GetManagedFields())
+	})
+
+	t.Run("typed object", func(t *testing.T) {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:          "example",
+			Annotations:   map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}", "team": "a"},
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		}}
+		obj, err := newIngestTransform(ingestOptions{})(pod)
+		require.NoError(t, err)
+		assert.Nil(t, obj.(*corev1.Pod).ManagedFields)
+		assert.Equal(t, map[string]string{"team": "a"}, obj.(*corev1.Pod).Annotations)
+	})
+
+	t.Run("typed object with the last modified time", func(t *testing.T) {
+		latest := &metav1.Time{Time: time.Date(2026, 5, 19, 17, 6, 59, 0, time.UTC)}
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name: "example",
+			ManagedFields: []metav1.ManagedFieldsEntry{
+				{Manager: "kubectl", Time: latest, FieldsV1: &metav1.FieldsV1{Raw: []byte("{}")}},
+				{Manager: "kubelet", Time: &metav1.Time{Time: latest.Add(-time.Hour)}},
+			},
+		}}
+		obj, err := newIngestTransform(ingestOptions{lastModifiedTime: true})(pod)
+		require.NoError(t, err)
+		assert.Equal(t, []metav1.ManagedFieldsEntry{{Time: latest}}, obj.(*corev1.Pod).ManagedFields)
+
+		// The transform is idempotent.
+		again, err := newIngestTransform(ingestOptions{lastModifiedTime: true})(obj.(*corev1.Pod).DeepCopy())
+		require.NoError(t, err)
+		assert.Equal(t, obj, again)
+	})
+}
+
+func TestIngestOptionsOf(t *testing.T) {
+	opts := ingestOptionsOf([]*DataGathererDynamic{
+		{CheckTLSKeyPairs: true},
+		{IncludeLastModifiedTime: true},
+	})
+	assert.Equal(t, ingestOptions{checkTLSKeyPairs: true, lastModifiedTime: true}, opts)
+}
+
+// The sensitive data of the Secrets isn't kept in the informer's store.
+func TestDynamicGatherer_IngestRedaction(t *testing.T) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	cl := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "UnstructuredList"},
+		newIngestSecret(),
+	)
+	dg, err := (&ConfigDynamic{GroupVersionResource: gvr}).newDataGathererWithClient(t.Context(), cl, nil)
+	require.NoError(t, err)
+	dynDg := dg.(*DataGathererDynamic)
+	dynDg.IncludeLastModifiedTime = true
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() { done <- dg.Run(ctx) }()
+	require.NoError(t, dg.WaitForCacheSync(ctx))
+
+	stored := dynDg.informers[0].GetStore().List()
+	require.Len(t, stored, 1)
+	secret := stored[0].(*unstructured.Unstructured)
+	assert.Equal(t, map[string]any{"tls.crt": "Y2VydA==", "ca.crt": "Y2E="}, secret.Object["data"])
+	assert.Nil(t, secret.GetManagedFields())
+	assert.Equal(t, "2026-05-19T17:06:59Z", secret.Object[lastModifiedTimeFieldName])
+
+	cancel()
+	require.NoError(t, <-done)
+}
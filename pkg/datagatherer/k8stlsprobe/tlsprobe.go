@@ -0,0 +1,512 @@
+// Package k8stlsprobe implements a data gatherer that connects to the TLS
+// endpoints exposed by the Services, the Ingresses, and the OpenShift Routes of
+// the cluster and records the certificates actually served. The certificates
+// stored in Secrets aren't always the ones served, for instance when a
+// workload hasn't reloaded a renewed certificate.
+package k8stlsprobe
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	k8scache "k8s.io/client-go/tools/cache"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/api/reader"
+	"github.com/jetstack/preflight/pkg/datagatherer"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+	"github.com/jetstack/preflight/pkg/kubeconfig"
+)
+
+const (
+	// SNIAuto sends the DNS name of the Service, or the host of the Ingress
+	// or Route, as SNI.
+	SNIAuto = "auto"
+	// SNINone doesn't send any SNI.
+	SNINone = "none"
+
+	defaultConcurrency = 10
+	defaultTimeout     = 5 * time.Second
+)
+
+var (
+	defaultPorts = []int32{443}
+	routesGVR    = schema.GroupVersionResource{Group: "route.openshift.io", Version: "v1", Resource: "routes"}
+)
+
+// ConfigTLSProbe contains the configuration for the k8s-tls-probe
+// data-gatherer.
+type ConfigTLSProbe struct {
+	// KubeConfigPath is the path to the kubeconfig file. If empty, will assume it runs in-cluster.
+	KubeConfigPath string `yaml:"kubeconfig"`
+	// Ports are the Service ports that are probed, in addition to the ports
+	// named "https" or with the "https" appProtocol. Defaults to 443.
+	Ports []int32 `yaml:"ports"`
+	// SNI is either "auto" (default) or "none".
+	SNI string `yaml:"sni"`
+	// Concurrency is the maximum number of endpoints probed at the same
+	// time. Defaults to 10.
+	Concurrency int `yaml:"concurrency"`
+	// Timeout is the maximum duration of the connection and of the TLS
+	// handshake with each endpoint. Defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// UnmarshalYAML unmarshals the ConfigTLSProbe.
+func (c *ConfigTLSProbe) UnmarshalYAML(unmarshal func(any) error) error {
+	aux := struct {
+		KubeConfigPath string        `yaml:"kubeconfig"`
+		Ports          []int32       `yaml:"ports"`
+		SNI            string        `yaml:"sni"`
+		Concurrency    int           `yaml:"concurrency"`
+		Timeout        time.Duration `yaml:"timeout"`
+	}{}
+	err := unmarshal(&aux)
+	if err != nil {
+		return err
+	}
+
+	c.KubeConfigPath = aux.KubeConfigPath
+	c.Ports = aux.Ports
+	c.SNI = aux.SNI
+	c.Concurrency = aux.Concurrency
+	c.Timeout = aux.Timeout
+
+	return nil
+}
+
+// validate validates the configuration.
+func (c *ConfigTLSProbe) validate() error {
+	var errs []string
+	for i, port := range c.Ports {
+		if port < 1 || port > 65535 {
+			errs = append(errs, fmt.Sprintf("invalid port %d: %d is not between 1 and 65535", i, port))
+		}
+	}
+	switch c.SNI {
+	case "", SNIAuto, SNINone:
+	default:
+		errs = append(errs, fmt.Sprintf("invalid sni %q: must be %q or %q", c.SNI, SNIAuto, SNINone))
+	}
+	if c.Concurrency < 0 {
+		errs = append(errs, fmt.Sprintf("invalid concurrency: must not be negative, got %d", c.Concurrency))
+	}
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Sprintf("invalid timeout: must not be negative, got %s", c.Timeout))
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// NewDataGatherer constructs a new instance of the k8s-tls-probe
+// data-gatherer. The Routes are only watched when the cluster serves the
+// route.openshift.io API.
+func (c *ConfigTLSProbe) NewDataGatherer(ctx context.Context) (datagatherer.DataGatherer, error) {
+	clientset, err := kubeconfig.NewClientSet(c.KubeConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := kubeconfig.NewDynamicClient(c.KubeConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	discoveryClient, err := kubeconfig.NewDiscoveryClient(c.KubeConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := servesRoutes(discoveryClient)
+	if err != nil {
+		return nil, err
+	}
+	if !routes {
+		cl = nil
+	}
+	return c.newDataGathererWithClients(clientset, cl)
+}
+
+func servesRoutes(cl discovery.DiscoveryInterface) (bool, error) {
+	_, err := cl.ServerResourcesForGroupVersion(routesGVR.GroupVersion().String())
+	switch {
+	case apierrors.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("while checking if the cluster serves %s: %v", routesGVR.GroupVersion(), err)
+	}
+	return true, nil
+}
+
+// newDataGathererWithClients creates the data gatherer. The Routes aren't
+// watched when cl is nil.
+func (c *ConfigTLSProbe) newDataGathererWithClients(clientset kubernetes.Interface, cl dynamic.Interface) (*DataGathererTLSProbe, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	g := &DataGathererTLSProbe{
+		ports:       c.Ports,
+		sni:         cmp.Or(c.SNI, SNIAuto),
+		concurrency: cmp.Or(c.Concurrency, defaultConcurrency),
+		timeout:     cmp.Or(c.Timeout, defaultTimeout),
+		dial:        (&net.Dialer{}).DialContext,
+		secrets:     map[types.UID]knownSecret{},
+		now:         time.Now,
+	}
+	if len(g.ports) == 0 {
+		g.ports = defaultPorts
+	}
+
+	g.factory = informers.NewSharedInformerFactory(clientset, 60*time.Second)
+	g.services = g.factory.Core().V1().Services().Informer()
+	g.ingresses = g.factory.Networking().V1().Ingresses().Informer()
+	if cl != nil {
+		g.dynamicFactory = dynamicinformer.NewDynamicSharedInformerFactory(cl, 60*time.Second)
+		g.routes = g.dynamicFactory.ForResource(routesGVR).Informer()
+	}
+	return g, nil
+}
+
+// DataGathererTLSProbe stores the config for a k8s-tls-probe datagatherer.
+// It is also a k8scache.ResourceEventHandler for Secrets, which is used to
+// match the served certificates with the gathered Secrets.
+type DataGathererTLSProbe struct {
+	ports       []int32
+	sni         string
+	concurrency int
+	timeout     time.Duration
+	dial        func(ctx context.Context, network, address string) (net.Conn, error)
+
+	factory        informers.SharedInformerFactory
+	dynamicFactory dynamicinformer.DynamicSharedInformerFactory
+	services       k8scache.SharedIndexInformer
+	ingresses      k8scache.SharedIndexInformer
+	// routes is nil when the cluster doesn't serve the Routes.
+	routes k8scache.SharedIndexInformer
+
+	mu      sync.Mutex
+	secrets map[types.UID]knownSecret
+
+	now func() time.Time
+}
+
+// knownSecret is a Secret whose tls.crt contains a certificate.
+type knownSecret struct {
+	resource api.ResourceReference
+	// fingerprint is the SHA-256 fingerprint of the first certificate of
+	// tls.crt.
+	fingerprint string
+}
+
+// target is an endpoint to probe.
+type target struct {
+	resource   api.ResourceReference
+	address    string
+	serverName string
+}
+
+var _ datagatherer.DataGatherer = &DataGathererTLSProbe{}
+var _ k8scache.ResourceEventHandler = &DataGathererTLSProbe{}
+
+// Run starts the informers.
+func (g *DataGathererTLSProbe) Run(ctx context.Context) error {
+	g.factory.Start(ctx.Done())
+	if g.dynamicFactory != nil {
+		g.dynamicFactory.Start(ctx.Done())
+	}
+	return nil
+}
+
+// WaitForCacheSync waits for the informers' caches to sync. It returns
+// k8sdynamic.ErrCacheSyncTimeout on timeout, so that the agent handles it as
+// for the k8s-dynamic data gatherers.
+func (g *DataGathererTLSProbe) WaitForCacheSync(ctx context.Context) error {
+	hasSynced := []k8scache.InformerSynced{g.services.HasSynced, g.ingresses.HasSynced}
+	if g.routes != nil {
+		hasSynced = append(hasSynced, g.routes.HasSynced)
+	}
+	if !k8scache.WaitForCacheSync(ctx.Done(), hasSynced...) {
+		return k8sdynamic.ErrCacheSyncTimeout
+	}
+	return nil
+}
+
+// OnAdd implements k8scache.ResourceEventHandler.
+func (g *DataGathererTLSProbe) OnAdd(obj any, _ bool) {
+	g.setSecret(obj)
+}
+
+// OnUpdate implements k8scache.ResourceEventHandler.
+func (g *DataGathererTLSProbe) OnUpdate(_, newObj any) {
+	g.setSecret(newObj)
+}
+
+// OnDelete implements k8scache.ResourceEventHandler.
+func (g *DataGathererTLSProbe) OnDelete(obj any) {
+	if tombstone, ok := obj.(k8scache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	meta, ok := obj.(metav1.Object)
+	if !ok {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.secrets, meta.GetUID())
+}
+
+func (g *DataGathererTLSProbe) setSecret(obj any) {
+	var (
+		meta   metav1.Object
+		tlsCrt []byte
+	)
+	switch obj := obj.(type) {
+	case *corev1.Secret:
+		meta, tlsCrt = obj, obj.Data[corev1.TLSCertKey]
+	case *unstructured.Unstructured:
+		if obj.GetKind() != "Secret" || obj.GroupVersionKind().Group != "" {
+			return
+		}
+		encoded, _, _ := unstructured.NestedString(obj.Object, "data", corev1.TLSCertKey)
+		meta = obj
+		if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			tlsCrt = decoded
+		}
+	default:
+		return
+	}
+	// The certificates parsed before an invalid one are kept.
+	certs, _ := reader.ParseCertificates(tlsCrt)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(certs) == 0 {
+		delete(g.secrets, meta.GetUID())
+		return
+	}
+	g.secrets[meta.GetUID()] = knownSecret{
+		resource: api.ResourceReference{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Namespace:  meta.GetNamespace(),
+			Name:       meta.GetName(),
+			UID:        string(meta.GetUID()),
+		},
+		fingerprint: fingerprint(certs[0]),
+	}
+}
+
+// Fetch probes the endpoints of the Services, the Ingresses, and the Routes,
+// and returns the results as api.TLSProbesData.
+func (g *DataGathererTLSProbe) Fetch(ctx context.Context) (any, int, error) {
+	targets := g.targets()
+
+	probes := make([]api.TLSProbe, len(targets))
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(g.concurrency)
+	for i, t := range targets {
+		group.Go(func() error {
+			probes[i] = g.probe(ctx, t)
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	return &api.TLSProbesData{Probes: probes}, len(probes), nil
+}
+
+// targets returns the endpoints to probe, sorted by resource and address.
+func (g *DataGathererTLSProbe) targets() []target {
+	var targets []target
+	for _, obj := range g.services.GetStore().List() {
+		targets = append(targets, g.serviceTargets(obj.(*corev1.Service))...)
+	}
+	for _, obj := range g.ingresses.GetStore().List() {
+		targets = append(targets, g.ingressTargets(obj.(*networkingv1.Ingress))...)
+	}
+	if g.routes != nil {
+		for _, obj := range g.routes.GetStore().List() {
+			targets = append(targets, g.routeTargets(obj.(*unstructured.Unstructured))...)
+		}
+	}
+	slices.SortFunc(targets, func(a, b target) int {
+		return cmp.Or(
+			cmp.Compare(a.resource.Kind, b.resource.Kind),
+			cmp.Compare(a.resource.Namespace, b.resource.Namespace),
+			cmp.Compare(a.resource.Name, b.resource.Name),
+			cmp.Compare(a.address, b.address),
+		)
+	})
+	return targets
+}
+
+// serviceTargets returns the HTTPS ports of the Service. The headless and
+// ExternalName Services are skipped.
+func (g *DataGathererTLSProbe) serviceTargets(svc *corev1.Service) []target {
+	if svc.Spec.Type == corev1.ServiceTypeExternalName || svc.Spec.ClusterIP == corev1.ClusterIPNone {
+		return nil
+	}
+	host := fmt.Sprintf("%s.%s.svc", svc.Name, svc.Namespace)
+	var targets []target
+	for _, port := range svc.Spec.Ports {
+		if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
+			continue
+		}
+		https := port.Name == "https" || (port.AppProtocol != nil && *port.AppProtocol == "https")
+		if !https && !slices.Contains(g.ports, port.Port) {
+			continue
+		}
+		targets = append(targets, g.target(api.ResourceReference{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Namespace:  svc.Namespace,
+			Name:       svc.Name,
+			UID:        string(svc.UID),
+		}, host, port.Port))
+	}
+	return targets
+}
+
+// ingressTargets returns the TLS hosts of the Ingress. The wildcard hosts are
+// skipped since they can't be connected to.
+func (g *DataGathererTLSProbe) ingressTargets(ing *networkingv1.Ingress) []target {
+	resource := api.ResourceReference{
+		APIVersion: "networking.k8s.io/v1",
+		Kind:       "Ingress",
+		Namespace:  ing.Namespace,
+		Name:       ing.Name,
+		UID:        string(ing.UID),
+	}
+	var hosts []string
+	for _, tls := range ing.Spec.TLS {
+		for _, host := range tls.Hosts {
+			if host != "" && !strings.HasPrefix(host, "*") && !slices.Contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	var targets []target
+	for _, host := range hosts {
+		targets = append(targets, g.target(resource, host, 443))
+	}
+	return targets
+}
+
+// routeTargets returns the host of the Route if it terminates TLS.
+func (g *DataGathererTLSProbe) routeTargets(route *unstructured.Unstructured) []target {
+	host, _, _ := unstructured.NestedString(route.Object, "spec", "host")
+	_, hasTLS, _ := unstructured.NestedMap(route.Object, "spec", "tls")
+	if host == "" || !hasTLS || strings.HasPrefix(host, "*") {
+		return nil
+	}
+	return []target{g.target(api.ResourceReference{
+		APIVersion: route.GetAPIVersion(),
+		Kind:       route.GetKind(),
+		Namespace:  route.GetNamespace(),
+		Name:       route.GetName(),
+		UID:        string(route.GetUID()),
+	}, host, 443)}
+}
+
+func (g *DataGathererTLSProbe) target(resource api.ResourceReference, host string, port int32) target {
+	t := target{
+		resource: resource,
+		address:  net.JoinHostPort(host, strconv.Itoa(int(port))),
+	}
+	if g.sni == SNIAuto {
+		t.serverName = host
+	}
+	return t
+}
+
+// probe connects to the target and records the served chain. The chain isn't
+// verified, since the goal is to report what is served, including invalid
+// certificates.
+func (g *DataGathererTLSProbe) probe(ctx context.Context, t target) api.TLSProbe {
+	probe := api.TLSProbe{
+		Resource:     t.resource,
+		Address:      t.address,
+		ServerName:   t.serverName,
+		Certificates: []api.CertificateSummary{},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	conn, err := g.dial(ctx, "tcp", t.address)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         t.serverName,
+		InsecureSkipVerify: true,
+		// The old versions are allowed so that they can be reported.
+		MinVersion: tls.VersionTLS10,
+	})
+	defer tlsConn.Close()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		probe.Error = fmt.Sprintf("TLS handshake failed: %v", err)
+		return probe
+	}
+
+	state := tlsConn.ConnectionState()
+	probe.TLSVersion = tls.VersionName(state.Version)
+	probe.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	now := g.now()
+	for _, cert := range state.PeerCertificates {
+		probe.Certificates = append(probe.Certificates, reader.Summarize(cert, now))
+	}
+	if len(state.PeerCertificates) > 0 {
+		probe.MatchingSecrets = g.matchingSecrets(fingerprint(state.PeerCertificates[0]))
+	}
+	return probe
+}
+
+// matchingSecrets returns the Secrets whose leaf certificate has the given
+// fingerprint, sorted by namespace and name.
+func (g *DataGathererTLSProbe) matchingSecrets(fingerprint string) []api.ResourceReference {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var matching []api.ResourceReference
+	for _, s := range g.secrets {
+		if s.fingerprint == fingerprint {
+			matching = append(matching, s.resource)
+		}
+	}
+	slices.SortFunc(matching, func(a, b api.ResourceReference) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+	})
+	return matching
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,200 @@
+package k8stlsprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/testutil/testcert"
+)
+
+func TestFetch(t *testing.T) {
+	webCert := testcert.New(t, testcert.Options{CommonName: "web.example.com", DNSNames: []string{"web.example.com"}})
+	certPEM, keyPEM := webCert.PEM(), webCert.KeyPEM(t)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	// The server records the SNI of each handshake.
+	var mu sync.Mutex
+	serverNames := map[string]bool{}
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		serverNames[hello.ServerName] = true
+		return &cert, nil
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The other server uses the default httptest certificate, which isn't
+	// stored in any Secret.
+	other := httptest.NewTLSServer(http.NotFoundHandler())
+	defer other.Close()
+
+	clientset := fake.NewClientset(
+		service("team-a", "web", corev1.ServicePort{Name: "tls", Port: 443}, corev1.ServicePort{Name: "http", Port: 80}),
+		service("team-a", "api", corev1.ServicePort{Name: "https", Port: 8443}),
+		service("team-a", "down", corev1.ServicePort{Port: 443}),
+		headless("team-a", "headless", corev1.ServicePort{Port: 443}),
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "web", UID: "uid-ingress"},
+			Spec: networkingv1.IngressSpec{TLS: []networkingv1.IngressTLS{
+				{Hosts: []string{"web.example.com", "*.example.com"}, SecretName: "web-tls"},
+				{Hosts: []string{"web.example.com"}, SecretName: "web-tls"},
+			}},
+		},
+	)
+	addresses := map[string]string{
+		"web.team-a.svc:443":  srv.Listener.Addr().String(),
+		"api.team-a.svc:8443": other.Listener.Addr().String(),
+		"web.example.com:443": srv.Listener.Addr().String(),
+	}
+
+	newGatherer := func(t *testing.T, cfg ConfigTLSProbe) *DataGathererTLSProbe {
+		g, err := cfg.newDataGathererWithClients(clientset, nil)
+		require.NoError(t, err)
+		g.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if addr, ok := addresses[address]; ok {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}
+			return nil, fmt.Errorf("dial %s: no such host", address)
+		}
+		require.NoError(t, g.Run(t.Context()))
+		require.NoError(t, g.WaitForCacheSync(t.Context()))
+		return g
+	}
+
+	t.Run("services and ingresses", func(t *testing.T) {
+		g := newGatherer(t, ConfigTLSProbe{})
+		g.OnAdd(secret("team-b", "web-tls", certPEM), true)
+		g.OnAdd(secret("team-b", "unrelated", []byte("not a certificate")), true)
+
+		data, count, err := g.Fetch(t.Context())
+		require.NoError(t, err)
+		probes := data.(*api.TLSProbesData).Probes
+		require.Equal(t, 4, count)
+		require.Len(t, probes, 4)
+
+		ingress := probes[0]
+		assert.Equal(t, api.ResourceReference{APIVersion: "networking.k8s.io/v1", Kind: "Ingress", Namespace: "team-b", Name: "web", UID: "uid-ingress"}, ingress.Resource)
+		assert.Equal(t, "web.example.com:443", ingress.Address)
+		assert.Equal(t, "web.example.com", ingress.ServerName)
+		assert.Empty(t, ingress.Error)
+		assert.Equal(t, "TLS 1.3", ingress.TLSVersion)
+		assert.NotEmpty(t, ingress.CipherSuite)
+		require.Len(t, ingress.Certificates, 1)
+		assert.Equal(t, "CN=web.example.com", ingress.Certificates[0].Subject)
+		assert.Equal(t, []api.ResourceReference{{APIVersion: "v1", Kind: "Secret", Namespace: "team-b", Name: "web-tls", UID: "uid-web-tls"}}, ingress.MatchingSecrets)
+
+		// The port named https is probed even though it isn't in the
+		// configured ports.
+		apiService := probes[1]
+		assert.Equal(t, "Service", apiService.Resource.Kind)
+		assert.Equal(t, "api.team-a.svc:8443", apiService.Address)
+		assert.Empty(t, apiService.Error)
+		assert.NotEmpty(t, apiService.Certificates)
+		assert.Empty(t, apiService.MatchingSecrets)
+
+		down := probes[2]
+		assert.Equal(t, "down.team-a.svc:443", down.Address)
+		assert.Equal(t, "dial down.team-a.svc:443: no such host", down.Error)
+		assert.NotNil(t, down.Certificates, "the certificates must be encoded as an empty array")
+
+		web := probes[3]
+		assert.Equal(t, "web.team-a.svc:443", web.Address)
+		assert.Equal(t, "web.team-a.svc", web.ServerName)
+		assert.Len(t, web.MatchingSecrets, 1)
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, map[string]bool{"web.example.com": true, "web.team-a.svc": true}, serverNames)
+	})
+
+	t.Run("ports, SNI, and deleted Secrets", func(t *testing.T) {
+		g := newGatherer(t, ConfigTLSProbe{Ports: []int32{443, 80}, SNI: SNINone, Concurrency: 1})
+		secret := secret("team-b", "web-tls", certPEM)
+		g.OnAdd(secret, true)
+		g.OnDelete(secret)
+
+		data, _, err := g.Fetch(t.Context())
+		require.NoError(t, err)
+		probes := data.(*api.TLSProbesData).Probes
+		var addresses []string
+		for _, p := range probes {
+			addresses = append(addresses, p.Address)
+			assert.Empty(t, p.ServerName)
+			assert.Empty(t, p.MatchingSecrets)
+		}
+		assert.Equal(t, []string{"web.example.com:443", "api.team-a.svc:8443", "down.team-a.svc:443", "web.team-a.svc:443", "web.team-a.svc:80"}, addresses)
+	})
+}
+
+func TestRouteTargets(t *testing.T) {
+	g := &DataGathererTLSProbe{sni: SNIAuto}
+	route := func(host string, tls bool) *unstructured.Unstructured {
+		spec := map[string]any{"host": host}
+		if tls {
+			spec["tls"] = map[string]any{"termination": "edge"}
+		}
+		return &unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "route.openshift.io/v1",
+			"kind":       "Route",
+			"metadata":   map[string]any{"namespace": "team-a", "name": "web", "uid": "uid-route"},
+			"spec":       spec,
+		}}
+	}
+
+	assert.Equal(t, []target{{
+		resource:   api.ResourceReference{APIVersion: "route.openshift.io/v1", Kind: "Route", Namespace: "team-a", Name: "web", UID: "uid-route"},
+		address:    "web.apps.example.com:443",
+		serverName: "web.apps.example.com",
+	}}, g.routeTargets(route("web.apps.example.com", true)))
+	assert.Empty(t, g.routeTargets(route("web.apps.example.com", false)))
+	assert.Empty(t, g.routeTargets(route("", true)))
+}
+
+func TestValidate(t *testing.T) {
+	err := (&ConfigTLSProbe{Ports: []int32{0}, SNI: "foo", Concurrency: -1, Timeout: -time.Second}).validate()
+	assert.EqualError(t, err, `invalid port 0: 0 is not between 1 and 65535, invalid sni "foo": must be "auto" or "none", invalid concurrency: must not be negative, got -1, invalid timeout: must not be negative, got -1s`)
+}
+
+func service(namespace, name string, ports ...corev1.ServicePort) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID("uid-" + name)},
+		Spec:       corev1.ServiceSpec{ClusterIP: "10.0.0.1", Ports: ports},
+	}
+}
+
+func headless(namespace, name string, ports ...corev1.ServicePort) *corev1.Service {
+	svc := service(namespace, name, ports...)
+	svc.Spec.ClusterIP = corev1.ClusterIPNone
+	return svc
+}
+
+func secret(namespace, name string, tlsCrt []byte) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]any{"namespace": namespace, "name": name, "uid": "uid-" + name},
+		"type":       "kubernetes.io/tls",
+		"data":       map[string]any{"tls.crt": base64.StdEncoding.EncodeToString(tlsCrt)},
+	}}
+}
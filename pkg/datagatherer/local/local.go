@@ -4,7 +4,11 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/jetstack/preflight/api"
 	"github.com/jetstack/preflight/pkg/datagatherer"
 )
 
@@ -12,19 +16,47 @@ import (
 type Config struct {
 	// DataPath is the path to file containing the data to load.
 	DataPath string `yaml:"data-path"`
+	// Paths are the files, directories, or glob patterns containing
+	// Kubernetes manifests in JSON or YAML. The directories are walked
+	// recursively for .json, .yaml, and .yml files. Mutually exclusive with
+	// DataPath.
+	Paths []string `yaml:"paths"`
+	// Watch reloads the manifests when the files change, instead of reading
+	// them on each Fetch. The resources removed from the files are reported
+	// as deleted. Requires Paths.
+	Watch bool `yaml:"watch"`
 }
 
 // validate validates the configuration.
 func (c *Config) validate() error {
-	if c.DataPath == "" {
-		return fmt.Errorf("invalid configuration: DataPath cannot be empty")
+	switch {
+	case c.DataPath == "" && len(c.Paths) == 0:
+		return fmt.Errorf("invalid configuration: either DataPath or Paths must be set")
+	case c.DataPath != "" && len(c.Paths) > 0:
+		return fmt.Errorf("invalid configuration: DataPath and Paths are mutually exclusive")
+	case c.Watch && len(c.Paths) == 0:
+		return fmt.Errorf("invalid configuration: Watch requires Paths")
+	}
+	for _, path := range c.Paths {
+		if _, err := filepath.Match(path, ""); err != nil {
+			return fmt.Errorf("invalid configuration: invalid path %q: %v", path, err)
+		}
 	}
 	return nil
 }
 
-// DataGatherer is a data-gatherer that loads data from a local file.
+// DataGatherer is a data-gatherer that loads data from a local file, or
+// Kubernetes manifests from local files.
 type DataGatherer struct {
 	dataPath string
+	paths    []string
+	watch    bool
+
+	// The following fields are only used when watching.
+	mu        sync.Mutex
+	resources map[string]*api.GatheredResource
+	synced    chan struct{}
+	now       func() time.Time
 }
 
 // NewDataGatherer returns a new DataGatherer.
@@ -34,22 +66,60 @@ func (c *Config) NewDataGatherer(ctx context.Context) (datagatherer.DataGatherer
 	}
 
 	return &DataGatherer{
-		dataPath: c.DataPath,
+		dataPath:  c.DataPath,
+		paths:     c.Paths,
+		watch:     c.Watch,
+		resources: map[string]*api.GatheredResource{},
+		synced:    make(chan struct{}),
+		now:       time.Now,
 	}, nil
 }
 
+// Run watches the manifests when Watch is set, and returns immediately
+// otherwise.
 func (g *DataGatherer) Run(ctx context.Context) error {
-	// no async functionality, see Fetch
-	return nil
+	if !g.watch {
+		// no async functionality, see Fetch
+		return nil
+	}
+	return g.runWatch(ctx)
 }
 
+// WaitForCacheSync waits for the manifests to be loaded for the first time
+// when Watch is set, and returns immediately otherwise.
 func (g *DataGatherer) WaitForCacheSync(ctx context.Context) error {
-	// no async functionality, see Fetch
-	return nil
+	if !g.watch {
+		// no async functionality, see Fetch
+		return nil
+	}
+	select {
+	case <-g.synced:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for the manifests to be loaded: %w", ctx.Err())
+	}
 }
 
-// Fetch loads and returns the data from the LocalDatagatherer's dataPath
+// Fetch loads and returns the data from the LocalDatagatherer's dataPath. When
+// Paths is set, it returns the resources decoded from the manifests as
+// api.DynamicData instead.
 func (g *DataGatherer) Fetch(ctx context.Context) (any, int, error) {
+	switch {
+	case g.watch:
+		items := g.snapshot()
+		return &api.DynamicData{Items: items}, len(items), nil
+	case len(g.paths) > 0:
+		files, _, err := expandPaths(ctx, g.paths)
+		if err != nil {
+			return nil, -1, err
+		}
+		items := []*api.GatheredResource{}
+		for _, obj := range loadManifests(ctx, files) {
+			items = append(items, &api.GatheredResource{Resource: obj})
+		}
+		return &api.DynamicData{Items: items}, len(items), nil
+	}
+
 	dataBytes, err := os.ReadFile(g.dataPath)
 	if err != nil {
 		return nil, -1, err
@@ -0,0 +1,213 @@
+package local
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/jetstack/preflight/api"
+)
+
+const (
+	deploymentYAML = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: team-a
+spec:
+  replicas: 2
+---
+# An empty document.
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: team-a
+`
+	secretListJSON = `{
+  "apiVersion": "v1",
+  "kind": "List",
+  "items": [
+    {"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "tls", "namespace": "team-a", "uid": "uid-tls"}},
+    {"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "token", "namespace": "team-b", "uid": "uid-token"}}
+  ]
+}`
+	secretYAML = `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: web-tls
+  namespace: team-a
+  annotations:
+    kubectl.kubernetes.io/last-applied-configuration: '{"data":{"tls.key":"a2V5"}}'
+    team: a
+  managedFields:
+  - manager: kubectl
+    operation: Apply
+type: kubernetes.io/tls
+data:
+  tls.crt: Y2VydA==
+  tls.key: a2V5
+`
+	// Helm values files aren't Kubernetes resources.
+	valuesYAML = `
+replicaCount: 1
+`
+)
+
+func TestFetch(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "apps/web.yaml", deploymentYAML)
+	writeFile(t, dir, "apps/values.yaml", valuesYAML)
+	writeFile(t, dir, "dump/secrets.json", secretListJSON)
+	writeFile(t, dir, "dump/README.md", "# Not a manifest")
+	writeFile(t, dir, "broken/broken.yaml", "apiVersion: v1\nkind: [")
+	writeFile(t, dir, "apps/.git/config.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: hidden\n")
+	writeFile(t, dir, "other/service.manifest", "apiVersion: v1\nkind: Service\nmetadata:\n  name: other\n")
+
+	t.Run("directories and globs", func(t *testing.T) {
+		g := newDataGatherer(t, Config{Paths: []string{
+			filepath.Join(dir, "apps"),
+			filepath.Join(dir, "dump"),
+			filepath.Join(dir, "broken"),
+			filepath.Join(dir, "other/*.manifest"),
+			filepath.Join(dir, "does-not-exist"),
+		}})
+		data, count, err := g.Fetch(t.Context())
+		require.NoError(t, err)
+		items := data.(*api.DynamicData).Items
+		assert.Equal(t, 5, count)
+		assert.Equal(t, []string{
+			"apps/v1/Deployment/team-a/web",
+			"v1/Service/team-a/web",
+			"uid-tls",
+			"uid-token",
+			"v1/Service//other",
+		}, keys(items))
+
+		deployment := items[0].Resource.(*unstructured.Unstructured)
+		replicas, _, _ := unstructured.NestedInt64(deployment.Object, "spec", "replicas")
+		assert.Equal(t, int64(2), replicas)
+	})
+
+	t.Run("the Secrets are redacted", func(t *testing.T) {
+		writeFile(t, dir, "secret/web-tls.yaml", secretYAML)
+		g := newDataGatherer(t, Config{Paths: []string{filepath.Join(dir, "secret")}})
+		data, count, err := g.Fetch(t.Context())
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+		assert.Equal(t, map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]any{
+				"name":        "web-tls",
+				"namespace":   "team-a",
+				"annotations": map[string]any{"team": "a"},
+			},
+			"type": "kubernetes.io/tls",
+			"data": map[string]any{"tls.crt": "Y2VydA=="},
+		}, data.(*api.DynamicData).Items[0].Resource.(*unstructured.Unstructured).Object)
+	})
+
+	t.Run("data-path", func(t *testing.T) {
+		g := newDataGatherer(t, Config{DataPath: filepath.Join(dir, "dump/README.md")})
+		data, count, err := g.Fetch(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, []byte("# Not a manifest"), data)
+		assert.Equal(t, -1, count)
+	})
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "web.yaml", deploymentYAML)
+
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	g := newDataGatherer(t, Config{Paths: []string{dir}, Watch: true})
+	g.now = func() time.Time { return now }
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() { done <- g.Run(ctx) }()
+	require.NoError(t, g.WaitForCacheSync(ctx))
+
+	fetch := func(t require.TestingT) []*api.GatheredResource {
+		data, count, err := g.Fetch(ctx)
+		require.NoError(t, err)
+		items := data.(*api.DynamicData).Items
+		require.Len(t, items, count)
+		return items
+	}
+	assert.Equal(t, []string{"apps/v1/Deployment/team-a/web", "v1/Service/team-a/web"}, keys(fetch(t)))
+
+	// The files created after the start are loaded.
+	writeFile(t, dir, "nested/secrets.json", secretListJSON)
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Len(c, fetch(c), 4)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// The resources removed from the files are reported as deleted once.
+	require.NoError(t, os.Remove(filepath.Join(dir, "web.yaml")))
+	var items []*api.GatheredResource
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		items = fetch(c)
+		assert.False(c, items[0].DeletedAt.IsZero())
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, []string{"apps/v1/Deployment/team-a/web", "uid-tls", "uid-token", "v1/Service/team-a/web"}, keys(items))
+	assert.Equal(t, now, items[0].DeletedAt.Time)
+	assert.Equal(t, now, items[3].DeletedAt.Time)
+	assert.True(t, items[1].DeletedAt.IsZero())
+	assert.True(t, items[0].DeletionInferred)
+	assert.Equal(t, []string{"uid-tls", "uid-token"}, keys(fetch(t)))
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{"empty", Config{}, "invalid configuration: either DataPath or Paths must be set"},
+		{"both", Config{DataPath: "data.json", Paths: []string{"manifests"}}, "invalid configuration: DataPath and Paths are mutually exclusive"},
+		{"watch without paths", Config{DataPath: "data.json", Watch: true}, "invalid configuration: Watch requires Paths"},
+		{"invalid glob", Config{Paths: []string{"manifests/["}}, `invalid configuration: invalid path "manifests/[": syntax error in pattern`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.EqualError(t, test.config.validate(), test.wantErr)
+		})
+	}
+}
+
+func newDataGatherer(t *testing.T, cfg Config) *DataGatherer {
+	t.Helper()
+	dg, err := cfg.NewDataGatherer(t.Context())
+	require.NoError(t, err)
+	return dg.(*DataGatherer)
+}
+
+func keys(items []*api.GatheredResource) []string {
+	var keys []string
+	for _, item := range items {
+		keys = append(keys, resourceKey(item.Resource.(*unstructured.Unstructured)))
+	}
+	return keys
+}
+
+func writeFile(t *testing.T, root, name, contents string) {
+	t.Helper()
+	path := filepath.Join(root, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+}
@@ -0,0 +1,267 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/datagatherer/k8sdynamic"
+	"github.com/jetstack/preflight/pkg/logs"
+)
+
+// reloadDelay groups the bursts of file events, e.g. when an editor saves a
+// file or when a Git checkout updates many files, into a single reload.
+const reloadDelay = 200 * time.Millisecond
+
+var manifestExtensions = []string{".json", ".yaml", ".yml"}
+
+// expandPaths returns the manifest files found in the paths, and the
+// directories to watch for changes. The files matched by a glob pattern are
+// returned regardless of their extension, whereas only the manifest
+// extensions are returned when walking a directory. The hidden directories
+// aren't walked.
+func expandPaths(ctx context.Context, paths []string) ([]string, []string, error) {
+	log := klog.FromContext(ctx)
+	var files, dirs []string
+	for _, pattern := range paths {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid path %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			log.Info("No file matches the path", "path", pattern)
+		}
+		// The directory of a glob pattern is watched so that the files
+		// created later are noticed.
+		if dir := filepath.Dir(pattern); pattern != dir && hasMeta(pattern) && !hasMeta(dir) {
+			dirs = append(dirs, dir)
+		}
+		for _, match := range matches {
+			err := filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				switch {
+				case d.IsDir() && path != match && strings.HasPrefix(d.Name(), "."):
+					// E.g. the .git directory of a GitOps repository.
+					return fs.SkipDir
+				case d.IsDir():
+					dirs = append(dirs, path)
+				case path == match:
+					// Editors often replace the files they save, so the
+					// directory of the file is watched rather than the file.
+					files = append(files, path)
+					dirs = append(dirs, filepath.Dir(path))
+				case slices.Contains(manifestExtensions, filepath.Ext(path)):
+					files = append(files, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to walk %q: %v", match, err)
+			}
+		}
+	}
+	slices.Sort(files)
+	slices.Sort(dirs)
+	return slices.Compact(files), slices.Compact(dirs), nil
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// loadManifests decodes the resources of the manifest files, in order. The
+// Lists are flattened. The files that can't be decoded are skipped, as are the
+// documents that aren't Kubernetes resources, such as Helm values files. The
+// resources are redacted like the ones of the k8s-dynamic data gatherers, so
+// that the Secret data, e.g. of a `kubectl get -o yaml` dump, is never kept
+// nor uploaded.
+func loadManifests(ctx context.Context, files []string) []*unstructured.Unstructured {
+	log := klog.FromContext(ctx)
+	objs := []*unstructured.Unstructured{}
+	for _, file := range files {
+		fileObjs, err := decodeManifest(ctx, file)
+		if err != nil {
+			log.Error(err, "Skipping a file that can't be decoded", "path", file)
+			continue
+		}
+		objs = append(objs, fileObjs...)
+	}
+	return objs
+}
+
+func decodeManifest(ctx context.Context, file string) ([]*unstructured.Unstructured, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var objs []*unstructured.Unstructured
+	decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+	for i := 0; ; i++ {
+		var raw json.RawMessage
+		err := decoder.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %v", i, err)
+		}
+		if len(raw) == 0 || string(raw) == "null" {
+			continue
+		}
+
+		obj, _, err := unstructured.UnstructuredJSONScheme.Decode(raw, nil, nil)
+		if runtime.IsMissingKind(err) || runtime.IsMissingVersion(err) {
+			klog.FromContext(ctx).V(logs.Debug).Info("Skipping a document that isn't a Kubernetes resource", "path", file, "document", i)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %v", i, err)
+		}
+		var docObjs []*unstructured.Unstructured
+		switch obj := obj.(type) {
+		case *unstructured.Unstructured:
+			docObjs = append(docObjs, obj)
+		case *unstructured.UnstructuredList:
+			for j := range obj.Items {
+				docObjs = append(docObjs, &obj.Items[j])
+			}
+		}
+		for _, obj := range docObjs {
+			if err := k8sdynamic.RedactResource(obj); err != nil {
+				return nil, fmt.Errorf("document %d: %v", i, err)
+			}
+		}
+		objs = append(objs, docObjs...)
+	}
+}
+
+// resourceKey identifies a resource across reloads. The manifests of GitOps
+// repositories usually have no UID, so the name is used instead.
+func resourceKey(obj *unstructured.Unstructured) string {
+	if uid := obj.GetUID(); uid != "" {
+		return string(uid)
+	}
+	return strings.Join([]string{obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace(), obj.GetName()}, "/")
+}
+
+// runWatch loads the manifests, then reloads them each time a file or a
+// directory changes, until the context is cancelled.
+func (g *DataGatherer) runWatch(ctx context.Context) error {
+	log := klog.FromContext(ctx)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch the manifests: %v", err)
+	}
+	defer watcher.Close()
+
+	if err := g.reload(ctx, watcher); err != nil {
+		return err
+	}
+	close(g.synced)
+
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			log.V(logs.Debug).Info("Manifest changed", "path", event.Name, "op", event.Op.String())
+			timer.Reset(reloadDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error(err, "Error while watching the manifests")
+		case <-timer.C:
+			if err := g.reload(ctx, watcher); err != nil {
+				log.Error(err, "Failed to reload the manifests")
+			}
+		}
+	}
+}
+
+// reload watches the directories found in the paths, and replaces the
+// resources with the ones decoded from the manifests. The resources that are no
+// longer found are marked as deleted until the next Fetch.
+func (g *DataGatherer) reload(ctx context.Context, watcher *fsnotify.Watcher) error {
+	_, dirs, err := expandPaths(ctx, g.paths)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			klog.FromContext(ctx).Info("Failed to watch a directory", "path", dir, "err", err)
+		}
+	}
+	// The paths are expanded again now that the directories are watched, so
+	// that the files created in a new directory before it was watched aren't
+	// missed.
+	files, _, err := expandPaths(ctx, g.paths)
+	if err != nil {
+		return err
+	}
+	objs := loadManifests(ctx, files)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	found := map[string]bool{}
+	for _, obj := range objs {
+		key := resourceKey(obj)
+		found[key] = true
+		g.resources[key] = &api.GatheredResource{Resource: obj}
+	}
+	now := g.now()
+	for key, item := range g.resources {
+		if !found[key] && item.DeletedAt.IsZero() {
+			// The deletion is inferred from the missing manifest.
+			item.DeletedAt = api.Time{Time: now}
+			item.DeletionInferred = true
+		}
+	}
+	return nil
+}
+
+// snapshot returns the watched resources sorted by key, and forgets the
+// deleted resources, which have now been reported.
+func (g *DataGatherer) snapshot() []*api.GatheredResource {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keys := make([]string, 0, len(g.resources))
+	for key := range g.resources {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	items := make([]*api.GatheredResource, 0, len(keys))
+	for _, key := range keys {
+		item := g.resources[key]
+		items = append(items, &api.GatheredResource{Resource: item.Resource, DeletedAt: item.DeletedAt, DeletionInferred: item.DeletionInferred})
+		if !item.DeletedAt.IsZero() {
+			delete(g.resources, key)
+		}
+	}
+	return items
+}
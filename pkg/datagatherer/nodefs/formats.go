@@ -0,0 +1,336 @@
+package nodefs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/api/reader"
+)
+
+const (
+	formatPEM    = "pem"
+	formatDER    = "der"
+	formatPKCS12 = "pkcs12"
+	formatJKS    = "jks"
+)
+
+// parseFile detects the format of the file and parses the certificates it
+// contains. The private keys are never parsed: only their type and size are
+// recorded. It returns false if the file isn't a certificate file.
+func parseFile(contents []byte, now time.Time) (api.NodeFile, bool) {
+	file := api.NodeFile{Certificates: []api.CertificateSummary{}}
+	var (
+		certs []*x509.Certificate
+		err   error
+	)
+	switch {
+	case isJKS(contents):
+		file.Format = formatJKS
+		certs, file.PrivateKeys, err = parseJKS(contents)
+	case bytes.Contains(contents, []byte("-----BEGIN ")):
+		file.Format = formatPEM
+		certs, file.PrivateKeys, err = parsePEM(contents)
+		if len(certs) == 0 && len(file.PrivateKeys) == 0 && err == nil {
+			// E.g. a public key or a certificate signing request.
+			return api.NodeFile{}, false
+		}
+	case len(contents) > 0 && contents[0] == 0x30: // ASN.1 SEQUENCE
+		if certs, err = x509.ParseCertificates(contents); err == nil {
+			file.Format = formatDER
+			break
+		}
+		var isPKCS12 bool
+		certs, file.PrivateKeys, isPKCS12, err = parsePKCS12(contents)
+		if !isPKCS12 {
+			return api.NodeFile{}, false
+		}
+		file.Format = formatPKCS12
+	default:
+		return api.NodeFile{}, false
+	}
+
+	if err != nil {
+		file.Error = err.Error()
+	}
+	for _, cert := range certs {
+		file.Certificates = append(file.Certificates, reader.Summarize(cert, now))
+	}
+	return file, true
+}
+
+// parsePEM parses the CERTIFICATE blocks and records the type and size of the
+// private key blocks.
+func parsePEM(contents []byte) ([]*x509.Certificate, []api.PrivateKeySummary, error) {
+	var (
+		certs []*x509.Certificate
+		keys  []api.PrivateKeySummary
+		errs  []error
+	)
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("certificate %d: %v", len(certs)+len(errs), err))
+				continue
+			}
+			certs = append(certs, cert)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			keys = append(keys, api.PrivateKeySummary{Type: block.Type, Size: len(block.Bytes)})
+		}
+	}
+	return certs, keys, errors.Join(errs...)
+}
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+
+	oidKeyBag              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidSafeContentsBag     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 6}
+
+	oidX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+)
+
+// The PKCS#12 structures, see RFC 7292.
+type (
+	pfxPDU struct {
+		Version  int
+		AuthSafe contentInfo
+		MacData  asn1.RawValue `asn1:"optional"`
+	}
+	contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+	}
+	safeBag struct {
+		ID         asn1.ObjectIdentifier
+		Value      asn1.RawValue `asn1:"tag:0,explicit"`
+		Attributes asn1.RawValue `asn1:"optional"`
+	}
+	certBag struct {
+		ID   asn1.ObjectIdentifier
+		Data []byte `asn1:"tag:0,explicit"`
+	}
+)
+
+// parsePKCS12 parses the certificates stored in the unencrypted parts of a
+// PKCS#12 file. No password is tried, so the certificates stored in encrypted
+// parts are reported as an error; the private keys are never decrypted. It
+// returns false if the file isn't a PKCS#12 file.
+func parsePKCS12(contents []byte) ([]*x509.Certificate, []api.PrivateKeySummary, bool, error) {
+	var pfx pfxPDU
+	rest, err := asn1.Unmarshal(contents, &pfx)
+	if err != nil || len(rest) > 0 || pfx.Version != 3 || !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return nil, nil, false, nil
+	}
+
+	var authSafeData []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafeData); err != nil {
+		return nil, nil, true, fmt.Errorf("failed to parse the PKCS#12 authenticated safe: %v", err)
+	}
+	var authSafe []contentInfo
+	if _, err := asn1.Unmarshal(authSafeData, &authSafe); err != nil {
+		return nil, nil, true, fmt.Errorf("failed to parse the PKCS#12 authenticated safe: %v", err)
+	}
+
+	var (
+		certs     []*x509.Certificate
+		keys      []api.PrivateKeySummary
+		encrypted int
+	)
+	for _, ci := range authSafe {
+		switch {
+		case ci.ContentType.Equal(oidEncryptedDataContentType):
+			encrypted++
+		case ci.ContentType.Equal(oidDataContentType):
+			var safeContents []byte
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &safeContents); err != nil {
+				return certs, keys, true, fmt.Errorf("failed to parse the PKCS#12 safe contents: %v", err)
+			}
+			if err := parseSafeContents(safeContents, &certs, &keys); err != nil {
+				return certs, keys, true, err
+			}
+		}
+	}
+	if encrypted > 0 {
+		return certs, keys, true, fmt.Errorf("skipped %d encrypted PKCS#12 safe contents, which require the password", encrypted)
+	}
+	return certs, keys, true, nil
+}
+
+func parseSafeContents(contents []byte, certs *[]*x509.Certificate, keys *[]api.PrivateKeySummary) error {
+	var bags []safeBag
+	if _, err := asn1.Unmarshal(contents, &bags); err != nil {
+		return fmt.Errorf("failed to parse the PKCS#12 safe contents: %v", err)
+	}
+	for _, bag := range bags {
+		switch {
+		case bag.ID.Equal(oidCertBag):
+			var cb certBag
+			if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+				return fmt.Errorf("failed to parse a PKCS#12 certificate bag: %v", err)
+			}
+			if !cb.ID.Equal(oidX509Certificate) {
+				continue
+			}
+			cert, err := x509.ParseCertificate(cb.Data)
+			if err != nil {
+				return fmt.Errorf("certificate %d: %v", len(*certs), err)
+			}
+			*certs = append(*certs, cert)
+		case bag.ID.Equal(oidKeyBag):
+			*keys = append(*keys, api.PrivateKeySummary{Type: "keyBag", Size: len(bag.Value.Bytes)})
+		case bag.ID.Equal(oidPKCS8ShroudedKeyBag):
+			*keys = append(*keys, api.PrivateKeySummary{Type: "pkcs8ShroudedKeyBag", Size: len(bag.Value.Bytes)})
+		case bag.ID.Equal(oidSafeContentsBag):
+			if err := parseSafeContents(bag.Value.Bytes, certs, keys); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	jksMagic   = 0xFEEDFEED
+	jceksMagic = 0xCECECECE
+
+	jksPrivateKeyEntry  = 1
+	jksTrustedCertEntry = 2
+	jksSecretKeyEntry   = 3
+)
+
+func isJKS(contents []byte) bool {
+	if len(contents) < 4 {
+		return false
+	}
+	magic := binary.BigEndian.Uint32(contents)
+	return magic == jksMagic || magic == jceksMagic
+}
+
+// parseJKS parses the certificates of a JKS or JCEKS keystore. The keystore
+// integrity isn't checked since it requires the password. The encrypted
+// private keys are skipped, and the parsing stops at the first secret key
+// entry, which is a serialized Java object.
+func parseJKS(contents []byte) ([]*x509.Certificate, []api.PrivateKeySummary, error) {
+	r := &jksReader{r: bytes.NewReader(contents)}
+	r.uint32() // magic
+	version := r.uint32()
+	if r.err == nil && version != 1 && version != 2 {
+		return nil, nil, fmt.Errorf("unsupported keystore version %d", version)
+	}
+	count := r.uint32()
+
+	var (
+		certs []*x509.Certificate
+		keys  []api.PrivateKeySummary
+		errs  []error
+	)
+	readCert := func() {
+		certType := "X.509"
+		if version == 2 {
+			certType = r.string()
+		}
+		der := r.bytes()
+		if r.err != nil || certType != "X.509" {
+			return
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("certificate %d: %v", len(certs)+len(errs), err))
+			return
+		}
+		certs = append(certs, cert)
+	}
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		tag := r.uint32()
+		r.string() // alias
+		r.skip(8)  // creation date
+		switch tag {
+		case jksPrivateKeyEntry:
+			key := r.bytes()
+			keys = append(keys, api.PrivateKeySummary{Type: "PrivateKeyEntry", Size: len(key)})
+			chainLen := r.uint32()
+			for j := uint32(0); j < chainLen && r.err == nil; j++ {
+				readCert()
+			}
+		case jksTrustedCertEntry:
+			readCert()
+		case jksSecretKeyEntry:
+			keys = append(keys, api.PrivateKeySummary{Type: "SecretKeyEntry"})
+			errs = append(errs, errors.New("the entries after the first secret key entry weren't read"))
+			return certs, keys, errors.Join(errs...)
+		default:
+			errs = append(errs, fmt.Errorf("unknown keystore entry tag %d", tag))
+			return certs, keys, errors.Join(errs...)
+		}
+	}
+	if r.err != nil {
+		errs = append(errs, fmt.Errorf("failed to read the keystore: %v", r.err))
+	}
+	return certs, keys, errors.Join(errs...)
+}
+
+// jksReader reads the big-endian fields of a keystore. After the first error,
+// the methods return zero values and the error is kept in err.
+type jksReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *jksReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > r.r.Len() {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, b)
+	return b
+}
+
+func (r *jksReader) skip(n int) {
+	r.read(n)
+}
+
+func (r *jksReader) uint32() uint32 {
+	b := r.read(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *jksReader) bytes() []byte {
+	return r.read(int(r.uint32()))
+}
+
+// string reads a modified UTF-8 string, which is identical to UTF-8 for the
+// aliases and the certificate types found in practice.
+func (r *jksReader) string() string {
+	b := r.read(2)
+	if b == nil {
+		return ""
+	}
+	return string(r.read(int(binary.BigEndian.Uint16(b))))
+}
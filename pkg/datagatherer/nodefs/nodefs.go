@@ -0,0 +1,272 @@
+// Package nodefs implements a data gatherer that scans the filesystem of the
+// node it runs on for certificate files. The kubelet serving certificates, the
+// etcd and control plane PKI, and the certificates baked into host paths never
+// appear in the Kubernetes API. The data gatherer is meant to run in a
+// DaemonSet that mounts the host filesystem read-only.
+package nodefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/datagatherer"
+	"github.com/jetstack/preflight/pkg/logs"
+)
+
+const (
+	defaultMaxFileSize = 1 << 20
+	defaultMaxFiles    = 10000
+
+	// nodeNameEnv is set to the name of the node by the Helm charts, using
+	// the downward API.
+	nodeNameEnv = "POD_NODE"
+)
+
+var defaultPaths = []string{"/etc/kubernetes", "/var/lib/kubelet/pki"}
+
+// ConfigNodeFilesystem contains the configuration for the node-filesystem
+// data-gatherer.
+type ConfigNodeFilesystem struct {
+	// Paths are the absolute paths that are scanned. They may contain the
+	// glob patterns supported by filepath.Match, and the directories are
+	// walked recursively. Defaults to /etc/kubernetes and
+	// /var/lib/kubelet/pki.
+	Paths []string `yaml:"paths"`
+	// HostRoot is the directory where the host filesystem is mounted, e.g.
+	// /host. The Paths are relative to it, and the paths of the files are
+	// reported as seen from the host.
+	HostRoot string `yaml:"host-root"`
+	// MaxFileSize is the size in bytes above which the files are skipped.
+	// Defaults to 1 MiB.
+	MaxFileSize int64 `yaml:"max-file-size"`
+	// MaxFiles is the maximum number of files read during each scan.
+	// Defaults to 10000.
+	MaxFiles int `yaml:"max-files"`
+	// NodeName is the name of the node the files are found on. Defaults to
+	// the value of the POD_NODE environment variable.
+	NodeName string `yaml:"node-name"`
+}
+
+// UnmarshalYAML unmarshals the ConfigNodeFilesystem.
+func (c *ConfigNodeFilesystem) UnmarshalYAML(unmarshal func(any) error) error {
+	aux := struct {
+		Paths       []string `yaml:"paths"`
+		HostRoot    string   `yaml:"host-root"`
+		MaxFileSize int64    `yaml:"max-file-size"`
+		MaxFiles    int      `yaml:"max-files"`
+		NodeName    string   `yaml:"node-name"`
+	}{}
+	err := unmarshal(&aux)
+	if err != nil {
+		return err
+	}
+
+	c.Paths = aux.Paths
+	c.HostRoot = aux.HostRoot
+	c.MaxFileSize = aux.MaxFileSize
+	c.MaxFiles = aux.MaxFiles
+	c.NodeName = aux.NodeName
+
+	return nil
+}
+
+// validate validates the configuration.
+func (c *ConfigNodeFilesystem) validate() error {
+	var errs []string
+	for i, path := range c.Paths {
+		if !filepath.IsAbs(path) {
+			errs = append(errs, fmt.Sprintf("invalid path %d: %q must be absolute", i, path))
+			continue
+		}
+		if _, err := filepath.Match(path, ""); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid path %d: %q: %v", i, path, err))
+		}
+	}
+	if c.MaxFileSize < 0 {
+		errs = append(errs, fmt.Sprintf("invalid max-file-size: must not be negative, got %d", c.MaxFileSize))
+	}
+	if c.MaxFiles < 0 {
+		errs = append(errs, fmt.Sprintf("invalid max-files: must not be negative, got %d", c.MaxFiles))
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// NewDataGatherer constructs a new instance of the node-filesystem
+// data-gatherer.
+func (c *ConfigNodeFilesystem) NewDataGatherer(ctx context.Context) (datagatherer.DataGatherer, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	nodeName := c.NodeName
+	if nodeName == "" {
+		nodeName = os.Getenv(nodeNameEnv)
+	}
+	if nodeName == "" {
+		return nil, fmt.Errorf("the node name is unknown: set node-name or the %s environment variable", nodeNameEnv)
+	}
+
+	g := &DataGathererNodeFilesystem{
+		paths:       c.Paths,
+		hostRoot:    c.HostRoot,
+		maxFileSize: c.MaxFileSize,
+		maxFiles:    c.MaxFiles,
+		nodeName:    nodeName,
+		now:         time.Now,
+	}
+	if len(g.paths) == 0 {
+		g.paths = defaultPaths
+	}
+	if g.maxFileSize == 0 {
+		g.maxFileSize = defaultMaxFileSize
+	}
+	if g.maxFiles == 0 {
+		g.maxFiles = defaultMaxFiles
+	}
+	return g, nil
+}
+
+// DataGathererNodeFilesystem stores the config for a node-filesystem
+// datagatherer.
+type DataGathererNodeFilesystem struct {
+	paths       []string
+	hostRoot    string
+	maxFileSize int64
+	maxFiles    int
+	nodeName    string
+	now         func() time.Time
+}
+
+var _ datagatherer.DataGatherer = &DataGathererNodeFilesystem{}
+
+func (g *DataGathererNodeFilesystem) Run(ctx context.Context) error {
+	// no async functionality, see Fetch
+	return nil
+}
+
+func (g *DataGathererNodeFilesystem) WaitForCacheSync(ctx context.Context) error {
+	// no async functionality, see Fetch
+	return nil
+}
+
+// Fetch scans the configured paths and returns the files that contain
+// certificates or private keys. The symbolic links aren't followed, and the
+// files that can't be read are skipped.
+func (g *DataGathererNodeFilesystem) Fetch(ctx context.Context) (any, int, error) {
+	log := klog.FromContext(ctx)
+	data := &api.NodeFilesData{NodeName: g.nodeName, Files: []api.NodeFile{}}
+	now := g.now()
+	seen := map[string]bool{}
+	errLimit := errors.New("limit reached")
+
+	visit := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.V(logs.Debug).Info("Skipping a path that can't be read", "path", path, "err", err)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() || seen[path] {
+			return nil
+		}
+		seen[path] = true
+		if len(seen) > g.maxFiles {
+			return errLimit
+		}
+
+		file, ok := g.scanFile(ctx, path, now)
+		if ok {
+			data.Files = append(data.Files, file)
+		}
+		return nil
+	}
+
+	for _, pattern := range g.paths {
+		matches, err := filepath.Glob(filepath.Join(g.hostRoot, pattern))
+		if err != nil {
+			return nil, -1, fmt.Errorf("failed to expand %q: %v", pattern, err)
+		}
+		for _, match := range matches {
+			err := filepath.WalkDir(match, visit)
+			if errors.Is(err, errLimit) {
+				log.Info("Stopped scanning the node filesystem, the maximum number of files was reached", "maxFiles", g.maxFiles)
+				break
+			}
+			if err != nil {
+				return nil, -1, err
+			}
+		}
+		if len(seen) > g.maxFiles {
+			break
+		}
+	}
+
+	slices.SortFunc(data.Files, func(a, b api.NodeFile) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return data, len(data.Files), nil
+}
+
+// scanFile reads and parses a file. It returns false if the file is too large,
+// can't be read, or isn't a certificate file.
+func (g *DataGathererNodeFilesystem) scanFile(ctx context.Context, path string, now time.Time) (api.NodeFile, bool) {
+	log := klog.FromContext(ctx).V(logs.Debug)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Info("Skipping a file that can't be read", "path", path, "err", err)
+		return api.NodeFile{}, false
+	}
+	defer f.Close()
+
+	// The size is checked while reading, in case the file grows after the
+	// walk.
+	contents, err := io.ReadAll(io.LimitReader(f, g.maxFileSize+1))
+	if err != nil {
+		log.Info("Skipping a file that can't be read", "path", path, "err", err)
+		return api.NodeFile{}, false
+	}
+	if int64(len(contents)) > g.maxFileSize {
+		log.Info("Skipping a file larger than max-file-size", "path", path, "maxFileSize", g.maxFileSize)
+		return api.NodeFile{}, false
+	}
+
+	file, ok := parseFile(contents, now)
+	if !ok {
+		return api.NodeFile{}, false
+	}
+	file.Path = g.hostPath(path)
+	file.Size = int64(len(contents))
+	return file, true
+}
+
+// hostPath returns the path of the file as seen from the host.
+func (g *DataGathererNodeFilesystem) hostPath(path string) string {
+	if g.hostRoot == "" {
+		return path
+	}
+	rel, err := filepath.Rel(g.hostRoot, path)
+	if err != nil {
+		return path
+	}
+	return "/" + filepath.ToSlash(rel)
+}
@@ -0,0 +1,208 @@
+package nodefs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/testutil/testcert"
+)
+
+func TestFetch(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	kubelet := testcert.New(t, testcert.Options{CommonName: "kubelet", NotAfter: now.Add(24 * time.Hour)})
+	ca := testcert.New(t, testcert.Options{CommonName: "kubernetes", NotAfter: now.Add(-24 * time.Hour)})
+
+	plainP12, err := os.ReadFile("testdata/plain.p12")
+	require.NoError(t, err)
+	encryptedP12, err := os.ReadFile("testdata/encrypted.p12")
+	require.NoError(t, err)
+
+	host := t.TempDir()
+	writeFile(t, host, "var/lib/kubelet/pki/kubelet.crt", append(kubelet.PEM(), ca.PEM()...))
+	writeFile(t, host, "var/lib/kubelet/pki/kubelet.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: make([]byte, 121)}))
+	writeFile(t, host, "etc/kubernetes/pki/ca.der", ca.Certificate.Raw)
+	writeFile(t, host, "etc/kubernetes/pki/etcd/plain.p12", plainP12)
+	writeFile(t, host, "etc/kubernetes/pki/etcd/encrypted.p12", encryptedP12)
+	writeFile(t, host, "etc/kubernetes/pki/keystore.jks", newJKS(kubelet.Certificate, ca.Certificate))
+	writeFile(t, host, "etc/kubernetes/pki/broken.crt", []byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"))
+	// The files that aren't certificate files are skipped.
+	writeFile(t, host, "etc/kubernetes/manifests/etcd.yaml", []byte("apiVersion: v1\nkind: Pod\n"))
+	writeFile(t, host, "etc/kubernetes/pki/sa.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("key")}))
+	writeFile(t, host, "etc/kubernetes/pki/random.bin", []byte{0x30, 0x03, 0x02, 0x01, 0x01})
+	// The files larger than max-file-size are skipped.
+	writeFile(t, host, "etc/kubernetes/pki/large.crt", append(kubelet.PEM(), bytes.Repeat([]byte("#"), 4096)...))
+	// The symbolic links aren't followed.
+	require.NoError(t, os.Symlink(filepath.Join(host, "var/lib/kubelet/pki/kubelet.crt"), filepath.Join(host, "var/lib/kubelet/pki/kubelet-current.crt")))
+
+	newGatherer := func(t *testing.T, cfg ConfigNodeFilesystem) *DataGathererNodeFilesystem {
+		t.Helper()
+		cfg.HostRoot = host
+		cfg.NodeName = "node-1"
+		dg, err := cfg.NewDataGatherer(t.Context())
+		require.NoError(t, err)
+		g := dg.(*DataGathererNodeFilesystem)
+		g.now = func() time.Time { return now }
+		return g
+	}
+
+	t.Run("all formats", func(t *testing.T) {
+		g := newGatherer(t, ConfigNodeFilesystem{
+			Paths:       []string{"/etc/kubernetes/pki", "/var/lib/kubelet/pki/*.crt", "/var/lib/kubelet/pki/*.key", "/does/not/exist"},
+			MaxFileSize: 2048,
+		})
+		data, count, err := g.Fetch(t.Context())
+		require.NoError(t, err)
+		nodeFiles := data.(*api.NodeFilesData)
+		assert.Equal(t, "node-1", nodeFiles.NodeName)
+
+		files := map[string]api.NodeFile{}
+		var paths []string
+		for _, f := range nodeFiles.Files {
+			files[f.Path] = f
+			paths = append(paths, f.Path)
+		}
+		assert.Equal(t, []string{
+			"/etc/kubernetes/pki/broken.crt",
+			"/etc/kubernetes/pki/ca.der",
+			"/etc/kubernetes/pki/etcd/encrypted.p12",
+			"/etc/kubernetes/pki/etcd/plain.p12",
+			"/etc/kubernetes/pki/keystore.jks",
+			"/var/lib/kubelet/pki/kubelet.crt",
+			"/var/lib/kubelet/pki/kubelet.key",
+		}, paths)
+		assert.Equal(t, 7, count)
+
+		pemFile := files["/var/lib/kubelet/pki/kubelet.crt"]
+		assert.Equal(t, "pem", pemFile.Format)
+		assert.Equal(t, int64(len(kubelet.PEM())+len(ca.PEM())), pemFile.Size)
+		require.Len(t, pemFile.Certificates, 2)
+		assert.Equal(t, "CN=kubelet", pemFile.Certificates[0].Subject)
+		assert.False(t, pemFile.Certificates[0].Expired)
+		assert.True(t, pemFile.Certificates[1].Expired)
+		assert.Empty(t, pemFile.Error)
+
+		keyFile := files["/var/lib/kubelet/pki/kubelet.key"]
+		assert.Empty(t, keyFile.Certificates)
+		assert.Equal(t, []api.PrivateKeySummary{{Type: "EC PRIVATE KEY", Size: 121}}, keyFile.PrivateKeys)
+
+		assert.Equal(t, "der", files["/etc/kubernetes/pki/ca.der"].Format)
+		assert.Equal(t, "CN=kubernetes", files["/etc/kubernetes/pki/ca.der"].Certificates[0].Subject)
+
+		plain := files["/etc/kubernetes/pki/etcd/plain.p12"]
+		assert.Equal(t, "pkcs12", plain.Format)
+		assert.Empty(t, plain.Error)
+		require.Len(t, plain.Certificates, 1)
+		assert.Equal(t, "CN=etcd-server", plain.Certificates[0].Subject)
+		require.Len(t, plain.PrivateKeys, 1)
+		assert.Equal(t, "keyBag", plain.PrivateKeys[0].Type)
+
+		encrypted := files["/etc/kubernetes/pki/etcd/encrypted.p12"]
+		assert.Equal(t, "pkcs12", encrypted.Format)
+		assert.Equal(t, "skipped 1 encrypted PKCS#12 safe contents, which require the password", encrypted.Error)
+		assert.Empty(t, encrypted.Certificates)
+		require.Len(t, encrypted.PrivateKeys, 1)
+		assert.Equal(t, "pkcs8ShroudedKeyBag", encrypted.PrivateKeys[0].Type)
+
+		jks := files["/etc/kubernetes/pki/keystore.jks"]
+		assert.Equal(t, "jks", jks.Format)
+		assert.Empty(t, jks.Error)
+		require.Len(t, jks.Certificates, 2)
+		assert.Equal(t, "CN=kubelet", jks.Certificates[0].Subject)
+		assert.Equal(t, "CN=kubernetes", jks.Certificates[1].Subject)
+		assert.Equal(t, []api.PrivateKeySummary{{Type: "PrivateKeyEntry", Size: 64}}, jks.PrivateKeys)
+
+		broken := files["/etc/kubernetes/pki/broken.crt"]
+		assert.Contains(t, broken.Error, "certificate 0: x509: ")
+		assert.NotNil(t, broken.Certificates, "the certificates must be encoded as an empty array")
+	})
+
+	t.Run("max-files", func(t *testing.T) {
+		g := newGatherer(t, ConfigNodeFilesystem{Paths: []string{"/var/lib/kubelet/pki"}, MaxFiles: 1})
+		_, count, err := g.Fetch(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("truncated keystore", func(t *testing.T) {
+		jks := newJKS(kubelet.Certificate, ca.Certificate)
+		file, ok := parseFile(jks[:len(jks)-100], now)
+		require.True(t, ok)
+		assert.Len(t, file.Certificates, 1)
+		assert.Equal(t, "failed to read the keystore: unexpected EOF", file.Error)
+	})
+}
+
+func TestNewDataGatherer(t *testing.T) {
+	t.Run("invalid configuration", func(t *testing.T) {
+		_, err := (&ConfigNodeFilesystem{Paths: []string{"etc", "/etc/[", "/etc/*"}, MaxFileSize: -1, MaxFiles: -1, NodeName: "node-1"}).NewDataGatherer(t.Context())
+		assert.EqualError(t, err, `invalid path 0: "etc" must be absolute, invalid path 1: "/etc/[": syntax error in pattern, invalid max-file-size: must not be negative, got -1, invalid max-files: must not be negative, got -1`)
+	})
+
+	t.Run("node name from the environment", func(t *testing.T) {
+		t.Setenv(nodeNameEnv, "")
+		_, err := (&ConfigNodeFilesystem{}).NewDataGatherer(t.Context())
+		assert.EqualError(t, err, "the node name is unknown: set node-name or the POD_NODE environment variable")
+
+		t.Setenv(nodeNameEnv, "node-2")
+		dg, err := (&ConfigNodeFilesystem{}).NewDataGatherer(t.Context())
+		require.NoError(t, err)
+		g := dg.(*DataGathererNodeFilesystem)
+		assert.Equal(t, "node-2", g.nodeName)
+		assert.Equal(t, defaultPaths, g.paths)
+	})
+}
+
+func writeFile(t *testing.T, root, name string, contents []byte) {
+	t.Helper()
+	path := filepath.Join(root, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, contents, 0o644))
+}
+
+// newJKS returns a version 2 JKS keystore with a private key entry whose chain
+// is the leaf, and a trusted certificate entry for the CA. The private key is
+// made of zeros since it is never read.
+func newJKS(leaf, ca *x509.Certificate) []byte {
+	var b bytes.Buffer
+	u32 := func(v uint32) { _ = binary.Write(&b, binary.BigEndian, v) }
+	str := func(s string) {
+		_ = binary.Write(&b, binary.BigEndian, uint16(len(s)))
+		b.WriteString(s)
+	}
+	cert := func(c *x509.Certificate) {
+		str("X.509")
+		u32(uint32(len(c.Raw)))
+		b.Write(c.Raw)
+	}
+
+	u32(jksMagic)
+	u32(2)
+	u32(2)
+
+	u32(jksPrivateKeyEntry)
+	str("kubelet")
+	b.Write(make([]byte, 8))
+	u32(64)
+	b.Write(make([]byte, 64))
+	u32(1)
+	cert(leaf)
+
+	u32(jksTrustedCertEntry)
+	str("ca")
+	b.Write(make([]byte, 8))
+	cert(ca)
+
+	// The SHA-1 digest of the keystore, which isn't checked.
+	b.Write(make([]byte, 20))
+	return b.Bytes()
+}
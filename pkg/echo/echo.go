@@ -1,21 +1,46 @@
 package echo
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 
 	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/webhooksig"
 )
 
 var EchoListen string
 
 var Compact bool
 
+// HMACSecretFile is the path to the secret used to verify the signature of the
+// requests sent in Webhook mode. The signature isn't verified when empty.
+var HMACSecretFile string
+
+// hmacSecret is loaded from HMACSecretFile when the server starts.
+var hmacSecret []byte
+
+// signatureMaxSkew is how far the signature timestamp may be from the time at
+// which the request is received.
+const signatureMaxSkew = 5 * time.Minute
+
 func Echo(cmd *cobra.Command, args []string) error {
+	if HMACSecretFile != "" {
+		secret, err := os.ReadFile(HMACSecretFile)
+		if err != nil {
+			return fmt.Errorf("while reading the HMAC secret: %w", err)
+		}
+		hmacSecret = bytes.TrimRight(secret, "\r\n")
+		fmt.Println("Verifying the HMAC signature of the requests")
+	}
+
 	http.HandleFunc("/", echoHandler)
 	fmt.Println("Listening to requests at ", EchoListen)
 	return http.ListenAndServe(EchoListen, nil)
@@ -27,9 +52,22 @@ func echoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, fmt.Sprintf("reading body: %+v", err), http.StatusBadRequest)
+		return
+	}
+
+	if hmacSecret != nil {
+		if err := webhooksig.Verify(hmacSecret, r.Header, body, time.Now(), signatureMaxSkew); err != nil {
+			writeError(w, fmt.Sprintf("verifying signature: %+v", err), http.StatusUnauthorized)
+			return
+		}
+	}
+
 	// decode all data, however only datareadings are printed below
 	var payload api.DataReadingsPost
-	err := json.NewDecoder(r.Body).Decode(&payload)
+	err = json.Unmarshal(body, &payload)
 	if err != nil {
 		writeError(w, fmt.Sprintf("decoding body: %+v", err), http.StatusBadRequest)
 		return
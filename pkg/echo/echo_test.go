@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
 	"k8s.io/apimachinery/pkg/version"
 
 	"github.com/jetstack/preflight/api"
+	"github.com/jetstack/preflight/pkg/webhooksig"
 )
 
 type testInput struct {
@@ -82,3 +84,49 @@ func TestEchoServerRequestResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestEchoServerVerifiesSignature(t *testing.T) {
+	hmacSecret = []byte("secret")
+	t.Cleanup(func() { hmacSecret = nil })
+
+	body := []byte(`{"data_readings":[]}`)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	tests := []struct {
+		description string
+		signature   string
+		exp         int
+	}{
+		{
+			description: "valid signature should return status code 200",
+			signature:   webhooksig.Sign([]byte("secret"), timestamp, body),
+			exp:         http.StatusOK,
+		},
+		{
+			description: "signature made with another secret should return status code 401",
+			signature:   webhooksig.Sign([]byte("other"), timestamp, body),
+			exp:         http.StatusUnauthorized,
+		},
+		{
+			description: "missing signature should return status code 401",
+			exp:         http.StatusUnauthorized,
+		},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, "http://example.com/readings", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("[%s]\nfailed to generate request to test echo server: %s", test.description, err)
+		}
+		req.Header.Set(webhooksig.TimestampHeader, timestamp)
+		if test.signature != "" {
+			req.Header.Set(webhooksig.SignatureHeader, test.signature)
+		}
+
+		rr := httptest.NewRecorder()
+		echoHandler(rr, req)
+
+		if rr.Result().StatusCode != test.exp {
+			t.Fatalf("[%s]\necho server responded with an unexpected code: %d", test.description, rr.Result().StatusCode)
+		}
+	}
+}
@@ -25,6 +25,14 @@ type AgentRBACManifests struct {
 const agentNamespace = "jetstack-secure"
 const agentSubjectName = "agent"
 
+// namespacesReaderName is the name of the ClusterRole granting access to the
+// Namespaces, needed by the dgs that select namespaces by label.
+var namespacesReaderName = fmt.Sprintf("%s-agent-namespaces-reader", agentNamespace)
+
+// crdsReaderName is the name of the ClusterRole granting access to the CRDs,
+// needed by the optional dgs that watch their CRD.
+var crdsReaderName = fmt.Sprintf("%s-agent-crds-reader", agentNamespace)
+
 func GenerateAgentRBACManifests(dataGatherers []agent.DataGatherer) AgentRBACManifests {
 	// create a new AgentRBACManifest struct
 	var AgentRBACManifests AgentRBACManifests
@@ -56,7 +64,9 @@ func GenerateAgentRBACManifests(dataGatherers []agent.DataGatherer) AgentRBACMan
 
 		// if dyConfig.IncludeNamespaces has more than 0 items in it
 		//   then, for each namespace create a rbac.RoleBinding in that namespace
-		if len(dyConfig.IncludeNamespaces) != 0 {
+		// unless the namespaces are selected by pattern or by label, in which
+		//   case the resources are watched in all the namespaces
+		if len(dyConfig.IncludeNamespaces) != 0 && !dyConfig.HasDynamicNamespaces() {
 			for _, ns := range dyConfig.IncludeNamespaces {
 				AgentRBACManifests.RoleBindings = append(AgentRBACManifests.RoleBindings, rbac.RoleBinding{
 					TypeMeta: metav1.TypeMeta{
@@ -112,11 +122,76 @@ func GenerateAgentRBACManifests(dataGatherers []agent.DataGatherer) AgentRBACMan
 			})
 		}
 
+		// the namespace selector needs to read the labels of the namespaces
+		if dyConfig.NamespaceSelector != "" && !hasClusterRole(AgentRBACManifests.ClusterRoles, namespacesReaderName) {
+			addClusterReader(&AgentRBACManifests, namespacesReaderName, "", "namespaces")
+		}
+
+		// the optional dgs watch their CRD
+		if dyConfig.Optional && !hasClusterRole(AgentRBACManifests.ClusterRoles, crdsReaderName) {
+			addClusterReader(&AgentRBACManifests, crdsReaderName, "apiextensions.k8s.io", "customresourcedefinitions")
+		}
 	}
 
 	return AgentRBACManifests
 }
 
+// addClusterReader adds a ClusterRole granting read access to the resource in
+// all the namespaces, and its ClusterRoleBinding.
+func addClusterReader(manifests *AgentRBACManifests, name, group, resource string) {
+	manifests.ClusterRoles = append(manifests.ClusterRoles, rbac.ClusterRole{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ClusterRole",
+			APIVersion: "rbac.authorization.k8s.io/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Rules: []rbac.PolicyRule{
+			{
+				Verbs:     []string{"get", "list", "watch"},
+				APIGroups: []string{group},
+				Resources: []string{resource},
+			},
+		},
+	})
+	manifests.ClusterRoleBindings = append(manifests.ClusterRoleBindings, rbac.ClusterRoleBinding{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ClusterRoleBinding",
+			APIVersion: "rbac.authorization.k8s.io/v1",
+		},
+
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+
+		Subjects: []rbac.Subject{
+			{
+				Kind:      "ServiceAccount",
+				Name:      agentSubjectName,
+				Namespace: agentNamespace,
+			},
+		},
+
+		RoleRef: rbac.RoleRef{
+			Kind:     "ClusterRole",
+			Name:     name,
+			APIGroup: "rbac.authorization.k8s.io",
+		},
+	})
+}
+
+// hasClusterRole returns true if a ClusterRole with the name exists, e.g.
+// because a dg collects the namespaces.
+func hasClusterRole(clusterRoles []rbac.ClusterRole, name string) bool {
+	for _, clusterRole := range clusterRoles {
+		if clusterRole.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func createClusterRoleString(clusterRoles []rbac.ClusterRole) string {
 	var builder strings.Builder
 	for _, cb := range clusterRoles {
@@ -0,0 +1,147 @@
+// Package testcert creates X.509 certificates for use in tests.
+//
+// It is separate from the testutil package, which imports pkg/client, so that
+// the tests of pkg/client and of the packages it imports can use it too.
+package testcert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Options configures the certificate created by New. The zero value creates a
+// self-signed certificate with an ECDSA P-256 key that is currently valid.
+type Options struct {
+	CommonName   string
+	Organization []string
+	DNSNames     []string
+	IPAddresses  []net.IP
+
+	// SerialNumber defaults to a number that is unique within the test
+	// binary.
+	SerialNumber int64
+
+	// NotAfter defaults to an hour from now, and NotBefore to a year before
+	// NotAfter.
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// IsCA makes the certificate a CA. The cert signing key usage is added to
+	// KeyUsage.
+	IsCA        bool
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+
+	// Parent signs the certificate. The certificate is self-signed when nil.
+	Parent *Cert
+
+	// RSABits selects an RSA key of the given size. Otherwise, the key is an
+	// ECDSA key on Curve, which defaults to P-256.
+	RSABits int
+	Curve   elliptic.Curve
+
+	// SignatureAlgorithm defaults to the one picked by x509.CreateCertificate
+	// for the key of the signer.
+	SignatureAlgorithm x509.SignatureAlgorithm
+}
+
+// Cert is a certificate created by New and its private key.
+type Cert struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+var lastSerial atomic.Int64
+
+// New creates a certificate. It fails the test on error.
+func New(t testing.TB, opts Options) *Cert {
+	t.Helper()
+
+	var key crypto.Signer
+	var err error
+	switch {
+	case opts.RSABits > 0:
+		key, err = rsa.GenerateKey(rand.Reader, opts.RSABits)
+	case opts.Curve != nil:
+		key, err = ecdsa.GenerateKey(opts.Curve, rand.Reader)
+	default:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	require.NoError(t, err)
+
+	serial := opts.SerialNumber
+	if serial == 0 {
+		serial = lastSerial.Add(1)
+	}
+	notAfter := opts.NotAfter
+	if notAfter.IsZero() {
+		notAfter = time.Now().Add(time.Hour)
+	}
+	notBefore := opts.NotBefore
+	if notBefore.IsZero() {
+		notBefore = notAfter.Add(-365 * 24 * time.Hour)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: opts.CommonName, Organization: opts.Organization},
+		DNSNames:              opts.DNSNames,
+		IPAddresses:           opts.IPAddresses,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  opts.IsCA,
+		KeyUsage:              opts.KeyUsage,
+		ExtKeyUsage:           opts.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		SignatureAlgorithm:    opts.SignatureAlgorithm,
+	}
+	if opts.IsCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	parent, parentKey := template, key
+	if opts.Parent != nil {
+		parent, parentKey = opts.Parent.Certificate, opts.Parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &Cert{Certificate: cert, Key: key}
+}
+
+// PEM returns the PEM-encoded certificate.
+func (c *Cert) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate.Raw})
+}
+
+// KeyPEM returns the PEM-encoded PKCS #8 private key. It fails the test on
+// error.
+func (c *Cert) KeyPEM(t testing.TB) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(c.Key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// Chain returns the concatenation of the PEM-encoded certificates.
+func Chain(certs ...*Cert) []byte {
+	var out []byte
+	for _, c := range certs {
+		out = append(out, c.PEM()...)
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+// Package webhooksig signs and verifies the requests sent by the agent in
+// Webhook mode. It is kept separate from pkg/client so that the receivers of
+// the requests, such as the echo server, don't need to import the clients.
+package webhooksig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TimestampHeader contains the Unix time, in seconds, at which the request
+	// was signed.
+	TimestampHeader = "X-Agent-Timestamp"
+
+	// SignatureHeader contains the HMAC-SHA256 signature of the request, in
+	// the form "sha256=<hex>". See Sign.
+	SignatureHeader = "X-Agent-Signature"
+)
+
+// Sign returns the value of the SignatureHeader header for the given secret,
+// timestamp, and request body. The signature is the hex-encoded HMAC-SHA256 of
+// the timestamp, a dot, and the body. Including the timestamp in the signature
+// prevents replaying an old request with a new timestamp.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature headers of a request signed with Sign. Requests
+// signed more than maxSkew before or after now are rejected to protect against
+// replays.
+func Verify(secret []byte, header http.Header, body []byte, now time.Time, maxSkew time.Duration) error {
+	timestamp := header.Get(TimestampHeader)
+	if timestamp == "" {
+		return fmt.Errorf("missing %s header", TimestampHeader)
+	}
+	signature := header.Get(SignatureHeader)
+	if signature == "" {
+		return fmt.Errorf("missing %s header", SignatureHeader)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header: %w", TimestampHeader, err)
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("the request was signed %s ago, which is outside the allowed window of %s", skew.Round(time.Second), maxSkew)
+	}
+
+	if !strings.HasPrefix(signature, "sha256=") {
+		return fmt.Errorf("invalid %s header: expected the sha256= prefix", SignatureHeader)
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return errors.New("the signature doesn't match")
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package webhooksig
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"data_readings":[]}`)
+	now := time.Unix(1717243200, 0)
+
+	header := http.Header{}
+	header.Set(TimestampHeader, "1717243200")
+	header.Set(SignatureHeader, Sign(secret, "1717243200", body))
+
+	assert.NoError(t, Verify(secret, header, body, now, time.Minute))
+	assert.EqualError(t, Verify(secret, header, []byte(`{}`), now, time.Minute), "the signature doesn't match")
+	assert.EqualError(t, Verify(secret, header, body, now.Add(10*time.Minute), time.Minute), "the request was signed 10m0s ago, which is outside the allowed window of 1m0s")
+
+	// Changing the timestamp invalidates the signature.
+	replayed := header.Clone()
+	replayed.Set(TimestampHeader, "1717243230")
+	assert.EqualError(t, Verify(secret, replayed, body, now, time.Minute), "the signature doesn't match")
+
+	assert.EqualError(t, Verify(secret, http.Header{}, body, now, time.Minute), "missing X-Agent-Timestamp header")
+}